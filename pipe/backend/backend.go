@@ -5,7 +5,10 @@
 // Handler for the PowerDNS pipebackend protocol, as documented here:
 // https://doc.powerdns.com/md/authoritative/backend-pipe/
 //
-// Can speak all three (at time of writing) protocol versions.
+// Can speak protocol versions 1 to 5. Versions 4 and 5 use the same query and
+// response formats as version 3; version 4 adds the zone name to AXFR requests,
+// which are handled by the callback given to OnAXFR, and version 5 adds the CMD
+// request, handled by the callback given to OnCommand.
 //
 // Usage:
 //
@@ -20,6 +23,7 @@ import (
 	"io"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 type Backend struct {
@@ -29,7 +33,13 @@ type Backend struct {
 	// The protocol version negotiated with the remote end
 	ProtocolVersion int
 
-	io *bufio.ReadWriter
+	io       *bufio.ReadWriter
+	commands CommandCallback
+	axfr     AXFRCallback
+
+	// Messages waiting to be sent as LOG lines
+	logMu sync.Mutex
+	logs  []string
 }
 
 // A callback of this type is executed whenever a query is received. If an error
@@ -37,6 +47,17 @@ type Backend struct {
 // backend. Otherwise, the responses are serialised and sent back in order.
 type Callback func(b *Backend, q *Query) ([]*Response, error)
 
+// A callback of this type is executed whenever a CMD line is received, with the
+// rest of the line. The output is sent back to PowerDNS, which shows it to
+// whoever ran "pdns_control backend-cmd"; an error is reported in its place.
+type CommandCallback func(b *Backend, line string) (string, error)
+
+// A callback of this type is executed whenever an AXFR request is received,
+// with the id of the zone to transfer and, from protocol version 4, its name
+// (blank otherwise). The responses are the records of the zone, which are sent
+// back in order; an error is handled as for queries.
+type AXFRCallback func(b *Backend, id int, zone string) ([]*Response, error)
+
 // Build a new backend object. The banner is reported to the client upon
 // successful negotiation; the io can be anything.
 func New(r io.Reader, w io.Writer, banner string) *Backend {
@@ -64,7 +85,7 @@ func (b *Backend) Negotiate() error {
 	}
 
 	version, err := strconv.Atoi(parts[1])
-	if version < 1 || version > 3 || err != nil {
+	if version < 1 || version > 5 || err != nil {
 		return errors.New("Unknown protocol version requested")
 	}
 
@@ -90,9 +111,94 @@ func (b *Backend) handleQ(data string, callback Callback) ([]*Response, error) {
 	return callback(b, &query)
 }
 
-// TODO
-func (b *Backend) handleAXFR() ([]*Response, error) {
-	return nil, errors.New("AXFR requests not supported")
+// Set the callback to run for CMD lines
+func (b *Backend) OnCommand(f CommandCallback) {
+	b.commands = f
+}
+
+// Runs the command callback and writes its output, one line at a time,
+// followed by END
+func (b *Backend) handleCMD(line string) error {
+	var out string
+	var err error
+	if b.commands == nil {
+		err = errors.New("Commands not supported")
+	} else {
+		out, err = b.commands(b, line)
+	}
+	if err != nil {
+		out = "Error: " + err.Error()
+	}
+
+	for _, l := range strings.Split(strings.TrimRight(out, "\n"), "\n") {
+		// A line reading END would cut the output short
+		if l == "END" {
+			l = " END"
+		}
+		if _, err := b.io.WriteString(l + "\n"); err != nil {
+			return fmt.Errorf("%s while writing CMD output", err)
+		}
+	}
+
+	_, err = b.io.WriteString("END\n")
+	if err == nil {
+		err = b.io.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("%s while writing END", err)
+	}
+	return nil
+}
+
+// Queue a message to be sent to PowerDNS as a LOG line, for it to write to its
+// own log. PowerDNS only reads from the backend when it is expecting an answer,
+// so queued messages are sent before the next answer to a query or PING. Safe
+// to call from any goroutine.
+func (b *Backend) Log(msg string) {
+	b.logMu.Lock()
+	defer b.logMu.Unlock()
+	b.logs = append(b.logs, strings.Replace(msg, "\n", " ", -1))
+}
+
+func (b *Backend) writeLogs() error {
+	b.logMu.Lock()
+	logs := b.logs
+	b.logs = nil
+	b.logMu.Unlock()
+
+	for _, msg := range logs {
+		if _, err := b.io.WriteString("LOG\t" + msg + "\n"); err != nil {
+			return fmt.Errorf("%s while writing LOG", err)
+		}
+	}
+	return nil
+}
+
+// Set the callback to run for AXFR requests
+func (b *Backend) OnAXFR(f AXFRCallback) {
+	b.axfr = f
+}
+
+func (b *Backend) handleAXFR(data string) ([]*Response, error) {
+	if b.axfr == nil {
+		return nil, errors.New("AXFR requests not supported")
+	}
+
+	parts := strings.Split(data, "\t")
+	id, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, errors.New("Bad zone id in AXFR request")
+	}
+
+	zone := ""
+	if b.ProtocolVersion >= 4 {
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("v%d AXFR request should have 2 data parts", b.ProtocolVersion)
+		}
+		zone = parts[1]
+	}
+
+	return b.axfr(b, id, zone)
 }
 
 // Reads lines in a loop, processing them by executing the provided callback
@@ -120,11 +226,26 @@ func (b *Backend) Run(callback Callback) error {
 		case "PING":
 			responses, err = nil, nil // We just need to return END
 		case "AXFR":
-			responses, err = b.handleAXFR()
+			if len(parts) < 2 {
+				parts = append(parts, "")
+			}
+			responses, err = b.handleAXFR(parts[1])
+		case "CMD":
+			if len(parts) < 2 {
+				parts = append(parts, "")
+			}
+			if err := b.handleCMD(parts[1]); err != nil {
+				return err
+			}
+			continue
 		default:
 			responses, err = nil, errors.New("Bad command")
 		}
 
+		if err := b.writeLogs(); err != nil {
+			return err
+		}
+
 		if err != nil {
 			// avoid protocol errors
 			clean := strings.Replace(err.Error(), "\n", " ", -1)
@@ -154,7 +154,7 @@ func TestHandlesPing(t *testing.T) {
 	h.AssertEqualString(t, "END\n", w.String(), "Bad response")
 }
 
-func TestAXFRIsTODO(t *testing.T) {
+func TestAXFRWithoutCallback(t *testing.T) {
 	b, r, w := BuildAndNegotiate(t, 3)
 	r.WriteString("AXFR\n")
 	AssertRun(t, b, h.EmptyDispatch)
@@ -167,3 +167,102 @@ func TestUnknownCommand(t *testing.T) {
 	AssertRun(t, b, h.EmptyDispatch)
 	h.AssertEqualString(t, "LOG\tError handling line: Bad command\nFAIL\n", w.String(), "Bad response")
 }
+
+func TestVersions4And5UseVersion3Format(t *testing.T) {
+	for _, v := range []int{4, 5} {
+		b, r, w := BuildAndNegotiate(t, v)
+		r.WriteString(h.FakeQueryString(t, 3))
+
+		fr := h.FakeResponse(3)
+		AssertRun(t, b, func(b *Backend, q *Query) ([]*Response, error) {
+			h.AssertEqualString(t, "127.0.0.3", q.EdnsSubnetAddress, "Bad ECS address")
+			return []*Response{fr}, nil
+		})
+		h.AssertEqualString(t, h.FakeResponseString(t, 3)+"END\n", w.String(), "Bad response")
+	}
+}
+
+func TestCommandsArePassedToCallback(t *testing.T) {
+	b, r, w := BuildAndNegotiate(t, 5)
+	var line string
+	b.OnCommand(func(b *Backend, l string) (string, error) {
+		line = l
+		return "one\ntwo\n", nil
+	})
+
+	r.WriteString("CMD\tpurge\texample.com\n")
+	AssertRun(t, b, h.EmptyDispatch)
+	h.AssertEqualString(t, "purge\texample.com", line, "Wrong command line")
+	h.AssertEqualString(t, "one\ntwo\nEND\n", w.String(), "Bad response")
+	w.Reset()
+
+	b.OnCommand(func(b *Backend, l string) (string, error) {
+		return "", errors.New("No such command")
+	})
+	r.WriteString("CMD\tbogus\n")
+	AssertRun(t, b, h.EmptyDispatch)
+	h.AssertEqualString(t, "Error: No such command\nEND\n", w.String(), "Bad response")
+}
+
+func TestCommandsWithoutCallback(t *testing.T) {
+	b, r, w := BuildAndNegotiate(t, 5)
+	r.WriteString("CMD\tpurge\n")
+	AssertRun(t, b, h.EmptyDispatch)
+	h.AssertEqualString(t, "Error: Commands not supported\nEND\n", w.String(), "Bad response")
+}
+
+func TestLogMessagesPrecedeNextAnswer(t *testing.T) {
+	b, r, w := BuildAndNegotiate(t, 5)
+	b.Log("Reload failed:\nbad zone")
+
+	r.WriteString("CMD\tpurge\n")
+	r.WriteString("PING\n")
+	r.WriteString("PING\n")
+	AssertRun(t, b, h.EmptyDispatch)
+	h.AssertEqualString(
+		t, "Error: Commands not supported\nEND\nLOG\tReload failed: bad zone\nEND\nEND\n",
+		w.String(), "Bad response",
+	)
+}
+
+func TestAXFRIsPassedToCallback(t *testing.T) {
+	for _, v := range []int{3, 4} {
+		b, r, w := BuildAndNegotiate(t, v)
+		var gotID int
+		var gotZone string
+		b.OnAXFR(func(b *Backend, id int, zone string) ([]*Response, error) {
+			gotID, gotZone = id, zone
+			return []*Response{h.FakeResponse(3)}, nil
+		})
+
+		if v == 3 {
+			r.WriteString("AXFR\t42\n")
+		} else {
+			r.WriteString("AXFR\t42\texample.com\n")
+		}
+		AssertRun(t, b, h.EmptyDispatch)
+		h.AssertEqualInt(t, 42, gotID, "Wrong zone id")
+		if v == 4 {
+			h.AssertEqualString(t, "example.com", gotZone, "Wrong zone name")
+		} else {
+			h.AssertEqualString(t, "", gotZone, "Zone name given before v4")
+		}
+		h.AssertEqualString(t, h.FakeResponseString(t, 3)+"END\n", w.String(), "Bad response")
+	}
+}
+
+func TestBadAXFRRequests(t *testing.T) {
+	b, r, w := BuildAndNegotiate(t, 4)
+	b.OnAXFR(func(b *Backend, id int, zone string) ([]*Response, error) {
+		return nil, nil
+	})
+
+	r.WriteString("AXFR\tfoo\texample.com\n")
+	r.WriteString("AXFR\t1\n")
+	AssertRun(t, b, h.EmptyDispatch)
+	h.AssertEqualString(
+		t, "LOG\tError handling line: Bad zone id in AXFR request\nFAIL\n"+
+			"LOG\tError handling line: v4 AXFR request should have 2 data parts\nFAIL\n",
+		w.String(), "Bad response",
+	)
+}
@@ -11,7 +11,7 @@ import (
 //
 // QName, QClass, QType, Id and RemoteIpAddress are present in all versions
 // LocalIpAddress was added in version 2
-// EdnsSubnetAddress was added in version 3
+// EdnsSubnetAddress was added in version 3; versions 4 and 5 are the same
 type Query struct {
 	ProtocolVersion   int
 	QName             string
@@ -37,9 +37,9 @@ func (q *Query) fromData(data string) (err error) {
 			return errors.New("v2 query should have 6 data parts")
 		}
 		q.LocalIpAddress = parts[5]
-	case 3:
+	case 3, 4, 5:
 		if len(parts) != 7 {
-			return errors.New("v3 query should have 7 data parts")
+			return fmt.Errorf("v%d query should have 7 data parts", q.ProtocolVersion)
 		}
 		q.LocalIpAddress = parts[5]
 		q.EdnsSubnetAddress = parts[6]
@@ -58,7 +58,7 @@ func (q *Query) fromData(data string) (err error) {
 }
 
 func (q *Query) String() (string, error) {
-	if q.ProtocolVersion < 1 || q.ProtocolVersion > 3 {
+	if q.ProtocolVersion < 1 || q.ProtocolVersion > 5 {
 		return "", errors.New("Unknown protocol version in query")
 	}
 	switch q.ProtocolVersion {
@@ -73,7 +73,7 @@ func (q *Query) String() (string, error) {
 			q.QName, q.QClass, q.QType, q.Id, q.RemoteIpAddress,
 			q.LocalIpAddress,
 		), nil
-	case 3:
+	case 3, 4, 5:
 		return fmt.Sprintf(
 			"Q\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
 			q.QName, q.QClass, q.QType, q.Id, q.RemoteIpAddress,
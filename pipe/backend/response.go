@@ -31,7 +31,7 @@ func (r *Response) String() (string, error) {
 			"DATA\t%s\t%s\t%s\t%s\t%s\t%s\n",
 			r.QName, r.QClass, r.QType, r.TTL, r.Id, r.Content,
 		), nil
-	case 3:
+	case 3, 4, 5:
 		return fmt.Sprintf(
 			"DATA\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
 			r.ScopeBits, r.Auth, r.QName, r.QClass, r.QType, r.TTL, r.Id, r.Content,
@@ -0,0 +1,466 @@
+// Copyright 2015 Bytemark Computer Consulting Ltd. All rights reserved
+// Licensed under the GNU General Public License, version 2. See the LICENSE
+// file for more details
+
+// Answers ACME DNS-01 challenges (RFC 8555, section 8.4) for ACME clients, with
+// an HTTP API compatible with acme-dns, which most clients can use. Usage:
+//
+//	r, err := acme.New("auth.example.com", "/var/lib/pdns-pipe/acme.json")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	r.Serve(x)
+//	go func() {
+//		err := http.ListenAndServe(":8082", r)
+//		log.Printf("ACME API: %v", err)
+//	}()
+//
+// A client registers once, with "POST /register", and gets a username, a
+// password and a subdomain of the responder's domain. A CNAME record is then
+// made from the challenge name of each host the client wants certificates for:
+//
+//	_acme-challenge.www.example.com. CNAME 8e5700ea-a4bf-41c7-8a77-e990661dcc6a.auth.example.com.
+//
+// To answer a challenge, the client sends the token with "POST /update", with
+// the X-Api-User and X-Api-Key headers set to its username and password:
+//
+//	{"subdomain": "8e5700ea-a4bf-41c7-8a77-e990661dcc6a", "txt": "<43 characters>"}
+//
+// and the token is given in answer to TXT queries for the subdomain until its
+// Lifetime is up. The two latest tokens are kept, so that a certificate for a
+// name and its wildcard can be issued at once. Expired tokens are removed as
+// new ones arrive, so nothing needs to be cleaned up by hand.
+//
+// Registrations and tokens are kept in the state file, if one is given. It is
+// locked while it is changed, and read again for each query, so every pipe
+// process PowerDNS runs gives the same answers, although only one of them can
+// listen on the API's port. Without a state file, tokens are only answered by
+// the process they were sent to, so one is needed unless PowerDNS runs a
+// single pipe process.
+//
+// The responder's domain must be in a zone the DSL serves, typically one of
+// its own set up with DSL.Zone. Registrations can be limited to certain client
+// networks with "allowfrom"; clients are identified by the address of the
+// connection, so a proxy in front of the API would need its own checks.
+package acme
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	"io"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Returned by Update for a subdomain that isn't registered
+var ErrNoSubdomain = errors.New("No such subdomain")
+
+// Returned by Update for a token that isn't 43 characters of base64url, the
+// form DNS-01 challenges take
+var ErrBadTXT = errors.New("Bad TXT token")
+
+var tokenRE = regexp.MustCompile(`^[A-Za-z0-9_-]{43}$`)
+
+// Answers challenges for subdomains of a domain
+type Responder struct {
+	// The domain the subdomains are below
+	Domain string
+
+	// How long tokens are answered for after they are sent. Defaults to an
+	// hour.
+	Lifetime time.Duration
+
+	// The TTL of the TXT answers. Defaults to 1 second, so that resolvers
+	// (and the DSL's cache) don't hold on to old tokens.
+	TTL int
+
+	// Stops "POST /register" making new registrations; they can still be
+	// made with Register
+	DisableRegistration bool
+
+	path     string
+	loaded   os.FileInfo // the state file as last read or written
+	mu       sync.Mutex
+	accounts map[string]*account // by username
+	tokens   map[string][]token  // by subdomain
+}
+
+// Credentials for updating the tokens of a subdomain, as "POST /register"
+// gives them
+type Registration struct {
+	Username   string   `json:"username"`
+	Password   string   `json:"password"`
+	FullDomain string   `json:"fulldomain"`
+	Subdomain  string   `json:"subdomain"`
+	AllowFrom  []string `json:"allowfrom"`
+}
+
+// A registration, as kept in the state file. Only a hash of the password is
+// kept; passwords are random and long, so a plain hash is as good as a slow
+// one.
+type account struct {
+	Username  string   `json:"username"`
+	KeyHash   string   `json:"key_hash"`
+	Subdomain string   `json:"subdomain"`
+	AllowFrom []string `json:"allowfrom"`
+}
+
+type token struct {
+	Text    string    `json:"txt"`
+	Expires time.Time `json:"expires"`
+}
+
+// The contents of the state file
+type state struct {
+	Accounts []*account         `json:"accounts"`
+	Tokens   map[string][]token `json:"tokens"`
+}
+
+// Get a responder for subdomains of the domain, keeping registrations and
+// tokens in the state file at path. The file is read if it exists, and written
+// when registrations are made and tokens are sent. If path is empty, they are
+// only kept in memory.
+func New(domain, path string) (*Responder, error) {
+	r := &Responder{
+		Domain:   strings.ToLower(strings.TrimSuffix(domain, ".")),
+		Lifetime: time.Hour,
+		TTL:      1,
+		path:     path,
+		accounts: make(map[string]*account),
+		tokens:   make(map[string][]token),
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Answer TXT queries for the subdomains with their current tokens
+func (r *Responder) Serve(d *dsl.DSL) {
+	d.TXT(`[a-z0-9-]+\.`+regexp.QuoteMeta(r.Domain), func(c *dsl.Context) {
+		subdomain := strings.ToLower(strings.SplitN(c.Query.QName, ".", 2)[0])
+		tokens, err := r.current(subdomain)
+		if err != nil {
+			c.Error = err
+			return
+		}
+		c.DefaultTTL = r.TTL
+		for _, text := range tokens {
+			c.ReplyTXT(text)
+		}
+	})
+}
+
+// Make a new registration, which may only be used from the networks given (or
+// from anywhere, if there are none)
+func (r *Responder) Register(allowFrom []string) (*Registration, error) {
+	nets := []string{}
+	for _, cidr := range allowFrom {
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("Bad allowfrom network: %q", cidr)
+		}
+		nets = append(nets, prefix.Masked().String())
+	}
+
+	username, err1 := uuid()
+	subdomain, err2 := uuid()
+	password, err3 := password()
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	a := &account{
+		Username:  username,
+		KeyHash:   hash(password),
+		Subdomain: subdomain,
+		AllowFrom: nets,
+	}
+	err := r.locked(func() bool {
+		r.accounts[username] = a
+		return true
+	})
+	if err != nil {
+		delete(r.accounts, username)
+		return nil, err
+	}
+
+	return &Registration{
+		Username:   username,
+		Password:   password,
+		FullDomain: subdomain + "." + r.Domain,
+		Subdomain:  subdomain,
+		AllowFrom:  a.AllowFrom,
+	}, nil
+}
+
+// Answer with the token for the subdomain, until its Lifetime is up. Of the
+// tokens sent for a subdomain, the two latest are answered with.
+func (r *Responder) Update(subdomain, txt string) error {
+	subdomain = strings.ToLower(subdomain)
+	if !tokenRE.MatchString(txt) {
+		return ErrBadTXT
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	found := false
+	err := r.locked(func() bool {
+		if r.account(subdomain) == nil {
+			return false
+		}
+		found = true
+
+		now := time.Now()
+		r.prune(now)
+
+		kept := []token{}
+		for _, t := range r.tokens[subdomain] {
+			if t.Text != txt {
+				kept = append(kept, t)
+			}
+		}
+		kept = append(kept, token{Text: txt, Expires: now.Add(r.Lifetime)})
+		if len(kept) > 2 {
+			kept = kept[len(kept)-2:]
+		}
+		r.tokens[subdomain] = kept
+		return true
+	})
+	switch {
+	case err != nil:
+		return err
+	case !found:
+		return ErrNoSubdomain
+	}
+	return nil
+}
+
+// The tokens to answer with for a subdomain, latest first
+func (r *Responder) current(subdomain string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	r.prune(time.Now())
+	tokens := r.tokens[subdomain]
+	out := make([]string, len(tokens))
+	for i, t := range tokens {
+		out[len(tokens)-1-i] = t.Text
+	}
+	return out, nil
+}
+
+// Drops expired tokens, and subdomains left with none
+func (r *Responder) prune(now time.Time) {
+	for subdomain, tokens := range r.tokens {
+		kept := tokens[:0]
+		for _, t := range tokens {
+			if now.Before(t.Expires) {
+				kept = append(kept, t)
+			}
+		}
+		if len(kept) == 0 {
+			delete(r.tokens, subdomain)
+		} else {
+			r.tokens[subdomain] = kept
+		}
+	}
+}
+
+// Finds the account for a subdomain
+func (r *Responder) account(subdomain string) *account {
+	for _, a := range r.accounts {
+		if a.Subdomain == subdomain {
+			return a
+		}
+	}
+	return nil
+}
+
+// Checks a username and password, returning the account they are for, or nil
+// if they don't match one
+func (r *Responder) authenticate(username, password string) (*account, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	a := r.accounts[strings.ToLower(username)]
+	if a == nil || subtle.ConstantTimeCompare([]byte(hash(password)), []byte(a.KeyHash)) != 1 {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// Checks an address is in the networks an account may be used from
+func (a *account) allows(addr netip.Addr) bool {
+	if len(a.AllowFrom) == 0 {
+		return true
+	}
+	for _, cidr := range a.AllowFrom {
+		if prefix, err := netip.ParsePrefix(cidr); err == nil && prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs f with the state file locked and freshly read, and writes the file
+// again if f returns true. Without a state file, f is just run.
+func (r *Responder) locked(f func() bool) error {
+	if r.path == "" {
+		f()
+		return nil
+	}
+
+	lock, err := os.OpenFile(r.path+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+
+	if err := r.reload(); err != nil {
+		return err
+	}
+	if f() {
+		return r.save()
+	}
+	return nil
+}
+
+// Checks whether the state file is still the one last read or written. It is
+// only ever replaced whole, by a rename, so a different file means a change.
+func (r *Responder) unchanged() bool {
+	if r.path == "" {
+		return true
+	}
+	fi, err := os.Stat(r.path)
+	return err == nil && r.loaded != nil && os.SameFile(fi, r.loaded) &&
+		fi.Size() == r.loaded.Size() && fi.ModTime().Equal(r.loaded.ModTime())
+}
+
+// Reads the state file again if it has changed
+func (r *Responder) reload() error {
+	if r.unchanged() {
+		return nil
+	}
+	return r.load()
+}
+
+// Reads the state file, if there is one and it exists. It is only ever
+// replaced whole, so it doesn't need to be locked to be read.
+func (r *Responder) load() error {
+	if r.path == "" {
+		return nil
+	}
+
+	f, err := os.Open(r.path)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	var st state
+	if err := json.Unmarshal(data, &st); err != nil {
+		return fmt.Errorf("%s: %s", r.path, err)
+	}
+	r.accounts = make(map[string]*account)
+	for _, a := range st.Accounts {
+		r.accounts[a.Username] = a
+	}
+	r.tokens = st.Tokens
+	if r.tokens == nil {
+		r.tokens = make(map[string][]token)
+	}
+	r.loaded = fi
+	return nil
+}
+
+func (r *Responder) save() error {
+	st := state{Accounts: make([]*account, 0, len(r.accounts)), Tokens: r.tokens}
+	for _, a := range r.accounts {
+		st.Accounts = append(st.Accounts, a)
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0600); err != nil {
+		return err
+	}
+	fi, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return err
+	}
+	r.loaded = fi
+	return nil
+}
+
+func hash(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// A random (version 4) UUID
+func uuid() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:], nil
+}
+
+// 40 random characters from the base64url alphabet, as acme-dns gives
+func password() (string, error) {
+	const chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	b := make([]byte, 40)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = chars[b[i]&63]
+	}
+	return string(b), nil
+}
@@ -0,0 +1,224 @@
+package acme_test
+
+import (
+	"encoding/json"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl/acme"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Tokens are 43 characters of base64url
+var tokens = []string{
+	strings.Repeat("a", 43),
+	strings.Repeat("b", 43),
+	strings.Repeat("c", 43),
+}
+
+func BuildResponder(t *testing.T) (*Responder, *dsl.DSL) {
+	r, err := New("Auth.Example.com.", "")
+	h.RefuteError(t, err, "New")
+	d := dsl.New()
+	r.Serve(d)
+	return r, d
+}
+
+// Makes a request, with any headers given as name and value pairs
+func Do(r http.Handler, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func AssertReply(t *testing.T, status int, body string, w *httptest.ResponseRecorder, msg string) {
+	t.Helper()
+	h.AssertEqualInt(t, status, w.Code, msg+": wrong status")
+	h.AssertEqualString(t, body, strings.TrimSpace(w.Body.String()), msg+": wrong body")
+}
+
+func AssertTXT(t *testing.T, d *dsl.DSL, qname, exp string) {
+	t.Helper()
+	q := h.FakeQuery(3)
+	q.QType, q.QName = "TXT", qname
+	rsp, err := d.Lookup(q)
+	h.RefuteError(t, err, "Lookup")
+	out := []string{}
+	for _, r := range rsp {
+		out = append(out, r.TTL+" "+r.Content)
+	}
+	h.AssertEqualString(t, exp, strings.Join(out, "\n"), "Wrong TXT answers for "+qname)
+}
+
+func Register(t *testing.T, r http.Handler, body string) *Registration {
+	t.Helper()
+	w := Do(r, "POST", "/register", body)
+	h.AssertEqualInt(t, http.StatusCreated, w.Code, "POST /register: "+w.Body.String())
+	reg := &Registration{}
+	h.RefuteError(t, json.Unmarshal(w.Body.Bytes(), reg), "Decoding registration")
+	return reg
+}
+
+func Update(r http.Handler, reg *Registration, txt string) *httptest.ResponseRecorder {
+	return Do(r, "POST", "/update", `{"subdomain": "`+reg.Subdomain+`", "txt": "`+txt+`"}`,
+		"X-Api-User", reg.Username, "X-Api-Key", reg.Password)
+}
+
+func TestRegisterAndUpdate(t *testing.T) {
+	r, d := BuildResponder(t)
+	reg := Register(t, r, "")
+
+	h.AssertEqualInt(t, 36, len(reg.Username), "Username should be a UUID")
+	h.AssertEqualInt(t, 40, len(reg.Password), "Wrong password length")
+	h.AssertEqualString(t, reg.Subdomain+".auth.example.com", reg.FullDomain, "Wrong full domain")
+	h.Assert(t, reg.AllowFrom != nil && len(reg.AllowFrom) == 0, "allowfrom should be an empty list")
+	AssertTXT(t, d, reg.FullDomain, "")
+
+	AssertReply(t, http.StatusOK, `{"txt":"`+tokens[0]+`"}`, Update(r, reg, tokens[0]), "Update")
+	AssertTXT(t, d, strings.ToUpper(reg.FullDomain), `1 "`+tokens[0]+`"`)
+
+	// The two latest tokens are answered with
+	AssertReply(t, http.StatusOK, `{"txt":"`+tokens[1]+`"}`, Update(r, reg, tokens[1]), "Update")
+	AssertTXT(t, d, reg.FullDomain, `1 "`+tokens[1]+`"`+"\n"+`1 "`+tokens[0]+`"`)
+	AssertReply(t, http.StatusOK, `{"txt":"`+tokens[2]+`"}`, Update(r, reg, tokens[2]), "Update")
+	AssertTXT(t, d, reg.FullDomain, `1 "`+tokens[2]+`"`+"\n"+`1 "`+tokens[1]+`"`)
+
+	// Other registrations have tokens of their own
+	other := Register(t, r, `{"allowfrom": []}`)
+	h.Assert(t, other.Subdomain != reg.Subdomain, "Registrations should get different subdomains")
+	AssertTXT(t, d, other.FullDomain, "")
+	AssertTXT(t, d, "nope.auth.example.com", "")
+
+	AssertReply(t, http.StatusOK, "", Do(r, "GET", "/health", ""), "GET /health")
+}
+
+func TestUpdateErrors(t *testing.T) {
+	r, d := BuildResponder(t)
+	reg := Register(t, r, "")
+	other := Register(t, r, "")
+	body := `{"subdomain": "` + reg.Subdomain + `", "txt": "` + tokens[0] + `"}`
+
+	AssertReply(t, http.StatusUnauthorized, `{"error":"forbidden"}`, Do(r, "POST", "/update", body), "No credentials")
+	AssertReply(t, http.StatusUnauthorized, `{"error":"forbidden"}`,
+		Do(r, "POST", "/update", body, "X-Api-User", reg.Username, "X-Api-Key", other.Password), "Wrong password")
+	AssertReply(t, http.StatusUnauthorized, `{"error":"forbidden"}`,
+		Do(r, "POST", "/update", body, "X-Api-User", other.Username, "X-Api-Key", other.Password), "Someone else's subdomain")
+	AssertReply(t, http.StatusBadRequest, `{"error":"bad_txt"}`, Update(r, reg, "short"), "Short token")
+	AssertReply(t, http.StatusBadRequest, `{"error":"bad_txt"}`, Update(r, reg, strings.Repeat("!", 43)), "Token with bad characters")
+	AssertReply(t, http.StatusBadRequest, `{"error":"malformed_json_payload"}`,
+		Do(r, "POST", "/update", "{", "X-Api-User", reg.Username, "X-Api-Key", reg.Password), "Bad JSON")
+	AssertReply(t, http.StatusNotFound, `{"error":"not_found"}`, Do(r, "GET", "/update", ""), "GET /update")
+	AssertTXT(t, d, reg.FullDomain, "")
+
+	// httptest requests come from 192.0.2.1
+	AssertReply(t, http.StatusBadRequest, `{"error":"invalid_allowfrom_cidr"}`,
+		Do(r, "POST", "/register", `{"allowfrom": ["192.0.2.1"]}`), "Bad allowfrom")
+	near := Register(t, r, `{"allowfrom": ["192.0.2.0/24", "2001:db8::/32"]}`)
+	far := Register(t, r, `{"allowfrom": ["198.51.100.7/24"]}`)
+	h.AssertEqualString(t, "198.51.100.0/24", strings.Join(far.AllowFrom, " "), "allowfrom should be normalised")
+	AssertReply(t, http.StatusOK, `{"txt":"`+tokens[0]+`"}`, Update(r, near, tokens[0]), "Update from an allowed network")
+	AssertReply(t, http.StatusUnauthorized, `{"error":"forbidden"}`, Update(r, far, tokens[0]), "Update from elsewhere")
+
+	r.DisableRegistration = true
+	AssertReply(t, http.StatusNotFound, `{"error":"not_found"}`, Do(r, "POST", "/register", ""), "Registration disabled")
+	_, err := r.Register(nil)
+	h.RefuteError(t, err, "Register should still work")
+}
+
+func TestTokensExpire(t *testing.T) {
+	r, d := BuildResponder(t)
+	r.Lifetime = 100 * time.Millisecond
+	reg, err := r.Register(nil)
+	h.RefuteError(t, err, "Register")
+
+	h.RefuteError(t, r.Update(reg.Subdomain, tokens[0]), "Update")
+	AssertTXT(t, d, reg.FullDomain, `1 "`+tokens[0]+`"`)
+	time.Sleep(200 * time.Millisecond)
+	AssertTXT(t, d, reg.FullDomain, "")
+
+	// Sending a token again gives it a new lifetime
+	h.RefuteError(t, r.Update(reg.Subdomain, tokens[0]), "Update")
+	time.Sleep(60 * time.Millisecond)
+	h.RefuteError(t, r.Update(reg.Subdomain, tokens[0]), "Update")
+	time.Sleep(60 * time.Millisecond)
+	AssertTXT(t, d, reg.FullDomain, `1 "`+tokens[0]+`"`)
+
+	h.Assert(t, r.Update("nope", tokens[0]) == ErrNoSubdomain, "Expected ErrNoSubdomain")
+	h.Assert(t, r.Update(reg.Subdomain, "nope") == ErrBadTXT, "Expected ErrBadTXT")
+}
+
+func TestRegistrationsAreKept(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acme.json")
+	r, err := New("auth.example.com", path)
+	h.RefuteError(t, err, "New")
+	reg := Register(t, r, `{"allowfrom": ["192.0.2.0/24"]}`)
+
+	r, err = New("auth.example.com", path)
+	h.RefuteError(t, err, "New from state file")
+	d := dsl.New()
+	r.Serve(d)
+	AssertReply(t, http.StatusOK, `{"txt":"`+tokens[0]+`"}`, Update(r, reg, tokens[0]), "Update after restart")
+	AssertTXT(t, d, reg.FullDomain, `1 "`+tokens[0]+`"`)
+}
+
+func TestTokensAreShared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acme.json")
+	r1, err := New("auth.example.com", path)
+	h.RefuteError(t, err, "New")
+	r2, err := New("auth.example.com", path)
+	h.RefuteError(t, err, "New")
+	d1, d2 := dsl.New(), dsl.New()
+	r1.Serve(d1)
+	r2.Serve(d2)
+
+	// Registered and updated through one, answered by both
+	reg := Register(t, r1, "")
+	AssertReply(t, http.StatusOK, `{"txt":"`+tokens[0]+`"}`, Update(r1, reg, tokens[0]), "Update")
+	AssertTXT(t, d1, reg.FullDomain, `1 "`+tokens[0]+`"`)
+	AssertTXT(t, d2, reg.FullDomain, `1 "`+tokens[0]+`"`)
+
+	// Either can take updates
+	AssertReply(t, http.StatusOK, `{"txt":"`+tokens[1]+`"}`, Update(r2, reg, tokens[1]), "Update through the other")
+	AssertTXT(t, d1, reg.FullDomain, `1 "`+tokens[1]+`"`+"\n"+`1 "`+tokens[0]+`"`)
+
+	// A state file that can't be read fails queries rather than answering
+	// with nothing
+	h.RefuteError(t, os.WriteFile(path, []byte("{bogus"), 0600), "Writing state file")
+	q := h.FakeQuery(3)
+	q.QType, q.QName = "TXT", reg.FullDomain
+	_, err = d1.Lookup(q)
+	h.Assert(t, err != nil, "Expected an error reading the state file")
+	AssertReply(t, http.StatusInternalServerError, `{"error":"db_error"}`, Update(r1, reg, tokens[2]), "Update")
+}
+
+func TestUnchangedStateFileIsntReadAgain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acme.json")
+	r, err := New("auth.example.com", path)
+	h.RefuteError(t, err, "New")
+	d := dsl.New()
+	r.Serve(d)
+	reg := Register(t, r, "")
+	AssertReply(t, http.StatusOK, `{"txt":"`+tokens[0]+`"}`, Update(r, reg, tokens[0]), "Update")
+
+	// Spoil the file in place, keeping its size and time, so it only looks
+	// unchanged; reading it again would fail
+	fi, err := os.Stat(path)
+	h.RefuteError(t, err, "Stat")
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	h.RefuteError(t, err, "OpenFile")
+	_, err = f.Write([]byte("{bogus"))
+	h.RefuteError(t, err, "Write")
+	h.RefuteError(t, f.Close(), "Close")
+	h.RefuteError(t, os.Chtimes(path, fi.ModTime(), fi.ModTime()), "Chtimes")
+
+	AssertTXT(t, d, reg.FullDomain, `1 "`+tokens[0]+`"`)
+}
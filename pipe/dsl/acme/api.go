@@ -0,0 +1,123 @@
+package acme
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Request bodies larger than this are refused
+const maxBody = 64 << 10
+
+// Serve the acme-dns API: "POST /register", "POST /update" and "GET /health".
+// Errors are given as acme-dns gives them, e.g. {"error": "forbidden"}.
+func (r *Responder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/register":
+		if req.Method != "POST" || r.DisableRegistration {
+			break
+		}
+		r.register(w, req)
+		return
+	case "/update":
+		if req.Method != "POST" {
+			break
+		}
+		r.update(w, req)
+		return
+	case "/health":
+		if req.Method != "GET" && req.Method != "HEAD" {
+			break
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	fail(w, http.StatusNotFound, "not_found")
+}
+
+func (r *Responder) register(w http.ResponseWriter, req *http.Request) {
+	var body struct {
+		AllowFrom []string `json:"allowfrom"`
+	}
+	// The body is optional
+	if req.ContentLength != 0 {
+		if err := decode(w, req, &body); err != nil {
+			fail(w, http.StatusBadRequest, "malformed_json_payload")
+			return
+		}
+	}
+
+	for _, cidr := range body.AllowFrom {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			fail(w, http.StatusBadRequest, "invalid_allowfrom_cidr")
+			return
+		}
+	}
+
+	reg, err := r.Register(body.AllowFrom)
+	if err != nil {
+		fail(w, http.StatusInternalServerError, "db_error")
+		return
+	}
+	reply(w, http.StatusCreated, reg)
+}
+
+func (r *Responder) update(w http.ResponseWriter, req *http.Request) {
+	a, err := r.authenticate(req.Header.Get("X-Api-User"), req.Header.Get("X-Api-Key"))
+	if err != nil {
+		fail(w, http.StatusInternalServerError, "db_error")
+		return
+	}
+	if a == nil || !a.allows(remoteAddr(req)) {
+		fail(w, http.StatusUnauthorized, "forbidden")
+		return
+	}
+
+	var body struct {
+		Subdomain string `json:"subdomain"`
+		TXT       string `json:"txt"`
+	}
+	if err := decode(w, req, &body); err != nil {
+		fail(w, http.StatusBadRequest, "malformed_json_payload")
+		return
+	}
+	if !strings.EqualFold(body.Subdomain, a.Subdomain) {
+		fail(w, http.StatusUnauthorized, "forbidden")
+		return
+	}
+
+	switch err := r.Update(body.Subdomain, body.TXT); err {
+	case nil:
+		reply(w, http.StatusOK, map[string]string{"txt": body.TXT})
+	case ErrBadTXT:
+		fail(w, http.StatusBadRequest, "bad_txt")
+	case ErrNoSubdomain:
+		fail(w, http.StatusBadRequest, "bad_subdomain")
+	default:
+		fail(w, http.StatusInternalServerError, "db_error")
+	}
+}
+
+// The address a request came from, or the zero Addr if it can't be told
+func remoteAddr(req *http.Request) netip.Addr {
+	addr, err := netip.ParseAddrPort(req.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	return addr.Addr()
+}
+
+func decode(w http.ResponseWriter, req *http.Request, v interface{}) error {
+	return json.NewDecoder(http.MaxBytesReader(w, req.Body, maxBody)).Decode(v)
+}
+
+func reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func fail(w http.ResponseWriter, status int, msg string) {
+	reply(w, status, map[string]string{"error": msg})
+}
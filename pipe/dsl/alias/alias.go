@@ -0,0 +1,301 @@
+// Copyright 2015 Bytemark Computer Consulting Ltd. All rights reserved
+// Licensed under the GNU General Public License, version 2. See the LICENSE
+// file for more details
+
+// ALIAS (or ANAME) records for DSL callbacks: the addresses of some other name,
+// typically a CDN hostname, are looked up through a recursive DNS server and
+// served as A and AAAA records for the queried name. Unlike a CNAME, this can
+// be done at a zone apex. Usage:
+//
+//	r := alias.New("127.0.0.1:53")
+//	x.A(root, r.Alias("example.cdn.net"))
+//	x.AAAA(root, r.Alias("example.cdn.net"))
+//
+// Answers are cached for their TTL, bounded by MinTTL and MaxTTL. If a lookup
+// fails, PowerDNS is sent a FAIL, unless ServeStale is set and an expired
+// answer is available, in which case that is served with StaleTTL instead.
+package alias
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"math/rand"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Looks up and caches the addresses of alias targets
+type Resolver struct {
+	// The recursive DNS server to send queries to, as host:port
+	Server string
+
+	// Bounds on how long answers are cached for, whatever their TTL. The
+	// TTL of the answers given to PowerDNS is bounded in the same way.
+	// Default to 30 seconds and one hour.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+
+	// How long to wait for the server. Defaults to 2 seconds.
+	Timeout time.Duration
+
+	// If a lookup fails, serve the last answer we had, even though it has
+	// expired, with a TTL of StaleTTL (default 30 seconds)
+	ServeStale bool
+	StaleTTL   time.Duration
+
+	mu    sync.Mutex
+	cache map[key]*entry
+}
+
+type key struct {
+	name  string
+	qtype dnsmessage.Type
+}
+
+type entry struct {
+	addrs   []netip.Addr
+	expires time.Time
+}
+
+// Get a new resolver using the given server, with the default settings
+func New(server string) *Resolver {
+	return &Resolver{
+		Server:   server,
+		MinTTL:   30 * time.Second,
+		MaxTTL:   time.Hour,
+		Timeout:  2 * time.Second,
+		StaleTTL: 30 * time.Second,
+		cache:    make(map[key]*entry),
+	}
+}
+
+// Builds a callback that answers A or AAAA queries (according to
+// Context.QType) with the addresses of the target
+func (r *Resolver) Alias(target string) dsl.Callback {
+	return func(c *dsl.Context) {
+		var qtype dnsmessage.Type
+		switch c.QType {
+		case "A":
+			qtype = dnsmessage.TypeA
+		case "AAAA":
+			qtype = dnsmessage.TypeAAAA
+		default:
+			c.Error = fmt.Errorf("ALIAS can't answer %s queries", c.QType)
+			return
+		}
+
+		addrs, ttl, err := r.lookup(target, qtype)
+		if err != nil {
+			c.Error = err
+			return
+		}
+
+		for _, addr := range addrs {
+			c.ReplyTTL(addr.String(), seconds(ttl))
+		}
+	}
+}
+
+// Returns the addresses of the given type for the name, from the cache if
+// possible, along with how much longer they may be cached for
+func (r *Resolver) Lookup(name, qtype string) ([]netip.Addr, time.Duration, error) {
+	switch qtype {
+	case "A":
+		return r.lookup(name, dnsmessage.TypeA)
+	case "AAAA":
+		return r.lookup(name, dnsmessage.TypeAAAA)
+	}
+	return nil, 0, fmt.Errorf("Can't look up %s records", qtype)
+}
+
+func (r *Resolver) lookup(name string, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	k := key{name: strings.ToLower(strings.TrimSuffix(name, ".")), qtype: qtype}
+	now := time.Now()
+
+	r.mu.Lock()
+	cached := r.cache[k]
+	r.mu.Unlock()
+
+	if cached != nil && now.Before(cached.expires) {
+		return cached.addrs, cached.expires.Sub(now), nil
+	}
+
+	addrs, ttl, err := r.resolve(k.name, qtype)
+	if err != nil {
+		if r.ServeStale && cached != nil {
+			return cached.addrs, r.StaleTTL, nil
+		}
+		return nil, 0, err
+	}
+
+	ttl = r.clamp(ttl)
+	r.mu.Lock()
+	if r.cache == nil {
+		r.cache = make(map[key]*entry)
+	}
+	r.cache[k] = &entry{addrs: addrs, expires: now.Add(ttl)}
+	r.mu.Unlock()
+
+	return addrs, ttl, nil
+}
+
+func (r *Resolver) clamp(ttl time.Duration) time.Duration {
+	if ttl < r.MinTTL {
+		ttl = r.MinTTL
+	}
+	if r.MaxTTL > 0 && ttl > r.MaxTTL {
+		ttl = r.MaxTTL
+	}
+	return ttl
+}
+
+// Whole seconds, rounding up so a TTL is never given as 0
+func seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// Forget all cached answers
+func (r *Resolver) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache = make(map[key]*entry)
+}
+
+// Asks the server for the name. The answer's TTL is the lowest of the records
+// in it (including any CNAMEs followed by the server), or for an empty answer,
+// the negative caching TTL from the SOA record in the authority section.
+func (r *Resolver) resolve(name string, qtype dnsmessage.Type) ([]netip.Addr, time.Duration, error) {
+	qname, err := dnsmessage.NewName(name + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = 2 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: uint16(rand.Intn(1 << 16)), RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: qname, Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+
+	rsp, err := r.exchange(ctx, "udp", query)
+	if err == nil && rsp.Truncated {
+		rsp, err = r.exchange(ctx, "tcp", query)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("ALIAS lookup of %s failed: %s", name, err)
+	}
+
+	switch rsp.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return nil, 0, fmt.Errorf("ALIAS lookup of %s failed: %s", name, rsp.RCode)
+	}
+
+	var addrs []netip.Addr
+	var ttl uint32
+	first := true
+	lower := func(t uint32) {
+		if first || t < ttl {
+			ttl, first = t, false
+		}
+	}
+
+	for _, rr := range rsp.Answers {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			if qtype == dnsmessage.TypeA {
+				addrs = append(addrs, netip.AddrFrom4(body.A))
+			}
+		case *dnsmessage.AAAAResource:
+			if qtype == dnsmessage.TypeAAAA {
+				addrs = append(addrs, netip.AddrFrom16(body.AAAA))
+			}
+		case *dnsmessage.CNAMEResource:
+		default:
+			continue
+		}
+		lower(rr.Header.TTL)
+	}
+
+	if len(addrs) == 0 {
+		first = true
+		for _, rr := range rsp.Authorities {
+			if soa, ok := rr.Body.(*dnsmessage.SOAResource); ok {
+				lower(rr.Header.TTL)
+				lower(soa.MinTTL)
+			}
+		}
+	}
+
+	return addrs, time.Duration(ttl) * time.Second, nil
+}
+
+func (r *Resolver) exchange(ctx context.Context, network string, query dnsmessage.Message) (*dnsmessage.Message, error) {
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, r.Server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	buf := make([]byte, 65536)
+	var n int
+	if network == "tcp" {
+		packed = append([]byte{byte(len(packed) >> 8), byte(len(packed))}, packed...)
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return nil, err
+		}
+		n = int(binary.BigEndian.Uint16(buf))
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err := conn.Write(packed); err != nil {
+			return nil, err
+		}
+		for {
+			if n, err = conn.Read(buf); err != nil {
+				return nil, err
+			}
+			// Ignore anything that isn't a reply to our query
+			if n >= 2 && binary.BigEndian.Uint16(buf) == query.ID {
+				break
+			}
+		}
+	}
+
+	var rsp dnsmessage.Message
+	if err := rsp.Unpack(buf[:n]); err != nil {
+		return nil, err
+	}
+	if rsp.ID != query.ID || !rsp.Response {
+		return nil, errors.New("Mismatched reply")
+	}
+	return &rsp, nil
+}
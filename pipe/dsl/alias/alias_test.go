@@ -0,0 +1,252 @@
+package alias_test
+
+import (
+	"encoding/binary"
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl/alias"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"golang.org/x/net/dns/dnsmessage"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A stand-in recursive server. cdn.example.net is a CNAME for
+// edge.example.net, which has one A and one AAAA record.
+type FakeServer struct {
+	udp     net.PacketConn
+	tcp     net.Listener
+	mu      sync.Mutex
+	queries int
+	ttl     uint32
+	fail    bool
+	trunc   bool
+}
+
+func NewFakeServer(t *testing.T) *FakeServer {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	h.RefuteError(t, err, "Listen UDP")
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	h.RefuteError(t, err, "Listen TCP")
+
+	s := &FakeServer{udp: udp, tcp: tcp, ttl: 300}
+	go s.serveUDP()
+	go s.serveTCP()
+	return s
+}
+
+func (s *FakeServer) Addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+func (s *FakeServer) Close() {
+	s.udp.Close()
+	s.tcp.Close()
+}
+
+func (s *FakeServer) Queries() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.queries
+}
+
+func (s *FakeServer) Set(f func(s *FakeServer)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f(s)
+}
+
+func (s *FakeServer) serveUDP() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if rsp := s.answer(buf[:n], true); rsp != nil {
+			s.udp.WriteTo(rsp, addr)
+		}
+	}
+}
+
+func (s *FakeServer) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		buf := make([]byte, 65536)
+		if _, err := io.ReadFull(conn, buf[:2]); err == nil {
+			n := int(binary.BigEndian.Uint16(buf))
+			if _, err := io.ReadFull(conn, buf[:n]); err == nil {
+				rsp := s.answer(buf[:n], false)
+				conn.Write(append([]byte{byte(len(rsp) >> 8), byte(len(rsp))}, rsp...))
+			}
+		}
+		conn.Close()
+	}
+}
+
+func (s *FakeServer) answer(packet []byte, udp bool) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries++
+
+	var q dnsmessage.Message
+	if q.Unpack(packet) != nil || len(q.Questions) != 1 {
+		return nil
+	}
+	question := q.Questions[0]
+	rsp := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: q.ID, Response: true, RecursionAvailable: true},
+		Questions: q.Questions,
+	}
+
+	switch {
+	case s.fail:
+		rsp.RCode = dnsmessage.RCodeServerFailure
+	case s.trunc && udp:
+		rsp.Truncated = true
+	case strings.EqualFold(question.Name.String(), "cdn.example.net."):
+		edge := dnsmessage.MustNewName("edge.example.net.")
+		rsp.Answers = append(rsp.Answers, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: question.Name, Class: dnsmessage.ClassINET, TTL: 3600},
+			Body:   &dnsmessage.CNAMEResource{CNAME: edge},
+		})
+		header := dnsmessage.ResourceHeader{Name: edge, Class: dnsmessage.ClassINET, TTL: s.ttl}
+		if question.Type == dnsmessage.TypeA {
+			rsp.Answers = append(rsp.Answers, dnsmessage.Resource{
+				Header: header, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}},
+			})
+		} else if question.Type == dnsmessage.TypeAAAA {
+			rsp.Answers = append(rsp.Answers, dnsmessage.Resource{
+				Header: header,
+				Body:   &dnsmessage.AAAAResource{AAAA: [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}},
+			})
+		}
+	default:
+		rsp.RCode = dnsmessage.RCodeNameError
+		rsp.Authorities = append(rsp.Authorities, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{
+				Name: dnsmessage.MustNewName("example.net."), Class: dnsmessage.ClassINET, TTL: 3600,
+			},
+			Body: &dnsmessage.SOAResource{
+				NS: dnsmessage.MustNewName("ns.example.net."), MBox: dnsmessage.MustNewName("hostmaster.example.net."),
+				MinTTL: 120,
+			},
+		})
+	}
+
+	out, _ := rsp.Pack()
+	return out
+}
+
+func AliasDSL(r *Resolver, target string) *dsl.DSL {
+	d := dsl.New()
+	d.A(`example\.com`, r.Alias(target))
+	d.AAAA(`example\.com`, r.Alias(target))
+	return d
+}
+
+func Lookup(t *testing.T, d *dsl.DSL, qtype string) ([]*backend.Response, error) {
+	q := h.FakeQuery(3)
+	q.QName, q.QType = "example.com", qtype
+	return d.Lookup(q)
+}
+
+func AssertAnswers(t *testing.T, d *dsl.DSL, qtype, exp string) {
+	rsp, err := Lookup(t, d, qtype)
+	h.RefuteError(t, err, "Lookup")
+	out := make([]string, len(rsp))
+	for i, r := range rsp {
+		out[i] = r.QName + " " + r.QType + " " + r.TTL + " " + r.Content
+	}
+	h.AssertEqualString(t, exp, strings.Join(out, "\n"), "Wrong answers")
+}
+
+func TestAliasAnswersWithTargetAddresses(t *testing.T) {
+	s := NewFakeServer(t)
+	defer s.Close()
+	d := AliasDSL(New(s.Addr()), "cdn.example.net")
+
+	AssertAnswers(t, d, "A", "example.com A 300 192.0.2.1")
+	AssertAnswers(t, d, "AAAA", "example.com AAAA 300 2001:db8::1")
+	AssertAnswers(t, d, "ANY", "example.com A 300 192.0.2.1\nexample.com AAAA 300 2001:db8::1")
+	AssertAnswers(t, AliasDSL(New(s.Addr()), "missing.example.net"), "A", "")
+}
+
+func TestAliasCachesWithinBounds(t *testing.T) {
+	s := NewFakeServer(t)
+	defer s.Close()
+
+	r := New(s.Addr())
+	d := AliasDSL(r, "cdn.example.net")
+	AssertAnswers(t, d, "A", "example.com A 300 192.0.2.1")
+	Lookup(t, d, "A")
+	h.AssertEqualInt(t, 1, s.Queries(), "Answer should be cached")
+
+	// TTLs are clamped, and the cached answer counts down
+	r = New(s.Addr())
+	r.MaxTTL = 100 * time.Second
+	AssertAnswers(t, AliasDSL(r, "cdn.example.net"), "A", "example.com A 100 192.0.2.1")
+
+	s.Set(func(s *FakeServer) { s.ttl = 1 })
+	r = New(s.Addr())
+	AssertAnswers(t, AliasDSL(r, "cdn.example.net"), "A", "example.com A 30 192.0.2.1")
+
+	// Negative answers are cached with the SOA minimum
+	_, ttl, err := r.Lookup("missing.example.net", "A")
+	h.RefuteError(t, err, "Lookup")
+	h.AssertEqualInt(t, 120, int(ttl/time.Second), "Negative TTL")
+
+	before := s.Queries()
+	r.Flush()
+	Lookup(t, AliasDSL(r, "cdn.example.net"), "A")
+	h.AssertEqualInt(t, before+1, s.Queries(), "Flush should empty the cache")
+}
+
+func TestAliasFailures(t *testing.T) {
+	s := NewFakeServer(t)
+	defer s.Close()
+
+	r := New(s.Addr())
+	r.MinTTL, r.MaxTTL = 0, 10*time.Millisecond
+	d := AliasDSL(r, "cdn.example.net")
+	AssertAnswers(t, d, "A", "example.com A 1 192.0.2.1")
+
+	time.Sleep(20 * time.Millisecond)
+	s.Set(func(s *FakeServer) { s.fail = true })
+	_, err := Lookup(t, d, "A")
+	h.Assert(t, err != nil, "SERVFAIL should give an error")
+
+	r.ServeStale = true
+	AssertAnswers(t, d, "A", "example.com A 30 192.0.2.1")
+
+	// Nothing stale to serve
+	_, err = Lookup(t, d, "AAAA")
+	h.Assert(t, err != nil, "SERVFAIL should give an error")
+}
+
+func TestAliasRetriesTruncatedOverTCP(t *testing.T) {
+	s := NewFakeServer(t)
+	defer s.Close()
+	s.Set(func(s *FakeServer) { s.trunc = true })
+
+	AssertAnswers(t, AliasDSL(New(s.Addr()), "cdn.example.net"), "A", "example.com A 300 192.0.2.1")
+	h.AssertEqualInt(t, 2, s.Queries(), "Should query over UDP then TCP")
+}
+
+func TestAliasTimesOut(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	h.RefuteError(t, err, "Listen")
+	defer conn.Close()
+
+	r := New(conn.LocalAddr().String())
+	r.Timeout = 50 * time.Millisecond
+	_, err = Lookup(t, AliasDSL(r, "cdn.example.net"), "A")
+	h.Assert(t, err != nil, "Silent server should give an error")
+}
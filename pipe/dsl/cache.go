@@ -0,0 +1,260 @@
+package dsl
+
+import (
+	"container/list"
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings for the answer cache; see DSL.Cache
+type CacheOptions struct {
+	// The most entries to keep. When full, the least recently used entry
+	// is dropped. Defaults to 10000.
+	Size int
+
+	// Keep separate entries for each client network (see
+	// Context.ClientSubnet). Without this, answers with ScopeBits set are
+	// never cached, since they aren't valid for every client.
+	BySubnet bool
+
+	// How long to cache empty answers for. By default, they aren't cached.
+	NegativeTTL time.Duration
+
+	// For this long after an entry expires, it is still served (with a TTL
+	// of 1 second) while a fresh answer is looked up in the background
+	StaleWhileRevalidate time.Duration
+}
+
+// Cache answers, so callbacks aren't run for every query. Usage:
+//
+//	x.Cache(dsl.CacheOptions{Size: 50000, StaleWhileRevalidate: time.Minute})
+//
+// Entries are keyed on the query name and type, the view if there are any (so
+// that one view's answers are never given to another's clients), and
+// optionally the client network. They are kept for the lowest TTL of the
+// answers, and the TTLs given to PowerDNS count down accordingly. Failed
+// lookups aren't cached.
+//
+// Entries can be dropped with DSL.Purge. The "purge" command does the same,
+// so with pipe protocol version 5 and backend.Backend.OnCommand(x.RunCommand):
+//
+//	pdns_control backend-cmd purge                # everything
+//	pdns_control backend-cmd purge www.example.com # one name
+//	pdns_control backend-cmd purge example.com$    # a name and all below it
+func (d *DSL) Cache(o CacheOptions) {
+	if o.Size <= 0 {
+		o.Size = 10000
+	}
+	d.cache = &cache{
+		opts:    o,
+		lru:     list.New(),
+		entries: make(map[cacheKey]*list.Element),
+	}
+
+	d.Command("purge", func(args []string) (string, error) {
+		if len(args) == 0 {
+			args = []string{""}
+		}
+		n := 0
+		for _, pattern := range args {
+			n += d.Purge(pattern)
+		}
+		return strconv.Itoa(n), nil
+	})
+}
+
+// Drop cache entries, returning how many were dropped. An empty pattern drops
+// everything; a name drops the entries for that name; and a name followed by
+// "$" drops the entries for that name and all names below it.
+func (d *DSL) Purge(pattern string) int {
+	if d.cache == nil {
+		return 0
+	}
+	return d.cache.purge(pattern)
+}
+
+type cacheKey struct {
+	qname  string
+	qtype  string
+	subnet string
+	view   string
+}
+
+type cacheEntry struct {
+	key        cacheKey
+	answers    []*backend.Response
+	stored     time.Time
+	expires    time.Time
+	refreshing bool
+}
+
+type cache struct {
+	opts    CacheOptions
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[cacheKey]*list.Element
+}
+
+func (c *cache) key(d *DSL, q *backend.Query) cacheKey {
+	k := cacheKey{qname: strings.ToLower(canonical(q.QName)), qtype: q.QType}
+	if c.opts.BySubnet {
+		if subnet, ok := clientSubnet(q); ok {
+			k.subnet = subnet.String()
+		}
+	}
+	if len(d.views) > 0 {
+		if v, _ := d.viewFor(q); v != nil {
+			k.view = v.Name
+		}
+	}
+	return k
+}
+
+func (c *cache) lookup(d *DSL, q *backend.Query) ([]*backend.Response, error) {
+	k := c.key(d, q)
+	now := time.Now()
+
+	c.mu.Lock()
+	if el, ok := c.entries[k]; ok {
+		e := el.Value.(*cacheEntry)
+		switch {
+		case now.Before(e.expires):
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			return e.copy(q, int(now.Sub(e.stored)/time.Second), false), nil
+		case now.Before(e.expires.Add(c.opts.StaleWhileRevalidate)):
+			c.lru.MoveToFront(el)
+			if !e.refreshing {
+				e.refreshing = true
+				refresh := *q
+				go c.refresh(d, &refresh, k)
+			}
+			c.mu.Unlock()
+			return e.copy(q, 0, true), nil
+		}
+	}
+	c.mu.Unlock()
+
+	return c.fetch(d, q, k, now)
+}
+
+// Looks up the answers for a query and stores them, unless they depend on the
+// client in a way the key doesn't cover
+func (c *cache) fetch(d *DSL, q *backend.Query, k cacheKey, now time.Time) ([]*backend.Response, error) {
+	dependent := false
+	answers, err := d.lookup(q, scope{clientDependent: &dependent})
+	if err == nil && (!dependent || c.opts.BySubnet) {
+		c.store(k, answers, now)
+	}
+	return answers, err
+}
+
+func (c *cache) refresh(d *DSL, q *backend.Query, k cacheKey) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	c.fetch(d, q, k, time.Now())
+
+	// If nothing was stored, the old entry can be refreshed again later
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[k]; ok {
+		el.Value.(*cacheEntry).refreshing = false
+	}
+}
+
+// Works out how long the answers can be cached for, if at all
+func (c *cache) ttl(answers []*backend.Response) (time.Duration, bool) {
+	if len(answers) == 0 {
+		return c.opts.NegativeTTL, c.opts.NegativeTTL > 0
+	}
+
+	lowest := -1
+	for _, answer := range answers {
+		ttl, err := strconv.Atoi(answer.TTL)
+		if err != nil {
+			return 0, false
+		}
+		if scope, _ := strconv.Atoi(answer.ScopeBits); scope > 0 && !c.opts.BySubnet {
+			return 0, false
+		}
+		if lowest < 0 || ttl < lowest {
+			lowest = ttl
+		}
+	}
+	return time.Duration(lowest) * time.Second, lowest > 0
+}
+
+func (c *cache) store(k cacheKey, answers []*backend.Response, now time.Time) {
+	ttl, ok := c.ttl(answers)
+	if !ok {
+		return
+	}
+
+	stored := make([]*backend.Response, len(answers))
+	for i, answer := range answers {
+		r := *answer
+		stored[i] = &r
+	}
+	e := &cacheEntry{key: k, answers: stored, stored: now, expires: now.Add(ttl)}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[k]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[k] = c.lru.PushFront(e)
+	for c.lru.Len() > c.opts.Size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *cache) purge(pattern string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	name := strings.ToLower(canonical(pattern))
+	below := strings.HasSuffix(name, "$")
+	name = strings.TrimSuffix(name, "$")
+
+	n := 0
+	for k, el := range c.entries {
+		if pattern == "" || k.qname == name || (below && strings.HasSuffix(k.qname, "."+name)) {
+			c.lru.Remove(el)
+			delete(c.entries, k)
+			n++
+		}
+	}
+	return n
+}
+
+// Copies the cached answers for a query, with their TTLs reduced by the time
+// they have been cached for
+func (e *cacheEntry) copy(q *backend.Query, elapsed int, stale bool) []*backend.Response {
+	out := make([]*backend.Response, len(e.answers))
+	for i, answer := range e.answers {
+		r := *answer
+		r.Id = q.Id
+		if strings.EqualFold(r.QName, q.QName) {
+			r.QName = q.QName
+		}
+
+		ttl, _ := strconv.Atoi(r.TTL)
+		ttl -= elapsed
+		if stale || ttl < 1 {
+			ttl = 1
+		}
+		r.TTL = strconv.Itoa(ttl)
+		out[i] = &r
+	}
+	return out
+}
@@ -0,0 +1,196 @@
+package dsl_test
+
+import (
+	"errors"
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A callback that counts how often it runs, replying with the count
+type Counter struct {
+	mu   sync.Mutex
+	runs int
+	ttl  int
+}
+
+func (c *Counter) Runs() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.runs
+}
+
+func (c *Counter) Reply(ctx *Context) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.runs++
+	ttl := c.ttl
+	if ttl == 0 {
+		ttl = 300
+	}
+	ctx.ReplyTTL(strings.Repeat("x", c.runs), ttl)
+}
+
+func CacheDSL(o CacheOptions) (*DSL, *Counter) {
+	d, counter := New(), &Counter{}
+	d.TXT(`.*`, counter.Reply)
+	d.Cache(o)
+	return d, counter
+}
+
+func TXTQuery(qname string) *backend.Query {
+	return TypedQuery("TXT", qname)
+}
+
+func TestCacheServesRepeatedQueries(t *testing.T) {
+	d, counter := CacheDSL(CacheOptions{})
+	AssertAnswer(t, d, TXTQuery("www.example.com"), "x")
+
+	q := TXTQuery("WWW.example.com")
+	q.Id = "42"
+	rsp := AssertLookup(t, d, q, 1, nil)
+	h.AssertEqualInt(t, 1, counter.Runs(), "Callback should only run once")
+	h.AssertEqualString(t, "x", rsp[0].Content, "Wrong cached answer")
+	h.AssertEqualString(t, "42", rsp[0].Id, "Id should come from the query")
+	h.AssertEqualString(t, "WWW.example.com", rsp[0].QName, "QName should come from the query")
+	h.AssertEqualString(t, "300", rsp[0].TTL, "Wrong TTL")
+
+	AssertAnswer(t, d, TXTQuery("other.example.com"), "xx")
+	AssertLookup(t, d, AQuery("www.example.com"), 0, nil)
+	h.AssertEqualInt(t, 2, counter.Runs(), "Other names and types shouldn't be cached together")
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	d, counter := CacheDSL(CacheOptions{Size: 2})
+	AssertAnswer(t, d, TXTQuery("a.example.com"), "x")
+	AssertAnswer(t, d, TXTQuery("b.example.com"), "xx")
+	AssertAnswer(t, d, TXTQuery("a.example.com"), "x")
+	AssertAnswer(t, d, TXTQuery("c.example.com"), "xxx")
+
+	AssertAnswer(t, d, TXTQuery("a.example.com"), "x")
+	AssertAnswer(t, d, TXTQuery("b.example.com"), "xxxx")
+	h.AssertEqualInt(t, 4, counter.Runs(), "b should have been evicted")
+}
+
+func TestCacheSkipsErrorsAndScopedAnswers(t *testing.T) {
+	d, runs := New(), 0
+	d.TXT(`fail\.example\.com`, func(c *Context) { runs++; c.Error = errors.New("Failed") })
+	d.Subnets("TXT", `scoped\.example\.com`, map[netip.Prefix]Callback{
+		netip.MustParsePrefix("127.0.0.0/8"): func(c *Context) { runs++; c.Reply("scoped") },
+	})
+	d.Cache(CacheOptions{})
+
+	for i := 0; i < 2; i++ {
+		AssertLookup(t, d, TXTQuery("fail.example.com"), 0, errors.New("Failed"))
+		AssertLookup(t, d, TXTQuery("scoped.example.com"), 1, nil)
+	}
+	h.AssertEqualInt(t, 4, runs, "Nothing should be cached")
+}
+
+func TestCacheBySubnet(t *testing.T) {
+	d, counter := New(), &Counter{}
+	d.Subnets("TXT", `.*`, map[netip.Prefix]Callback{
+		netip.MustParsePrefix("0.0.0.0/0"): counter.Reply,
+	})
+	d.Cache(CacheOptions{BySubnet: true})
+
+	q := TXTQuery("www.example.com")
+	q.EdnsSubnetAddress = "192.0.2.0/24"
+	AssertAnswer(t, d, q, "x")
+	AssertAnswer(t, d, q, "x")
+	q.EdnsSubnetAddress = "198.51.100.0/24"
+	AssertAnswer(t, d, q, "xx")
+	h.AssertEqualInt(t, 2, counter.Runs(), "Should cache per subnet")
+}
+
+func TestCacheNegativeAnswers(t *testing.T) {
+	d, counter := CacheDSL(CacheOptions{})
+	AssertLookup(t, d, AQuery("www.example.com"), 0, nil)
+
+	runs := 0
+	d = New()
+	d.A(`.*`, func(c *Context) { runs++ })
+	d.Cache(CacheOptions{NegativeTTL: time.Minute})
+	AssertLookup(t, d, AQuery("www.example.com"), 0, nil)
+	AssertLookup(t, d, AQuery("www.example.com"), 0, nil)
+	h.AssertEqualInt(t, 1, runs, "Empty answer should be cached")
+	h.AssertEqualInt(t, 0, counter.Runs(), "Sanity")
+}
+
+func TestCacheExpiryAndStaleWhileRevalidate(t *testing.T) {
+	d, counter := CacheDSL(CacheOptions{StaleWhileRevalidate: time.Minute})
+	counter.ttl = 1
+	AssertAnswer(t, d, TXTQuery("www.example.com"), "x")
+	time.Sleep(1100 * time.Millisecond)
+
+	// The stale answer is served while the new one is looked up
+	rsp := AssertLookup(t, d, TXTQuery("www.example.com"), 1, nil)
+	h.AssertEqualString(t, "x", rsp[0].Content, "Stale answer expected")
+	h.AssertEqualString(t, "1", rsp[0].TTL, "Stale answer should have a short TTL")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for counter.Runs() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	AssertAnswer(t, d, TXTQuery("www.example.com"), "xx")
+
+	// Without stale-while-revalidate, expired entries are looked up again
+	d, counter = CacheDSL(CacheOptions{})
+	counter.ttl = 1
+	AssertAnswer(t, d, TXTQuery("www.example.com"), "x")
+	time.Sleep(1100 * time.Millisecond)
+	AssertAnswer(t, d, TXTQuery("www.example.com"), "xx")
+}
+
+func TestCachePurge(t *testing.T) {
+	d, counter := CacheDSL(CacheOptions{})
+	for _, name := range []string{"example.com", "www.example.com", "www.example.org"} {
+		AssertLookup(t, d, TXTQuery(name), 1, nil)
+	}
+
+	h.AssertEqualInt(t, 0, d.Purge("other.example.com"), "Nothing should be purged")
+	h.AssertEqualInt(t, 1, d.Purge("WWW.example.org."), "Exact name should be purged")
+	h.AssertEqualInt(t, 2, d.Purge("example.com$"), "Names below should be purged")
+
+	AssertLookup(t, d, TXTQuery("www.example.com"), 1, nil)
+	h.AssertEqualInt(t, 4, counter.Runs(), "Purged entry should be looked up again")
+
+	out, err := d.RunCommand(nil, "purge")
+	h.RefuteError(t, err, "purge command")
+	h.AssertEqualString(t, "1", out, "Wrong purge count")
+}
+
+func TestRunCommand(t *testing.T) {
+	d := New()
+	d.Command("echo", func(args []string) (string, error) {
+		return strings.Join(args, " "), nil
+	})
+
+	out, err := d.RunCommand(nil, "echo\thello  world")
+	h.RefuteError(t, err, "echo command")
+	h.AssertEqualString(t, "hello world", out, "Wrong output")
+
+	_, err = d.RunCommand(nil, "bogus")
+	h.AssertEqualString(t, `Unknown command "bogus". Commands: echo`, err.Error(), "Wrong error")
+}
+
+func TestCacheKeepsViewsApart(t *testing.T) {
+	d := New()
+	d.TXT(`.*`, ReplyHandler("default"))
+	internal := New()
+	internal.TXT(`.*`, ReplyHandler("internal"))
+	d.AddView(&View{Name: "internal", Sources: Prefixes("10.0.0.0/8"), Routes: internal})
+	d.Cache(CacheOptions{})
+
+	q := TXTQuery("www.example.com")
+	AssertAnswer(t, d, q, "default")
+	q.RemoteIpAddress = "10.0.0.1"
+	AssertAnswer(t, d, q, "internal")
+	q.RemoteIpAddress = "192.0.2.1"
+	AssertAnswer(t, d, q, "default")
+}
@@ -0,0 +1,116 @@
+package dsl
+
+import (
+	"errors"
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+)
+
+// The longest chain of CNAMEs that will be followed by a single lookup
+const maxCNAMEChain = 8
+
+// If this is enabled, CNAME answers returned for a non-CNAME query are followed
+// to their targets within the DSL, and the answers for those are returned too.
+// This includes CNAMEs given by callbacks registered with DSL.RegisterAnyType,
+// such as those of store.Serve, when they are all that is given. Chains of
+// CNAMEs are followed up to a length of 8, and loops are detected.
+//
+// Targets are looked up within this DSL only, so a DSL mounted with DSL.Mount
+// won't follow CNAMEs that point outside of itself.
+func (d *DSL) ChaseCNAMEs(enabled bool) {
+	d.chase = enabled
+}
+
+// A name with a CNAME can't have any other data (RFC 1034, section 3.6.2), so
+// if CNAME callbacks answer for the query name then we return their answers,
+// rather than running the callbacks for the query type. This lets PowerDNS
+// follow the CNAME, instead of replying NODATA.
+//
+// Queries for CNAME or ANY are left alone.
+func (d *DSL) lookupCNAME(q *backend.Query, s scope) ([]*backend.Response, error) {
+	if q.QType == "CNAME" || q.QType == "ANY" || len(d.callbacks["CNAME"]) == 0 {
+		return nil, nil
+	}
+
+	answers, err := d.run(q, s, d.jobs(q, []string{"CNAME"}))
+	if err != nil || len(answers) == 0 {
+		return answers, err
+	}
+	return d.chaseCNAME(q, s, answers)
+}
+
+// Checks whether answers to a query are only a CNAME, so should be chased
+func onlyCNAME(q *backend.Query, answers []*backend.Response) bool {
+	if q.QType == "CNAME" || q.QType == "ANY" || len(answers) == 0 {
+		return false
+	}
+	for _, a := range answers {
+		if a.QType != "CNAME" {
+			return false
+		}
+	}
+	return true
+}
+
+// Follows the CNAME in the answers, if chasing is enabled, returning the
+// answers with those for its target added
+func (d *DSL) chaseCNAME(q *backend.Query, s scope, answers []*backend.Response) ([]*backend.Response, error) {
+	if !d.chase {
+		return answers, nil
+	}
+
+	if s.seen == nil {
+		s.seen = make(map[string]bool)
+	}
+	s.seen[canonical(q.QName)] = true
+
+	// A CNAME RRset can only have one record, so we don't know which target
+	// to follow if there are more
+	target := canonical(answers[0].Content)
+	if len(answers) > 1 || s.seen[target] || len(s.seen) >= maxCNAMEChain {
+		return answers, nil
+	}
+
+	tq := *q
+	tq.QName = target
+	if s.mount != nil {
+		s.relative, _ = s.mount.relative(target)
+	}
+
+	more, err := d.lookup(&tq, s)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(answers, more...), nil
+}
+
+// DNSSEC records are allowed to coexist with a CNAME. Callbacks registered
+// with DSL.RegisterAnyType are left to look after themselves.
+var cnameCompatible = map[string]bool{
+	"CNAME": true, "RRSIG": true, "NSEC": true, "NSEC3": true, anyType: true,
+}
+
+// Checks that no name has both a CNAME and other data. This can only be done
+// for exact names and for regexps that are identical; the results of regexps
+// that merely overlap aren't known until a query comes in.
+func (d *DSL) validateCNAMEs() error {
+	for _, cname := range d.callbacks["CNAME"] {
+		for _, qtype := range d.qtypeSort {
+			if cnameCompatible[qtype] {
+				continue
+			}
+			for _, other := range d.callbacks[qtype] {
+				if cname.name != other.name {
+					continue
+				}
+				if cname.name != "" {
+					return errors.New("CNAME for " + cname.name + " conflicts with " + qtype + " data")
+				}
+				if cname.matcher.String() == other.matcher.String() {
+					return errors.New("CNAME for " + cname.matcher.String() + " conflicts with " + qtype + " data")
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package dsl_test
+
+import (
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"testing"
+)
+
+func CNAMEDSL() *DSL {
+	d := New()
+	d.CNAME(`www\.example\.com`, ReplyHandler("web.example.com"))
+	d.A(`www\.example\.com`, ReplyHandler("192.0.2.1"))
+	d.A(`web\.example\.com`, ReplyHandler("192.0.2.2"))
+	return d
+}
+
+func TestCNAMEIsReturnedForOtherQTypes(t *testing.T) {
+	d := CNAMEDSL()
+	rsp := AssertLookup(t, d, AQuery("www.example.com"), 1, nil)
+	h.AssertEqualString(t, "CNAME", rsp[0].QType, "CNAME not returned")
+	h.AssertEqualString(t, "web.example.com", rsp[0].Content, "Bad CNAME")
+}
+
+func TestCNAMEAndANYQueriesAreUnaffected(t *testing.T) {
+	d := CNAMEDSL()
+	q := AQuery("www.example.com")
+	q.QType = "CNAME"
+	AssertLookup(t, d, q, 1, nil)
+	q.QType = "ANY"
+	AssertLookup(t, d, q, 2, nil)
+}
+
+func TestNamesWithoutCNAMEAreAnsweredNormally(t *testing.T) {
+	d := CNAMEDSL()
+	rsp := AssertLookup(t, d, AQuery("web.example.com"), 1, nil)
+	h.AssertEqualString(t, "192.0.2.2", rsp[0].Content, "Bad answer")
+}
+
+func TestCNAMEErrorsAreReported(t *testing.T) {
+	d := New()
+	d.CNAME(`.*`, ErrorReplyHandler)
+	AssertLookup(t, d, AQuery("www.example.com"), 0, ErrorReplyError)
+}
+
+func TestCNAMEChasing(t *testing.T) {
+	d := CNAMEDSL()
+	d.ChaseCNAMEs(true)
+	rsp := AssertLookup(t, d, AQuery("www.example.com"), 2, nil)
+	h.AssertEqualString(t, "CNAME", rsp[0].QType, "CNAME should be first")
+	h.AssertEqualString(t, "web.example.com", rsp[1].QName, "Target answer has wrong name")
+	h.AssertEqualString(t, "192.0.2.2", rsp[1].Content, "Target not chased")
+}
+
+func TestCNAMEChasingFollowsChainsAndStopsOnLoops(t *testing.T) {
+	d := New()
+	d.ChaseCNAMEs(true)
+	d.CNAME(`a\.example\.com`, ReplyHandler("b.example.com."))
+	d.CNAME(`b\.example\.com`, ReplyHandler("c.example.com"))
+	d.CNAME(`c\.example\.com`, ReplyHandler("a.example.com"))
+	rsp := AssertLookup(t, d, AQuery("a.example.com"), 3, nil)
+	h.AssertEqualString(t, "c.example.com", rsp[2].QName, "Chain not followed")
+}
+
+func TestWildcardCNAME(t *testing.T) {
+	d := New()
+	d.RegisterName("CNAME", "*.example.com", ReplyHandler("web.example.com"))
+	d.RegisterName("A", "web.example.com", ReplyHandler("192.0.2.2"))
+	rsp := AssertLookup(t, d, AQuery("foo.example.com"), 1, nil)
+	h.AssertEqualString(t, "CNAME", rsp[0].QType, "Wildcard CNAME not returned")
+	AssertLookup(t, d, AQuery("web.example.com"), 1, nil)
+}
+
+func TestValidateRejectsCNAMEAndOtherData(t *testing.T) {
+	d := New()
+	d.RegisterName("CNAME", "www.example.com", NullHandler)
+	d.RegisterName("RRSIG", "www.example.com", NullHandler)
+	h.RefuteError(t, d.Validate(), "DNSSEC data can coexist with CNAME")
+
+	d.RegisterName("A", "www.example.com", NullHandler)
+	err := d.Validate()
+	h.Assert(t, err != nil, "Conflict not detected")
+	h.AssertEqualString(t, "CNAME for www.example.com conflicts with A data", err.Error(), "Bad error")
+
+	d = CNAMEDSL()
+	err = d.Validate()
+	h.Assert(t, err != nil, "Conflict not detected")
+	h.AssertEqualString(t, `CNAME for ^(?i)www\.example\.com$ conflicts with A data`, err.Error(), "Bad error")
+}
+
+func TestValidateRejectsCNAMEAtZoneApex(t *testing.T) {
+	d := New()
+	d.Zone("example.com", func(z *Zone) {
+		z.SOA(ExampleSOA)
+		z.NS("ns1.example.com")
+		z.RegisterName("CNAME", "@", NullHandler)
+	})
+	h.Assert(t, d.Validate() != nil, "CNAME at apex not detected")
+}
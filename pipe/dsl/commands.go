@@ -0,0 +1,46 @@
+package dsl
+
+import (
+	"fmt"
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	"sort"
+	"strings"
+)
+
+// A command that can be run by PowerDNS with "pdns_control backend-cmd", given
+// the rest of the words on the command line. The output is shown to the user.
+type Command func(args []string) (string, error)
+
+// Register a command. Commands are run by RunCommand, which can be given to
+// backend.Backend.OnCommand (this needs protocol version 5):
+//
+//	x.Command("hello", func(args []string) (string, error) {
+//		return "Hello, " + strings.Join(args, " "), nil
+//	})
+//	pipe.OnCommand(x.RunCommand)
+func (d *DSL) Command(name string, f Command) {
+	d.commands[name] = f
+}
+
+// Runs the command named by the first word of the line
+func (d *DSL) RunCommand(b *backend.Backend, line string) (string, error) {
+	words := strings.Fields(line)
+	if len(words) == 0 {
+		return "", fmt.Errorf("No command given. Commands: %s", d.commandNames())
+	}
+
+	f, ok := d.commands[words[0]]
+	if !ok {
+		return "", fmt.Errorf("Unknown command %q. Commands: %s", words[0], d.commandNames())
+	}
+	return f(words[1:])
+}
+
+func (d *DSL) commandNames() string {
+	names := make([]string, 0, len(d.commands))
+	for name := range d.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,450 @@
+// Copyright 2015 Bytemark Computer Consulting Ltd. All rights reserved
+// Licensed under the GNU General Public License, version 2. See the LICENSE
+// file for more details
+
+// Builds a DSL from a YAML (or JSON) description of zones and records, so they
+// can be changed without recompiling. Records either have fixed content, or
+// refer by name to a callback supplied by the program. For instance:
+//
+//	ttl: 3600
+//	zones:
+//	  - name: example.com
+//	    soa:
+//	      mname: ns1.example.com
+//	      rname: hostmaster.example.com
+//	      serial: 2015010101
+//	      refresh: 10800
+//	      retry: 900
+//	      expire: 604800
+//	      minimum: 300
+//	    ns: [ns1.example.com, ns2.example.com]
+//	    records:
+//	      - {name: "@", type: MX, content: "10 mail.example.com"}
+//	      - {name: www, type: A, ttl: 300, content: [192.0.2.1, 192.0.2.2]}
+//	      - {name: api, type: A, handler: nearest-api}
+//	records:
+//	  - {name: host.example.org, type: A, content: 192.0.2.3}
+//
+// is loaded with:
+//
+//	x, err := config.ParseFile("records.yaml", config.Handlers{
+//		"nearest-api": nearestAPI,
+//	})
+//
+// Record names in zones are relative to the apex unless they end with a dot;
+// "@" is the apex, and names may begin with "*." to make wildcards. Records
+// outside zones have absolute names. Names in record content are passed to
+// PowerDNS as they are, so should be absolute. A ttl given for a record with a
+// handler is the default TTL of the handler's answers.
+//
+// Mistakes are reported with the line number they were found on.
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Callbacks that records in the configuration can refer to by name
+type Handlers map[string]dsl.Callback
+
+// An error in the configuration, and where it was found
+type Error struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s: line %d: %s", e.File, e.Line, e.Msg)
+}
+
+func errorAt(n *yaml.Node, format string, args ...interface{}) error {
+	return &Error{Line: n.Line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Build a DSL from the configuration file at path
+func ParseFile(path string, handlers Handlers) (*dsl.DSL, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := Parse(data, handlers)
+	if e, ok := err.(*Error); ok {
+		e.File = path
+	} else if err != nil {
+		err = fmt.Errorf("%s: %s", path, err)
+	}
+	return d, err
+}
+
+// Build a DSL from YAML or JSON configuration data
+func Parse(data []byte, handlers Handlers) (*dsl.DSL, error) {
+	var doc yaml.Node
+	err := yaml.NewDecoder(bytes.NewReader(data)).Decode(&doc)
+	if err != nil && err != io.EOF {
+		return nil, syntaxError(err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, &Error{Line: 1, Msg: "Empty configuration"}
+	}
+
+	b := &builder{handlers: handlers}
+	return b.build(doc.Content[0])
+}
+
+// The YAML package gives syntax errors as "yaml: line N: message"
+var yamlError = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+
+func syntaxError(err error) error {
+	if m := yamlError.FindStringSubmatch(err.Error()); m != nil {
+		var line int
+		fmt.Sscan(m[1], &line)
+		return &Error{Line: line, Msg: m[2]}
+	}
+	return err
+}
+
+type builder struct {
+	handlers Handlers
+}
+
+// Checks that a node is a mapping with only the allowed keys, returning the
+// values by key
+func fields(n *yaml.Node, allowed ...string) (map[string]*yaml.Node, error) {
+	if n.Kind != yaml.MappingNode {
+		return nil, errorAt(n, "Expected a mapping")
+	}
+
+	out := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		known := false
+		for _, a := range allowed {
+			known = known || key.Value == a
+		}
+		if !known {
+			return nil, errorAt(key, "Unknown field %q (expected one of: %s)", key.Value, strings.Join(allowed, ", "))
+		}
+		if _, dup := out[key.Value]; dup {
+			return nil, errorAt(key, "Duplicate field %q", key.Value)
+		}
+		out[key.Value] = value
+	}
+	return out, nil
+}
+
+func decode(n *yaml.Node, what string, v interface{}) error {
+	if n.Kind != yaml.ScalarNode || n.Decode(v) != nil {
+		return errorAt(n, "Bad %s: %q", what, n.Value)
+	}
+	return nil
+}
+
+func sequence(n *yaml.Node, what string) ([]*yaml.Node, error) {
+	if n.Kind != yaml.SequenceNode {
+		return nil, errorAt(n, "%s should be a list", what)
+	}
+	return n.Content, nil
+}
+
+func (b *builder) build(root *yaml.Node) (*dsl.DSL, error) {
+	top, err := fields(root, "ttl", "zones", "records")
+	if err != nil {
+		return nil, err
+	}
+
+	ttl := 3600
+	if n := top["ttl"]; n != nil {
+		if err := decodeTTL(n, &ttl); err != nil {
+			return nil, err
+		}
+	}
+	d := dsl.NewWithTTL(ttl)
+
+	if n := top["zones"]; n != nil {
+		zones, err := sequence(n, "zones")
+		if err != nil {
+			return nil, err
+		}
+		for _, zn := range zones {
+			if err := b.zone(d, zn); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if n := top["records"]; n != nil {
+		if err := b.records(n, "", d.Static, d.RegisterName); err != nil {
+			return nil, err
+		}
+	}
+
+	// Anything left, such as CNAMEs alongside other data, can't be tied to
+	// a line
+	if err := d.Validate(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func decodeTTL(n *yaml.Node, ttl *int) error {
+	if err := decode(n, "TTL", ttl); err != nil {
+		return err
+	}
+	if *ttl < 0 || *ttl > 1<<31-1 {
+		return errorAt(n, "Bad TTL: %q", n.Value)
+	}
+	return nil
+}
+
+func (b *builder) zone(d *dsl.DSL, n *yaml.Node) error {
+	f, err := fields(n, "name", "ttl", "soa", "ns", "records")
+	if err != nil {
+		return err
+	}
+
+	var name string
+	if f["name"] == nil {
+		return errorAt(n, "Zone has no name")
+	}
+	if err := decodeName(f["name"], &name); err != nil {
+		return err
+	}
+	if f["soa"] == nil {
+		return errorAt(n, "Zone %s has no soa", name)
+	}
+	if f["ns"] == nil {
+		return errorAt(n, "Zone %s has no ns", name)
+	}
+
+	soa, err := decodeSOA(f["soa"])
+	if err != nil {
+		return err
+	}
+
+	nsNodes, err := sequence(f["ns"], "ns")
+	if err != nil {
+		return err
+	}
+	ns := make([]string, len(nsNodes))
+	for i, nn := range nsNodes {
+		if err := decodeName(nn, &ns[i]); err != nil {
+			return err
+		}
+	}
+
+	var zoneErr error
+	d.Zone(name, func(z *dsl.Zone) {
+		if n := f["ttl"]; n != nil {
+			if zoneErr = decodeTTL(n, &z.DefaultTTL); zoneErr != nil {
+				return
+			}
+		}
+		z.SOA(soa)
+		z.NS(ns...)
+
+		if n := f["records"]; n != nil {
+			zoneErr = b.records(n, z.Name, z.Static, z.RegisterName)
+		}
+	})
+	return zoneErr
+}
+
+var soaFields = []string{"mname", "rname", "serial", "refresh", "retry", "expire", "minimum"}
+
+func decodeSOA(n *yaml.Node) (dsl.SOA, error) {
+	var soa dsl.SOA
+	f, err := fields(n, soaFields...)
+	if err != nil {
+		return soa, err
+	}
+	for _, field := range soaFields {
+		if f[field] == nil {
+			return soa, errorAt(n, "soa has no %s", field)
+		}
+	}
+
+	if err := decodeName(f["mname"], &soa.MName); err != nil {
+		return soa, err
+	}
+	if err := decodeName(f["rname"], &soa.RName); err != nil {
+		return soa, err
+	}
+	numbers := []*uint32{&soa.Serial, &soa.Refresh, &soa.Retry, &soa.Expire, &soa.Minimum}
+	for i, field := range soaFields[2:] {
+		if err := decode(f[field], field, numbers[i]); err != nil {
+			return soa, err
+		}
+	}
+	return soa, nil
+}
+
+var validName = regexp.MustCompile(`^(?:@|\*|[A-Za-z0-9_-]+|\*\.[A-Za-z0-9_.-]+|[A-Za-z0-9_-][A-Za-z0-9_.-]*)$`)
+
+func decodeName(n *yaml.Node, name *string) error {
+	if err := decode(n, "name", name); err != nil {
+		return err
+	}
+	if !validName.MatchString(*name) || strings.Contains(*name, "..") || len(*name) > 254 {
+		return errorAt(n, "Bad name: %q", *name)
+	}
+	return nil
+}
+
+// Registers the records in a list, using static for those with content and
+// dynamic for those with handlers. Names are checked to be within the zone,
+// if there is one. Records with content are registered together, so that each
+// RRset is answered by a single route.
+func (b *builder) records(n *yaml.Node, zone string, static func(...dsl.Record), dynamic func(qtype, name string, f dsl.Callback)) error {
+	list, err := sequence(n, "records")
+	if err != nil {
+		return err
+	}
+
+	var records []dsl.Record
+
+	for _, rn := range list {
+		f, err := fields(rn, "name", "type", "ttl", "content", "handler")
+		if err != nil {
+			return err
+		}
+
+		var r dsl.Record
+		if f["name"] == nil || f["type"] == nil {
+			return errorAt(rn, "Records need a name and a type")
+		}
+		if err := decodeName(f["name"], &r.Name); err != nil {
+			return err
+		}
+		if err := checkInZone(f["name"], r.Name, zone); err != nil {
+			return err
+		}
+		if err := decode(f["type"], "type", &r.Type); err != nil {
+			return err
+		}
+		r.Type = strings.ToUpper(r.Type)
+		if !validType.MatchString(r.Type) {
+			return errorAt(f["type"], "Bad type: %q", r.Type)
+		}
+		if n := f["ttl"]; n != nil {
+			var ttl int
+			if err := decodeTTL(n, &ttl); err != nil {
+				return err
+			}
+			r.TTL = dsl.TTL(ttl)
+		}
+
+		switch {
+		case f["content"] != nil && f["handler"] != nil:
+			return errorAt(rn, "Records can have content or a handler, not both")
+
+		case f["handler"] != nil:
+			var name string
+			if err := decode(f["handler"], "handler", &name); err != nil {
+				return err
+			}
+			handler, ok := b.handlers[name]
+			if !ok {
+				return errorAt(f["handler"], "Unknown handler %q", name)
+			}
+			if r.TTL != nil {
+				handler = withTTL(handler, *r.TTL)
+			}
+			dynamic(r.Type, r.Name, handler)
+
+		case f["content"] != nil:
+			contents, err := decodeContents(f["content"], r.Type)
+			if err != nil {
+				return err
+			}
+			for _, content := range contents {
+				r.Content = content
+				records = append(records, r)
+			}
+
+		default:
+			return errorAt(rn, "Records need content or a handler")
+		}
+	}
+
+	static(records...)
+	return nil
+}
+
+// Wraps a handler so that its answers default to the TTL given for the record
+func withTTL(handler dsl.Callback, ttl int) dsl.Callback {
+	return func(c *dsl.Context) {
+		c.DefaultTTL = ttl
+		handler(c)
+	}
+}
+
+var validType = regexp.MustCompile(`^[A-Z][A-Z0-9]*$`)
+
+func checkInZone(n *yaml.Node, name, zone string) error {
+	if zone == "" || !strings.HasSuffix(name, ".") {
+		return nil
+	}
+	abs := strings.ToLower(strings.TrimSuffix(name, "."))
+	if abs != zone && !strings.HasSuffix(abs, "."+zone) {
+		return errorAt(n, "%s is outside zone %s", name, zone)
+	}
+	return nil
+}
+
+// Content may be a single value or a list of them
+func decodeContents(n *yaml.Node, qtype string) ([]string, error) {
+	nodes := []*yaml.Node{n}
+	if n.Kind == yaml.SequenceNode {
+		nodes = n.Content
+	}
+	if len(nodes) == 0 {
+		return nil, errorAt(n, "Empty content")
+	}
+
+	out := make([]string, len(nodes))
+	for i, cn := range nodes {
+		if err := decode(cn, "content", &out[i]); err != nil {
+			return nil, err
+		}
+		if err := checkContent(cn, qtype, out[i]); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// Catches the most common mistakes; PowerDNS checks everything else
+func checkContent(n *yaml.Node, qtype, content string) error {
+	if strings.TrimSpace(content) == "" {
+		return errorAt(n, "Empty content")
+	}
+
+	switch qtype {
+	case "A":
+		if addr, err := netip.ParseAddr(content); err != nil || !addr.Is4() {
+			return errorAt(n, "Bad A content: %q", content)
+		}
+	case "AAAA":
+		if addr, err := netip.ParseAddr(content); err != nil || !addr.Is6() || addr.Is4In6() {
+			return errorAt(n, "Bad AAAA content: %q", content)
+		}
+	case "SOA":
+		if _, err := dsl.ParseSOA(content); err != nil {
+			return errorAt(n, "%s", err)
+		}
+	}
+	return nil
+}
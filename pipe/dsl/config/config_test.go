@@ -0,0 +1,132 @@
+package config_test
+
+import (
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl/config"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const exampleYAML = `
+ttl: 600
+zones:
+  - name: example.com
+    ttl: 300
+    soa:
+      mname: ns1.example.com
+      rname: hostmaster.example.com
+      serial: 2015010101
+      refresh: 10800
+      retry: 900
+      expire: 604800
+      minimum: 300
+    ns: [ns1.example.com, ns2.example.com]
+    records:
+      - {name: "@", type: MX, content: "10 mail.example.com"}
+      - {name: www, type: A, ttl: 60, content: [192.0.2.1, 192.0.2.2]}
+      - {name: "*.dyn", type: txt, content: '"wild"'}
+      - {name: api, type: A, handler: api}
+      - {name: api2, type: A, ttl: 30, handler: api}
+      - {name: www, type: TXT, content: '"one"'}
+      - {name: www, type: TXT, content: ['"two"', '"three"']}
+records:
+  - {name: host.example.org, type: A, content: 192.0.2.3}
+`
+
+const exampleJSON = `{
+  "zones": [{
+    "name": "example.com",
+    "soa": {"mname": "ns1.example.com", "rname": "hostmaster.example.com",
+            "serial": 1, "refresh": 2, "retry": 3, "expire": 4, "minimum": 5},
+    "ns": ["ns1.example.com"],
+    "records": [{"name": "www", "type": "A", "content": "192.0.2.1"}]
+  }]
+}`
+
+var handlers = Handlers{
+	"api": func(c *dsl.Context) { c.Reply("192.0.2.99") },
+}
+
+func Query(qtype, qname string) *backend.Query {
+	q := h.FakeQuery(3)
+	q.QType, q.QName = qtype, qname
+	return q
+}
+
+func AssertAnswers(t *testing.T, d *dsl.DSL, q *backend.Query, exp string) {
+	rsp, err := d.Lookup(q)
+	h.RefuteError(t, err, "Lookup")
+	out := make([]string, len(rsp))
+	for i, r := range rsp {
+		out[i] = r.QType + " " + r.TTL + " " + r.Content
+	}
+	h.AssertEqualString(t, exp, strings.Join(out, "\n"), "Wrong answers for "+q.QName)
+}
+
+func TestParseYAML(t *testing.T) {
+	d, err := Parse([]byte(exampleYAML), handlers)
+	h.RefuteError(t, err, "Parse")
+
+	AssertAnswers(t, d, Query("SOA", "example.com"), "SOA 300 ns1.example.com hostmaster.example.com 2015010101 10800 900 604800 300")
+	AssertAnswers(t, d, Query("NS", "example.com"), "NS 300 ns1.example.com\nNS 300 ns2.example.com")
+	AssertAnswers(t, d, Query("MX", "example.com"), "MX 300 10 mail.example.com")
+	AssertAnswers(t, d, Query("A", "www.example.com"), "A 60 192.0.2.1\nA 60 192.0.2.2")
+	AssertAnswers(t, d, Query("TXT", "foo.dyn.example.com"), `TXT 300 "wild"`)
+	AssertAnswers(t, d, Query("A", "api.example.com"), "A 300 192.0.2.99")
+	AssertAnswers(t, d, Query("A", "api2.example.com"), "A 30 192.0.2.99")
+	AssertAnswers(t, d, Query("TXT", "www.example.com"), "TXT 300 \"one\"\nTXT 300 \"two\"\nTXT 300 \"three\"")
+	AssertAnswers(t, d, Query("A", "host.example.org"), "A 600 192.0.2.3")
+}
+
+func TestParseJSON(t *testing.T) {
+	d, err := Parse([]byte(exampleJSON), nil)
+	h.RefuteError(t, err, "Parse")
+	AssertAnswers(t, d, Query("A", "www.example.com"), "A 3600 192.0.2.1")
+}
+
+func AssertError(t *testing.T, doc, exp string) {
+	_, err := Parse([]byte(doc), handlers)
+	if err == nil {
+		t.Fatalf("Expected error %q", exp)
+	}
+	h.AssertEqualString(t, exp, err.Error(), "Wrong error")
+}
+
+func TestErrorsHaveLineNumbers(t *testing.T) {
+	zone := strings.Replace(exampleYAML, "      - {name: www, type: A, ttl: 60, content: [192.0.2.1, 192.0.2.2]}\n", "%s", 1)
+	for record, exp := range map[string]string{
+		"      - {name: www, type: A, content: 2001:db8::1}\n":          `line 17: Bad A content: "2001:db8::1"`,
+		"      - {name: www, type: A, ttl: soon, content: 1.2.3.4}\n":   `line 17: Bad TTL: "soon"`,
+		"      - {name: www, type: A, handler: nope}\n":                 `line 17: Unknown handler "nope"`,
+		"      - {name: www, type: A}\n":                                "line 17: Records need content or a handler",
+		"      - {name: www, type: A, contnet: 1.2.3.4}\n":              `line 17: Unknown field "contnet" (expected one of: name, type, ttl, content, handler)`,
+		"      - {name: www.example.org., type: A, content: 1.2.3.4}\n": "line 17: www.example.org. is outside zone example.com",
+		"      - {name: 'bad name', type: A, content: 1.2.3.4}\n":       `line 17: Bad name: "bad name"`,
+		"      - {name: www, type: 'A A', content: 1.2.3.4}\n":          `line 17: Bad type: "A A"`,
+		"      - {name: www, type: A, content: [1.2.3.4\n":              "line 16: did not find expected ',' or ']'",
+	} {
+		AssertError(t, strings.Replace(zone, "%s", record, 1), exp)
+	}
+
+	AssertError(t, "zones:\n  - name: example.com\n    ns: [ns1.example.com]\n", "line 2: Zone example.com has no soa")
+	AssertError(t, "zones:\n  - name: example.com\n    soa: {mname: a}\n    ns: []\n", "line 3: soa has no rname")
+	AssertError(t, "zones: example.com\n", "line 1: zones should be a list")
+	AssertError(t, "", "line 1: Empty configuration")
+	AssertError(t, "records:\n  - {name: a.example.com, type: CNAME, content: b.example.com}\n  - {name: a.example.com, type: A, content: 192.0.2.1}\n",
+		"CNAME for a.example.com conflicts with A data")
+}
+
+func TestParseFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.yaml")
+	h.RefuteError(t, os.WriteFile(path, []byte("ttl: never\n"), 0644), "WriteFile")
+	_, err := ParseFile(path, nil)
+	h.AssertEqualString(t, path+`: line 1: Bad TTL: "never"`, err.Error(), "Wrong error")
+
+	h.RefuteError(t, os.WriteFile(path, []byte(exampleYAML), 0644), "WriteFile")
+	_, err = ParseFile(path, handlers)
+	h.RefuteError(t, err, "ParseFile")
+}
@@ -6,13 +6,25 @@ import (
 )
 
 // Callbacks are run with a context instance, which allows them to accumulate
-// answers while maintaining a short type signature. It will also make
-// concurrent callbacks easier, when we handle that, but for now one context
-// is maintained across all callbacks for a particular query
+// answers while maintaining a short type signature. Normally one context is
+// maintained across all callbacks for a particular query; if the DSL is set to
+// run callbacks concurrently, each callback gets a context of its own.
 type Context struct {
 	// Replies that don't specify a TTL will be given this instead.
 	DefaultTTL int
 
+	// The zone the callback was registered against, if any
+	Zone *Zone
+
+	// The name of the view selected for the query, if any; see DSL.AddView
+	View string
+
+	// If the query was delegated to this DSL by DSL.Mount, the suffix it
+	// was mounted under and the query name relative to that suffix ("@"
+	// for the suffix itself). Both are blank otherwise.
+	MountPoint   string
+	RelativeName string
+
 	// The query that triggered this callback run. Note that its QType
 	// member may be "ANY"
 	Query *backend.Query
@@ -29,11 +41,38 @@ type Context struct {
 	// run, and the error text (only) will be reported to the backend.
 	Error error
 
+	// Whether answers are authoritative. Defaults to true; set it to false
+	// before replying with glue, or NS records for a delegation. Only sent
+	// to PowerDNS if protocol version 3 has been negotiated.
+	Auth bool
+
+	// The number of bits of the EDNS client subnet used to choose the
+	// answers, so resolvers know how widely they can cache them. Defaults
+	// to 0 (the answers are good for everyone). Only sent to PowerDNS if
+	// protocol version 3 has been negotiated.
+	//
+	// Both Auth and ScopeBits are reset before each callback is run, but a
+	// Before callback can set them for the callback that follows it.
+	ScopeBits int
+
 	// Answers to be sent to the backend are stored here. Context.Reply()
 	// calls, etc, generate answers and put them here, for instance.
-	// If multiple callbacks are being run, then later callbacks will be
-	// able to see the answers earlier ones generated (for now)
+	// If multiple callbacks are being run sequentially, then later
+	// callbacks will be able to see the answers earlier ones generated
 	Answers []*backend.Response
+
+	done     <-chan struct{}
+	mount    *Mount
+	locator  Locator
+	location *Location
+}
+
+// Returns a channel that is closed if the lookup this callback is a part of
+// has been abandoned because a concurrently-running callback reported an error.
+// Long-running callbacks can select on it to give up early. For sequential
+// lookups, the channel is nil and so never closes.
+func (c *Context) Done() <-chan struct{} {
+	return c.done
 }
 
 // Add an answer, using default QName and TTL for the query
@@ -48,12 +87,22 @@ func (c *Context) ReplyTTL(content string, ttl int) {
 
 // Add an answer, specifying both QName and TTL.
 func (c *Context) ReplyExtra(qname, content string, ttl int) {
-	c.Answers = append(c.Answers, &backend.Response{
+	r := &backend.Response{
 		QName:   qname,
 		QClass:  c.Query.QClass,
 		QType:   c.QType, // q.Query.QType may == "ANY"
 		Id:      c.Query.Id,
 		Content: content,
 		TTL:     strconv.Itoa(ttl),
-	})
+	}
+
+	if c.Query.ProtocolVersion >= 3 {
+		r.ScopeBits = strconv.Itoa(c.ScopeBits)
+		r.Auth = "0"
+		if c.Auth {
+			r.Auth = "1"
+		}
+	}
+
+	c.Answers = append(c.Answers, r)
 }
@@ -0,0 +1,140 @@
+package dsl
+
+import (
+	"fmt"
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	"net/netip"
+	"strconv"
+)
+
+// The well-known prefix for IPv4/IPv6 translation (RFC 6052)
+var WellKnownDNS64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+
+type dns64 struct {
+	prefix  netip.Prefix
+	clients []netip.Prefix
+}
+
+// Synthesise AAAA answers for clients of a NAT64 gateway (RFC 6147). When an
+// AAAA query gets no answers, the A answers for the same name are looked up,
+// and each address is embedded in the prefix as described in RFC 6052. The
+// prefix must be 32, 40, 48, 56, 64 or 96 bits long. For instance:
+//
+//	x.DNS64(dsl.WellKnownDNS64Prefix)
+//
+// If any client networks are given, only queries from clients within them
+// (see Context.ClientSubnet) get synthesised answers, whose ScopeBits are
+// widened to cover the network if need be. Empty answers then depend on the
+// client too, so they are only cached (see DSL.Cache) with BySubnet.
+//
+// Addresses that aren't globally reachable, such as those in 10.0.0.0/8 or
+// 192.0.2.0/24, aren't synthesised with the well-known prefix, as RFC 6052
+// (section 3.1) requires.
+func (d *DSL) DNS64(prefix netip.Prefix, clients ...netip.Prefix) {
+	switch prefix.Bits() {
+	case 32, 40, 48, 56, 64, 96:
+	default:
+		panic(fmt.Sprintf("Bad DNS64 prefix length: %s", prefix))
+	}
+	if !prefix.Addr().Is6() || prefix.Addr().Is4In6() {
+		panic(fmt.Sprintf("DNS64 prefix must be IPv6: %s", prefix))
+	}
+
+	d.dns64 = &dns64{prefix: prefix.Masked(), clients: clients}
+}
+
+// Embeds an IPv4 address in the prefix, skipping bits 64 to 71 (RFC 6052,
+// section 2.2)
+func (x *dns64) synthesise(v4 netip.Addr) netip.Addr {
+	bytes := x.prefix.Addr().As16()
+	pos := x.prefix.Bits() / 8
+	for _, octet := range v4.As4() {
+		if pos == 8 {
+			pos++
+		}
+		bytes[pos] = octet
+		pos++
+	}
+	return netip.AddrFrom16(bytes)
+}
+
+// Returns the length of the client network the query matched, or false if
+// synthesis doesn't apply to the client
+func (x *dns64) client(q *backend.Query) (int, bool) {
+	if len(x.clients) == 0 {
+		return 0, true
+	}
+
+	subnet, _ := clientSubnet(q)
+	addr := subnet.Addr()
+	bits, ok := 0, false
+	for _, prefix := range x.clients {
+		if prefix.Contains(addr) && (!ok || prefix.Bits() > bits) {
+			bits, ok = prefix.Bits(), true
+		}
+	}
+	return bits, ok
+}
+
+// The IPv4 networks RFC 6890 lists as not globally reachable, along with
+// multicast
+var notGlobal = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+func globallyReachable(addr netip.Addr) bool {
+	return !contains(notGlobal, addr)
+}
+
+// Looks up the A answers for an AAAA query, and turns them into AAAA answers
+func (d *DSL) lookupDNS64(q *backend.Query, s scope) ([]*backend.Response, error) {
+	bits, ok := d.dns64.client(q)
+	if !ok {
+		s.markClientDependent(len(d.dns64.clients) > 0)
+		return nil, nil
+	}
+
+	aq := *q
+	aq.QType = "A"
+	answers, err := d.resolve(&aq, s)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*backend.Response
+	for _, answer := range answers {
+		if answer.QType != "A" {
+			continue
+		}
+		v4, err := netip.ParseAddr(answer.Content)
+		if err != nil || !v4.Is4() {
+			continue
+		}
+		if d.dns64.prefix == WellKnownDNS64Prefix && !globallyReachable(v4) {
+			continue
+		}
+
+		r := *answer
+		r.QType = "AAAA"
+		r.Content = d.dns64.synthesise(v4).String()
+		if scope, err := strconv.Atoi(r.ScopeBits); err == nil && scope < bits {
+			r.ScopeBits = strconv.Itoa(bits)
+		}
+		out = append(out, &r)
+	}
+	s.markClientDependent(len(d.dns64.clients) > 0 && len(out) == 0)
+	return out, nil
+}
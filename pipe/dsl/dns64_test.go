@@ -0,0 +1,99 @@
+package dsl_test
+
+import (
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func DNS64DSL(prefix string, clients ...netip.Prefix) *DSL {
+	d := New()
+	d.A(`global\.example\.com`, ReplyHandler("198.41.0.4"))
+	d.A(`v4only\.example\.com`, ReplyHandler("192.0.2.33"))
+	d.A(`private\.example\.com`, ReplyHandler("10.1.2.3"))
+	d.A(`dual\.example\.com`, ReplyHandler("192.0.2.1"))
+	d.AAAA(`dual\.example\.com`, ReplyHandler("2001:db8::1"))
+	d.DNS64(netip.MustParsePrefix(prefix), clients...)
+	return d
+}
+
+func TestDNS64SynthesisesFromA(t *testing.T) {
+	d := DNS64DSL("64:ff9b::/96")
+	AssertAnswer(t, d, TypedQuery("AAAA", "global.example.com"), "64:ff9b::c629:4")
+	AssertAnswer(t, d, TypedQuery("AAAA", "dual.example.com"), "2001:db8::1")
+	AssertAnswer(t, d, TypedQuery("AAAA", "missing.example.com"), "")
+	AssertAnswer(t, d, TypedQuery("A", "global.example.com"), "198.41.0.4")
+
+	// Not globally reachable, so not with the well-known prefix
+	AssertAnswer(t, d, TypedQuery("AAAA", "private.example.com"), "")
+	d = DNS64DSL("2001:db8:64::/96")
+	AssertAnswer(t, d, TypedQuery("AAAA", "private.example.com"), "2001:db8:64::a01:203")
+}
+
+// RFC 6890 lists these as not globally reachable
+func TestDNS64WellKnownPrefixSkipsSpecialPurposeAddresses(t *testing.T) {
+	for _, addr := range []string{
+		"0.1.2.3", "10.1.2.3", "100.64.0.1", "127.0.0.1", "169.254.1.1",
+		"172.16.0.1", "192.0.0.1", "192.0.2.33", "192.168.1.1", "198.18.0.1",
+		"198.51.100.1", "203.0.113.1", "224.0.0.1", "240.0.0.1", "255.255.255.255",
+	} {
+		d := New()
+		d.A(`special\.example\.com`, ReplyHandler(addr))
+		d.DNS64(netip.MustParsePrefix("64:ff9b::/96"))
+		AssertLookup(t, d, TypedQuery("AAAA", "special.example.com"), 0, nil)
+	}
+}
+
+// The examples from RFC 6052, section 2.4
+func TestDNS64PrefixLengths(t *testing.T) {
+	for prefix, exp := range map[string]string{
+		"2001:db8::/32":         "2001:db8:c000:221::",
+		"2001:db8:100::/40":     "2001:db8:1c0:2:21::",
+		"2001:db8:122::/48":     "2001:db8:122:c000:2:2100::",
+		"2001:db8:122:300::/56": "2001:db8:122:3c0:0:221::",
+		"2001:db8:122:344::/64": "2001:db8:122:344:c0:2:2100:0",
+		"2001:db8:122:344::/96": "2001:db8:122:344::c000:221",
+	} {
+		AssertAnswer(t, DNS64DSL(prefix), TypedQuery("AAAA", "v4only.example.com"), exp)
+	}
+}
+
+func TestDNS64RestrictedToClients(t *testing.T) {
+	d := DNS64DSL("64:ff9b::/96", netip.MustParsePrefix("2001:db8:aa::/48"))
+
+	q := TypedQuery("AAAA", "global.example.com")
+	q.EdnsSubnetAddress = "2001:db8:aa:1::/64"
+	rsp := AssertLookup(t, d, q, 1, nil)
+	h.AssertEqualString(t, "64:ff9b::c629:4", rsp[0].Content, "Should synthesise")
+	h.AssertEqualString(t, "48", rsp[0].ScopeBits, "Scope should cover the client network")
+
+	q.EdnsSubnetAddress = "2001:db8:bb:1::/64"
+	AssertLookup(t, d, q, 0, nil)
+}
+
+// An excluded client's empty answer mustn't be cached for everyone
+func TestDNS64RestrictedEmptyAnswersArentCached(t *testing.T) {
+	d := DNS64DSL("64:ff9b::/96", netip.MustParsePrefix("2001:db8:aa::/48"))
+	d.Cache(CacheOptions{NegativeTTL: time.Minute})
+
+	q := TypedQuery("AAAA", "global.example.com")
+	q.EdnsSubnetAddress = "2001:db8:bb:1::/64"
+	AssertLookup(t, d, q, 0, nil)
+
+	q.EdnsSubnetAddress = "2001:db8:aa:1::/64"
+	rsp := AssertLookup(t, d, q, 1, nil)
+	h.AssertEqualString(t, "64:ff9b::c629:4", rsp[0].Content, "Should synthesise")
+}
+
+func TestDNS64BadPrefix(t *testing.T) {
+	for _, prefix := range []string{"64:ff9b::/80", "192.0.2.0/32"} {
+		func() {
+			defer func() {
+				h.Assert(t, recover() != nil, "Should panic for "+prefix)
+			}()
+			New().DNS64(netip.MustParsePrefix(prefix))
+		}()
+	}
+}
@@ -20,6 +20,14 @@
 //		c.Reply("ns3.example.com")
 //	})
 //
+//	// Alternatively, let DSL.Zone take care of the SOA and NS records, and
+//	// register routes relative to the apex. See the Zone docs for more.
+//	x.Zone("example.org", func(z *dsl.Zone) {
+//		z.SOA(dsl.SOA{MName: "ns1.example.com", ...})
+//		z.NS("ns1.example.com", "ns2.example.com", "ns3.example.com")
+//		z.A("www", answer)
+//	})
+//
 //	// You don't have to use anonymous functions, of course
 //	func answer(c *dsl.Context) {
 //		switch c.Query.QType {
@@ -48,6 +56,20 @@
 //		c.Reply(<-c)
 //	})
 //
+//	// If your callbacks spend their time waiting on databases, etc, you can
+//	// ask for all the callbacks matching a query to be run at the same time.
+//	// Answers are still returned in the same order as they would otherwise.
+//	// Each callback gets its own context; c.Done() is closed if another
+//	// callback fails, so you can stop waiting early.
+//	x.Concurrent(true)
+//	x.TXT(root, func(c *dsl.Context) {
+//		select {
+//		case txt := <-lookupTXT(c.Query.QName):
+//			c.Reply(txt)
+//		case <-c.Done():
+//		}
+//	})
+//
 //	// If your regexp includes capture groups, they are quoted back to you.
 //	// Here's a simple DNS echo server. Note the use of ReplyExtra to allow
 //	// a non-default TTL to be set.
@@ -57,6 +79,14 @@
 //		c.ReplyTTL(c.Query.QName, c.Matches[0], 0)
 //	})
 //
+//	// Regexps can't tell us which names exist, so they can't give proper
+//	// DNS wildcard semantics. Exact names can; a wildcard registered like
+//	// this is only used for names that don't otherwise exist.
+//	x.RegisterName("A", "*.example.com", answer)
+//	x.RegisterName("MX", "mail.example.com", func(c *dsl.Context) {
+//		c.Reply("10 mx.example.com")
+//	})
+//
 //	// Dispatch is up to you. It will probably look like this, but you
 //	// might want to add logging around the request or something more
 //	// complicated (different DSL instance depending on backend version?)
@@ -68,6 +98,11 @@
 //	}
 //
 //	pipe := backend.New( r, w, "Example backend" )
+//
+//	// The static records of zones (see DSL.Static and DSL.Contents) can
+//	// be transferred to PowerDNS, from protocol version 4 on
+//	pipe.OnAXFR(x.Transfer)
+//
 //	err1 := pipe.Negotiate() // do check for errors
 //	err2 := pipe.Run(doit)
 //
@@ -78,13 +113,35 @@ package dsl
 import (
 	"github.com/BytemarkHosting/go-pdns/pipe/backend"
 	"regexp"
+	"sync"
 )
 
 // Instances of this struct are used to hold onto registered callbacks, etc.
 type DSL struct {
 	callbacks  map[string][]callbackNode
+	names      map[string]bool
 	qtypeSort  []string
 	defaultTTL int
+	concurrent bool
+	chase      bool
+	zones      []*Zone
+	mounts     []*Mount
+	views      []*View
+	locator    Locator
+	dns64      *dns64
+	cache      *cache
+	commands   map[string]Command
+	serials    *Serials
+
+	// The name of the view these are the Routes of, if any
+	viewName string
+
+	// Counts changes to the routes, so that work derived from them (such
+	// as zone serials) can tell when it needs redoing
+	generation uint64
+
+	// Held for reading during lookups, and for writing by Replace
+	mu sync.RWMutex
 
 	beforeCallback Callback
 }
@@ -98,8 +155,10 @@ func New() *DSL {
 func NewWithTTL(ttl int) *DSL {
 	return &DSL{
 		callbacks:  make(map[string][]callbackNode),
+		names:      make(map[string]bool),
 		qtypeSort:  make([]string, 0),
 		defaultTTL: ttl,
+		commands:   make(map[string]Command),
 	}
 }
 
@@ -110,6 +169,18 @@ type Callback func(c *Context)
 type callbackNode struct {
 	matcher *regexp.Regexp
 	fn      Callback
+	zone    *Zone
+
+	// Set for callbacks registered with DSL.RegisterName, which are
+	// matched on the name rather than the regexp
+	name string
+
+	// Set for callbacks registered with DSL.Static
+	static []Record
+
+	// Set for the SOA and NS callbacks registered by DSL.Zone, which
+	// answer from the zone's settings
+	settings bool
 }
 
 // Register a callback to run before every request. Set c.Error to halt
@@ -133,7 +204,25 @@ func (d *DSL) Before(f Callback) {
 // will be reflected in the responses returned by it; future concurrent DSL
 // should maintain this ordering.
 func (d *DSL) Register(qtype string, re *regexp.Regexp, f Callback) {
+	d.register(qtype, re, f, nil)
+}
+
+// The qtype that callbacks registered with DSL.RegisterAnyType are kept under
+const anyType = "*"
 
+// Register a callback to be run for queries of every type, ANY included, with
+// a QName matching the regular expression. This suits callbacks that answer
+// from some other source of records, which can't say in advance which types it
+// has. The callback is run once per query, after any callbacks registered for
+// the query type itself (or, for ANY queries, in the usual order).
+//
+// c.QType is set to the query type, which may be "ANY"; set it to the type of
+// each answer before replying with it.
+func (d *DSL) RegisterAnyType(re *regexp.Regexp, f Callback) {
+	d.register(anyType, re, f, nil)
+}
+
+func (d *DSL) register(qtype string, re *regexp.Regexp, f Callback, zone *Zone) {
 	// Maintain our obtuse sense of order
 	alreadyIn := false
 	for _, prospect := range d.qtypeSort {
@@ -146,77 +235,322 @@ func (d *DSL) Register(qtype string, re *regexp.Regexp, f Callback) {
 		d.qtypeSort = append(d.qtypeSort, qtype)
 	}
 
-	node := callbackNode{matcher: re, fn: f}
+	node := callbackNode{matcher: re, fn: f, zone: zone}
 	d.callbacks[qtype] = append(d.callbacks[qtype], node)
+	d.generation++
+}
+
+// Run callbacks matching a query concurrently, rather than one after another.
+// Each callback gets its own Context, so callbacks no longer see answers that
+// other callbacks have generated. The Before callback is run in the same
+// goroutine as the callback it precedes, so it must be safe to call
+// concurrently as well.
+func (d *DSL) Concurrent(enabled bool) {
+	d.concurrent = enabled
 }
 
-// Once we're concurrent, this method will create the context and return it
-func (d *DSL) runNode(c *Context, node *callbackNode) {
-	matches := node.matcher.FindStringSubmatch(c.Query.QName)
+// Returns the capture groups if the node matches the given qname, or nil if it
+// doesn't. Exact-name nodes are matched against the owner instead.
+func (n *callbackNode) match(qname string, o owner) []string {
+	if n.name != "" {
+		switch {
+		case n.name != o.name:
+			return nil
+		case o.wild != "":
+			return []string{o.wild}
+		default:
+			return []string{}
+		}
+	}
 
-	if matches != nil && len(matches) > 0 {
-		// Probably unnecessary, but ensure that the previous value of
-		// Matches is preserved. This could also be = nil
-		oldmatches := c.Matches
-		defer func(c *Context) { c.Matches = oldmatches }(c)
+	matches := n.matcher.FindStringSubmatch(qname)
+	if len(matches) == 0 {
+		return nil
+	}
 
-		// The first match is the whole thing, followed by the capture
-		// groups. We're only interested in the latter.
-		c.Matches = matches[1:]
+	// The first match is the whole thing, followed by the capture groups.
+	// We're only interested in the latter.
+	return matches[1:]
+}
 
-		if d.beforeCallback != nil {
-			d.beforeCallback(c)
-		}
+// Runs the Before callback, then the node's callback if Before didn't set an
+// error. Matches are set in the context for the duration of the call.
+func (d *DSL) runNode(c *Context, node *callbackNode, matches []string) {
+	// Probably unnecessary, but ensure that the previous value of
+	// Matches is preserved. This could also be = nil
+	oldmatches := c.Matches
+	defer func(c *Context) { c.Matches = oldmatches }(c)
+
+	c.Matches = matches
+
+	if c.mount != nil && c.mount.before != nil {
+		c.mount.before(c)
+	}
+
+	if d.beforeCallback != nil && c.Error == nil {
+		d.beforeCallback(c)
+	}
+
+	if c.Error == nil {
+		node.fn(c)
+	}
+}
+
+// A callback that matched the query, with everything needed to run it
+type job struct {
+	qtype   string
+	node    *callbackNode
+	matches []string
+}
 
-		if c.Error == nil {
-			node.fn(c)
+// The qtypes whose callbacks should be run for a query
+func (d *DSL) qtypes(q *backend.Query) []string {
+	if q.QType == "ANY" {
+		return d.qtypeSort
+	}
+	if len(d.callbacks[anyType]) > 0 {
+		return []string{q.QType, anyType}
+	}
+	return []string{q.QType}
+}
+
+// Builds the list of callbacks of the given qtypes to run for a query, in the
+// order they should be run (and their answers returned) in.
+func (d *DSL) jobs(q *backend.Query, runOn []string) []job {
+	o := d.ownerOf(q.QName)
+	jobs := make([]job, 0)
+	for _, qtype := range runOn {
+		nodes := d.callbacks[qtype]
+		for i := range nodes {
+			if matches := nodes[i].match(q.QName, o); matches != nil {
+				jobs = append(jobs, job{qtype: qtype, node: &nodes[i], matches: matches})
+			}
 		}
 	}
+
+	return jobs
 }
 
-// Run all registered callbacks against the query. If any callbacks report an
-// error, we halt and return the error only (partially constructed responses are
-// discarded).
-//
-// For now, callbacks are run sequentially, rather than in parallel. There could
-// be a speedup to running each callback in its own goroutine. Currently, all
-// callbacks share the same context instance; we'd have to change that if we
-// ran them in parallel.
-func (d *DSL) Lookup(q *backend.Query) ([]*backend.Response, error) {
+func (d *DSL) newContext(q *backend.Query, s scope) Context {
 	c := Context{
 		DefaultTTL: d.defaultTTL,
 		Query:      q,
 		Answers:    make([]*backend.Response, 0),
 		Error:      nil,
+		View:       s.view,
+		locator:    s.locator,
+	}
+	if s.mount != nil {
+		c.MountPoint = s.mount.Name
+		c.RelativeName = s.relative
+		c.mount = s.mount
 	}
+	return c
+}
 
-	var runOn []string
-	if q.QType == "ANY" {
-		runOn = d.qtypeSort
+// Sets up the parts of the context that depend on the callback being run
+func (d *DSL) prepare(c *Context, j job) {
+	c.QType = j.qtype
+	if c.QType == anyType {
+		c.QType = c.Query.QType
+	}
+	c.Auth = true
+	c.ScopeBits = 0
+	c.Zone = j.node.zone
+	if c.Zone != nil {
+		c.DefaultTTL = c.Zone.DefaultTTL
+	} else if c.mount != nil && c.mount.DefaultTTL != 0 {
+		c.DefaultTTL = c.mount.DefaultTTL
 	} else {
-		runOn = []string{q.QType}
+		c.DefaultTTL = d.defaultTTL
 	}
+}
 
-	for _, qtype := range runOn {
-		c.QType = qtype
-		for _, node := range d.callbacks[qtype] {
-			d.runNode(&c, &node)
-			if c.Error != nil {
-				return nil, c.Error
-			}
+// Run all registered callbacks against the query. If any callbacks report an
+// error, we halt and return the error only (partially constructed responses are
+// discarded).
+//
+// By default, callbacks are run sequentially and share the same context
+// instance. If DSL.Concurrent has been called, they are run in parallel
+// instead; see runConcurrently.
+//
+// If CNAME callbacks answer for the query name, their answers are returned in
+// place of those for the query type (unless that is CNAME or ANY); see
+// lookupCNAME.
+//
+// If DSL.Cache has been called, answers are taken from the cache where
+// possible, and callbacks are only run on a miss.
+func (d *DSL) Lookup(q *backend.Query) ([]*backend.Response, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if d.cache != nil {
+		return d.cache.lookup(d, q)
+	}
+	return d.lookup(q, scope{})
+}
+
+// State that is carried through a lookup as it is delegated to views, mounts
+// and so on
+type scope struct {
+	// The view selected for the query, if any
+	view string
+
+	// The mount the query was delegated through, if any, and the query
+	// name relative to it
+	mount    *Mount
+	relative string
+
+	// Names seen while chasing CNAMEs, to detect loops
+	seen map[string]bool
+
+	// The locator inherited from the DSL the lookup started in, if any
+	locator Locator
+
+	// If not nil, set when the answers depend on the client in a way their
+	// ScopeBits can't show, as with an empty answer, so the cache knows
+	// they aren't valid for everyone
+	clientDependent *bool
+}
+
+func (s scope) markClientDependent(dependent bool) {
+	if dependent && s.clientDependent != nil {
+		*s.clientDependent = true
+	}
+}
+
+func (d *DSL) lookup(q *backend.Query, s scope) ([]*backend.Response, error) {
+	answers, err := d.resolve(q, s)
+	if err == nil && len(answers) == 0 && d.dns64 != nil && q.QType == "AAAA" {
+		return d.lookupDNS64(q, s)
+	}
+	return answers, err
+}
+
+func (d *DSL) resolve(q *backend.Query, s scope) ([]*backend.Response, error) {
+	if d.locator != nil {
+		s.locator = d.locator
+	}
+
+	v, bits := d.viewFor(q)
+	answers, err := d.resolveIn(v, q, s)
+	widenScope(answers, bits)
+	return answers, err
+}
+
+// Resolves the query with the routes of the view, or this DSL's own routes if
+// there is no view
+func (d *DSL) resolveIn(v *View, q *backend.Query, s scope) ([]*backend.Response, error) {
+	if v != nil {
+		s.view = v.Name
+		return v.Routes.lookup(q, s)
+	}
+
+	if child, relative := d.mountFor(q.QName); child != nil {
+		s.mount, s.relative = child, relative
+		return child.child.lookup(q, s)
+	}
+
+	if answers, err := d.lookupCNAME(q, s); err != nil || len(answers) > 0 {
+		return answers, err
+	}
+
+	answers, err := d.run(q, s, d.jobs(q, d.qtypes(q)))
+	if err == nil && onlyCNAME(q, answers) {
+		return d.chaseCNAME(q, s, answers)
+	}
+	return answers, err
+}
+
+// Runs the callbacks in the list against the query, returning their answers
+func (d *DSL) run(q *backend.Query, s scope, jobs []job) ([]*backend.Response, error) {
+	if d.concurrent && len(jobs) > 1 {
+		return d.runConcurrently(q, s, jobs)
+	}
+
+	c := d.newContext(q, s)
+	for _, j := range jobs {
+		d.prepare(&c, j)
+		d.runNode(&c, j.node, j.matches)
+		if c.Error != nil {
+			return nil, c.Error
 		}
 	}
 
 	return c.Answers, nil
 }
 
+// Each callback is run in its own goroutine, with its own context. Answers are
+// merged in the same order that a sequential lookup would produce. As soon as
+// any callback reports an error, the contexts of the others are marked as done
+// and the error is returned without waiting for them to finish.
+func (d *DSL) runConcurrently(q *backend.Query, s scope, jobs []job) ([]*backend.Response, error) {
+	done := make(chan struct{})
+	finished := make(chan int, len(jobs))
+	contexts := make([]Context, len(jobs))
+
+	for i, j := range jobs {
+		contexts[i] = d.newContext(q, s)
+		contexts[i].done = done
+		d.prepare(&contexts[i], j)
+
+		go func(i int, j job) {
+			c := &contexts[i]
+			select {
+			case <-done:
+			default:
+				d.runNode(c, j.node, j.matches)
+			}
+			finished <- i
+		}(i, j)
+	}
+
+	for range jobs {
+		i := <-finished
+		if err := contexts[i].Error; err != nil {
+			close(done)
+			return nil, err
+		}
+	}
+
+	answers := make([]*backend.Response, 0)
+	for i := range contexts {
+		answers = append(answers, contexts[i].Answers...)
+	}
+
+	return answers, nil
+}
+
 // Reports the registered callbacks, in order. Handy for testing or status.
+// Callbacks registered outside of any zone come first; those registered
+// against zones follow, grouped by zone, then the suffixes of any mounts and
+// the names of any views.
 func (d *DSL) String() string {
+	out := d.table(nil)
+	for _, z := range d.zones {
+		out = out + "zone " + z.Name + "\n" + d.table(z)
+	}
+	for _, m := range d.mounts {
+		out = out + "mount " + m.Name + "\n"
+	}
+	for _, v := range d.views {
+		out = out + "view " + v.Name + "\n"
+	}
+	return out
+}
+
+// Reports the registered callbacks belonging to a particular zone (or none)
+func (d *DSL) table(zone *Zone) string {
 	out := ""
 	for _, qtype := range d.qtypeSort {
-		out = out + qtype + "\t:"
+		entries := ""
 		for _, node := range d.callbacks[qtype] {
-			out = out + "\t" + node.matcher.String() + "\n"
+			if node.zone == zone {
+				entries = entries + "\t" + node.matcher.String() + "\n"
+			}
+		}
+		if entries != "" {
+			out = out + qtype + "\t:" + entries
 		}
 	}
 	return out
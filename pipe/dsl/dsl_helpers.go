@@ -1161,3 +1161,493 @@ func (d *DSL) WKS(matcher string, f Callback) {
 	re := regexp.MustCompile(fmt.Sprintf("^(?i)%s$", matcher))
 	d.Register("WKS", re, f)
 }
+
+// Helper function to register a callback for A queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) A(matcher string, f Callback) {
+	z.Register("A", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for AAAA queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) AAAA(matcher string, f Callback) {
+	z.Register("AAAA", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for AFSDB queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) AFSDB(matcher string, f Callback) {
+	z.Register("AFSDB", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for APL queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) APL(matcher string, f Callback) {
+	z.Register("APL", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for ATMA queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) ATMA(matcher string, f Callback) {
+	z.Register("ATMA", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for AXFR queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) AXFR(matcher string, f Callback) {
+	z.Register("AXFR", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for CAA queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) CAA(matcher string, f Callback) {
+	z.Register("CAA", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for CDNSKEY queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) CDNSKEY(matcher string, f Callback) {
+	z.Register("CDNSKEY", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for CDS queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) CDS(matcher string, f Callback) {
+	z.Register("CDS", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for CERT queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) CERT(matcher string, f Callback) {
+	z.Register("CERT", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for CNAME queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) CNAME(matcher string, f Callback) {
+	z.Register("CNAME", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for DHCID queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) DHCID(matcher string, f Callback) {
+	z.Register("DHCID", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for DLV queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) DLV(matcher string, f Callback) {
+	z.Register("DLV", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for DNAME queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) DNAME(matcher string, f Callback) {
+	z.Register("DNAME", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for DNSKEY queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) DNSKEY(matcher string, f Callback) {
+	z.Register("DNSKEY", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for DS queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) DS(matcher string, f Callback) {
+	z.Register("DS", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for EID queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) EID(matcher string, f Callback) {
+	z.Register("EID", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for GID queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) GID(matcher string, f Callback) {
+	z.Register("GID", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for GPOS queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) GPOS(matcher string, f Callback) {
+	z.Register("GPOS", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for HINFO queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) HINFO(matcher string, f Callback) {
+	z.Register("HINFO", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for HIP queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) HIP(matcher string, f Callback) {
+	z.Register("HIP", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for IPSECKEY queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) IPSECKEY(matcher string, f Callback) {
+	z.Register("IPSECKEY", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for ISDN queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) ISDN(matcher string, f Callback) {
+	z.Register("ISDN", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for IXFR queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) IXFR(matcher string, f Callback) {
+	z.Register("IXFR", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for KEY queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) KEY(matcher string, f Callback) {
+	z.Register("KEY", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for KX queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) KX(matcher string, f Callback) {
+	z.Register("KX", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for LOC queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) LOC(matcher string, f Callback) {
+	z.Register("LOC", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for LP queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) LP(matcher string, f Callback) {
+	z.Register("LP", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for MAILA queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) MAILA(matcher string, f Callback) {
+	z.Register("MAILA", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for MAILB queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) MAILB(matcher string, f Callback) {
+	z.Register("MAILB", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for MB queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) MB(matcher string, f Callback) {
+	z.Register("MB", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for MD queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) MD(matcher string, f Callback) {
+	z.Register("MD", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for MF queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) MF(matcher string, f Callback) {
+	z.Register("MF", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for MG queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) MG(matcher string, f Callback) {
+	z.Register("MG", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for MINFO queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) MINFO(matcher string, f Callback) {
+	z.Register("MINFO", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for MR queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) MR(matcher string, f Callback) {
+	z.Register("MR", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for MX queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) MX(matcher string, f Callback) {
+	z.Register("MX", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for NAPTR queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) NAPTR(matcher string, f Callback) {
+	z.Register("NAPTR", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for NID queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) NID(matcher string, f Callback) {
+	z.Register("NID", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for NIMLOC queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) NIMLOC(matcher string, f Callback) {
+	z.Register("NIMLOC", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for NINFO queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) NINFO(matcher string, f Callback) {
+	z.Register("NINFO", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for NSAP queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) NSAP(matcher string, f Callback) {
+	z.Register("NSAP", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for NSEC queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) NSEC(matcher string, f Callback) {
+	z.Register("NSEC", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for NULL queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) NULL(matcher string, f Callback) {
+	z.Register("NULL", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for NXT queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) NXT(matcher string, f Callback) {
+	z.Register("NXT", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for OPENPGPKEY queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) OPENPGPKEY(matcher string, f Callback) {
+	z.Register("OPENPGPKEY", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for OPT queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) OPT(matcher string, f Callback) {
+	z.Register("OPT", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for PTR queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) PTR(matcher string, f Callback) {
+	z.Register("PTR", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for PX queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) PX(matcher string, f Callback) {
+	z.Register("PX", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for RKEY queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) RKEY(matcher string, f Callback) {
+	z.Register("RKEY", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for RP queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) RP(matcher string, f Callback) {
+	z.Register("RP", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for RRSIG queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) RRSIG(matcher string, f Callback) {
+	z.Register("RRSIG", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for RT queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) RT(matcher string, f Callback) {
+	z.Register("RT", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for SIG queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) SIG(matcher string, f Callback) {
+	z.Register("SIG", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for SINK queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) SINK(matcher string, f Callback) {
+	z.Register("SINK", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for SPF queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) SPF(matcher string, f Callback) {
+	z.Register("SPF", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for SRV queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) SRV(matcher string, f Callback) {
+	z.Register("SRV", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for SSHFP queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) SSHFP(matcher string, f Callback) {
+	z.Register("SSHFP", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for TA queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) TA(matcher string, f Callback) {
+	z.Register("TA", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for TALINK queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) TALINK(matcher string, f Callback) {
+	z.Register("TALINK", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for TKEY queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) TKEY(matcher string, f Callback) {
+	z.Register("TKEY", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for TLSA queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) TLSA(matcher string, f Callback) {
+	z.Register("TLSA", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for TSIG queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) TSIG(matcher string, f Callback) {
+	z.Register("TSIG", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for TXT queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) TXT(matcher string, f Callback) {
+	z.Register("TXT", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for TYPE queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) TYPE(matcher string, f Callback) {
+	z.Register("TYPE", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for UID queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) UID(matcher string, f Callback) {
+	z.Register("UID", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for UINFO queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) UINFO(matcher string, f Callback) {
+	z.Register("UINFO", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for UNSPEC queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) UNSPEC(matcher string, f Callback) {
+	z.Register("UNSPEC", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for URI queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) URI(matcher string, f Callback) {
+	z.Register("URI", z.Compile(matcher), f)
+}
+
+// Helper function to register a callback for WKS queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) WKS(matcher string, f Callback) {
+	z.Register("WKS", z.Compile(matcher), f)
+}
@@ -6,8 +6,10 @@ import (
 	"github.com/BytemarkHosting/go-pdns/pipe/backend"
 	. "github.com/BytemarkHosting/go-pdns/pipe/dsl"
 	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"regexp"
 	"strings"
 	"testing"
+	"time"
 )
 
 func ReplyHandler(x string) func(c *Context) {
@@ -179,3 +181,146 @@ func TestCallbackReturningErrorStopsLaterCallbacksFromRunning(t *testing.T) {
 	AssertLookup(t, d, SOAQuery(), 0, ErrorReplyError)
 	h.Assert(t, ok, "Later callback was run")
 }
+
+func TestConcurrentLookupMaintainsCallbackOrder(t *testing.T) {
+	d := New()
+	d.Concurrent(true)
+	d.SOA(`*`, func(c *Context) { time.Sleep(10 * time.Millisecond); c.Reply("SOA 1") })
+	d.MX(`*`, ReplyHandler("MX 1"))
+	d.SOA(`*`, ReplyHandler("SOA 2"))
+	d.A(`*`, func(c *Context) { time.Sleep(5 * time.Millisecond); c.Reply("A 1") })
+	rsp := AssertLookup(t, d, h.FakeQuery(1), 4, nil)
+	msg := "Order is wrong"
+	h.AssertEqualString(t, "SOA 1", rsp[0].Content, msg)
+	h.AssertEqualString(t, "SOA 2", rsp[1].Content, msg)
+	h.AssertEqualString(t, "MX 1", rsp[2].Content, msg)
+	h.AssertEqualString(t, "A 1", rsp[3].Content, msg)
+	h.AssertEqualString(t, "A", rsp[3].QType, "QType is wrong")
+}
+
+func TestConcurrentLookupRunsCallbacksInParallel(t *testing.T) {
+	d := New()
+	d.Concurrent(true)
+	ping, pong := make(chan bool), make(chan bool)
+	d.SOA(`*`, func(c *Context) { ping <- true; c.Reply(fmt.Sprint(<-pong)) })
+	d.SOA(`*`, func(c *Context) { <-ping; pong <- true; c.Reply("ok") })
+
+	finished := make(chan bool)
+	go func() {
+		AssertLookup(t, d, SOAQuery(), 2, nil)
+		finished <- true
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("Callbacks were not run in parallel")
+	}
+}
+
+func TestConcurrentLookupGivesEachCallbackItsOwnContext(t *testing.T) {
+	d := New()
+	d.Concurrent(true)
+	seen := make(chan int, 2)
+	d.SOA(`*`, func(c *Context) { seen <- len(c.Answers); c.Reply("1") })
+	d.SOA(`*`, func(c *Context) { seen <- len(c.Answers); c.Reply("2") })
+	AssertLookup(t, d, SOAQuery(), 2, nil)
+	h.AssertEqualInt(t, 0, <-seen, "Answers were shared")
+	h.AssertEqualInt(t, 0, <-seen, "Answers were shared")
+}
+
+func TestConcurrentLookupCancelsOtherCallbacksOnError(t *testing.T) {
+	d := New()
+	d.Concurrent(true)
+	started, cancelled := make(chan bool), make(chan bool, 1)
+	d.SOA(`*`, func(c *Context) {
+		started <- true
+		select {
+		case <-c.Done():
+			cancelled <- true
+		case <-time.After(time.Second):
+			cancelled <- false
+		}
+	})
+	d.SOA(`*`, func(c *Context) { <-started; ErrorReplyHandler(c) })
+	AssertLookup(t, d, SOAQuery(), 0, ErrorReplyError)
+	h.Assert(t, <-cancelled, "Slow callback was not cancelled")
+}
+
+func TestSequentialLookupIsNeverDone(t *testing.T) {
+	d := New()
+	var done <-chan struct{}
+	d.SOA(`*`, func(c *Context) { done = c.Done() })
+	AssertLookup(t, d, SOAQuery(), 0, nil)
+	h.Assert(t, done == nil, "Sequential context should have no done channel")
+}
+
+func TestAuthAndScopeBitsDefaults(t *testing.T) {
+	d := New()
+	d.SOA(`*`, ReplyHandler("Foo"))
+	rsp := AssertLookup(t, d, SOAQuery(), 1, nil)
+	h.AssertEqualString(t, "1", rsp[0].Auth, "Answers should be authoritative")
+	h.AssertEqualString(t, "0", rsp[0].ScopeBits, "Scope should be 0")
+}
+
+func TestAuthAndScopeBitsCanBeSetPerCallback(t *testing.T) {
+	d := New()
+	d.SOA(`*`, func(c *Context) { c.Auth = false; c.ScopeBits = 24; c.Reply("glue") })
+	d.SOA(`*`, ReplyHandler("Foo"))
+	rsp := AssertLookup(t, d, SOAQuery(), 2, nil)
+	h.AssertEqualString(t, "0", rsp[0].Auth, "Auth not cleared")
+	h.AssertEqualString(t, "24", rsp[0].ScopeBits, "ScopeBits not set")
+	h.AssertEqualString(t, "1", rsp[1].Auth, "Auth not reset for next callback")
+	h.AssertEqualString(t, "0", rsp[1].ScopeBits, "ScopeBits not reset for next callback")
+}
+
+func TestBeforeCanSetAuthAndScopeBits(t *testing.T) {
+	d := New()
+	d.Before(func(c *Context) { c.Auth = false; c.ScopeBits = 16 })
+	d.SOA(`*`, ReplyHandler("Foo"))
+	rsp := AssertLookup(t, d, SOAQuery(), 1, nil)
+	h.AssertEqualString(t, "0", rsp[0].Auth, "Auth not cleared")
+	h.AssertEqualString(t, "16", rsp[0].ScopeBits, "ScopeBits not set")
+}
+
+func TestAuthAndScopeBitsAreIgnoredBeforeVersion3(t *testing.T) {
+	d := New()
+	d.SOA(`*`, func(c *Context) { c.ScopeBits = 24; c.Reply("Foo") })
+	q := SOAQuery()
+	q.ProtocolVersion = 2
+	rsp := AssertLookup(t, d, q, 1, nil)
+	h.AssertEqualString(t, "", rsp[0].Auth, "Auth should be blank")
+	h.AssertEqualString(t, "", rsp[0].ScopeBits, "ScopeBits should be blank")
+
+	rsp[0].ProtocolVersion = 2
+	str, err := rsp[0].String()
+	h.RefuteError(t, err, "sanity")
+	h.AssertEqualString(t, "DATA\texample.com\tIN\tSOA\t3600\t-1\tFoo\n", str, "Bad v2 response")
+}
+
+func TestRegisterAnyType(t *testing.T) {
+	d := New()
+	d.TXT("example.com", ReplyHandler(`"first"`))
+	d.RegisterAnyType(regexp.MustCompile(`^example\.com$`), func(c *Context) {
+		qtype := c.Query.QType
+		if qtype == "ANY" || qtype == "MX" {
+			c.QType = "MX"
+			c.Reply("10 mail.example.com")
+		}
+		if qtype == "ANY" || qtype == "TXT" {
+			c.QType = "TXT"
+			c.Reply(`"second"`)
+		}
+	})
+
+	rsp := AssertLookup(t, d, TypedQuery("TXT", "example.com"), 2, nil)
+	h.AssertEqualString(t, `"first" "second"`, rsp[0].Content+" "+rsp[1].Content, "Wrong TXT answers")
+
+	rsp = AssertLookup(t, d, TypedQuery("MX", "example.com"), 1, nil)
+	h.AssertEqualString(t, "MX", rsp[0].QType, "Wrong answer type")
+
+	rsp = AssertLookup(t, d, TypedQuery("ANY", "example.com"), 3, nil)
+	h.AssertEqualString(t, "TXT MX TXT", rsp[0].QType+" "+rsp[1].QType+" "+rsp[2].QType, "Wrong ANY answers")
+
+	AssertLookup(t, d, TypedQuery("A", "www.example.com"), 0, nil)
+}
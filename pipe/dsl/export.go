@@ -0,0 +1,250 @@
+package dsl
+
+import (
+	"errors"
+	"fmt"
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The contents of a zone, as far as they can be known without running any
+// callbacks; see DSL.Contents
+type ZoneContents struct {
+	// The apex, in lower case and without a trailing dot
+	Name string
+
+	// The static records of the zone, with their TTLs filled in. The SOA
+	// comes first, then the rest in canonical order (RFC 4034, section
+	// 6.1), with NS records first at each name.
+	Records []Record
+
+	// Descriptions of the routes that may answer for names in the zone, but
+	// whose answers can't be known without running them
+	Dynamic []string
+}
+
+// Enumerates the records of a zone. The zone may have been set up with
+// DSL.Zone, or by giving its SOA record to DSL.Static (as zonefile.Load does).
+// If the zone is covered by a mount, the mounted DSL is asked instead.
+//
+// Static records, and the SOA and NS settings of zones, are listed in full.
+// Other routes can't be, since their answers depend on the query, so they are
+// described in Dynamic instead. These are exact-name routes in the zone, regexp
+// routes registered against the zone or whose pattern mentions or matches its
+// apex, mounts below the apex, and views (which take precedence for the clients
+// they match).
+//
+// Names in zones nested within this one are left out, apart from the NS records
+// that delegate them.
+//
+// If the DSL has Serials (see DSL.AutoSerial), the SOA record has the serial
+// they give for the zone.
+func (d *DSL) Contents(zone string) (*ZoneContents, error) {
+	return d.contents(canonical(zone), d.viewName)
+}
+
+// Enumerates the records of a zone, as served in the view
+func (d *DSL) contents(zone, view string) (*ZoneContents, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if m, _ := d.mountFor(zone); m != nil {
+		return m.child.contents(zone, view)
+	}
+
+	zc, ok := d.zoneContents(zone)
+	if !ok {
+		return nil, fmt.Errorf("No SOA record for zone %s", zone)
+	}
+
+	if z := d.findZone(zone); z != nil && z.soa != nil {
+		zc.Records[0].Content = z.currentSOA(view).String()
+	}
+	return zc, nil
+}
+
+// Enumerates the zone, with the SOA as it was configured. Returns false if
+// the zone has no SOA record.
+func (d *DSL) zoneContents(zone string) (*ZoneContents, bool) {
+	zc := &ZoneContents{Name: zone}
+	var soa *Record
+	var records []Record
+
+	z := d.findZone(zone)
+	if z != nil {
+		if z.soa != nil {
+			soa = &Record{Name: zone, Type: "SOA", TTL: TTL(z.DefaultTTL), Content: z.soa.String()}
+		}
+		for _, ns := range z.ns {
+			records = append(records, Record{Name: zone, Type: "NS", TTL: TTL(z.DefaultTTL), Content: ns})
+		}
+	}
+
+	// Delegations to nested zones
+	for _, sub := range d.zones {
+		if sub.Name != zone && isBelow(sub.Name, zone) {
+			for _, ns := range sub.ns {
+				records = append(records, Record{Name: sub.Name, Type: "NS", TTL: TTL(sub.DefaultTTL), Content: ns})
+			}
+		}
+	}
+
+	for _, qtype := range d.qtypeSort {
+		nodes := d.callbacks[qtype]
+		for i := range nodes {
+			n := &nodes[i]
+			switch {
+			case n.settings:
+				// Covered above
+			case n.static != nil:
+				for _, r := range n.static {
+					if !d.inZone(r.Name, zone) {
+						continue
+					}
+					// A copy, so the registered record can't
+					// be changed through it
+					ttl := d.ttlFor(n)
+					if r.TTL != nil {
+						ttl = *r.TTL
+					}
+					r.TTL = TTL(ttl)
+					if r.Type == "SOA" && r.Name == zone {
+						if soa == nil {
+							found := r
+							soa = &found
+						}
+						continue
+					}
+					records = append(records, r)
+				}
+			case d.mayAnswer(n, zone, z):
+				zc.Dynamic = append(zc.Dynamic, describe(n, qtype))
+			}
+		}
+	}
+
+	if soa == nil {
+		return nil, false
+	}
+
+	for _, m := range d.mounts {
+		if isBelow(m.Name, zone) {
+			zc.Dynamic = append(zc.Dynamic, "Mount at "+m.Name)
+		}
+	}
+	for _, v := range d.views {
+		zc.Dynamic = append(zc.Dynamic, "View "+v.Name)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Name != b.Name {
+			return canonicalLess(a.Name, b.Name)
+		}
+		if (a.Type == "NS") != (b.Type == "NS") {
+			return a.Type == "NS"
+		}
+		return a.Type < b.Type
+	})
+
+	zc.Records = append([]Record{*soa}, records...)
+	return zc, true
+}
+
+// Answers AXFR requests with the static records of a zone, as enumerated by
+// DSL.Contents; give it to backend.Backend.OnAXFR. PowerDNS only sends the zone
+// name from protocol version 4 on, so earlier versions can't be served. Dynamic
+// routes are left out of the transfer, and a LOG line says so.
+func (d *DSL) Transfer(b *backend.Backend, id int, zone string) ([]*backend.Response, error) {
+	if zone == "" {
+		return nil, errors.New("AXFR needs protocol version 4 or later")
+	}
+
+	zc, err := d.Contents(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(zc.Dynamic) > 0 && b != nil {
+		b.Log(fmt.Sprintf("AXFR of %s leaves out %d dynamic routes", zc.Name, len(zc.Dynamic)))
+	}
+
+	responses := make([]*backend.Response, 0, len(zc.Records))
+	for _, r := range zc.Records {
+		responses = append(responses, &backend.Response{
+			ScopeBits: "0",
+			Auth:      "1",
+			QName:     r.Name,
+			QClass:    "IN",
+			QType:     r.Type,
+			TTL:       strconv.Itoa(*r.TTL),
+			Id:        strconv.Itoa(id),
+			Content:   r.Content,
+		})
+	}
+	return responses, nil
+}
+
+// Whether the name is the zone apex or below it
+func isBelow(name, zone string) bool {
+	return name == zone || zone == "" || strings.HasSuffix(name, "."+zone)
+}
+
+// Whether the name belongs to the zone, rather than to a zone nested within it
+func (d *DSL) inZone(name, zone string) bool {
+	if !isBelow(name, zone) {
+		return false
+	}
+	for _, sub := range d.zones {
+		if sub.Name != zone && isBelow(sub.Name, zone) && isBelow(name, sub.Name) {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *DSL) ttlFor(n *callbackNode) int {
+	if n.zone != nil {
+		return n.zone.DefaultTTL
+	}
+	return d.defaultTTL
+}
+
+// Whether a dynamic route might answer for names in the zone
+func (d *DSL) mayAnswer(n *callbackNode, zone string, z *Zone) bool {
+	switch {
+	case n.name != "":
+		return d.inZone(n.name, zone)
+	case n.zone != nil:
+		return n.zone == z
+	}
+
+	pattern := strings.ToLower(n.matcher.String())
+	return n.matcher.MatchString(zone) ||
+		strings.Contains(pattern, regexp.QuoteMeta(zone)) ||
+		strings.Contains(pattern, zone)
+}
+
+func describe(n *callbackNode, qtype string) string {
+	if qtype == anyType {
+		qtype = "Any-type"
+	}
+	if n.name != "" {
+		return qtype + " route for " + n.name
+	}
+	return qtype + " route matching " + n.matcher.String()
+}
+
+// Orders names as RFC 4034 does: by their labels, compared from the right
+func canonicalLess(a, b string) bool {
+	al, bl := strings.Split(a, "."), strings.Split(b, ".")
+	for i, j := len(al)-1, len(bl)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if al[i] != bl[j] {
+			return al[i] < bl[j]
+		}
+	}
+	return len(al) < len(bl)
+}
@@ -0,0 +1,144 @@
+package dsl_test
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func DumpRecords(records []Record) string {
+	out := make([]string, len(records))
+	for i, r := range records {
+		out[i] = fmt.Sprintf("%s %d %s %s", r.Name, *r.TTL, r.Type, r.Content)
+	}
+	return strings.Join(out, "\n")
+}
+
+func ExportDSL() *DSL {
+	d := NewWithTTL(600)
+	d.Zone("example.com", func(z *Zone) {
+		z.DefaultTTL = 300
+		z.SOA(SOA{MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 1, Refresh: 2, Retry: 3, Expire: 4, Minimum: 5})
+		z.NS("ns1.example.com", "ns2.example.com")
+		z.Static(
+			Record{Name: "www", Type: "AAAA", Content: "2001:db8::1"},
+			Record{Name: "www", Type: "A", TTL: TTL(60), Content: "192.0.2.1"},
+			Record{Name: "@", Type: "MX", Content: "10 mail.example.com"},
+			Record{Name: "*", Type: "TXT", Content: `"wild"`},
+			Record{Name: "a.b", Type: "A", Content: "192.0.2.2"},
+			Record{Name: "www.sub", Type: "A", Content: "192.0.2.3"},
+		)
+		z.A("api", func(c *Context) { c.Reply("192.0.2.4") })
+		z.RegisterName("TXT", "dyn", func(c *Context) { c.Reply(`"dyn"`) })
+	})
+	d.Zone("sub.example.com", func(z *Zone) {
+		z.SOA(SOA{MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 1})
+		z.NS("ns3.example.com")
+	})
+	d.A(`.*\.example\.org`, func(c *Context) { c.Reply("192.0.2.5") })
+	return d
+}
+
+func TestContents(t *testing.T) {
+	zc, err := ExportDSL().Contents("Example.COM.")
+	h.RefuteError(t, err, "Contents")
+	h.AssertEqualString(t, "example.com", zc.Name, "Wrong name")
+	h.AssertEqualString(t, strings.Join([]string{
+		"example.com 300 SOA ns1.example.com hostmaster.example.com 1 2 3 4 5",
+		"example.com 300 NS ns1.example.com",
+		"example.com 300 NS ns2.example.com",
+		"example.com 300 MX 10 mail.example.com",
+		"*.example.com 300 TXT \"wild\"",
+		"a.b.example.com 300 A 192.0.2.2",
+		"sub.example.com 600 NS ns3.example.com",
+		"www.example.com 60 A 192.0.2.1",
+		"www.example.com 300 AAAA 2001:db8::1",
+	}, "\n"), DumpRecords(zc.Records), "Wrong records")
+	h.AssertEqualString(t,
+		`A route matching ^(?i)(?:api)\.example\.com$`+"\n"+"TXT route for dyn.example.com",
+		strings.Join(zc.Dynamic, "\n"), "Wrong dynamic routes")
+
+	zc, err = ExportDSL().Contents("sub.example.com")
+	h.RefuteError(t, err, "Contents")
+	h.AssertEqualString(t, strings.Join([]string{
+		"sub.example.com 600 SOA ns1.example.com hostmaster.example.com 1 0 0 0 0",
+		"sub.example.com 600 NS ns3.example.com",
+		"www.sub.example.com 300 A 192.0.2.3",
+	}, "\n"), DumpRecords(zc.Records), "Wrong records")
+	h.AssertEqualInt(t, 0, len(zc.Dynamic), "Wrong dynamic routes")
+}
+
+func TestContentsOfStaticZones(t *testing.T) {
+	d := New()
+	d.Static(
+		Record{Name: "example.org", Type: "NS", Content: "ns1.example.org"},
+		Record{Name: "example.org", Type: "SOA", Content: "ns1.example.org hostmaster.example.org 1 2 3 4 5"},
+		Record{Name: "www.example.org", Type: "A", Content: "192.0.2.1"},
+	)
+	d.A(`.*\.example\.org`, func(c *Context) { c.Reply("192.0.2.5") })
+	d.Mount("team.example.org", New())
+
+	zc, err := d.Contents("example.org")
+	h.RefuteError(t, err, "Contents")
+	h.AssertEqualString(t, strings.Join([]string{
+		"example.org 3600 SOA ns1.example.org hostmaster.example.org 1 2 3 4 5",
+		"example.org 3600 NS ns1.example.org",
+		"www.example.org 3600 A 192.0.2.1",
+	}, "\n"), DumpRecords(zc.Records), "Wrong records")
+	h.AssertEqualString(t,
+		`A route matching ^(?i).*\.example\.org$`+"\n"+"Mount at team.example.org",
+		strings.Join(zc.Dynamic, "\n"), "Wrong dynamic routes")
+
+	_, err = d.Contents("example.net")
+	h.AssertEqualString(t, "No SOA record for zone example.net", err.Error(), "Wrong error")
+}
+
+func TestContentsOfMountedZones(t *testing.T) {
+	child := New()
+	child.Zone("team.example.com", func(z *Zone) {
+		z.SOA(SOA{MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 7})
+		z.NS("ns1.example.com")
+	})
+	d := New()
+	d.Mount("team.example.com", child)
+
+	zc, err := d.Contents("team.example.com")
+	h.RefuteError(t, err, "Contents")
+	h.AssertEqualInt(t, 2, len(zc.Records), "Wrong number of records")
+}
+
+func TestTransfer(t *testing.T) {
+	d := ExportDSL()
+	b := backend.New(bytes.NewBufferString("HELO\t4\nPING\n"), &bytes.Buffer{}, "")
+
+	rsp, err := d.Transfer(b, 3, "example.com")
+	h.RefuteError(t, err, "Transfer")
+	h.AssertEqualInt(t, 9, len(rsp), "Wrong number of records")
+	h.AssertEqualString(t, "example.com SOA 300 3", rsp[0].QName+" "+rsp[0].QType+" "+rsp[0].TTL+" "+rsp[0].Id, "Wrong SOA")
+	h.AssertEqualString(t, "www.example.com A 192.0.2.1", rsp[7].QName+" "+rsp[7].QType+" "+rsp[7].Content, "Wrong A")
+
+	_, err = d.Transfer(b, 3, "")
+	h.AssertEqualString(t, "AXFR needs protocol version 4 or later", err.Error(), "Wrong error")
+}
+
+func TestTransferLogsDynamicRoutes(t *testing.T) {
+	w := &bytes.Buffer{}
+	b := backend.New(bytes.NewBufferString("HELO\t4\nAXFR\t1\texample.com\n"), w, "")
+	h.RefuteError(t, b.Negotiate(), "Negotiate")
+	w.Reset()
+
+	d := New()
+	d.Zone("example.com", func(z *Zone) {
+		z.SOA(SOA{MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: 1})
+		z.NS("ns1.example.com")
+		z.Register("A", regexp.MustCompile(`^www\.example\.com$`), func(c *Context) {})
+	})
+	b.OnAXFR(d.Transfer)
+	h.RefuteError(t, b.Run(h.EmptyDispatch), "Run")
+	h.Assert(t, strings.HasPrefix(w.String(), "LOG\tAXFR of example.com leaves out 1 dynamic routes\nDATA\t0\t1\texample.com\tIN\tSOA\t3600\t1\t"), "Wrong output: "+w.String())
+}
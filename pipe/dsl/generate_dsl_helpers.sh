@@ -39,3 +39,20 @@ func (d *DSL) ${record}(matcher string, f Callback) {
 
 done
 
+
+# Zones provide their own SOA and NS answers, so don't get helpers for those
+for record in $records; do
+
+case "${record}" in
+	SOA|NS) continue ;;
+esac
+
+echo "
+// Helper function to register a callback for ${record} queries within a zone.
+// The matcher is relative to the zone apex; see Zone.Compile for the rules it
+// is compiled with.
+func (z *Zone) ${record}(matcher string, f Callback) {
+	z.Register(\"${record}\", z.Compile(matcher), f)
+}"
+
+done
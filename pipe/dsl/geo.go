@@ -0,0 +1,83 @@
+package dsl
+
+import (
+	"net/netip"
+)
+
+// Geographic information about a client network, as given by a Locator
+type Location struct {
+	// ISO 3166-1 country code, e.g. "GB"
+	Country string
+
+	// Two-letter continent code, e.g. "EU"
+	Continent string
+
+	// The autonomous system the network belongs to, and its owner
+	ASN   uint
+	ASOrg string
+
+	// Approximate coordinates, in degrees. Only meaningful if HasCoordinates
+	// is set.
+	Latitude       float64
+	Longitude      float64
+	HasCoordinates bool
+
+	// The network the information applies to
+	Network netip.Prefix
+}
+
+// Anything that can give geographic information about an address. See the
+// geo package for one that reads MaxMind databases.
+type Locator interface {
+	Locate(addr netip.Addr) (*Location, error)
+}
+
+// Set the locator used by Context.Geo. It is inherited by the routes of views
+// and mounted DSLs, unless they have a locator of their own.
+func (d *DSL) Locator(l Locator) {
+	d.locator = l
+}
+
+// Returns geographic information about the client (see Context.ClientAddr),
+// for choosing answers by location:
+//
+//	x.A(root, func(c *dsl.Context) {
+//		switch c.Geo().Continent {
+//		case "EU": c.Reply("192.0.2.1")
+//		default:   c.Reply("198.51.100.1")
+//		}
+//	})
+//
+// Context.ScopeBits is set to the length of the network the information applies
+// to, so resolvers cache the answer for the right set of clients. If no locator
+// has been set or the client can't be located, the returned Location is empty
+// (but never nil), and ScopeBits is left alone.
+func (c *Context) Geo() *Location {
+	if c.location == nil {
+		c.location = &Location{}
+		if addr, ok := c.ClientAddr(); ok && c.locator != nil {
+			if loc, err := c.locator.Locate(addr); err == nil && loc != nil {
+				c.location = loc
+			}
+		}
+	}
+
+	if c.location.Network.IsValid() {
+		c.ScopeBits = c.location.Network.Bits()
+	}
+	return c.location
+}
+
+// Returns geographic information about any address, using the locator set with
+// DSL.Locator. Unlike Context.Geo, ScopeBits is left alone. If the address
+// can't be located, nil is returned.
+func (c *Context) Locate(addr netip.Addr) *Location {
+	if c.locator == nil {
+		return nil
+	}
+	loc, err := c.locator.Locate(addr)
+	if err != nil {
+		return nil
+	}
+	return loc
+}
@@ -0,0 +1,187 @@
+// Copyright 2015 Bytemark Computer Consulting Ltd. All rights reserved
+// Licensed under the GNU General Public License, version 2. See the LICENSE
+// file for more details
+
+// Geographic information for DSL callbacks, read from MaxMind-format (.mmdb)
+// databases on local disk, such as GeoLite2-City and GeoLite2-ASN. Usage:
+//
+//	db, err := geo.Open("GeoLite2-City.mmdb", "GeoLite2-ASN.mmdb")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer db.Close()
+//	x.Locator(db)
+//
+//	// Send clients to the closest of our sites
+//	sites := []geo.Site{
+//		{Name: "192.0.2.1", Latitude: 51.5, Longitude: -0.1},    // London
+//		{Name: "198.51.100.1", Latitude: 40.7, Longitude: -74}, // New York
+//	}
+//	x.A(root, func(c *dsl.Context) {
+//		c.Reply(geo.Nearest(c.Geo(), sites).Name)
+//	})
+package geo
+
+import (
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	"github.com/oschwald/maxminddb-golang"
+	"math"
+	"net"
+	"net/netip"
+)
+
+// One or more MaxMind databases, usable as a dsl.Locator
+type DB struct {
+	readers []*maxminddb.Reader
+}
+
+// The parts of the GeoIP2 / GeoLite2 City, Country and ASN schemas we use
+type record struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	Continent struct {
+		Code string `maxminddb:"code"`
+	} `maxminddb:"continent"`
+	Location struct {
+		Latitude  *float64 `maxminddb:"latitude"`
+		Longitude *float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+// Open the databases at the given paths. Locations are built up from all of
+// them, so a City database can be combined with an ASN one; where they
+// overlap, the first database to give a value wins.
+func Open(paths ...string) (*DB, error) {
+	db := &DB{}
+	for _, path := range paths {
+		reader, err := maxminddb.Open(path)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		db.readers = append(db.readers, reader)
+	}
+	return db, nil
+}
+
+// Close the databases
+func (db *DB) Close() error {
+	var err error
+	for _, reader := range db.readers {
+		if closeErr := reader.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Look up an address. Location.Network is set to the most specific network
+// given by any of the databases, since the answer may depend on any of them.
+// If no database has data for the address, a nil Location is returned.
+func (db *DB) Locate(addr netip.Addr) (*dsl.Location, error) {
+	var loc *dsl.Location
+	ip := net.IP(addr.Unmap().AsSlice())
+
+	for _, reader := range db.readers {
+		var rec record
+		network, ok, err := reader.LookupNetwork(ip, &rec)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		if loc == nil {
+			loc = &dsl.Location{}
+		}
+		merge(loc, &rec)
+
+		if prefix, ok := toPrefix(network); ok {
+			if !loc.Network.IsValid() || prefix.Bits() > loc.Network.Bits() {
+				loc.Network = prefix
+			}
+		}
+	}
+
+	return loc, nil
+}
+
+// Fills in any fields of the location that are still empty
+func merge(loc *dsl.Location, rec *record) {
+	if loc.Country == "" {
+		loc.Country = rec.Country.ISOCode
+	}
+	if loc.Continent == "" {
+		loc.Continent = rec.Continent.Code
+	}
+	if loc.ASN == 0 {
+		loc.ASN, loc.ASOrg = rec.ASN, rec.ASOrg
+	}
+	if !loc.HasCoordinates && rec.Location.Latitude != nil && rec.Location.Longitude != nil {
+		loc.Latitude = *rec.Location.Latitude
+		loc.Longitude = *rec.Location.Longitude
+		loc.HasCoordinates = true
+	}
+}
+
+func toPrefix(network *net.IPNet) (netip.Prefix, bool) {
+	if network == nil {
+		return netip.Prefix{}, false
+	}
+	addr, ok := netip.AddrFromSlice(network.IP)
+	if !ok {
+		return netip.Prefix{}, false
+	}
+	bits, _ := network.Mask.Size()
+	if addr.Is4In6() {
+		addr, bits = addr.Unmap(), bits-96
+	}
+	return netip.PrefixFrom(addr, bits), true
+}
+
+// A location we can send clients to
+type Site struct {
+	// Whatever you need to identify the site; perhaps an address to reply with
+	Name string
+
+	// Coordinates of the site, in degrees
+	Latitude  float64
+	Longitude float64
+}
+
+// Radius of the Earth, in kilometres
+const earthRadius = 6371.0
+
+// The great-circle distance between two points, in kilometres
+func Distance(lat1, lon1, lat2, lon2 float64) float64 {
+	toRad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := toRad(lat2 - lat1)
+	dLon := toRad(lon2 - lon1)
+
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(toRad(lat1))*math.Cos(toRad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+// Returns the site nearest to the location. If the location has no
+// coordinates, the first site is returned, so list your default first. Panics
+// if there are no sites.
+func Nearest(loc *dsl.Location, sites []Site) Site {
+	best := sites[0]
+	if loc == nil || !loc.HasCoordinates {
+		return best
+	}
+
+	bestDistance := math.Inf(1)
+	for _, site := range sites {
+		distance := Distance(loc.Latitude, loc.Longitude, site.Latitude, site.Longitude)
+		if distance < bestDistance {
+			best, bestDistance = site, distance
+		}
+	}
+	return best
+}
@@ -0,0 +1,230 @@
+package geo_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl/geo"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"math"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// Just enough of a MaxMind DB writer to build test databases. Only IPv4
+// databases with 24-bit records are supported.
+type mmdbWriter struct {
+	nodes [][2]int // -1 for empty, >= 0 for a node, <= -2 for data
+	data  bytes.Buffer
+}
+
+func (w *mmdbWriter) insert(prefix string, value map[string]interface{}) {
+	p := netip.MustParsePrefix(prefix)
+	ip := p.Addr().As4()
+
+	offset := w.data.Len()
+	encode(&w.data, value)
+
+	if len(w.nodes) == 0 {
+		w.nodes = append(w.nodes, [2]int{-1, -1})
+	}
+	node := 0
+	for i := 0; i < p.Bits(); i++ {
+		bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+		if i == p.Bits()-1 {
+			w.nodes[node][bit] = -2 - offset
+			break
+		}
+		if w.nodes[node][bit] < 0 {
+			w.nodes = append(w.nodes, [2]int{-1, -1})
+			w.nodes[node][bit] = len(w.nodes) - 1
+		}
+		node = w.nodes[node][bit]
+	}
+}
+
+func (w *mmdbWriter) bytes() []byte {
+	out := &bytes.Buffer{}
+	count := len(w.nodes)
+	for _, node := range w.nodes {
+		for _, record := range node {
+			value := count
+			if record >= 0 {
+				value = record
+			} else if record <= -2 {
+				value = count + 16 + (-2 - record)
+			}
+			out.Write([]byte{byte(value >> 16), byte(value >> 8), byte(value)})
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(w.data.Bytes())
+	out.WriteString("\xab\xcd\xefMaxMind.com")
+	encode(out, map[string]interface{}{
+		"node_count":                  uint32(count),
+		"record_size":                 uint16(24),
+		"ip_version":                  uint16(4),
+		"database_type":               "Test",
+		"binary_format_major_version": uint16(2),
+		"binary_format_minor_version": uint16(0),
+		"build_epoch":                 uint32(0),
+	})
+	return out.Bytes()
+}
+
+func control(out *bytes.Buffer, typ byte, size int) {
+	switch {
+	case size < 29:
+		out.WriteByte(typ<<5 | byte(size))
+	case size < 285:
+		out.WriteByte(typ<<5 | 29)
+		out.WriteByte(byte(size - 29))
+	default:
+		panic("Sizes this big aren't supported")
+	}
+}
+
+func encode(out *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case string:
+		control(out, 2, len(v))
+		out.WriteString(v)
+	case float64:
+		control(out, 3, 8)
+		binary.Write(out, binary.BigEndian, math.Float64bits(v))
+	case uint16:
+		control(out, 5, 2)
+		binary.Write(out, binary.BigEndian, v)
+	case uint32:
+		control(out, 6, 4)
+		binary.Write(out, binary.BigEndian, v)
+	case map[string]interface{}:
+		control(out, 7, len(v))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			encode(out, key)
+			encode(out, v[key])
+		}
+	default:
+		panic("Unsupported type")
+	}
+}
+
+func WriteDB(t *testing.T, w *mmdbWriter) string {
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	h.RefuteError(t, os.WriteFile(path, w.bytes(), 0644), "Writing database")
+	return path
+}
+
+func CityDB(t *testing.T) string {
+	w := &mmdbWriter{}
+	w.insert("192.0.2.0/24", map[string]interface{}{
+		"country":   map[string]interface{}{"iso_code": "GB"},
+		"continent": map[string]interface{}{"code": "EU"},
+		"location":  map[string]interface{}{"latitude": 51.5, "longitude": -0.1},
+	})
+	w.insert("198.51.100.0/25", map[string]interface{}{
+		"country":   map[string]interface{}{"iso_code": "US"},
+		"continent": map[string]interface{}{"code": "NA"},
+		"location":  map[string]interface{}{"latitude": 40.7, "longitude": -74.0},
+	})
+	return WriteDB(t, w)
+}
+
+func ASNDB(t *testing.T) string {
+	w := &mmdbWriter{}
+	w.insert("192.0.0.0/16", map[string]interface{}{
+		"autonomous_system_number":       uint32(64496),
+		"autonomous_system_organization": "Example Networks",
+	})
+	return WriteDB(t, w)
+}
+
+func OpenDB(t *testing.T) *DB {
+	db, err := Open(CityDB(t), ASNDB(t))
+	h.RefuteError(t, err, "Opening databases")
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestLocateCombinesDatabases(t *testing.T) {
+	db := OpenDB(t)
+	loc, err := db.Locate(netip.MustParseAddr("192.0.2.10"))
+	h.RefuteError(t, err, "Locate")
+	h.Assert(t, loc != nil, "Address not found")
+	h.AssertEqualString(t, "GB", loc.Country, "Bad country")
+	h.AssertEqualString(t, "EU", loc.Continent, "Bad continent")
+	h.AssertEqualInt(t, 64496, int(loc.ASN), "Bad ASN")
+	h.AssertEqualString(t, "Example Networks", loc.ASOrg, "Bad AS organisation")
+	h.Assert(t, loc.HasCoordinates && loc.Latitude == 51.5, "Bad coordinates")
+	h.AssertEqualString(t, "192.0.2.0/24", loc.Network.String(), "Most specific network expected")
+}
+
+func TestLocateUnknownAddress(t *testing.T) {
+	db := OpenDB(t)
+	loc, err := db.Locate(netip.MustParseAddr("203.0.113.1"))
+	h.RefuteError(t, err, "Locate")
+	h.Assert(t, loc == nil, "Unknown address should give no location")
+}
+
+func TestOpenMissingFile(t *testing.T) {
+	_, err := Open(filepath.Join(t.TempDir(), "missing.mmdb"))
+	h.Assert(t, err != nil, "Expected an error")
+}
+
+func GeoQuery(ecs string) *backend.Query {
+	return &backend.Query{
+		ProtocolVersion: 3, QName: "www.example.com", QClass: "IN", QType: "A",
+		Id: "-1", RemoteIpAddress: "192.0.2.99", LocalIpAddress: "127.0.0.1",
+		EdnsSubnetAddress: ecs,
+	}
+}
+
+var Sites = []Site{
+	{Name: "london", Latitude: 51.5, Longitude: -0.1},
+	{Name: "newyork", Latitude: 40.7, Longitude: -74.0},
+	{Name: "sydney", Latitude: -33.9, Longitude: 151.2},
+}
+
+func TestGeoInDSLUsesClientSubnetAndSetsScope(t *testing.T) {
+	d := dsl.New()
+	d.Locator(OpenDB(t))
+	d.A(`.*`, func(c *dsl.Context) {
+		c.Reply(c.Geo().Country + " " + Nearest(c.Geo(), Sites).Name)
+	})
+
+	rsp, err := d.Lookup(GeoQuery("198.51.100.0/24"))
+	h.RefuteError(t, err, "Lookup")
+	h.AssertEqualString(t, "US newyork", rsp[0].Content, "ECS address not used")
+	h.AssertEqualString(t, "25", rsp[0].ScopeBits, "Scope not set from network")
+
+	rsp, err = d.Lookup(GeoQuery(""))
+	h.RefuteError(t, err, "Lookup")
+	h.AssertEqualString(t, "GB london", rsp[0].Content, "Remote address not used")
+	h.AssertEqualString(t, "24", rsp[0].ScopeBits, "Scope not set from network")
+
+	rsp, err = d.Lookup(GeoQuery("203.0.113.0/24"))
+	h.RefuteError(t, err, "Lookup")
+	h.AssertEqualString(t, " london", rsp[0].Content, "Unknown client should get defaults")
+	h.AssertEqualString(t, "0", rsp[0].ScopeBits, "Scope should be left alone")
+}
+
+func TestNearest(t *testing.T) {
+	loc := &dsl.Location{Latitude: -37.8, Longitude: 145.0, HasCoordinates: true} // Melbourne
+	h.AssertEqualString(t, "sydney", Nearest(loc, Sites).Name, "Wrong site")
+	h.AssertEqualString(t, "london", Nearest(&dsl.Location{}, Sites).Name, "First site is the default")
+}
+
+func TestDistance(t *testing.T) {
+	d := Distance(51.5, -0.1, 40.7, -74.0)
+	h.Assert(t, d > 5500 && d < 5600, "London to New York should be about 5570km")
+	h.Assert(t, Distance(10, 10, 10, 10) == 0, "No distance expected")
+}
@@ -0,0 +1,49 @@
+package lua
+
+import (
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl/pool"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the addresses given to IfPortUp and IfURLUp are checked
+var CheckInterval = 5 * time.Second
+
+// Like PowerDNS, we start checking addresses the first time they're asked
+// about, and carry on until told to stop
+var checks = struct {
+	sync.Mutex
+	pools map[string]*pool.Pool
+}{pools: make(map[string]*pool.Pool)}
+
+// Finds (or creates and starts) the pool checking a set of addresses
+func checkedPool(kind string, addresses []string, o Options, checker pool.Checker) *pool.Pool {
+	key := kind + "\x00" + strings.Join(addresses, ",")
+
+	checks.Lock()
+	defer checks.Unlock()
+
+	if p, ok := checks.pools[key]; ok {
+		return p
+	}
+
+	p := pool.New(addresses, checker)
+	p.Interval = CheckInterval
+	p.Timeout = o.Timeout
+	p.Start()
+	checks.pools[key] = p
+	return p
+}
+
+// Stop all the background checks started by IfPortUp and IfURLUp. They will
+// be started afresh if the functions are called again.
+func StopChecks() {
+	checks.Lock()
+	defer checks.Unlock()
+
+	for key, p := range checks.pools {
+		p.Stop()
+		delete(checks.pools, key)
+	}
+}
@@ -0,0 +1,257 @@
+// Copyright 2015 Bytemark Computer Consulting Ltd. All rights reserved
+// Licensed under the GNU General Public License, version 2. See the LICENSE
+// file for more details
+
+// Go equivalents of the functions available to PowerDNS LUA records, so zones
+// using them can be migrated to the DSL mechanically. The functions have the
+// same names (in Go style) and take the same arguments, plus the context of
+// the DSL callback they are called from. For instance, the LUA record:
+//
+//	www IN LUA A "ifportup(443, {'192.0.2.1', '192.0.2.2'})"
+//
+// becomes:
+//
+//	z.A("www", func(c *dsl.Context) {
+//		lua.Reply(c, lua.IfPortUp(c, 443, []string{"192.0.2.1", "192.0.2.2"}))
+//	})
+//
+// Bad arguments cause Context.Error to be set, so PowerDNS gets a FAIL rather
+// than a wrong answer. Functions returning a single value return "" in that
+// case, which Reply ignores.
+package lua
+
+import (
+	"fmt"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl/geo"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl/pool"
+	"hash/fnv"
+	"math/rand"
+	"net/netip"
+	"time"
+)
+
+// Reply with each of the values
+func Reply(c *dsl.Context, values ...string) {
+	for _, value := range values {
+		if value != "" {
+			c.Reply(value)
+		}
+	}
+}
+
+// Options for IfPortUp and IfURLUp, as in the LUA options table
+type Options struct {
+	// How to choose from the addresses that are up: "random" (the
+	// default), "all", "hashed" (on the client address) or "pickclosest"
+	Selector string
+
+	// How to choose from all the addresses if none are up. Same choices as
+	// Selector; also defaults to "random".
+	BackupSelector string
+
+	// How long each check may take. Defaults to 2 seconds.
+	Timeout time.Duration
+
+	// IfURLUp only: the body returned must contain this string
+	StringMatch string
+}
+
+func options(opts []Options) Options {
+	var o Options
+	if len(opts) > 0 {
+		o = opts[0]
+	}
+	if o.Selector == "" {
+		o.Selector = "random"
+	}
+	if o.BackupSelector == "" {
+		o.BackupSelector = "random"
+	}
+	if o.Timeout == 0 {
+		o.Timeout = 2 * time.Second
+	}
+	return o
+}
+
+// Returns the addresses that accept TCP connections on the port, chosen from
+// with the selector. If none do, the backup selector chooses from all of them.
+// Checks run in the background, starting from the first call; until the first
+// check of an address completes, it is assumed to be up.
+func IfPortUp(c *dsl.Context, port int, addresses []string, opts ...Options) []string {
+	o := options(opts)
+	p := checkedPool(fmt.Sprintf("port %d", port), addresses, o, pool.TCPCheck(port))
+	return choose(c, p, addresses, o)
+}
+
+// Returns the addresses in the first set that has any addresses where a GET of
+// the URL succeeds, chosen from with the selector. If there is no such set, the
+// backup selector chooses from all the addresses. The request is sent to each
+// address in turn, rather than to the host named in the URL. As with IfPortUp,
+// checks run in the background.
+func IfURLUp(c *dsl.Context, url string, sets [][]string, opts ...Options) []string {
+	o := options(opts)
+	checker := pool.HTTPCheck(url)
+	if o.StringMatch != "" {
+		checker = pool.HTTPBodyCheck(url, o.StringMatch)
+	}
+
+	var all []string
+	for _, set := range sets {
+		p := checkedPool("url "+url+" "+o.StringMatch, set, o, checker)
+		if up := upMembers(p); len(up) > 0 {
+			return selectFrom(c, o.Selector, up)
+		}
+		all = append(all, set...)
+	}
+
+	return selectFrom(c, o.BackupSelector, all)
+}
+
+func upMembers(p *pool.Pool) []string {
+	var up []string
+	for _, member := range p.Members() {
+		if p.IsHealthy(member) {
+			up = append(up, member)
+		}
+	}
+	return up
+}
+
+func choose(c *dsl.Context, p *pool.Pool, addresses []string, o Options) []string {
+	if up := upMembers(p); len(up) > 0 {
+		return selectFrom(c, o.Selector, up)
+	}
+	return selectFrom(c, o.BackupSelector, addresses)
+}
+
+var hashed = pool.ConsistentHash(32, 128)
+
+func selectFrom(c *dsl.Context, selector string, values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+
+	switch selector {
+	case "all":
+		return values
+	case "random":
+		return []string{PickRandom(c, values)}
+	case "hashed":
+		return hashed.Select(c, values)
+	case "pickclosest":
+		return []string{PickClosest(c, values)}
+	}
+
+	setError(c, fmt.Errorf("Unknown selector: %q", selector))
+	return nil
+}
+
+func setError(c *dsl.Context, err error) {
+	if c.Error == nil {
+		c.Error = err
+	}
+}
+
+// Returns one of the values at random
+func PickRandom(c *dsl.Context, values []string) string {
+	if len(values) == 0 {
+		setError(c, fmt.Errorf("pickrandom needs at least one value"))
+		return ""
+	}
+	return values[rand.Intn(len(values))]
+}
+
+// A value with a weight, as in the {weight, value} tables given to pickwhashed
+type Weighted struct {
+	Weight int
+	Value  string
+}
+
+// Picks one of the values, in proportion to its weight, by hashing the client
+// address; so a client always gets the same value.
+func PickWHashed(c *dsl.Context, values []Weighted) string {
+	total := 0
+	for _, v := range values {
+		if v.Weight > 0 {
+			total += v.Weight
+		}
+	}
+	if total == 0 {
+		setError(c, fmt.Errorf("pickwhashed needs at least one positive weight"))
+		return ""
+	}
+
+	addr, _ := c.ClientAddr()
+	h := fnv.New32a()
+	h.Write(addr.AsSlice())
+	n := int(h.Sum32() % uint32(total))
+
+	for _, v := range values {
+		if v.Weight > 0 {
+			n -= v.Weight
+			if n < 0 {
+				return v.Value
+			}
+		}
+	}
+	return ""
+}
+
+// Returns the address geographically closest to the client, using the locator
+// set with DSL.Locator. If the client can't be located, the first address is
+// returned; addresses that can't be located are never picked otherwise.
+func PickClosest(c *dsl.Context, addresses []string) string {
+	if len(addresses) == 0 {
+		setError(c, fmt.Errorf("pickclosest needs at least one address"))
+		return ""
+	}
+
+	sites := make([]geo.Site, 0, len(addresses))
+	for _, address := range addresses {
+		addr, err := netip.ParseAddr(address)
+		if err != nil {
+			setError(c, fmt.Errorf("pickclosest: bad address %q", address))
+			return ""
+		}
+		if loc := c.Locate(addr); loc != nil && loc.HasCoordinates {
+			sites = append(sites, geo.Site{Name: address, Latitude: loc.Latitude, Longitude: loc.Longitude})
+		}
+	}
+
+	if len(sites) == 0 || !c.Geo().HasCoordinates {
+		return addresses[0]
+	}
+	return geo.Nearest(c.Geo(), sites).Name
+}
+
+// A set of networks and the values to return for clients in them, as in the
+// {{netmasks}, {values}} tables given to view
+type ViewRule struct {
+	Subnets []string
+	Values  []string
+}
+
+// Returns the values of the first rule with a network containing the client
+// address. Context.ScopeBits is set to the length of the matching network.
+func View(c *dsl.Context, rules []ViewRule) []string {
+	addr, ok := c.ClientAddr()
+	if !ok {
+		return nil
+	}
+
+	for _, rule := range rules {
+		for _, subnet := range rule.Subnets {
+			prefix, err := netip.ParsePrefix(subnet)
+			if err != nil {
+				setError(c, fmt.Errorf("view: bad netmask %q", subnet))
+				return nil
+			}
+			if prefix.Contains(addr) {
+				c.ScopeBits = prefix.Bits()
+				return rule.Values
+			}
+		}
+	}
+	return nil
+}
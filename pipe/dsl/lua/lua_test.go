@@ -0,0 +1,252 @@
+package lua_test
+
+import (
+	"errors"
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl/lua"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Runs f as the callback for a query, returning the answers
+func Run(t *testing.T, q *backend.Query, f dsl.Callback) ([]*backend.Response, error) {
+	d := dsl.New()
+	d.Register(q.QType, regexp.MustCompile(`.*`), f)
+	return d.Lookup(q)
+}
+
+func Query(qtype, qname, client string) *backend.Query {
+	return &backend.Query{
+		ProtocolVersion: 3, QClass: "IN", QType: qtype, QName: qname, Id: "-1",
+		RemoteIpAddress: "127.0.0.1", EdnsSubnetAddress: client,
+	}
+}
+
+func Contents(rsp []*backend.Response) string {
+	out := make([]string, len(rsp))
+	for i, r := range rsp {
+		out[i] = r.Content
+	}
+	return strings.Join(out, ",")
+}
+
+func AssertReply(t *testing.T, q *backend.Query, exp string, f dsl.Callback) {
+	rsp, err := Run(t, q, f)
+	h.RefuteError(t, err, "Lookup")
+	h.AssertEqualString(t, exp, Contents(rsp), "Wrong answers")
+}
+
+func WaitFor(t *testing.T, cond func() bool, msg string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestIfPortUp(t *testing.T) {
+	CheckInterval = 10 * time.Millisecond
+	defer StopChecks()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	h.RefuteError(t, err, "Listen")
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	addresses := []string{"127.0.0.1", "127.0.0.2"}
+	all := Options{Selector: "all", BackupSelector: "all"}
+	up := func(c *dsl.Context) { Reply(c, IfPortUp(c, port, addresses, all)...) }
+
+	// Both are assumed to be up until checked, but the first check starts
+	// straight away, so it may already have found 127.0.0.2 down
+	rsp, _ := Run(t, Query("A", "www.example.com", ""), up)
+	first := Contents(rsp)
+	h.Assert(t, first == "127.0.0.1,127.0.0.2" || first == "127.0.0.1", "Wrong first answer: "+first)
+	WaitFor(t, func() bool {
+		rsp, _ := Run(t, Query("A", "www.example.com", ""), up)
+		return Contents(rsp) == "127.0.0.1"
+	}, "Closed port not noticed")
+
+	// With none up, the backup selector chooses from all of them
+	l.Close()
+	WaitFor(t, func() bool {
+		rsp, _ := Run(t, Query("A", "www.example.com", ""), up)
+		return Contents(rsp) == "127.0.0.1,127.0.0.2"
+	}, "Backup selector not used")
+}
+
+func TestIfURLUp(t *testing.T) {
+	CheckInterval = 10 * time.Millisecond
+	defer StopChecks()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	url := "http://www.example.com:" + strconv.Itoa(srv.Listener.Addr().(*net.TCPAddr).Port) + "/"
+
+	// Nothing answers on 127.0.0.2, so the second set should be used
+	sets := [][]string{{"127.0.0.2"}, {"127.0.0.1", "127.0.0.3"}}
+	opts := Options{Selector: "all", StringMatch: "ok"}
+	up := func(c *dsl.Context) { Reply(c, IfURLUp(c, url, sets, opts)...) }
+
+	WaitFor(t, func() bool {
+		rsp, _ := Run(t, Query("A", "www.example.com", ""), up)
+		return Contents(rsp) == "127.0.0.1"
+	}, "Second set not used")
+}
+
+func TestUnknownSelector(t *testing.T) {
+	defer StopChecks()
+	_, err := Run(t, Query("A", "www.example.com", ""), func(c *dsl.Context) {
+		Reply(c, IfPortUp(c, 1, []string{"192.0.2.1"}, Options{Selector: "bogus"})...)
+	})
+	h.Assert(t, err != nil, "Unknown selector should fail")
+}
+
+func TestPickRandom(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		rsp, err := Run(t, Query("A", "www.example.com", ""), func(c *dsl.Context) {
+			Reply(c, PickRandom(c, []string{"192.0.2.1", "192.0.2.2"}))
+		})
+		h.RefuteError(t, err, "Lookup")
+		seen[Contents(rsp)] = true
+	}
+	h.AssertEqualInt(t, 2, len(seen), "Both values should be picked")
+
+	_, err := Run(t, Query("A", "www.example.com", ""), func(c *dsl.Context) {
+		Reply(c, PickRandom(c, nil))
+	})
+	h.Assert(t, err != nil, "No values should fail")
+}
+
+func TestPickWHashed(t *testing.T) {
+	values := []Weighted{{1, "192.0.2.1"}, {3, "192.0.2.2"}, {0, "192.0.2.3"}}
+	pick := func(c *dsl.Context) { Reply(c, PickWHashed(c, values)) }
+
+	counts := make(map[string]int)
+	for i := 0; i < 2000; i++ {
+		client := netip.AddrFrom4([4]byte{10, byte(i >> 8), byte(i), 1}).String()
+		rsp, err := Run(t, Query("A", "www.example.com", client), pick)
+		h.RefuteError(t, err, "Lookup")
+		counts[Contents(rsp)]++
+
+		// The same client always gets the same answer
+		again, _ := Run(t, Query("A", "www.example.com", client), pick)
+		h.AssertEqualString(t, Contents(rsp), Contents(again), "Client should stick")
+	}
+
+	h.AssertEqualInt(t, 0, counts["192.0.2.3"], "Zero weight picked")
+	h.Assert(t, counts["192.0.2.1"] > 350 && counts["192.0.2.1"] < 650, "Bad distribution for weight 1")
+	h.Assert(t, counts["192.0.2.2"] > 1350 && counts["192.0.2.2"] < 1650, "Bad distribution for weight 3")
+}
+
+type FakeLocator map[string]*dsl.Location
+
+func (f FakeLocator) Locate(addr netip.Addr) (*dsl.Location, error) {
+	if loc, ok := f[addr.String()]; ok {
+		return loc, nil
+	}
+	return nil, errors.New("Not found")
+}
+
+func TestPickClosest(t *testing.T) {
+	locator := FakeLocator{
+		"198.51.100.1": {Latitude: 51.5, Longitude: -0.1, HasCoordinates: true},   // London
+		"198.51.100.2": {Latitude: 40.7, Longitude: -74.0, HasCoordinates: true},  // New York
+		"192.0.2.1":    {Latitude: 53.4, Longitude: -2.2, HasCoordinates: true},   // Manchester
+		"192.0.2.2":    {Latitude: 37.8, Longitude: -122.4, HasCoordinates: true}, // San Francisco
+	}
+	pick := func(c *dsl.Context) {
+		Reply(c, PickClosest(c, []string{"198.51.100.1", "198.51.100.2"}))
+	}
+
+	d := dsl.New()
+	d.Locator(locator)
+	d.A(`.*`, pick)
+
+	for client, exp := range map[string]string{
+		"192.0.2.1": "198.51.100.1",
+		"192.0.2.2": "198.51.100.2",
+		"192.0.2.3": "198.51.100.1", // unknown clients get the first address
+	} {
+		rsp, err := d.Lookup(Query("A", "www.example.com", client))
+		h.RefuteError(t, err, "Lookup")
+		h.AssertEqualString(t, exp, Contents(rsp), "Wrong closest for "+client)
+	}
+}
+
+func TestView(t *testing.T) {
+	rules := []ViewRule{
+		{Subnets: []string{"10.0.0.0/8"}, Values: []string{"192.0.2.1"}},
+		{Subnets: []string{"0.0.0.0/0"}, Values: []string{"192.0.2.2"}},
+	}
+
+	var scope int
+	view := func(c *dsl.Context) {
+		Reply(c, View(c, rules)...)
+		scope = c.ScopeBits
+	}
+	AssertReply(t, Query("A", "www.example.com", "10.1.2.3"), "192.0.2.1", view)
+	h.AssertEqualInt(t, 8, scope, "Bad scope")
+	AssertReply(t, Query("A", "www.example.com", "192.0.2.99"), "192.0.2.2", view)
+	h.AssertEqualInt(t, 0, scope, "Bad scope")
+
+	_, err := Run(t, Query("A", "www.example.com", ""), func(c *dsl.Context) {
+		Reply(c, View(c, []ViewRule{{Subnets: []string{"bogus"}}})...)
+	})
+	h.Assert(t, err != nil, "Bad netmask should fail")
+}
+
+func TestCreateReverse(t *testing.T) {
+	exceptions := map[string]string{"192.0.2.1": "gateway.example.com"}
+	reverse := func(format string) dsl.Callback {
+		return func(c *dsl.Context) { Reply(c, CreateReverse(c, format, exceptions)) }
+	}
+
+	q := Query("PTR", "10.2.0.192.in-addr.arpa", "")
+	AssertReply(t, q, "ip-192-0-2-10.example.com", reverse("ip-%5%.example.com"))
+	AssertReply(t, q, "192.0.2.10.example.com", reverse("%1%.%2%.%3%.%4%.example.com"))
+	AssertReply(t, q, "192-0-2-10", reverse("%1%-%2%-%3%-%4%"))
+	AssertReply(t, q, "c000020a.example.com", reverse("%6%.example.com"))
+	AssertReply(t, Query("PTR", "1.2.0.192.in-addr.arpa", ""), "gateway.example.com", reverse("%5%"))
+
+	_, err := Run(t, Query("PTR", "2.0.192.in-addr.arpa", ""), reverse("%5%"))
+	h.Assert(t, err != nil, "Partial name should fail")
+}
+
+func TestCreateReverse6(t *testing.T) {
+	reverse := func(format string) dsl.Callback {
+		return func(c *dsl.Context) { Reply(c, CreateReverse6(c, format, nil)) }
+	}
+
+	name := "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"
+	q := Query("PTR", name, "")
+	AssertReply(t, q, "2001-db8--1.example.com", reverse("%33%.example.com"))
+	AssertReply(t, q, "1.8.example.com", reverse("%1%.%25%.example.com"))
+	AssertReply(t, q, "2001.0db8.0001.example.com", reverse("%34%.%35%.%41%.example.com"))
+
+	_, err := Run(t, Query("PTR", "x."+name[2:], ""), reverse("%33%"))
+	h.Assert(t, err != nil, "Bad nibble should fail")
+}
@@ -0,0 +1,88 @@
+package lua
+
+import (
+	"fmt"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Builds a PTR answer for a query under in-addr.arpa, for use with wildcard
+// reverse routes. The format may contain:
+//
+// * %1% to %4%: the octets, in address order, as PowerDNS gives them
+// * %5%: the address, with the octets joined by dashes (%1%-%2%-%3%-%4%)
+// * %6%: the address in hex (7f000001)
+//
+// If the address is in the exceptions map, that value is returned instead.
+func CreateReverse(c *dsl.Context, format string, exceptions map[string]string) string {
+	_, addr, err := parseReverse(c.Query.QName, "in-addr.arpa", 4)
+	if err != nil {
+		setError(c, err)
+		return ""
+	}
+	if exception, ok := exceptions[addr.String()]; ok {
+		return exception
+	}
+
+	octets := addr.As4()
+	subs := make([]string, 0, 6)
+	for _, octet := range octets {
+		subs = append(subs, strconv.Itoa(int(octet)))
+	}
+	subs = append(subs,
+		strings.Replace(addr.String(), ".", "-", -1),
+		fmt.Sprintf("%02x%02x%02x%02x", octets[0], octets[1], octets[2], octets[3]),
+	)
+	return substitute(format, subs)
+}
+
+// Builds a PTR answer for a query under ip6.arpa. The format may contain:
+//
+// * %1% to %32%: the nibbles, in the order they appear in the query name
+// * %33%: the compressed address, with colons replaced by dashes (2001-db8--1)
+// * %34% to %41%: the eight 16-bit groups of the expanded address
+//
+// If the address (in compressed form) is in the exceptions map, that value is
+// returned instead.
+func CreateReverse6(c *dsl.Context, format string, exceptions map[string]string) string {
+	labels, addr, err := parseReverse(c.Query.QName, "ip6.arpa", 32)
+	if err != nil {
+		setError(c, err)
+		return ""
+	}
+	if exception, ok := exceptions[addr.String()]; ok {
+		return exception
+	}
+
+	subs := make([]string, 0, 41)
+	subs = append(subs, labels...)
+	subs = append(subs, strings.Replace(addr.String(), ":", "-", -1))
+	full := addr.StringExpanded()
+	subs = append(subs, strings.Split(full, ":")...)
+	return substitute(format, subs)
+}
+
+// Replaces %1%, %2%, etc. with the corresponding substitution. Higher numbers
+// are replaced first, so %1% doesn't clobber %10%.
+func substitute(format string, subs []string) string {
+	for i := len(subs); i > 0; i-- {
+		format = strings.Replace(format, "%"+strconv.Itoa(i)+"%", subs[i-1], -1)
+	}
+	return format
+}
+
+// Splits a reverse name into its labels, and the address they represent
+func parseReverse(qname, suffix string, count int) ([]string, netip.Addr, error) {
+	addr, err := dsl.ParseReverseName(qname)
+	if err != nil {
+		return nil, addr, err
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(qname, "."))
+	if !strings.HasSuffix(name, "."+suffix) {
+		return nil, netip.Addr{}, fmt.Errorf("Not a full %s name: %q", suffix, qname)
+	}
+	return strings.Split(name, ".")[:count], addr, nil
+}
@@ -0,0 +1,74 @@
+package dsl
+
+import (
+	"strings"
+)
+
+// A DSL mounted inside another under a suffix; see DSL.Mount
+type Mount struct {
+	// The suffix the child DSL is mounted under, in lower case and
+	// without a trailing dot
+	Name string
+
+	// If non-zero, replies from the child DSL's callbacks that don't
+	// specify a TTL are given this instead of the child's default TTL.
+	// Callbacks registered against a zone still use the zone's TTL.
+	DefaultTTL int
+
+	child  *DSL
+	before Callback
+}
+
+// Delegate all queries for the suffix, or any name below it, to another DSL.
+// The child's callbacks are matched against the full query name as usual, but
+// the name relative to the suffix is placed in Context.RelativeName. If the
+// query name is covered by several mounts, the longest suffix wins. None of
+// the parent's own callbacks (including its Before callback) are run for
+// delegated queries.
+//
+//	team := dsl.New()
+//	team.A(`www\.team\.example\.com`, answer)
+//	m := x.Mount("team.example.com", team)
+//	m.DefaultTTL = 300
+func (d *DSL) Mount(suffix string, child *DSL) *Mount {
+	m := &Mount{Name: canonical(suffix), child: child}
+	d.mounts = append(d.mounts, m)
+	return m
+}
+
+// Register a callback to run before every callback in the child DSL, when
+// queries reach it through this mount. It is run before the child's own
+// Before callback.
+func (m *Mount) Before(f Callback) {
+	m.before = f
+}
+
+// Returns the name relative to the mount point, or false if the name isn't
+// covered by the mount
+func (m *Mount) relative(qname string) (string, bool) {
+	name := canonical(qname)
+	if name == m.Name {
+		return "@", true
+	}
+	if m.Name == "" {
+		return name, true
+	}
+	if strings.HasSuffix(name, "."+m.Name) {
+		return name[:len(name)-len(m.Name)-1], true
+	}
+	return "", false
+}
+
+// Finds the mount with the longest suffix covering the query name, if any
+func (d *DSL) mountFor(qname string) (*Mount, string) {
+	var found *Mount
+	var relative string
+	for _, m := range d.mounts {
+		if rel, ok := m.relative(qname); ok {
+			if found == nil || len(m.Name) > len(found.Name) {
+				found, relative = m, rel
+			}
+		}
+	}
+	return found, relative
+}
@@ -0,0 +1,93 @@
+package dsl_test
+
+import (
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"testing"
+)
+
+func AQuery(qname string) *backend.Query {
+	q := h.FakeQuery(3)
+	q.QName = qname
+	q.QType = "A"
+	return q
+}
+
+func TestMountDelegatesQueriesUnderSuffix(t *testing.T) {
+	parent, child := New(), New()
+	parent.A(`.*`, ReplyHandler("parent"))
+	child.A(`.*`, ReplyHandler("child"))
+	parent.Mount("team.example.com.", child)
+
+	rsp := AssertLookup(t, parent, AQuery("www.Team.example.com"), 1, nil)
+	h.AssertEqualString(t, "child", rsp[0].Content, "Query not delegated")
+
+	rsp = AssertLookup(t, parent, AQuery("team.example.com"), 1, nil)
+	h.AssertEqualString(t, "child", rsp[0].Content, "Query for suffix not delegated")
+
+	rsp = AssertLookup(t, parent, AQuery("steam.example.com"), 1, nil)
+	h.AssertEqualString(t, "parent", rsp[0].Content, "Suffix must match whole labels")
+}
+
+func TestMountExposesRelativeName(t *testing.T) {
+	parent, child := New(), New()
+	var mountPoint, relative string
+	child.A(`.*`, func(c *Context) { mountPoint, relative = c.MountPoint, c.RelativeName })
+	parent.Mount("team.example.com", child)
+
+	AssertLookup(t, parent, AQuery("a.b.team.example.com"), 0, nil)
+	h.AssertEqualString(t, "team.example.com", mountPoint, "Bad mount point")
+	h.AssertEqualString(t, "a.b", relative, "Bad relative name")
+
+	AssertLookup(t, parent, AQuery("team.example.com"), 0, nil)
+	h.AssertEqualString(t, "@", relative, "Bad relative name for suffix")
+}
+
+func TestMountLongestSuffixWins(t *testing.T) {
+	parent, short, long := New(), New(), New()
+	short.A(`.*`, ReplyHandler("short"))
+	long.A(`.*`, ReplyHandler("long"))
+	parent.Mount("b.example.com", long)
+	parent.Mount("example.com", short)
+
+	rsp := AssertLookup(t, parent, AQuery("a.b.example.com"), 1, nil)
+	h.AssertEqualString(t, "long", rsp[0].Content, "Longest suffix should win")
+
+	rsp = AssertLookup(t, parent, AQuery("a.c.example.com"), 1, nil)
+	h.AssertEqualString(t, "short", rsp[0].Content, "Shorter suffix should match")
+}
+
+func TestMountBeforeAndDefaultTTL(t *testing.T) {
+	parent, child := New(), New()
+	parent.Before(ReplyHandler("parent before"))
+	child.Before(ReplyHandler("child before"))
+	child.A(`.*`, ReplyHandler("answer"))
+	m := parent.Mount("example.com", child)
+	m.Before(ReplyHandler("mount before"))
+	m.DefaultTTL = 60
+
+	rsp := AssertLookup(t, parent, AQuery("example.com"), 3, nil)
+	h.AssertEqualString(t, "mount before", rsp[0].Content, "Mount before not run first")
+	h.AssertEqualString(t, "child before", rsp[1].Content, "Child before not run")
+	h.AssertEqualString(t, "answer", rsp[2].Content, "Child callback not run")
+	h.AssertEqualString(t, "60", rsp[2].TTL, "Mount TTL not used")
+}
+
+func TestMountBeforeCanHaltLookup(t *testing.T) {
+	parent, child := New(), New()
+	ok := true
+	child.A(`.*`, func(c *Context) { ok = false })
+	parent.Mount("example.com", child).Before(ErrorReplyHandler)
+	AssertLookup(t, parent, AQuery("example.com"), 0, ErrorReplyError)
+	h.Assert(t, ok, "Child callback was run")
+}
+
+func TestValidateChecksMountedDSLs(t *testing.T) {
+	parent, child := New(), New()
+	child.Zone("team.example.com", nil)
+	parent.Mount("team.example.com", child)
+	err := parent.Validate()
+	h.Assert(t, err != nil, "Child errors should be reported")
+	h.AssertEqualString(t, "Mount team.example.com: Zone team.example.com has no SOA record", err.Error(), "Bad error")
+}
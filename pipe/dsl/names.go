@@ -0,0 +1,96 @@
+package dsl
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Register a callback against an exact name, rather than a regexp. Unlike
+// regexp routes, names registered this way are known to exist, which gives us
+// proper DNS wildcard semantics (RFC 4592):
+//
+// A name beginning with "*." is a wildcard. It is only used for a query if the
+// query name doesn't exist, and the wildcard is at its closest encloser (that
+// is, the nearest ancestor of the query name that does exist).
+//
+// A name exists if any callback of any qtype is registered against it, or if
+// it is an empty non-terminal (a name with nothing registered against it, but
+// with registered names below it).
+//
+// Answers from wildcard callbacks use the query name as usual, and Matches
+// holds the labels that the "*" stood in for. Regexp routes aren't affected
+// by any of this, and aren't taken into account when deciding whether a name
+// exists; they are run whenever they match, as ever.
+func (d *DSL) RegisterName(qtype, name string, f Callback) {
+	d.registerName(qtype, name, f, nil)
+}
+
+// Register a callback against an exact name, relative to the zone apex. The
+// name may be "@" for the apex itself, or begin with "*" for a wildcard. See
+// DSL.RegisterName for details.
+func (z *Zone) RegisterName(qtype, name string, f Callback) {
+	z.dsl.registerName(qtype, z.absolute(name), f, z)
+}
+
+// Turns a name relative to the zone apex into an absolute one
+func (z *Zone) absolute(name string) string {
+	if name == "" || name == "@" {
+		return z.Name
+	}
+	if strings.HasSuffix(name, ".") {
+		return canonical(name)
+	}
+	return canonical(name + "." + z.Name)
+}
+
+func (d *DSL) registerName(qtype, name string, f Callback, zone *Zone) {
+	name = canonical(name)
+	re := regexp.MustCompile(fmt.Sprintf("^(?i)%s$", regexp.QuoteMeta(name)))
+	d.register(qtype, re, f, zone)
+
+	nodes := d.callbacks[qtype]
+	nodes[len(nodes)-1].name = name
+
+	for ; name != ""; name = parent(name) {
+		d.names[name] = true
+	}
+}
+
+// Returns the name with its leftmost label removed
+func parent(name string) string {
+	if i := strings.Index(name, "."); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+// The name whose exact-name callbacks should answer a query
+type owner struct {
+	// The registered name to match; blank if there isn't one
+	name string
+
+	// If name is a wildcard, the labels of the query name it stands in for
+	wild string
+}
+
+// Works out which registered name should answer for the query name: either
+// the name itself, if it exists, or the wildcard at its closest encloser.
+func (d *DSL) ownerOf(qname string) owner {
+	name := canonical(qname)
+	if d.names[name] {
+		return owner{name: name}
+	}
+
+	for encloser := parent(name); encloser != ""; encloser = parent(encloser) {
+		if d.names[encloser] {
+			source := "*." + encloser
+			if !d.names[source] {
+				break
+			}
+			return owner{name: source, wild: name[:len(name)-len(encloser)-1]}
+		}
+	}
+
+	return owner{}
+}
@@ -0,0 +1,96 @@
+package dsl_test
+
+import (
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"testing"
+)
+
+func WildcardDSL() *DSL {
+	d := New()
+	d.RegisterName("A", "*.example.com", ReplyHandler("wildcard"))
+	d.RegisterName("A", "www.example.com", ReplyHandler("www"))
+	d.RegisterName("MX", "mail.example.com", ReplyHandler("10 mail.example.com"))
+	d.RegisterName("A", "host.ent.example.com", ReplyHandler("host"))
+	return d
+}
+
+func TestRegisterNameMatchesExactNameOnly(t *testing.T) {
+	d := New()
+	d.RegisterName("A", "www.example.com.", ReplyHandler("www"))
+	rsp := AssertLookup(t, d, AQuery("WWW.example.com"), 1, nil)
+	h.AssertEqualString(t, "www", rsp[0].Content, "Exact name not matched")
+	AssertLookup(t, d, AQuery("wwwxexample.com"), 0, nil)
+	AssertLookup(t, d, AQuery("a.www.example.com"), 0, nil)
+	AssertTableEntry(t, d, "A", `^(?i)www\.example\.com$`, "Bad table entry")
+}
+
+func TestWildcardAnswersForNonExistentNames(t *testing.T) {
+	d := WildcardDSL()
+	rsp := AssertLookup(t, d, AQuery("foo.example.com"), 1, nil)
+	h.AssertEqualString(t, "wildcard", rsp[0].Content, "Wildcard not used")
+	h.AssertEqualString(t, "foo.example.com", rsp[0].QName, "Answer should use query name")
+
+	rsp = AssertLookup(t, d, AQuery("a.b.example.com"), 1, nil)
+	h.AssertEqualString(t, "wildcard", rsp[0].Content, "Wildcard should cover several labels")
+}
+
+func TestWildcardDoesNotAnswerForExistingNames(t *testing.T) {
+	d := WildcardDSL()
+	rsp := AssertLookup(t, d, AQuery("www.example.com"), 1, nil)
+	h.AssertEqualString(t, "www", rsp[0].Content, "Exact name should win")
+
+	// mail.example.com exists with an MX, so an A query gets NODATA
+	AssertLookup(t, d, AQuery("mail.example.com"), 0, nil)
+}
+
+func TestWildcardDoesNotAnswerForEmptyNonTerminals(t *testing.T) {
+	d := WildcardDSL()
+	AssertLookup(t, d, AQuery("ent.example.com"), 0, nil)
+}
+
+func TestWildcardOnlyUsedAtClosestEncloser(t *testing.T) {
+	d := WildcardDSL()
+	// The closest encloser is ent.example.com, which has no wildcard
+	AssertLookup(t, d, AQuery("foo.ent.example.com"), 0, nil)
+	AssertLookup(t, d, AQuery("foo.www.example.com"), 0, nil)
+	AssertLookup(t, d, AQuery("example.org"), 0, nil)
+}
+
+func TestWildcardNameCanBeQueriedDirectly(t *testing.T) {
+	d := WildcardDSL()
+	rsp := AssertLookup(t, d, AQuery("*.example.com"), 1, nil)
+	h.AssertEqualString(t, "wildcard", rsp[0].Content, "Wildcard owner should exist")
+}
+
+func TestWildcardMatchesHoldSubstitutedLabels(t *testing.T) {
+	d := New()
+	var matches []string
+	d.RegisterName("A", "*.example.com", func(c *Context) { matches = c.Matches })
+	AssertLookup(t, d, AQuery("Foo.Bar.example.com"), 0, nil)
+	h.AssertEqualInt(t, 1, len(matches), "Wildcard labels not captured")
+	h.AssertEqualString(t, "foo.bar", matches[0], "Bad wildcard labels")
+}
+
+func TestRegexRoutesAreUnaffectedByWildcards(t *testing.T) {
+	d := WildcardDSL()
+	d.A(`www\.example\.com`, ReplyHandler("regex"))
+	d.A(`.*\.example\.com`, ReplyHandler("regex wildcard"))
+	rsp := AssertLookup(t, d, AQuery("www.example.com"), 3, nil)
+	h.AssertEqualString(t, "regex wildcard", rsp[2].Content, "Regex route should run")
+}
+
+func TestZoneRegisterNameIsRelative(t *testing.T) {
+	d := New()
+	d.Zone("example.com", func(z *Zone) {
+		z.RegisterName("A", "*", ReplyHandler("wildcard"))
+		z.RegisterName("A", "www", ReplyHandler("www"))
+	})
+	rsp := AssertLookup(t, d, AQuery("www.example.com"), 1, nil)
+	h.AssertEqualString(t, "www", rsp[0].Content, "Relative name not used")
+	rsp = AssertLookup(t, d, AQuery("foo.example.com"), 1, nil)
+	h.AssertEqualString(t, "wildcard", rsp[0].Content, "Relative wildcard not used")
+
+	// The apex exists (it has SOA and NS), so the wildcard doesn't apply
+	AssertLookup(t, d, AQuery("example.com"), 0, nil)
+}
@@ -0,0 +1,109 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Something that can check the health of a pool member. An error means the
+// member is unhealthy. Checks should give up when the context is done.
+type Checker interface {
+	Check(ctx context.Context, member string) error
+}
+
+// Lets an ordinary function be used as a Checker
+type CheckerFunc func(ctx context.Context, member string) error
+
+func (f CheckerFunc) Check(ctx context.Context, member string) error {
+	return f(ctx, member)
+}
+
+// Checks that a TCP connection can be made to the member on the given port
+func TCPCheck(port int) Checker {
+	return CheckerFunc(func(ctx context.Context, member string) error {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(member, strconv.Itoa(port)))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	})
+}
+
+// Checks that a GET of the URL succeeds when sent to the member, rather than
+// to whatever the host in the URL resolves to. The Host header (and, for
+// https, the name the certificate is checked against) still come from the
+// URL. Any 2xx or 3xx status is a success; redirects aren't followed.
+func HTTPCheck(rawurl string) Checker {
+	return httpCheck(rawurl, "")
+}
+
+// Like HTTPCheck, but the body returned must also contain the given string
+func HTTPBodyCheck(rawurl, match string) Checker {
+	return httpCheck(rawurl, match)
+}
+
+func httpCheck(rawurl, match string) Checker {
+	return CheckerFunc(func(ctx context.Context, member string) error {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return err
+		}
+
+		port := u.Port()
+		if port == "" {
+			port = "80"
+			if u.Scheme == "https" {
+				port = "443"
+			}
+		}
+
+		var dialer net.Dialer
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, network, net.JoinHostPort(member, port))
+				},
+				DisableKeepAlives: true,
+			},
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", rawurl, nil)
+		if err != nil {
+			return err
+		}
+
+		rsp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer rsp.Body.Close()
+
+		if rsp.StatusCode >= 400 {
+			return fmt.Errorf("%s returned %s", rawurl, rsp.Status)
+		}
+
+		if match == "" {
+			io.Copy(io.Discard, rsp.Body)
+			return nil
+		}
+
+		body, err := io.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(body), match) {
+			return fmt.Errorf("%s didn't contain %q", rawurl, match)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,235 @@
+// Copyright 2015 Bytemark Computer Consulting Ltd. All rights reserved
+// Licensed under the GNU General Public License, version 2. See the LICENSE
+// file for more details
+
+// Pools of records whose members are health-checked in the background, so
+// that only healthy members are given out. Usage:
+//
+//	lbs := pool.New([]string{"192.0.2.1", "192.0.2.2"}, pool.TCPCheck(443))
+//	lbs.Fallback = pool.FallbackBackup
+//	lbs.Backup = []string{"198.51.100.1"}
+//	lbs.Publish("lbs") // state is available through expvar
+//	lbs.Start()
+//	defer lbs.Stop()
+//
+//	x.A(root, lbs.Reply)
+package pool
+
+import (
+	"context"
+	"expvar"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	"sync"
+	"time"
+)
+
+// What to give out when no members of a pool are healthy
+type Fallback int
+
+const (
+	// Give out every member, as if they were all healthy. Since we can't
+	// tell the difference between all the members being down and our
+	// checks failing, this is usually the safest thing to do.
+	FallbackAll Fallback = iota
+
+	// Give out nothing
+	FallbackNone
+
+	// Give out the members of Pool.Backup instead
+	FallbackBackup
+)
+
+// A set of members (addresses, host names or whatever else a callback replies
+// with) that are checked periodically
+type Pool struct {
+	// How often members are checked, and how long each check may take.
+	// Default to 10 seconds and 2 seconds.
+	Interval time.Duration
+	Timeout  time.Duration
+
+	// A member changes state after this many consecutive checks disagree
+	// with its current state. Both default to 1.
+	Rise int
+	Fall int
+
+	// What to give out if no members are healthy, and the backup members to
+	// give out for FallbackBackup
+	Fallback Fallback
+	Backup   []string
+
+	members []string
+	checker Checker
+
+	mu    sync.RWMutex
+	state map[string]*memberState
+
+	metrics *expvar.Map
+	stop    chan struct{}
+	wg      sync.WaitGroup
+}
+
+type memberState struct {
+	up      bool
+	streak  int // consecutive checks disagreeing with up
+	checks  *expvar.Int
+	fails   *expvar.Int
+	healthy *expvar.Int
+}
+
+// Build a new pool. Members start out healthy, and checks don't begin until
+// Pool.Start is called.
+func New(members []string, checker Checker) *Pool {
+	p := &Pool{
+		Interval: 10 * time.Second,
+		Timeout:  2 * time.Second,
+		Rise:     1,
+		Fall:     1,
+		members:  members,
+		checker:  checker,
+		state:    make(map[string]*memberState),
+		metrics:  new(expvar.Map).Init(),
+	}
+
+	for _, member := range members {
+		s := &memberState{up: true, checks: new(expvar.Int), fails: new(expvar.Int), healthy: new(expvar.Int)}
+		s.healthy.Set(1)
+
+		m := new(expvar.Map).Init()
+		m.Set("healthy", s.healthy)
+		m.Set("checks", s.checks)
+		m.Set("failures", s.fails)
+		p.metrics.Set(member, m)
+
+		p.state[member] = s
+	}
+
+	return p
+}
+
+// The members of the pool, in the order they were given
+func (p *Pool) Members() []string {
+	return p.members
+}
+
+// Start checking members in the background: each member is checked straight
+// away, then every Interval.
+func (p *Pool) Start() {
+	p.stop = make(chan struct{})
+	for _, member := range p.members {
+		p.wg.Add(1)
+		go p.run(member)
+	}
+}
+
+// Stop checking members, waiting for any checks in progress to finish
+func (p *Pool) Stop() {
+	close(p.stop)
+	p.wg.Wait()
+}
+
+func (p *Pool) run(member string) {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	for {
+		p.CheckNow(member)
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Check a member immediately, updating its state
+func (p *Pool) CheckNow(member string) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.Timeout)
+	err := p.checker.Check(ctx, member)
+	cancel()
+	p.record(member, err == nil)
+}
+
+func (p *Pool) record(member string, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.state[member]
+	if s == nil {
+		return
+	}
+
+	s.checks.Add(1)
+	if !ok {
+		s.fails.Add(1)
+	}
+
+	if ok == s.up {
+		s.streak = 0
+		return
+	}
+
+	s.streak++
+	if (ok && s.streak >= p.Rise) || (!ok && s.streak >= p.Fall) {
+		s.up, s.streak = ok, 0
+		if ok {
+			s.healthy.Set(1)
+		} else {
+			s.healthy.Set(0)
+		}
+	}
+}
+
+// Whether a member is currently considered healthy
+func (p *Pool) IsHealthy(member string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	s := p.state[member]
+	return s != nil && s.up
+}
+
+// The healthy members, in order. If there are none, the fallback is given
+// instead; see Pool.Fallback.
+func (p *Pool) Healthy() []string {
+	p.mu.RLock()
+	healthy := make([]string, 0, len(p.members))
+	for _, member := range p.members {
+		if p.state[member].up {
+			healthy = append(healthy, member)
+		}
+	}
+	p.mu.RUnlock()
+
+	if len(healthy) > 0 {
+		return healthy
+	}
+
+	switch p.Fallback {
+	case FallbackNone:
+		return nil
+	case FallbackBackup:
+		return p.Backup
+	default:
+		return p.members
+	}
+}
+
+// A DSL callback replying with each member given by Pool.Healthy
+func (p *Pool) Reply(c *dsl.Context) {
+	for _, member := range p.Healthy() {
+		c.Reply(member)
+	}
+}
+
+// The state of each member, keyed by member: "healthy" (1 or 0), and the
+// number of "checks" and "failures" so far
+func (p *Pool) Metrics() *expvar.Map {
+	return p.metrics
+}
+
+// Publish the metrics with expvar, under the given name. Like expvar.Publish,
+// this panics if the name is already in use.
+func (p *Pool) Publish(name string) {
+	expvar.Publish(name, p.metrics)
+}
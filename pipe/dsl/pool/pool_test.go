@@ -0,0 +1,201 @@
+package pool_test
+
+import (
+	"context"
+	"errors"
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl/pool"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A checker whose results can be changed by the test
+type FakeChecker struct {
+	mu   sync.Mutex
+	down map[string]bool
+}
+
+func (f *FakeChecker) Check(ctx context.Context, member string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down[member] {
+		return errors.New("down")
+	}
+	return nil
+}
+
+func (f *FakeChecker) Set(member string, down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down == nil {
+		f.down = make(map[string]bool)
+	}
+	f.down[member] = down
+}
+
+func AssertHealthy(t *testing.T, p *Pool, exp string) {
+	h.AssertEqualString(t, exp, strings.Join(p.Healthy(), ","), "Wrong healthy members")
+}
+
+func TestMembersStartHealthyAndFollowChecks(t *testing.T) {
+	f := &FakeChecker{}
+	p := New([]string{"a", "b", "c"}, f)
+	AssertHealthy(t, p, "a,b,c")
+
+	f.Set("b", true)
+	p.CheckNow("b")
+	AssertHealthy(t, p, "a,c")
+	h.Assert(t, !p.IsHealthy("b"), "b should be down")
+
+	f.Set("b", false)
+	p.CheckNow("b")
+	AssertHealthy(t, p, "a,b,c")
+}
+
+func TestRiseAndFall(t *testing.T) {
+	f := &FakeChecker{}
+	p := New([]string{"a", "b"}, f)
+	p.Rise, p.Fall = 2, 3
+
+	f.Set("a", true)
+	p.CheckNow("a")
+	p.CheckNow("a")
+	h.Assert(t, p.IsHealthy("a"), "Fell too early")
+	p.CheckNow("a")
+	h.Assert(t, !p.IsHealthy("a"), "Should have fallen")
+
+	f.Set("a", false)
+	p.CheckNow("a")
+	h.Assert(t, !p.IsHealthy("a"), "Rose too early")
+	p.CheckNow("a")
+	h.Assert(t, p.IsHealthy("a"), "Should have risen")
+}
+
+func TestFallbacks(t *testing.T) {
+	f := &FakeChecker{}
+	p := New([]string{"a", "b"}, f)
+	f.Set("a", true)
+	f.Set("b", true)
+	p.CheckNow("a")
+	p.CheckNow("b")
+
+	AssertHealthy(t, p, "a,b")
+	p.Fallback = FallbackNone
+	AssertHealthy(t, p, "")
+	p.Fallback = FallbackBackup
+	p.Backup = []string{"z"}
+	AssertHealthy(t, p, "z")
+}
+
+func TestMetrics(t *testing.T) {
+	f := &FakeChecker{}
+	p := New([]string{"a"}, f)
+	f.Set("a", true)
+	p.CheckNow("a")
+	p.CheckNow("a")
+	h.AssertEqualString(
+		t, `{"a": {"checks": 2, "failures": 2, "healthy": 0}}`,
+		p.Metrics().String(), "Bad metrics",
+	)
+}
+
+func TestReplyInDSL(t *testing.T) {
+	f := &FakeChecker{}
+	p := New([]string{"192.0.2.1", "192.0.2.2"}, f)
+	f.Set("192.0.2.1", true)
+	p.CheckNow("192.0.2.1")
+
+	d := dsl.New()
+	d.A(`.*`, p.Reply)
+	rsp, err := d.Lookup(&backend.Query{ProtocolVersion: 1, QName: "example.com", QClass: "IN", QType: "A"})
+	h.RefuteError(t, err, "Lookup")
+	h.AssertEqualInt(t, 1, len(rsp), "One answer expected")
+	h.AssertEqualString(t, "192.0.2.2", rsp[0].Content, "Wrong member")
+}
+
+func TestBackgroundChecksWithTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	h.RefuteError(t, err, "Listen")
+	port := l.Addr().(*net.TCPAddr).Port
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	// Nothing listens on 127.0.0.2 with the same port
+	p := New([]string{"127.0.0.1", "127.0.0.2"}, TCPCheck(port))
+	p.Interval = 10 * time.Millisecond
+	p.Start()
+	defer p.Stop()
+
+	WaitFor(t, func() bool { return !p.IsHealthy("127.0.0.2") }, "Closed port not noticed")
+	h.Assert(t, p.IsHealthy("127.0.0.1"), "Open port should be healthy")
+
+	l.Close()
+	WaitFor(t, func() bool { return !p.IsHealthy("127.0.0.1") }, "Closed listener not noticed")
+}
+
+func TestHTTPCheckConnectsToMember(t *testing.T) {
+	status := http.StatusOK
+	var host string
+	var mu sync.Mutex
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		host = r.Host
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	port := strconv.Itoa(srv.Listener.Addr().(*net.TCPAddr).Port)
+	check := HTTPCheck("http://www.example.com:" + port + "/health")
+	ctx := context.Background()
+
+	h.RefuteError(t, check.Check(ctx, "127.0.0.1"), "Check should pass")
+	mu.Lock()
+	h.AssertEqualString(t, "www.example.com:"+port, host, "Host header should come from the URL")
+	status = http.StatusServiceUnavailable
+	mu.Unlock()
+
+	err := check.Check(ctx, "127.0.0.1")
+	h.Assert(t, err != nil, "Check should fail on 503")
+}
+
+func TestHTTPBodyCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("status: ok\n"))
+	}))
+	defer srv.Close()
+
+	port := strconv.Itoa(srv.Listener.Addr().(*net.TCPAddr).Port)
+	ctx := context.Background()
+
+	check := HTTPBodyCheck("http://www.example.com:"+port+"/", "status: ok")
+	h.RefuteError(t, check.Check(ctx, "127.0.0.1"), "Check should pass")
+
+	check = HTTPBodyCheck("http://www.example.com:"+port+"/", "status: down")
+	h.Assert(t, check.Check(ctx, "127.0.0.1") != nil, "Check should fail without a match")
+}
+
+func WaitFor(t *testing.T, cond func() bool, msg string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
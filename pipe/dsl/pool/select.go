@@ -0,0 +1,259 @@
+package pool
+
+import (
+	"encoding/binary"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// Chooses which of a set of members to give out for a query. PowerDNS shuffles
+// answers unless "noshuffle" is set, so selectors give out a single member,
+// which gives the same result either way.
+//
+//	x.A(root, lbs.ReplyWith(pool.ConsistentHash(24, 56)))
+//
+// Selectors can be used without a pool, too:
+//
+//	rr := pool.RoundRobin()
+//	x.A(root, func(c *dsl.Context) {
+//		for _, member := range rr.Select(c, addresses) {
+//			c.Reply(member)
+//		}
+//	})
+type Selector interface {
+	Select(c *dsl.Context, members []string) []string
+}
+
+// A DSL callback replying with the members chosen by the selector from the
+// healthy members of the pool (or the fallback; see Pool.Healthy)
+func (p *Pool) ReplyWith(s Selector) dsl.Callback {
+	return func(c *dsl.Context) {
+		for _, member := range s.Select(c, p.Healthy()) {
+			c.Reply(member)
+		}
+	}
+}
+
+type weighted struct {
+	weights map[string]int
+}
+
+// Picks a member at random, in proportion to its weight. Members missing from
+// the map have a weight of 1; those with a weight of 0 or less are never
+// picked.
+func Weighted(weights map[string]int) Selector {
+	return &weighted{weights: weights}
+}
+
+func (w *weighted) weight(member string) int {
+	weight, ok := w.weights[member]
+	if !ok {
+		return 1
+	}
+	if weight < 0 {
+		return 0
+	}
+	return weight
+}
+
+func (w *weighted) Select(c *dsl.Context, members []string) []string {
+	total := 0
+	for _, member := range members {
+		total += w.weight(member)
+	}
+	if total == 0 {
+		return nil
+	}
+
+	n := rand.Intn(total)
+	for _, member := range members {
+		n -= w.weight(member)
+		if n < 0 {
+			return []string{member}
+		}
+	}
+	return nil
+}
+
+type roundRobin struct {
+	next uint64
+}
+
+// Gives out each member in turn. The position is kept in memory, so it is
+// shared by the goroutines of one process; PowerDNS runs each pipe session as
+// a process of its own, though, and each of them has its own rotation. Use
+// SharedRoundRobin for a rotation that is strict across all of them.
+func RoundRobin() Selector {
+	return &roundRobin{}
+}
+
+func (r *roundRobin) Select(c *dsl.Context, members []string) []string {
+	if len(members) == 0 {
+		return nil
+	}
+	n := atomic.AddUint64(&r.next, 1) - 1
+	return []string{members[n%uint64(len(members))]}
+}
+
+type sharedRoundRobin struct {
+	mu    sync.Mutex
+	file  *os.File
+	local roundRobin
+}
+
+// Gives out each member in turn, like RoundRobin, but keeps the position in
+// the file at path, which is created if it doesn't exist. Every pipe process
+// using the same file takes turns from the same rotation. The file is locked
+// for each pick; if it can't be used, members are given out in turn by this
+// process alone.
+func SharedRoundRobin(path string) (Selector, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &sharedRoundRobin{file: f}, nil
+}
+
+func (r *sharedRoundRobin) Select(c *dsl.Context, members []string) []string {
+	if len(members) == 0 {
+		return nil
+	}
+	n, err := r.take()
+	if err != nil {
+		return r.local.Select(c, members)
+	}
+	return []string{members[n%uint64(len(members))]}
+}
+
+// Takes the next position from the file. Locks are held by open files, not
+// goroutines, so the mutex keeps this process's goroutines apart.
+func (r *sharedRoundRobin) take() (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fd := int(r.file.Fd())
+	if err := syscall.Flock(fd, syscall.LOCK_EX); err != nil {
+		return 0, err
+	}
+	defer syscall.Flock(fd, syscall.LOCK_UN)
+
+	var buf [8]byte
+	if _, err := r.file.ReadAt(buf[:], 0); err != nil && err != io.EOF {
+		return 0, err
+	}
+	n := binary.BigEndian.Uint64(buf[:])
+	binary.BigEndian.PutUint64(buf[:], n+1)
+	if _, err := r.file.WriteAt(buf[:], 0); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Number of points each member gets on the hash ring
+const ringPoints = 160
+
+type point struct {
+	hash   uint64
+	member string
+}
+
+type consistentHash struct {
+	v4Bits, v6Bits int
+
+	mu    sync.Mutex
+	key   string
+	rings map[string][]point
+}
+
+// Picks a member by hashing the client subnet (see dsl.Context.ClientSubnet),
+// truncated to the given number of bits, so a given client network sticks to
+// the same member. When a member goes down, only the clients that were using
+// it are moved elsewhere. Context.ScopeBits is set to the number of bits used.
+func ConsistentHash(v4Bits, v6Bits int) Selector {
+	return &consistentHash{v4Bits: v4Bits, v6Bits: v6Bits, rings: make(map[string][]point)}
+}
+
+// FNV is quick, but similar strings give similar hashes; the finaliser from
+// MurmurHash3 spreads them evenly around the ring
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// Builds (or finds) the ring for a set of members
+func (ch *consistentHash) ring(members []string) []point {
+	key := strings.Join(members, "\x00")
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ring, ok := ch.rings[key]; ok {
+		return ring
+	}
+
+	ring := make([]point, 0, len(members)*ringPoints)
+	for _, member := range members {
+		for i := 0; i < ringPoints; i++ {
+			ring = append(ring, point{hash: hash(member + "#" + strconv.Itoa(i)), member: member})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+
+	// Health changes give us a handful of different member sets; don't
+	// let them build up forever
+	if len(ch.rings) > 64 {
+		ch.rings = make(map[string][]point)
+	}
+	ch.rings[key] = ring
+	return ring
+}
+
+func (ch *consistentHash) Select(c *dsl.Context, members []string) []string {
+	if len(members) == 0 {
+		return nil
+	}
+
+	subnet, ok := c.ClientSubnet()
+	if !ok {
+		return []string{members[0]}
+	}
+
+	bits := ch.v4Bits
+	if subnet.Addr().Is6() {
+		bits = ch.v6Bits
+	}
+	if bits > subnet.Bits() {
+		bits = subnet.Bits()
+	}
+	key, _ := subnet.Addr().Prefix(bits)
+	c.ScopeBits = bits
+
+	return []string{lookupRing(ch.ring(members), key)}
+}
+
+func lookupRing(ring []point, key netip.Prefix) string {
+	h := hash(key.String())
+	i := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+	if i == len(ring) {
+		i = 0
+	}
+	return ring[i].member
+}
@@ -0,0 +1,179 @@
+package pool_test
+
+import (
+	"fmt"
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl/pool"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// Runs the selector against a query from the given client n times, counting
+// how often each member is picked
+func Tally(t *testing.T, s Selector, members []string, client string, n int) map[string]int {
+	d := dsl.New()
+	d.A(`.*`, func(c *dsl.Context) {
+		for _, member := range s.Select(c, members) {
+			c.Reply(member)
+		}
+	})
+
+	tally := make(map[string]int)
+	for i := 0; i < n; i++ {
+		rsp, err := d.Lookup(&backend.Query{
+			ProtocolVersion: 3, QName: "example.com", QClass: "IN", QType: "A",
+			RemoteIpAddress: "127.0.0.1", EdnsSubnetAddress: client,
+		})
+		h.RefuteError(t, err, "Lookup")
+		h.AssertEqualInt(t, 1, len(rsp), "One answer expected")
+		tally[rsp[0].Content]++
+	}
+	return tally
+}
+
+func AssertBetween(t *testing.T, low, high, n int, msg string) {
+	h.Assert(t, n >= low && n <= high, fmt.Sprintf("%s: %d not between %d and %d", msg, n, low, high))
+}
+
+func TestWeightedDistribution(t *testing.T) {
+	s := Weighted(map[string]int{"a": 3, "b": 1, "c": 0})
+	tally := Tally(t, s, []string{"a", "b", "c", "d"}, "", 10000)
+	AssertBetween(t, 5700, 6300, tally["a"], "a should get 3/5")
+	AssertBetween(t, 1800, 2200, tally["b"], "b should get 1/5")
+	AssertBetween(t, 1800, 2200, tally["d"], "d should default to a weight of 1")
+	h.AssertEqualInt(t, 0, tally["c"], "c should never be picked")
+}
+
+func TestWeightedWithNoWeight(t *testing.T) {
+	s := Weighted(map[string]int{"a": 0})
+	h.AssertEqualInt(t, 0, len(s.Select(nil, []string{"a"})), "Nothing should be picked")
+}
+
+func TestRoundRobinIsStrictAcrossGoroutines(t *testing.T) {
+	s := RoundRobin()
+	members := []string{"a", "b", "c"}
+
+	var mu sync.Mutex
+	tally := make(map[string]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for member, n := range Tally(t, s, members, "", 30) {
+				mu.Lock()
+				tally[member] += n
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, member := range members {
+		h.AssertEqualInt(t, 100, tally[member], "Uneven rotation for "+member)
+	}
+}
+
+func TestRoundRobinOrder(t *testing.T) {
+	s := RoundRobin()
+	members := []string{"a", "b"}
+	h.AssertEqualString(t, "a", s.Select(nil, members)[0], "Should start with first member")
+	h.AssertEqualString(t, "b", s.Select(nil, members)[0], "Should move on")
+	h.AssertEqualString(t, "a", s.Select(nil, members)[0], "Should wrap around")
+}
+
+func TestSharedRoundRobinIsStrictAcrossProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rotation")
+	members := []string{"a", "b", "c"}
+
+	// Each selector has the file open separately, as each pipe process would
+	var selectors []Selector
+	for i := 0; i < 2; i++ {
+		s, err := SharedRoundRobin(path)
+		h.RefuteError(t, err, "SharedRoundRobin")
+		selectors = append(selectors, s)
+	}
+	got := ""
+	for i := 0; i < 4; i++ {
+		got += selectors[i%2].Select(nil, members)[0]
+	}
+	h.AssertEqualString(t, "abca", got, "Selectors should share the rotation")
+
+	var mu sync.Mutex
+	tally := make(map[string]int)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(s Selector) {
+			defer wg.Done()
+			for member, n := range Tally(t, s, members, "", 30) {
+				mu.Lock()
+				tally[member] += n
+				mu.Unlock()
+			}
+		}(selectors[i%2])
+	}
+	wg.Wait()
+
+	h.AssertEqualInt(t, 100, tally["a"], "Uneven rotation for a")
+	h.AssertEqualInt(t, 100, tally["b"], "Uneven rotation for b")
+	h.AssertEqualInt(t, 100, tally["c"], "Uneven rotation for c")
+
+	_, err := SharedRoundRobin(filepath.Join(t.TempDir(), "missing", "rotation"))
+	h.Assert(t, err != nil, "Expected an error for a file that can't be made")
+}
+
+func TestConsistentHashIsStickyPerSubnet(t *testing.T) {
+	s := ConsistentHash(24, 56)
+	members := []string{"a", "b", "c"}
+	tally := Tally(t, s, members, "192.0.2.0/24", 50)
+	h.AssertEqualInt(t, 1, len(tally), "Same subnet should get the same member")
+
+	// Addresses in the same /24 hash the same
+	first := Tally(t, s, members, "198.51.100.7/32", 1)
+	second := Tally(t, s, members, "198.51.100.200/32", 1)
+	h.AssertEqualString(t, fmt.Sprint(first), fmt.Sprint(second), "Same /24 should get the same member")
+}
+
+func TestConsistentHashSetsScopeBits(t *testing.T) {
+	s := ConsistentHash(24, 56)
+	var scopes []int
+	d := dsl.New()
+	d.A(`.*`, func(c *dsl.Context) { s.Select(c, []string{"a"}); scopes = append(scopes, c.ScopeBits) })
+	for _, client := range []string{"192.0.2.1/32", "192.0.2.0/20", "2001:db8::/48", "2001:db8::1/128"} {
+		_, err := d.Lookup(&backend.Query{
+			ProtocolVersion: 3, QName: "example.com", QClass: "IN", QType: "A",
+			RemoteIpAddress: "127.0.0.1", EdnsSubnetAddress: client,
+		})
+		h.RefuteError(t, err, "Lookup")
+	}
+	h.AssertEqualString(t, "[24 20 48 56]", fmt.Sprint(scopes), "Bad scopes")
+}
+
+func TestConsistentHashDistributionAndStability(t *testing.T) {
+	s := ConsistentHash(24, 56)
+	all := []string{"a", "b", "c"}
+	without := []string{"a", "c"}
+
+	counts := make(map[string]int)
+	moved := 0
+	for i := 0; i < 3000; i++ {
+		client := fmt.Sprintf("10.%d.%d.0/24", i/256, i%256)
+		before := Tally(t, s, all, client, 1)
+		after := Tally(t, s, without, client, 1)
+		for member := range before {
+			counts[member]++
+			if member != "b" && after[member] != 1 {
+				moved++
+			}
+		}
+	}
+
+	for _, member := range all {
+		AssertBetween(t, 700, 1300, counts[member], "Uneven distribution for "+member)
+	}
+	h.AssertEqualInt(t, 0, moved, "Clients of healthy members should not move")
+}
@@ -0,0 +1,198 @@
+// Copyright 2015 Bytemark Computer Consulting Ltd. All rights reserved
+// Licensed under the GNU General Public License, version 2. See the LICENSE
+// file for more details
+
+// Reloads the routes of a running DSL without restarting the pipe process.
+// The routes are rebuilt from scratch by a function you supply, typically one
+// that reads zone files or a configuration file, and are swapped in with
+// dsl.DSL.Replace. If building or validating fails, the old routes are kept
+// and the error is logged. Usage:
+//
+//	x := dsl.New()
+//	r := reload.New(x, func() (*dsl.DSL, error) {
+//		return config.ParseFile("/etc/pdns/records.yaml", handlers)
+//	})
+//	if err := r.Reload(); err != nil {
+//		log.Fatal(err)
+//	}
+//	r.Watch("/etc/pdns/records.yaml")
+//	r.HandleSignals()
+//
+//	pipe := backend.New(os.Stdin, os.Stdout, "Example backend")
+//	r.Attach(pipe)
+//	pipe.OnCommand(x.RunCommand)
+//	err1 := pipe.Negotiate()
+//	err2 := pipe.Run(doit)
+//
+// Reloads are started by a change to a watched file, by SIGHUP, or by running
+// "pdns_control backend-cmd reload". Files are watched by polling their size
+// and modification time every Interval, so nothing beyond the standard library
+// is needed, and files that are replaced by renaming are handled too.
+package reload
+
+import (
+	"fmt"
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Rebuilds the routes of a DSL on demand
+type Reloader struct {
+	// The DSL whose routes are replaced
+	Target *dsl.DSL
+
+	// Builds the new routes
+	Build func() (*dsl.DSL, error)
+
+	// How often watched files are checked for changes. Defaults to 5 seconds.
+	Interval time.Duration
+
+	// Called with a message after each reload. If nil, messages are sent to
+	// PowerDNS as LOG lines through the attached backends, or to the
+	// standard logger if there aren't any.
+	Log func(msg string)
+
+	mu       sync.Mutex // Held while reloading
+	logMu    sync.Mutex
+	backends []*backend.Backend
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// Get a new reloader for the target DSL, and register a "reload" command on
+// it. The target isn't reloaded until something asks for it.
+func New(target *dsl.DSL, build func() (*dsl.DSL, error)) *Reloader {
+	r := &Reloader{
+		Target:   target,
+		Build:    build,
+		Interval: 5 * time.Second,
+		stop:     make(chan struct{}),
+	}
+
+	target.Command("reload", func(args []string) (string, error) {
+		if err := r.Reload(); err != nil {
+			return "", err
+		}
+		return "Reloaded", nil
+	})
+
+	return r
+}
+
+// Build new routes and swap them into the target. If that fails, the target
+// is left as it was. Either way, the outcome is logged.
+func (r *Reloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	other, err := r.Build()
+	if err == nil {
+		err = r.Target.Replace(other)
+	}
+
+	if err != nil {
+		r.log("Reload failed, keeping old routes: " + err.Error())
+		return err
+	}
+
+	r.log("Reloaded routes")
+	return nil
+}
+
+// Send log messages to PowerDNS through this backend. They go out with its
+// next answer.
+func (r *Reloader) Attach(b *backend.Backend) {
+	r.logMu.Lock()
+	defer r.logMu.Unlock()
+	r.backends = append(r.backends, b)
+}
+
+func (r *Reloader) log(msg string) {
+	if r.Log != nil {
+		r.Log(msg)
+		return
+	}
+
+	r.logMu.Lock()
+	defer r.logMu.Unlock()
+	if len(r.backends) == 0 {
+		log.Print(msg)
+		return
+	}
+	for _, b := range r.backends {
+		b.Log(msg)
+	}
+}
+
+// Reload in the background whenever any of the files changes, is created or is
+// removed, until Stop is called
+func (r *Reloader) Watch(files ...string) {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	last := statFiles(files)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ticker.C:
+			}
+
+			current := statFiles(files)
+			if current != last {
+				last = current
+				r.Reload()
+			}
+		}
+	}()
+}
+
+// Reload in the background whenever the process gets a SIGHUP, until Stop is
+// called
+func (r *Reloader) HandleSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(ch)
+		for {
+			select {
+			case <-r.stop:
+				return
+			case <-ch:
+				r.Reload()
+			}
+		}
+	}()
+}
+
+// Stop watching files and handling signals
+func (r *Reloader) Stop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+// A summary of the files' states, which changes when any of them does
+func statFiles(files []string) string {
+	state := ""
+	for _, file := range files {
+		fi, err := os.Stat(file)
+		if err != nil {
+			state += file + "\x00missing\x00"
+			continue
+		}
+		state += fmt.Sprintf("%s\x00%d\x00%d\x00", file, fi.Size(), fi.ModTime().UnixNano())
+	}
+	return state
+}
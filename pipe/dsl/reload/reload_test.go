@@ -0,0 +1,143 @@
+package reload_test
+
+import (
+	"bytes"
+	"errors"
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl/config"
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl/reload"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Config(addr string) string {
+	return "records:\n  - {name: www.example.com, type: A, content: " + addr + "}\n"
+}
+
+func WriteConfig(t *testing.T, path, content string) {
+	err := os.WriteFile(path, []byte(content), 0644)
+	h.RefuteError(t, err, "Writing config")
+}
+
+func AssertAnswer(t *testing.T, d *dsl.DSL, exp string) {
+	q := h.FakeQuery(3)
+	q.QType, q.QName = "A", "www.example.com"
+	rsp, err := d.Lookup(q)
+	h.RefuteError(t, err, "Lookup")
+	h.AssertEqualInt(t, 1, len(rsp), "Wrong number of answers")
+	h.AssertEqualString(t, exp, rsp[0].Content, "Wrong answer")
+}
+
+// Sets up a reloader building from a config file, with log messages sent to
+// the channel
+func ConfigReloader(t *testing.T, addr string) (*Reloader, *dsl.DSL, string, chan string) {
+	path := filepath.Join(t.TempDir(), "records.yaml")
+	WriteConfig(t, path, Config(addr))
+
+	d := dsl.New()
+	r := New(d, func() (*dsl.DSL, error) {
+		return config.ParseFile(path, nil)
+	})
+	logs := make(chan string, 10)
+	r.Log = func(msg string) { logs <- msg }
+
+	h.RefuteError(t, r.Reload(), "Initial reload")
+	h.AssertEqualString(t, "Reloaded routes", <-logs, "Wrong log message")
+	return r, d, path, logs
+}
+
+func Await(t *testing.T, logs chan string) string {
+	select {
+	case msg := <-logs:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for reload")
+	}
+	return ""
+}
+
+func TestWatchReloadsChangedFiles(t *testing.T) {
+	r, d, path, logs := ConfigReloader(t, "192.0.2.1")
+	defer r.Stop()
+	AssertAnswer(t, d, "192.0.2.1")
+
+	r.Interval = 10 * time.Millisecond
+	r.Watch(path)
+	WriteConfig(t, path, Config("192.0.2.100"))
+
+	h.AssertEqualString(t, "Reloaded routes", Await(t, logs), "Wrong log message")
+	AssertAnswer(t, d, "192.0.2.100")
+}
+
+func TestFailedReloadKeepsOldRoutes(t *testing.T) {
+	r, d, path, logs := ConfigReloader(t, "192.0.2.1")
+
+	WriteConfig(t, path, Config("not-an-address"))
+	err := r.Reload()
+	h.Assert(t, err != nil, "Expected an error")
+	msg := <-logs
+	h.Assert(t, strings.HasPrefix(msg, "Reload failed, keeping old routes: "+path+": line 2: "), "Wrong log message: "+msg)
+	AssertAnswer(t, d, "192.0.2.1")
+
+	// Routes that don't validate are rejected too
+	r.Build = func() (*dsl.DSL, error) {
+		other := dsl.New()
+		other.CNAME(`www\.example\.com`, func(c *dsl.Context) { c.Reply("example.com") })
+		other.A(`www\.example\.com`, func(c *dsl.Context) { c.Reply("192.0.2.2") })
+		return other, nil
+	}
+	h.Assert(t, r.Reload() != nil, "Expected a validation error")
+	<-logs
+	AssertAnswer(t, d, "192.0.2.1")
+}
+
+func TestReloadCommand(t *testing.T) {
+	_, d, path, logs := ConfigReloader(t, "192.0.2.1")
+
+	WriteConfig(t, path, Config("192.0.2.2"))
+	out, err := d.RunCommand(nil, "reload")
+	h.RefuteError(t, err, "Running reload")
+	h.AssertEqualString(t, "Reloaded", out, "Wrong output")
+	<-logs
+	AssertAnswer(t, d, "192.0.2.2")
+
+	WriteConfig(t, path, "bogus: true\n")
+	_, err = d.RunCommand(nil, "reload")
+	h.Assert(t, err != nil, "Expected an error")
+}
+
+func TestReloadOnSIGHUP(t *testing.T) {
+	r, d, path, logs := ConfigReloader(t, "192.0.2.1")
+	defer r.Stop()
+
+	r.HandleSignals()
+	WriteConfig(t, path, Config("192.0.2.3"))
+	h.RefuteError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP), "Sending SIGHUP")
+
+	h.AssertEqualString(t, "Reloaded routes", Await(t, logs), "Wrong log message")
+	AssertAnswer(t, d, "192.0.2.3")
+}
+
+func TestLogsGoToAttachedBackends(t *testing.T) {
+	rd := bytes.NewBufferString("HELO\t3\n")
+	w := &bytes.Buffer{}
+	b := backend.New(rd, w, "Testing")
+	h.RefuteError(t, b.Negotiate(), "Negotiating")
+	w.Reset()
+
+	r := New(dsl.New(), func() (*dsl.DSL, error) {
+		return nil, errors.New("No\nzones")
+	})
+	r.Attach(b)
+	r.Reload()
+
+	rd.WriteString("PING\n")
+	h.RefuteError(t, b.Run(h.EmptyDispatch), "Running backend")
+	h.AssertEqualString(t, "LOG\tReload failed, keeping old routes: No zones\nEND\n", w.String(), "Bad response")
+}
@@ -0,0 +1,43 @@
+package dsl
+
+// Replace the routes of this DSL with those of another, which is validated
+// first; if it isn't valid, nothing is changed and the error is returned.
+// Lookups in progress finish with the old routes, and later ones use the new.
+// This allows the routes to be rebuilt from scratch, from configuration files
+// and so on, while the DSL is serving queries.
+//
+// Everything registered against the other DSL is taken over: zones, views,
+// mounts, Before callbacks, and settings such as the default TTL and
+// Concurrent. The cache (which is emptied), Serials and any commands stay as
+// they were, so zone serials carry on from where they were. Only the DSL that
+// lookups start in can be replaced safely; mounted or view DSLs can't. The
+// other DSL shouldn't be used afterwards.
+func (d *DSL) Replace(other *DSL) error {
+	if err := other.Validate(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.callbacks = other.callbacks
+	d.names = other.names
+	d.qtypeSort = other.qtypeSort
+	d.defaultTTL = other.defaultTTL
+	d.concurrent = other.concurrent
+	d.chase = other.chase
+	d.zones = other.zones
+	d.mounts = other.mounts
+	d.views = other.views
+	d.locator = other.locator
+	d.dns64 = other.dns64
+	d.beforeCallback = other.beforeCallback
+
+	for _, z := range d.zones {
+		z.dsl = d
+	}
+	d.generation++
+
+	d.Purge("")
+	return nil
+}
@@ -0,0 +1,70 @@
+package dsl_test
+
+import (
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"sync"
+	"testing"
+)
+
+func TestReplaceSwapsRoutes(t *testing.T) {
+	d := New()
+	d.A(`.*`, ReplyHandler("192.0.2.1"))
+	d.Cache(CacheOptions{})
+	AssertAnswer(t, d, AQuery("www.example.com"), "192.0.2.1")
+
+	other := NewWithTTL(60)
+	other.Zone("example.com", func(z *Zone) {
+		z.SOA(SOA{MName: "ns1.example.com", RName: "hostmaster.example.com"})
+		z.NS("ns1.example.com")
+		z.A("www", ReplyHandler("192.0.2.2"))
+	})
+	h.RefuteError(t, d.Replace(other), "Replace")
+
+	// The cache is emptied, and the new routes are used
+	rsp := AssertLookup(t, d, AQuery("www.example.com"), 1, nil)
+	h.AssertEqualString(t, "192.0.2.2", rsp[0].Content, "New routes not used")
+	AssertLookup(t, d, AQuery("mail.example.com"), 0, nil)
+
+	// Zones registered before the swap now register against d
+	d.Zone("example.com", func(z *Zone) { z.A("mail", ReplyHandler("192.0.2.3")) })
+	AssertAnswer(t, d, AQuery("mail.example.com"), "192.0.2.3")
+}
+
+func TestReplaceRejectsInvalidRoutes(t *testing.T) {
+	d := New()
+	d.A(`.*`, ReplyHandler("192.0.2.1"))
+
+	other := New()
+	other.Zone("example.com", nil)
+	err := d.Replace(other)
+	h.AssertEqualString(t, "Zone example.com has no SOA record", err.Error(), "Wrong error")
+	AssertAnswer(t, d, AQuery("www.example.com"), "192.0.2.1")
+}
+
+func TestReplaceDuringLookups(t *testing.T) {
+	d := New()
+	d.A(`.*`, ReplyHandler("192.0.2.1"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				rsp, err := d.Lookup(AQuery("www.example.com"))
+				if err != nil || len(rsp) != 1 {
+					t.Error("Lookup failed during Replace")
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		other := New()
+		other.A(`.*`, ReplyHandler("192.0.2.2"))
+		h.RefuteError(t, d.Replace(other), "Replace")
+	}
+	wg.Wait()
+}
@@ -0,0 +1,180 @@
+package dsl
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Typed helpers for building the content of common record types. Each checks
+// that the callback is being run for the record type in question, validates
+// and canonicalises its arguments, then adds the answer with the default
+// QName and TTL, as Context.Reply does. If anything is wrong, Context.Error
+// is set instead, so no malformed content is sent to PowerDNS.
+//
+// Names are fully qualified. Since PowerDNS expects absolute names without a
+// trailing dot, one is removed if given; "@" is replaced by the zone apex in
+// callbacks registered against a zone.
+
+// Add an A answer. IPv4-mapped IPv6 addresses are accepted.
+func (c *Context) ReplyA(addr netip.Addr) {
+	addr = addr.Unmap()
+	if !addr.Is4() {
+		c.replyTyped("A", "", fmt.Errorf("Bad A address: %s", addr))
+		return
+	}
+	c.replyTyped("A", addr.String(), nil)
+}
+
+// Add an AAAA answer
+func (c *Context) ReplyAAAA(addr netip.Addr) {
+	if !addr.Is6() || addr.Is4In6() {
+		c.replyTyped("AAAA", "", fmt.Errorf("Bad AAAA address: %s", addr))
+		return
+	}
+	c.replyTyped("AAAA", addr.String(), nil)
+}
+
+// Add a CNAME answer
+func (c *Context) ReplyCNAME(target string) {
+	name, err := c.fqdn(target)
+	c.replyTyped("CNAME", name, err)
+}
+
+// Add an NS answer
+func (c *Context) ReplyNS(host string) {
+	name, err := c.fqdn(host)
+	c.replyTyped("NS", name, err)
+}
+
+// Add a PTR answer
+func (c *Context) ReplyPTR(host string) {
+	name, err := c.fqdn(host)
+	c.replyTyped("PTR", name, err)
+}
+
+// Add an MX answer. A host of "." makes a null MX (RFC 7505).
+func (c *Context) ReplyMX(pref uint16, host string) {
+	name, err := c.fqdn(host)
+	c.replyTyped("MX", fmt.Sprintf("%d %s", pref, name), err)
+}
+
+// Add an SRV answer. A target of "." means the service isn't available.
+func (c *Context) ReplySRV(priority, weight, port uint16, target string) {
+	name, err := c.fqdn(target)
+	c.replyTyped("SRV", fmt.Sprintf("%d %d %d %s", priority, weight, port, name), err)
+}
+
+// Add an SOA answer
+func (c *Context) ReplySOA(soa SOA) {
+	var err1, err2 error
+	soa.MName, err1 = c.fqdn(soa.MName)
+	soa.RName, err2 = c.fqdn(soa.RName)
+	if err1 == nil {
+		err1 = err2
+	}
+	c.replyTyped("SOA", soa.String(), err1)
+}
+
+// Add a TXT answer made up of one or more character strings. Strings longer
+// than 255 bytes are split up, as the wire format requires.
+func (c *Context) ReplyTXT(txt ...string) {
+	if len(txt) == 0 {
+		c.replyTyped("TXT", "", errors.New("TXT records need at least one string"))
+		return
+	}
+
+	quoted := make([]string, 0, len(txt))
+	for _, s := range txt {
+		for len(s) > 255 {
+			quoted = append(quoted, quote(s[:255]))
+			s = s[255:]
+		}
+		quoted = append(quoted, quote(s))
+	}
+	c.replyTyped("TXT", strings.Join(quoted, " "), nil)
+}
+
+// Add a CAA answer (RFC 8659). The tag is lower-cased.
+func (c *Context) ReplyCAA(flags uint8, tag, value string) {
+	tag = strings.ToLower(tag)
+	if !isCAATag(tag) {
+		c.replyTyped("CAA", "", fmt.Errorf("Bad CAA tag: %q", tag))
+		return
+	}
+	c.replyTyped("CAA", fmt.Sprintf("%d %s %s", flags, tag, quote(value)), nil)
+}
+
+// Checks the qtype and adds the answer, or sets Context.Error if anything has
+// gone wrong
+func (c *Context) replyTyped(qtype, content string, err error) {
+	if err == nil && c.QType != qtype {
+		err = fmt.Errorf("Can't reply with %s to %s query", qtype, c.QType)
+	}
+
+	if err != nil {
+		if c.Error == nil {
+			c.Error = err
+		}
+		return
+	}
+
+	c.Reply(content)
+}
+
+// Validates a name and gives it in the form PowerDNS expects
+func (c *Context) fqdn(name string) (string, error) {
+	if name == "@" {
+		if c.Zone == nil {
+			return "", errors.New("@ can only be used in zones")
+		}
+		return c.Zone.Name, nil
+	}
+	if name == "." {
+		return name, nil
+	}
+
+	name = canonical(name)
+	if name == "" || len(name) > 253 {
+		return "", fmt.Errorf("Bad name: %q", name)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || strings.ContainsAny(label, " \t\r\n\";()") {
+			return "", fmt.Errorf("Bad name: %q", name)
+		}
+	}
+	return name, nil
+}
+
+// Quotes a character string, escaping quotes and backslashes, and giving
+// non-printable bytes in \DDD form
+func quote(s string) string {
+	out := make([]byte, 0, len(s)+2)
+	out = append(out, '"')
+	for i := 0; i < len(s); i++ {
+		b := s[i]
+		switch {
+		case b == '"' || b == '\\':
+			out = append(out, '\\', b)
+		case b < ' ' || b > '~':
+			out = append(out, '\\')
+			out = append(out, fmt.Sprintf("%03d", b)...)
+		default:
+			out = append(out, b)
+		}
+	}
+	return string(append(out, '"'))
+}
+
+func isCAATag(tag string) bool {
+	if tag == "" || len(tag) > 15 {
+		return false
+	}
+	for _, r := range tag {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
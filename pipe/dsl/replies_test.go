@@ -0,0 +1,127 @@
+package dsl_test
+
+import (
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"net/netip"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Runs a callback for the given qtype and returns the single answer's content
+func AssertTypedReply(t *testing.T, qtype string, f Callback) string {
+	d := New()
+	d.Zone("example.com", func(z *Zone) { z.Register(qtype, z.Compile("@"), f) })
+	q := SOAQuery()
+	q.QType = qtype
+	rsp := AssertLookup(t, d, q, 1, nil)
+	h.AssertEqualString(t, qtype, rsp[0].QType, "Wrong qtype")
+	return rsp[0].Content
+}
+
+func AssertTypedReplyError(t *testing.T, qtype string, f Callback, msg string) {
+	d := New()
+	d.Register(qtype, regexp.MustCompile(`^example\.com$`), f)
+	q := SOAQuery()
+	q.QType = qtype
+	rsp, err := d.Lookup(q)
+	h.Assert(t, err != nil, "Expected an error")
+	h.AssertEqualString(t, msg, err.Error(), "Wrong error")
+	h.AssertEqualInt(t, 0, len(rsp), "No answers expected")
+}
+
+func TestReplyA(t *testing.T) {
+	h.AssertEqualString(t, "192.0.2.1", AssertTypedReply(t, "A", func(c *Context) {
+		c.ReplyA(netip.MustParseAddr("::ffff:192.0.2.1"))
+	}), "Bad A")
+	AssertTypedReplyError(t, "A", func(c *Context) {
+		c.ReplyA(netip.MustParseAddr("2001:db8::1"))
+	}, "Bad A address: 2001:db8::1")
+}
+
+func TestReplyAAAA(t *testing.T) {
+	h.AssertEqualString(t, "2001:db8::1", AssertTypedReply(t, "AAAA", func(c *Context) {
+		c.ReplyAAAA(netip.MustParseAddr("2001:DB8:0::1"))
+	}), "Bad AAAA")
+	AssertTypedReplyError(t, "AAAA", func(c *Context) {
+		c.ReplyAAAA(netip.MustParseAddr("192.0.2.1"))
+	}, "Bad AAAA address: 192.0.2.1")
+}
+
+func TestReplyChecksQType(t *testing.T) {
+	AssertTypedReplyError(t, "AAAA", func(c *Context) {
+		c.ReplyA(netip.MustParseAddr("192.0.2.1"))
+	}, "Can't reply with A to AAAA query")
+}
+
+func TestReplyNamesAreQualified(t *testing.T) {
+	h.AssertEqualString(t, "web.example.com", AssertTypedReply(t, "CNAME", func(c *Context) {
+		c.ReplyCNAME("Web.Example.com.")
+	}), "Bad CNAME")
+	h.AssertEqualString(t, "example.com", AssertTypedReply(t, "NS", func(c *Context) {
+		c.ReplyNS("@")
+	}), "Bad NS")
+	h.AssertEqualString(t, "host.example.com", AssertTypedReply(t, "PTR", func(c *Context) {
+		c.ReplyPTR("host.example.com")
+	}), "Bad PTR")
+
+	AssertTypedReplyError(t, "CNAME", func(c *Context) { c.ReplyCNAME("@") }, "@ can only be used in zones")
+	AssertTypedReplyError(t, "CNAME", func(c *Context) { c.ReplyCNAME("a..b") }, `Bad name: "a..b"`)
+	AssertTypedReplyError(t, "CNAME", func(c *Context) {
+		c.ReplyCNAME(strings.Repeat("a", 64) + ".com")
+	}, `Bad name: "`+strings.Repeat("a", 64)+`.com"`)
+}
+
+func TestReplyMXAndSRV(t *testing.T) {
+	h.AssertEqualString(t, "10 mail.example.com", AssertTypedReply(t, "MX", func(c *Context) {
+		c.ReplyMX(10, "mail.example.com.")
+	}), "Bad MX")
+	h.AssertEqualString(t, "0 .", AssertTypedReply(t, "MX", func(c *Context) {
+		c.ReplyMX(0, ".")
+	}), "Bad null MX")
+	h.AssertEqualString(t, "10 20 5060 sip.example.com", AssertTypedReply(t, "SRV", func(c *Context) {
+		c.ReplySRV(10, 20, 5060, "sip.example.com")
+	}), "Bad SRV")
+}
+
+func TestReplySOA(t *testing.T) {
+	soa := ExampleSOA
+	soa.MName = "NS1.example.com."
+	h.AssertEqualString(t, ExampleSOA.String(), AssertTypedReply(t, "SOA", func(c *Context) {
+		c.ReplySOA(soa)
+	}), "Bad SOA")
+}
+
+func TestReplyTXT(t *testing.T) {
+	h.AssertEqualString(t, `"v=spf1 -all"`, AssertTypedReply(t, "TXT", func(c *Context) {
+		c.ReplyTXT("v=spf1 -all")
+	}), "Bad TXT")
+	h.AssertEqualString(t, `"say \"hi\"" "back\\slash" "tab\009"`, AssertTypedReply(t, "TXT", func(c *Context) {
+		c.ReplyTXT(`say "hi"`, `back\slash`, "tab\t")
+	}), "Bad escaping")
+
+	long := strings.Repeat("a", 300)
+	exp := `"` + strings.Repeat("a", 255) + `" "` + strings.Repeat("a", 45) + `"`
+	h.AssertEqualString(t, exp, AssertTypedReply(t, "TXT", func(c *Context) {
+		c.ReplyTXT(long)
+	}), "Long string not split")
+
+	AssertTypedReplyError(t, "TXT", func(c *Context) { c.ReplyTXT() }, "TXT records need at least one string")
+}
+
+func TestReplyCAA(t *testing.T) {
+	h.AssertEqualString(t, `0 issue "letsencrypt.org"`, AssertTypedReply(t, "CAA", func(c *Context) {
+		c.ReplyCAA(0, "Issue", "letsencrypt.org")
+	}), "Bad CAA")
+	AssertTypedReplyError(t, "CAA", func(c *Context) {
+		c.ReplyCAA(0, "is-sue", "letsencrypt.org")
+	}, `Bad CAA tag: "is-sue"`)
+}
+
+func TestTypedReplyErrorDoesNotOverwriteEarlierError(t *testing.T) {
+	AssertTypedReplyError(t, "A", func(c *Context) {
+		c.Error = ErrorReplyError
+		c.ReplyA(netip.Addr{})
+	}, ErrorReplyError.Error())
+}
@@ -0,0 +1,155 @@
+package dsl
+
+import (
+	"fmt"
+	"net/netip"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Parses a full in-addr.arpa or ip6.arpa name (with 4 octets or 32 nibbles)
+// into the address it represents. Names of reverse zones, rather than single
+// addresses, are rejected.
+func ParseReverseName(qname string) (netip.Addr, error) {
+	name := strings.ToLower(canonical(qname))
+	bad := fmt.Errorf("Not a full reverse name: %q", qname)
+
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(labels) != 4 {
+			return netip.Addr{}, bad
+		}
+
+		var octets [4]byte
+		for i, label := range labels {
+			n, err := strconv.ParseUint(label, 10, 8)
+			if err != nil || (len(label) > 1 && label[0] == '0') {
+				return netip.Addr{}, bad
+			}
+			octets[3-i] = byte(n)
+		}
+		return netip.AddrFrom4(octets), nil
+
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		labels := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(labels) != 32 {
+			return netip.Addr{}, bad
+		}
+
+		var bytes [16]byte
+		for i, label := range labels {
+			n, err := strconv.ParseUint(label, 16, 8)
+			if err != nil || len(label) != 1 {
+				return netip.Addr{}, bad
+			}
+			pos := 31 - i
+			bytes[pos/2] |= byte(n) << (4 * uint(1-pos%2))
+		}
+		return netip.AddrFrom16(bytes), nil
+	}
+
+	return netip.Addr{}, bad
+}
+
+// Builds the matcher for reverse names of addresses in the prefix. Only the
+// labels wholly within the prefix are fixed; the callback checks the rest.
+func reverseMatcher(prefix netip.Prefix) *regexp.Regexp {
+	addr := prefix.Addr()
+	var fixed []string
+	var free, suffix string
+
+	if addr.Is4() {
+		octets := addr.As4()
+		n := prefix.Bits() / 8
+		for i := n - 1; i >= 0; i-- {
+			fixed = append(fixed, strconv.Itoa(int(octets[i])))
+		}
+		free = fmt.Sprintf(`(?:\d{1,3}\.){%d}`, 4-n)
+		suffix = "in-addr.arpa"
+	} else {
+		bytes := addr.As16()
+		n := prefix.Bits() / 4
+		for i := n - 1; i >= 0; i-- {
+			nibble := bytes[i/2] >> (4 * uint(1-i%2)) & 0xf
+			fixed = append(fixed, strconv.FormatUint(uint64(nibble), 16))
+		}
+		free = fmt.Sprintf(`(?:[0-9a-f]\.){%d}`, 32-n)
+		suffix = "ip6.arpa"
+	}
+
+	fixed = append(fixed, suffix)
+	return regexp.MustCompile("^(?i)" + free + regexp.QuoteMeta(strings.Join(fixed, ".")) + "$")
+}
+
+// Gives an address in the form used in generated names: dots or colons are
+// replaced by dashes, so 192.0.2.10 becomes 192-0-2-10 and 2001:db8::1 becomes
+// 2001-db8--1
+func dashed(addr netip.Addr) string {
+	return strings.NewReplacer(".", "-", ":", "-").Replace(addr.String())
+}
+
+func checkTemplate(template string) {
+	if strings.Count(template, "%s") != 1 {
+		panic(fmt.Sprintf("Reverse template must contain %%s exactly once: %q", template))
+	}
+}
+
+// Register PTR answers for every address in the prefix. The name for each is
+// made by putting the address, with dashes in place of dots or colons, in
+// place of the %s in the template. For instance:
+//
+//	x.Reverse(netip.MustParsePrefix("192.0.2.0/24"), "ip-%s.example.com")
+//
+// answers 10.2.0.192.in-addr.arpa with ip-192-0-2-10.example.com, and:
+//
+//	x.Reverse(netip.MustParsePrefix("2001:db8::/48"), "ip-%s.example.com")
+//
+// answers the ip6.arpa name for 2001:db8::1 with ip-2001-db8--1.example.com.
+// Prefixes needn't end on a label boundary. Use DSL.Forward to make the names
+// resolve back to the addresses.
+func (d *DSL) Reverse(prefix netip.Prefix, template string) {
+	checkTemplate(template)
+	prefix = prefix.Masked()
+
+	d.Register("PTR", reverseMatcher(prefix), func(c *Context) {
+		addr, err := ParseReverseName(c.Query.QName)
+		if err != nil || !prefix.Contains(addr) {
+			return
+		}
+		c.ReplyPTR(fmt.Sprintf(template, dashed(addr)))
+	})
+}
+
+// Register A (for an IPv4 prefix) or AAAA (for IPv6) answers for the names
+// generated by DSL.Reverse with the same prefix and template, so they are
+// forward-confirmed. Only the exact names generated are answered.
+func (d *DSL) Forward(prefix netip.Prefix, template string) {
+	checkTemplate(template)
+	prefix = prefix.Masked()
+
+	parts := strings.SplitN(canonical(template), "%s", 2)
+	re := regexp.MustCompile(
+		"^(?i)" + regexp.QuoteMeta(parts[0]) + "([0-9a-f-]+)" + regexp.QuoteMeta(parts[1]) + "$",
+	)
+
+	qtype, sep := "AAAA", ":"
+	if prefix.Addr().Is4() {
+		qtype, sep = "A", "."
+	}
+
+	d.Register(qtype, re, func(c *Context) {
+		name := strings.ToLower(c.Matches[0])
+		addr, err := netip.ParseAddr(strings.Replace(name, "-", sep, -1))
+		if err != nil || !prefix.Contains(addr) || dashed(addr) != name {
+			return
+		}
+
+		if addr.Is4() {
+			c.ReplyA(addr)
+		} else {
+			c.ReplyAAAA(addr)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package dsl_test
+
+import (
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"net/netip"
+	"testing"
+)
+
+const v6Name = "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"
+
+func ReverseDSL() *DSL {
+	d := New()
+	for _, prefix := range []string{"192.0.2.0/25", "2001:db8::/48"} {
+		d.Reverse(netip.MustParsePrefix(prefix), "ip-%s.example.com")
+		d.Forward(netip.MustParsePrefix(prefix), "ip-%s.example.com")
+	}
+	return d
+}
+
+func TypedQuery(qtype, qname string) *backend.Query {
+	q := AQuery(qname)
+	q.QType = qtype
+	return q
+}
+
+func AssertAnswer(t *testing.T, d *DSL, q *backend.Query, content string) {
+	if content == "" {
+		AssertLookup(t, d, q, 0, nil)
+		return
+	}
+	rsp := AssertLookup(t, d, q, 1, nil)
+	h.AssertEqualString(t, content, rsp[0].Content, "Wrong answer for "+q.QName)
+}
+
+func TestParseReverseName(t *testing.T) {
+	for name, exp := range map[string]string{
+		"10.2.0.192.in-addr.arpa":  "192.0.2.10",
+		"10.2.0.192.IN-ADDR.ARPA.": "192.0.2.10",
+		v6Name:                     "2001:db8::1",
+	} {
+		addr, err := ParseReverseName(name)
+		h.RefuteError(t, err, name)
+		h.AssertEqualString(t, exp, addr.String(), "Bad address for "+name)
+	}
+
+	for _, name := range []string{
+		"2.0.192.in-addr.arpa", "256.2.0.192.in-addr.arpa", "01.2.0.192.in-addr.arpa",
+		"0.1.2.0.192.in-addr.arpa", "8.b.d.0.1.0.0.2.ip6.arpa", "g" + v6Name[1:],
+		"10.2.0.192.example.com",
+	} {
+		_, err := ParseReverseName(name)
+		h.Assert(t, err != nil, "Should reject "+name)
+	}
+}
+
+func TestReverseAnswersPTR(t *testing.T) {
+	d := ReverseDSL()
+	AssertAnswer(t, d, TypedQuery("PTR", "10.2.0.192.in-addr.arpa"), "ip-192-0-2-10.example.com")
+	AssertAnswer(t, d, TypedQuery("PTR", v6Name), "ip-2001-db8--1.example.com")
+
+	// Outside the /25, and partial names
+	AssertAnswer(t, d, TypedQuery("PTR", "200.2.0.192.in-addr.arpa"), "")
+	AssertAnswer(t, d, TypedQuery("PTR", "2.0.192.in-addr.arpa"), "")
+	AssertAnswer(t, d, TypedQuery("PTR", "10.3.0.192.in-addr.arpa"), "")
+}
+
+func TestForwardConfirmsGeneratedNames(t *testing.T) {
+	d := ReverseDSL()
+	AssertAnswer(t, d, TypedQuery("A", "ip-192-0-2-10.example.com"), "192.0.2.10")
+	AssertAnswer(t, d, TypedQuery("A", "IP-192-0-2-10.example.com"), "192.0.2.10")
+	AssertAnswer(t, d, TypedQuery("AAAA", "ip-2001-db8--1.example.com"), "2001:db8::1")
+
+	// Not in the prefix, the wrong type, or not the canonical name
+	AssertAnswer(t, d, TypedQuery("A", "ip-192-0-2-200.example.com"), "")
+	AssertAnswer(t, d, TypedQuery("AAAA", "ip-192-0-2-10.example.com"), "")
+	AssertAnswer(t, d, TypedQuery("A", "ip-192-0-2-010.example.com"), "")
+	AssertAnswer(t, d, TypedQuery("AAAA", "ip-2001-0db8--1.example.com"), "")
+	AssertAnswer(t, d, TypedQuery("AAAA", "ip-2001-db9--1.example.com"), "")
+}
+
+func TestReverseTemplateMustHavePlaceholder(t *testing.T) {
+	defer func() {
+		h.Assert(t, recover() != nil, "Bad template should panic")
+	}()
+	New().Reverse(netip.MustParsePrefix("192.0.2.0/24"), "example.com")
+}
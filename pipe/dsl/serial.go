@@ -0,0 +1,355 @@
+package dsl
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How Serials picks a new serial for a zone whose data has changed. Whatever
+// the scheme, a new serial is always greater than the last one.
+type SerialScheme int
+
+const (
+	// YYYYMMDDnn: the date of the change (in UTC), followed by a count of
+	// the changes made that day. After 99 changes in a day, the serial
+	// carries on counting into the next day's range.
+	SerialDate SerialScheme = iota
+
+	// The time of the change, in seconds since the Unix epoch
+	SerialUnix
+
+	// One more than the last serial
+	SerialCounter
+)
+
+// Generates the serials of zone SOA records, changing them whenever the data
+// of the zone changes, so that secondaries know when to transfer it again.
+// Usage:
+//
+//	serials, err := dsl.NewSerials(dsl.SerialDate, "/var/lib/pdns-pipe/serials.json")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	x.AutoSerial(serials)
+//
+// The data of a zone is what DSL.Contents gives for it: the SOA and NS
+// settings, static records, and the list of dynamic routes. A change to what a
+// dynamic route answers can't be noticed, so call Touch when you know of one.
+//
+// Serials are kept, with a hash of the data they were issued for, in a state
+// file, so that they aren't repeated after a restart. PowerDNS runs several
+// pipe processes, so the file is shared: it is read again whenever another
+// process has changed it, and locked while a new serial is picked, so every
+// process serving the same data gives the same serial. A zone served by
+// several views (see DSL.AddView) has serials of its own in each, kept apart
+// by the view's name; the Routes of each view need AutoSerial too. Use a
+// separate state file for each set of zones.
+//
+// If the state file can't be read or written, serials are still served, from
+// what the process knows, and the error is logged.
+type Serials struct {
+	// How new serials are picked
+	Scheme SerialScheme
+
+	// Called with a message when the state file can't be read or written.
+	// If nil, messages go to the standard logger.
+	Log func(msg string)
+
+	path    string
+	mu      sync.Mutex
+	zones   map[string]*serialState // by view and zone; see serialKey
+	touched map[string]bool
+
+	// The state file as it was when last read or written, to tell whether
+	// another process has changed it since
+	loaded os.FileInfo
+}
+
+type serialState struct {
+	Serial uint32 `json:"serial"`
+	Hash   string `json:"hash"`
+}
+
+// Get serials using the given scheme, kept in the state file at path, which is
+// read now if it exists. If the path is blank, serials aren't kept anywhere.
+func NewSerials(scheme SerialScheme, path string) (*Serials, error) {
+	s := &Serials{
+		Scheme:  scheme,
+		path:    path,
+		zones:   make(map[string]*serialState),
+		touched: make(map[string]bool),
+	}
+	if path == "" {
+		return s, nil
+	}
+
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Zones are kept by name, or by view and name for those served by a view
+func serialKey(view, zone string) string {
+	if view == "" {
+		return zone
+	}
+	return view + " " + zone
+}
+
+// Checks whether a key is for the zone, in any view
+func keyFor(key, zone string) bool {
+	return key == zone || strings.HasSuffix(key, " "+zone)
+}
+
+// Serve the SOA records of zones with serials from s, in place of the serial
+// given to Zone.SOA. That serial is still used as a floor, so switching to
+// automatic serials never makes them go backwards.
+func (d *DSL) AutoSerial(s *Serials) {
+	d.serials = s
+}
+
+// Give the zone a new serial, in every view, even if its data doesn't seem to
+// have changed. This is written to the state file straight away, so other
+// processes sharing it give the new serial too. Answers that have already been
+// cached (see DSL.Cache) aren't affected until they expire or are purged.
+func (s *Serials) Touch(zone string) {
+	zone = canonical(zone)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Zones not in the state file get a new serial the first time anyway
+	changed := false
+	err := s.locked(func() bool {
+		for key, st := range s.zones {
+			if keyFor(key, zone) {
+				st.Serial = s.next(st.Serial)
+				changed = true
+			}
+		}
+		return changed
+	})
+	if err != nil {
+		// Not saved, so at least this process gives a new serial
+		for key := range s.zones {
+			if keyFor(key, zone) {
+				s.touched[key] = true
+			}
+		}
+		s.log(err)
+	}
+}
+
+// Returns the serial of a zone whose data has the given hash, picking a new
+// one if the data has changed. The state file is only locked and read if it
+// or the data has changed since the serial was last worked out. If the state
+// file can't be read or written, the serial is still returned, along with the
+// error.
+func (s *Serials) update(key, hash string, floor uint32) (uint32, error) {
+	current := func() (uint32, bool) {
+		st, ok := s.zones[key]
+		if ok && st.Hash == hash && !s.touched[key] && st.Serial >= floor {
+			return st.Serial, true
+		}
+		return 0, false
+	}
+	if serial, ok := current(); ok && s.unchanged() {
+		return serial, nil
+	}
+
+	var serial uint32
+	err := s.locked(func() bool {
+		var ok bool
+		if serial, ok = current(); ok {
+			return false
+		}
+
+		last := floor
+		if st, ok := s.zones[key]; ok && st.Serial > last {
+			last = st.Serial
+		}
+		serial = s.next(last)
+
+		s.zones[key] = &serialState{Serial: serial, Hash: hash}
+		delete(s.touched, key)
+		return true
+	})
+	return serial, err
+}
+
+// Checks whether the state file is still the one last read or written. It is
+// only ever replaced whole, by a rename, so a different file means a change.
+func (s *Serials) unchanged() bool {
+	if s.path == "" {
+		return true
+	}
+	fi, err := os.Stat(s.path)
+	return err == nil && s.loaded != nil && os.SameFile(fi, s.loaded) &&
+		fi.Size() == s.loaded.Size() && fi.ModTime().Equal(s.loaded.ModTime())
+}
+
+// Runs f with the state file locked and freshly read, and writes the file
+// again if f returns true. If the file can't be locked or read, f is still
+// run, against the state the process last knew, but nothing is written.
+func (s *Serials) locked(f func() bool) error {
+	if s.path == "" {
+		f()
+		return nil
+	}
+
+	lock, err := os.OpenFile(s.path+".lock", os.O_RDWR|os.O_CREATE, 0644)
+	if err == nil {
+		defer lock.Close()
+		err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX)
+	}
+	if err == nil && !s.unchanged() {
+		err = s.load()
+	}
+
+	changed := f()
+	if err != nil {
+		return err
+	}
+	if changed {
+		return s.save()
+	}
+	return nil
+}
+
+// Reads the state file, if it exists
+func (s *Serials) load() error {
+	f, err := os.Open(s.path)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	zones := make(map[string]*serialState)
+	if err := json.Unmarshal(data, &zones); err != nil {
+		return fmt.Errorf("%s: %s", s.path, err)
+	}
+	if zones != nil {
+		s.zones = zones
+	}
+	s.loaded = fi
+	return nil
+}
+
+func (s *Serials) log(err error) {
+	msg := "Zone serials: " + err.Error()
+	if s.Log != nil {
+		s.Log(msg)
+		return
+	}
+	log.Print(msg)
+}
+
+func (s *Serials) next(last uint32) uint32 {
+	now := time.Now().UTC()
+
+	var serial uint32
+	switch s.Scheme {
+	case SerialDate:
+		year, month, day := now.Date()
+		serial = uint32(year*1000000 + int(month)*10000 + day*100)
+	case SerialUnix:
+		serial = uint32(now.Unix())
+	}
+
+	if serial > last {
+		return serial
+	}
+	return last + 1
+}
+
+// Writes the state file, replacing the old one in a single step so that it
+// is never left half-written
+func (s *Serials) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.zones, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	fi, err := os.Stat(tmp)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.loaded = fi
+	return nil
+}
+
+// The SOA settings of the zone, as served in the view (which is "" outside
+// views), with the serial replaced by one from the DSL's Serials, if it has any
+func (z *Zone) currentSOA(view string) SOA {
+	soa := *z.soa
+	if z.dsl.serials != nil {
+		soa.Serial = z.dsl.serialFor(z, view)
+	}
+	return soa
+}
+
+// Works out the serial of the zone. The zone's data is only hashed again if
+// routes have been registered or replaced since the last time. Problems with
+// the state file are logged rather than failing the query.
+func (d *DSL) serialFor(z *Zone, view string) uint32 {
+	s := d.serials
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if z.hashAt != d.generation || z.hash == "" {
+		z.hash, z.hashAt = d.hashZone(z), d.generation
+	}
+
+	serial, err := s.update(serialKey(view, z.Name), z.hash, z.soa.Serial)
+	if err != nil {
+		s.log(err)
+	}
+	return serial
+}
+
+// Hashes the enumerable data of the zone
+func (d *DSL) hashZone(z *Zone) string {
+	zc, _ := d.zoneContents(z.Name)
+
+	h := sha256.New()
+	for _, r := range zc.Records {
+		fmt.Fprintf(h, "%s\t%d\t%s\t%s\n", r.Name, *r.TTL, r.Type, r.Content)
+	}
+	for _, desc := range zc.Dynamic {
+		fmt.Fprintf(h, "%s\n", desc)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,211 @@
+package dsl_test
+
+import (
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func SerialDSL(serial uint32, addrs ...string) *DSL {
+	d := New()
+	d.Zone("example.com", func(z *Zone) {
+		z.SOA(SOA{MName: "ns1.example.com", RName: "hostmaster.example.com", Serial: serial, Refresh: 2, Retry: 3, Expire: 4, Minimum: 5})
+		z.NS("ns1.example.com")
+		for _, addr := range addrs {
+			z.Static(Record{Name: "www", Type: "A", Content: addr})
+		}
+	})
+	return d
+}
+
+func SerialOf(t *testing.T, d *DSL) uint32 {
+	rsp := AssertLookup(t, d, TypedQuery("SOA", "example.com"), 1, nil)
+	n, err := strconv.ParseUint(strings.Fields(rsp[0].Content)[2], 10, 32)
+	h.RefuteError(t, err, "Parsing serial")
+	return uint32(n)
+}
+
+func TestCounterSerials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "serials.json")
+	s, err := NewSerials(SerialCounter, path)
+	h.RefuteError(t, err, "NewSerials")
+
+	d := SerialDSL(5, "192.0.2.1")
+	d.AutoSerial(s)
+	h.AssertEqualInt(t, 6, int(SerialOf(t, d)), "Serial should start above the configured one")
+	h.AssertEqualInt(t, 6, int(SerialOf(t, d)), "Serial changed without a data change")
+
+	h.RefuteError(t, d.Replace(SerialDSL(5, "192.0.2.1", "192.0.2.2")), "Replace")
+	h.AssertEqualInt(t, 7, int(SerialOf(t, d)), "Serial should change with the data")
+	h.RefuteError(t, d.Replace(SerialDSL(5, "192.0.2.1", "192.0.2.2")), "Replace")
+	h.AssertEqualInt(t, 7, int(SerialOf(t, d)), "Serial changed by reloading the same data")
+
+	s.Touch("Example.com.")
+	h.AssertEqualInt(t, 8, int(SerialOf(t, d)), "Serial should change when touched")
+
+	// A restart carries on from the state file
+	s, err = NewSerials(SerialCounter, path)
+	h.RefuteError(t, err, "NewSerials")
+	d = SerialDSL(5, "192.0.2.1", "192.0.2.2")
+	d.AutoSerial(s)
+	h.AssertEqualInt(t, 8, int(SerialOf(t, d)), "Serial should survive a restart")
+
+	d = SerialDSL(5, "192.0.2.1")
+	d.AutoSerial(s)
+	h.AssertEqualInt(t, 9, int(SerialOf(t, d)), "Serial should change after a restart with new data")
+
+	// The configured serial is a floor
+	d = SerialDSL(100, "192.0.2.1")
+	d.AutoSerial(s)
+	h.AssertEqualInt(t, 101, int(SerialOf(t, d)), "Serial should not go below the configured one")
+}
+
+func TestDateSerials(t *testing.T) {
+	s, err := NewSerials(SerialDate, "")
+	h.RefuteError(t, err, "NewSerials")
+
+	today, err := strconv.ParseUint(time.Now().UTC().Format("20060102")+"00", 10, 32)
+	h.RefuteError(t, err, "Parsing date")
+
+	d := SerialDSL(1, "192.0.2.1")
+	d.AutoSerial(s)
+	h.AssertEqualInt(t, int(today), int(SerialOf(t, d)), "Wrong first serial")
+
+	h.RefuteError(t, d.Replace(SerialDSL(1, "192.0.2.2")), "Replace")
+	h.AssertEqualInt(t, int(today)+1, int(SerialOf(t, d)), "Wrong second serial")
+
+	d = SerialDSL(4000000000, "192.0.2.1")
+	d.AutoSerial(s)
+	h.AssertEqualInt(t, 4000000001, int(SerialOf(t, d)), "Serial should not go below the configured one")
+}
+
+func TestUnixSerials(t *testing.T) {
+	s, err := NewSerials(SerialUnix, "")
+	h.RefuteError(t, err, "NewSerials")
+
+	before := time.Now().Unix()
+	d := SerialDSL(1, "192.0.2.1")
+	d.AutoSerial(s)
+	serial := int64(SerialOf(t, d))
+	h.Assert(t, serial >= before && serial <= time.Now().Unix(), "Serial should be the time")
+}
+
+func TestSerialsInContents(t *testing.T) {
+	s, _ := NewSerials(SerialCounter, "")
+	d := SerialDSL(41, "192.0.2.1")
+	d.AutoSerial(s)
+
+	zc, err := d.Contents("example.com")
+	h.RefuteError(t, err, "Contents")
+	h.AssertEqualString(t, "ns1.example.com hostmaster.example.com 42 2 3 4 5", zc.Records[0].Content, "Wrong SOA")
+	h.AssertEqualInt(t, 42, int(SerialOf(t, d)), "Wrong serial")
+}
+
+func TestBadSerialsStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "serials.json")
+	h.RefuteError(t, os.WriteFile(path, []byte("{bogus"), 0644), "Writing state file")
+
+	_, err := NewSerials(SerialCounter, path)
+	h.Assert(t, err != nil && strings.HasPrefix(err.Error(), path+": "), "Expected an error naming the file")
+
+	// Serials that can't be saved are still served, and the error is logged
+	s, err := NewSerials(SerialCounter, filepath.Join(t.TempDir(), "missing", "serials.json"))
+	h.RefuteError(t, err, "NewSerials")
+	logged := []string{}
+	s.Log = func(msg string) { logged = append(logged, msg) }
+	d := SerialDSL(1, "192.0.2.1")
+	d.AutoSerial(s)
+	h.AssertEqualInt(t, 2, int(SerialOf(t, d)), "Serial should still be served")
+	h.AssertEqualInt(t, 2, int(SerialOf(t, d)), "Serial shouldn't change")
+	h.Assert(t, len(logged) > 0 && strings.HasPrefix(logged[0], "Zone serials: "), "Expected the error to be logged")
+
+	_, err = d.Contents("example.com")
+	h.RefuteError(t, err, "Contents")
+}
+
+func TestSerialsSharedBetweenProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "serials.json")
+	s1, err := NewSerials(SerialCounter, path)
+	h.RefuteError(t, err, "NewSerials")
+	s2, err := NewSerials(SerialCounter, path)
+	h.RefuteError(t, err, "NewSerials")
+
+	d1, d2 := SerialDSL(1, "192.0.2.1"), SerialDSL(1, "192.0.2.1")
+	d1.AutoSerial(s1)
+	d2.AutoSerial(s2)
+	h.AssertEqualInt(t, 2, int(SerialOf(t, d1)), "Wrong first serial")
+	h.AssertEqualInt(t, 2, int(SerialOf(t, d2)), "Same data should give the same serial")
+
+	// A change seen by one is picked up by the other
+	h.RefuteError(t, d1.Replace(SerialDSL(1, "192.0.2.2")), "Replace")
+	h.RefuteError(t, d2.Replace(SerialDSL(1, "192.0.2.2")), "Replace")
+	h.AssertEqualInt(t, 3, int(SerialOf(t, d2)), "Wrong serial after a change")
+	h.AssertEqualInt(t, 3, int(SerialOf(t, d1)), "Same data should give the same serial")
+
+	s1.Touch("example.com")
+	h.AssertEqualInt(t, 4, int(SerialOf(t, d2)), "Touch should be seen by the other")
+	h.AssertEqualInt(t, 4, int(SerialOf(t, d1)), "Wrong serial after Touch")
+}
+
+func TestSerialsAreKeptApartByView(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "serials.json")
+	s, err := NewSerials(SerialCounter, path)
+	h.RefuteError(t, err, "NewSerials")
+
+	d, office := SerialDSL(1, "192.0.2.1"), SerialDSL(1, "10.0.0.1")
+	d.AutoSerial(s)
+	office.AutoSerial(s)
+	d.AddView(&View{Name: "office", Sources: Prefixes("10.0.0.0/8"), Routes: office})
+
+	serialIn := func(remote string) int {
+		q := TypedQuery("SOA", "example.com")
+		q.RemoteIpAddress = remote
+		rsp := AssertLookup(t, d, q, 1, nil)
+		n, err := strconv.Atoi(strings.Fields(rsp[0].Content)[2])
+		h.RefuteError(t, err, "Parsing serial")
+		return n
+	}
+
+	// Each view's data keeps its own serial, however queries alternate
+	for i := 0; i < 3; i++ {
+		h.AssertEqualInt(t, 2, serialIn("192.0.2.1"), "Wrong serial outside the view")
+		h.AssertEqualInt(t, 2, serialIn("10.0.0.1"), "Wrong serial in the view")
+	}
+	zc, err := office.Contents("example.com")
+	h.RefuteError(t, err, "Contents")
+	h.AssertEqualString(t, "ns1.example.com hostmaster.example.com 2 2 3 4 5", zc.Records[0].Content, "Wrong SOA in the view")
+
+	s.Touch("example.com")
+	h.AssertEqualInt(t, 3, serialIn("192.0.2.1"), "Touch should give a new serial outside the view")
+	h.AssertEqualInt(t, 3, serialIn("10.0.0.1"), "Touch should give a new serial in the view")
+}
+
+func TestUnchangedStateFileIsntReadAgain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "serials.json")
+	s, err := NewSerials(SerialCounter, path)
+	h.RefuteError(t, err, "NewSerials")
+	logged := []string{}
+	s.Log = func(msg string) { logged = append(logged, msg) }
+	d := SerialDSL(1, "192.0.2.1")
+	d.AutoSerial(s)
+	h.AssertEqualInt(t, 2, int(SerialOf(t, d)), "Wrong serial")
+
+	// Spoil the file in place, keeping its size and time, so it only looks
+	// unchanged; reading it again would fail
+	fi, err := os.Stat(path)
+	h.RefuteError(t, err, "Stat")
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	h.RefuteError(t, err, "OpenFile")
+	_, err = f.Write([]byte("{bogus"))
+	h.RefuteError(t, err, "Write")
+	h.RefuteError(t, f.Close(), "Close")
+	h.RefuteError(t, os.Chtimes(path, fi.ModTime(), fi.ModTime()), "Chtimes")
+
+	h.AssertEqualInt(t, 2, int(SerialOf(t, d)), "Wrong serial")
+	h.AssertEqualInt(t, 0, len(logged), "State file shouldn't have been read again")
+}
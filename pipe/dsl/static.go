@@ -0,0 +1,118 @@
+package dsl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A record with fixed content, as registered by DSL.Static
+type Record struct {
+	// The owner name. This may begin with "*." to make a wildcard.
+	Name string
+
+	Type string
+
+	// The TTL to serve the record with (see TTL). If nil, the default TTL
+	// of the DSL (or zone) is used.
+	TTL *int
+
+	// The content, in the form PowerDNS expects; for instance, "10
+	// mail.example.com" for an MX record
+	Content string
+}
+
+// A TTL for Record.TTL, e.g. Record{Name: "www", Type: "A", TTL: dsl.TTL(60)}
+func TTL(seconds int) *int {
+	return &seconds
+}
+
+// Register records with fixed content. These are registered against their
+// exact names, as with DSL.RegisterName, so wildcards work as they should.
+// Records with the same name and type are answered by a single route.
+func (d *DSL) Static(records ...Record) {
+	d.registerStatic(records, nil)
+}
+
+// Register records with fixed content against the zone. Names are relative to
+// the zone apex, as for Zone.RegisterName, unless they end with a dot.
+//
+// SOA and NS records for the apex are used as the zone's settings (see
+// Zone.SOA and Zone.NS) rather than being registered separately; NS records
+// are added to any the zone already has.
+func (z *Zone) Static(records ...Record) {
+	var rest []Record
+	for _, r := range records {
+		r.Name = z.absolute(r.Name)
+		switch {
+		case r.Name == z.Name && strings.EqualFold(r.Type, "SOA"):
+			soa, err := ParseSOA(r.Content)
+			if err != nil {
+				panic(fmt.Sprintf("Zone %s: %s", z.Name, err))
+			}
+			z.SOA(soa)
+		case r.Name == z.Name && strings.EqualFold(r.Type, "NS"):
+			z.ns = append(z.ns, canonical(r.Content))
+			z.dsl.generation++
+		default:
+			rest = append(rest, r)
+		}
+	}
+	z.dsl.registerStatic(rest, z)
+}
+
+func (d *DSL) registerStatic(records []Record, zone *Zone) {
+	type rrset struct{ name, qtype string }
+	sets := make(map[rrset][]Record)
+	var order []rrset
+
+	for _, r := range records {
+		r.Name = canonical(r.Name)
+		r.Type = strings.ToUpper(r.Type)
+		set := rrset{r.Name, r.Type}
+		if _, ok := sets[set]; !ok {
+			order = append(order, set)
+		}
+		sets[set] = append(sets[set], r)
+	}
+
+	for _, set := range order {
+		rrs := sets[set]
+		d.registerName(set.qtype, set.name, func(c *Context) {
+			for _, r := range rrs {
+				ttl := c.DefaultTTL
+				if r.TTL != nil {
+					ttl = *r.TTL
+				}
+				c.ReplyTTL(r.Content, ttl)
+			}
+		}, zone)
+
+		nodes := d.callbacks[set.qtype]
+		nodes[len(nodes)-1].static = rrs
+	}
+}
+
+// Parses the content of an SOA record, as PowerDNS gives it:
+// "mname rname serial refresh retry expire minimum"
+func ParseSOA(content string) (SOA, error) {
+	fields := strings.Fields(content)
+	if len(fields) != 7 {
+		return SOA{}, fmt.Errorf("Bad SOA content: %q", content)
+	}
+
+	var numbers [5]uint32
+	for i, field := range fields[2:] {
+		n, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return SOA{}, fmt.Errorf("Bad SOA content: %q", content)
+		}
+		numbers[i] = uint32(n)
+	}
+
+	return SOA{
+		MName: canonical(fields[0]), RName: canonical(fields[1]),
+		Serial: numbers[0], Refresh: numbers[1], Retry: numbers[2],
+		Expire: numbers[3], Minimum: numbers[4],
+	}, nil
+}
@@ -0,0 +1,56 @@
+package dsl_test
+
+import (
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"testing"
+)
+
+func TestStaticRecords(t *testing.T) {
+	d := NewWithTTL(600)
+	d.Static(
+		Record{Name: "www.example.com.", Type: "A", TTL: TTL(60), Content: "192.0.2.1"},
+		Record{Name: "WWW.example.com", Type: "a", Content: "192.0.2.2"},
+		Record{Name: "*.example.com", Type: "TXT", Content: `"wild"`},
+	)
+
+	rsp := AssertLookup(t, d, AQuery("www.example.com"), 2, nil)
+	h.AssertEqualString(t, "192.0.2.1/60 192.0.2.2/600",
+		rsp[0].Content+"/"+rsp[0].TTL+" "+rsp[1].Content+"/"+rsp[1].TTL, "Wrong answers")
+
+	AssertAnswer(t, d, TypedQuery("TXT", "foo.example.com"), `"wild"`)
+	AssertAnswer(t, d, TypedQuery("TXT", "www.example.com"), "")
+}
+
+func TestZoneStaticRecords(t *testing.T) {
+	d := New()
+	d.Zone("example.com", func(z *Zone) {
+		z.DefaultTTL = 300
+		z.Static(
+			Record{Name: "@", Type: "SOA", Content: "ns1.example.com. hostmaster.example.com. 1 2 3 4 5"},
+			Record{Name: "@", Type: "NS", Content: "ns1.example.com."},
+			Record{Name: "@", Type: "NS", Content: "ns2.example.com"},
+			Record{Name: "www", Type: "A", Content: "192.0.2.1"},
+			Record{Name: "mail.example.com.", Type: "A", Content: "192.0.2.2"},
+		)
+	})
+	h.RefuteError(t, d.Validate(), "Zone should be valid")
+
+	AssertAnswer(t, d, TypedQuery("SOA", "example.com"), "ns1.example.com hostmaster.example.com 1 2 3 4 5")
+	rsp := AssertLookup(t, d, TypedQuery("NS", "example.com"), 2, nil)
+	h.AssertEqualString(t, "ns2.example.com", rsp[1].Content, "Wrong NS")
+	rsp = AssertLookup(t, d, AQuery("www.example.com"), 1, nil)
+	h.AssertEqualString(t, "300", rsp[0].TTL, "Zone default TTL expected")
+	AssertAnswer(t, d, AQuery("mail.example.com"), "192.0.2.2")
+}
+
+func TestParseSOA(t *testing.T) {
+	soa, err := ParseSOA("ns1.example.com. hostmaster.example.com 2015010101 10800 900 604800 300")
+	h.RefuteError(t, err, "ParseSOA")
+	h.AssertEqualString(t, "ns1.example.com hostmaster.example.com 2015010101 10800 900 604800 300", soa.String(), "Wrong SOA")
+
+	_, err = ParseSOA("ns1.example.com hostmaster.example.com 1 2 3 4")
+	h.Assert(t, err != nil, "Too few fields should fail")
+	_, err = ParseSOA("ns1.example.com hostmaster.example.com 1 2 3 4 x")
+	h.Assert(t, err != nil, "Bad number should fail")
+}
@@ -0,0 +1,673 @@
+// Copyright 2015 Bytemark Computer Consulting Ltd. All rights reserved
+// Licensed under the GNU General Public License, version 2. See the LICENSE
+// file for more details
+
+// An HTTP API for changing the zones and RRsets of a store.Store at runtime,
+// to run in the pipe process alongside the backend. Usage:
+//
+//	s, err := sqlstore.Open("/var/lib/pdns-pipe/records.db")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	store.Serve(x, s)
+//
+//	srv, err := admin.New(s, admin.Config{
+//		Tokens:   []admin.Token{{Name: "deploy", Token: os.Getenv("ADMIN_TOKEN")}},
+//		AuditLog: "/var/log/pdns-pipe/audit.log",
+//	})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	srv.OnChange = func(zone string) { x.Purge(zone + "$") }
+//	go func() {
+//		err := http.ListenAndServe("127.0.0.1:8081", srv)
+//		log.Printf("Admin API: %v", err)
+//	}()
+//
+// PowerDNS runs several pipe processes, and only one of them can listen on the
+// port, so the store must be one they all share, such as an sqlstore or
+// boltstore; changes to a memory store would only be seen by the process that
+// got the port. OnChange is only called in that process too, so the others'
+// cached answers last until they expire.
+//
+// Requests must have an "Authorization: Bearer <token>" header with one of the
+// configured tokens. Bodies are JSON, and RRsets look like store.RRset:
+//
+//	GET    /zones                              names of the zones
+//	POST   /zones                              {"name": ..., "rrsets": [...]}
+//	GET    /zones/<zone>                       {"name": ..., "rrsets": [...]}
+//	PATCH  /zones/<zone>                       {"rrsets": [...]}
+//	DELETE /zones/<zone>
+//	GET    /zones/<zone>/rrsets/<name>/<type>  {"name": ..., "type": ..., "ttl": ..., "records": [...]}
+//	PUT    /zones/<zone>/rrsets/<name>/<type>  {"ttl": ..., "records": [...]}
+//	DELETE /zones/<zone>/rrsets/<name>/<type>
+//
+// PATCH replaces the RRsets given, all at once; an RRset with no records
+// deletes the RRset of its name and type. The serial of the zone's SOA record
+// is raised with each change, unless the change sets the SOA itself, so that
+// secondaries transferring the zone (see store.Transfer) pick it up.
+//
+// Names are absolute, with or without a trailing dot. Records are checked
+// before they are stored: addresses must be addresses, host names must be
+// names, TXT records must be quoted strings and so on, and a CNAME can't share
+// its name with other records.
+//
+// Zones and RRsets have ETags. A change with an If-Match header is only made if
+// the ETag still matches, so a client that read a zone or RRset can't overwrite
+// a change someone else made since; "If-None-Match: *" only creates an RRset
+// that doesn't exist yet. Changes through the API are made one at a time, but
+// other writers to the same store aren't locked out.
+//
+// Each change is written to the audit log as a line of JSON, giving the time,
+// the name of the token used, the address of the client, and the RRset before
+// and after.
+package admin
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl/store"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Request bodies larger than this are refused
+const maxBody = 1 << 20
+
+// A bearer token that may use the API
+type Token struct {
+	// Recorded in the audit log for changes made with the token
+	Name string `json:"name" yaml:"name"`
+
+	Token string `json:"token" yaml:"token"`
+
+	// Only allows GET and HEAD requests
+	ReadOnly bool `json:"read_only" yaml:"read_only"`
+}
+
+// Settings for a Server, typically read from the pipe's configuration file
+type Config struct {
+	Tokens []Token `json:"tokens" yaml:"tokens"`
+
+	// A file the audit log is appended to. If empty, the audit log is
+	// written with the standard logger.
+	AuditLog string `json:"audit_log" yaml:"audit_log"`
+}
+
+// An http.Handler for the API
+type Server struct {
+	// Where zones and RRsets are kept
+	Store store.Store
+
+	// The tokens that are accepted
+	Tokens []Token
+
+	// Where the audit log is written. If nil, it is written with the
+	// standard logger.
+	Audit io.Writer
+
+	// Called with the name of a zone after each change to it, e.g. to purge
+	// cached answers
+	OnChange func(zone string)
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// A zone and its RRsets, as sent and received
+type zoneData struct {
+	Name   string        `json:"name"`
+	RRsets []store.RRset `json:"rrsets"`
+}
+
+// A line of the audit log
+type entry struct {
+	Time   time.Time    `json:"time"`
+	User   string       `json:"user"`
+	Remote string       `json:"remote"`
+	Action string       `json:"action"`
+	Zone   string       `json:"zone"`
+	Old    *store.RRset `json:"old,omitempty"`
+	New    *store.RRset `json:"new,omitempty"`
+}
+
+// Get a server for the store, opening the audit log if one is configured
+func New(s store.Store, c Config) (*Server, error) {
+	for _, t := range c.Tokens {
+		if t.Token == "" {
+			return nil, fmt.Errorf("Empty token for %q", t.Name)
+		}
+	}
+
+	srv := &Server{Store: s, Tokens: c.Tokens}
+	if c.AuditLog != "" {
+		f, err := os.OpenFile(c.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		srv.file, srv.Audit = f, f
+	}
+	return srv, nil
+}
+
+// Close the audit log, if New opened it
+func (srv *Server) Close() error {
+	if srv.file == nil {
+		return nil
+	}
+	return srv.file.Close()
+}
+
+func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user := srv.authorise(w, r)
+	if user == nil {
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "zones":
+		srv.zones(w, r, user)
+	case len(parts) == 2 && parts[0] == "zones":
+		srv.zone(w, r, user, store.Canonical(parts[1]))
+	case len(parts) == 5 && parts[0] == "zones" && parts[2] == "rrsets":
+		srv.rrset(w, r, user, store.Canonical(parts[1]), store.Canonical(parts[3]), strings.ToUpper(parts[4]))
+	default:
+		fail(w, http.StatusNotFound, "Not found")
+	}
+}
+
+// Finds the token a request was made with, or replies with an error and
+// returns nil if it is missing, unknown or can't be used for the request
+func (srv *Server) authorise(w http.ResponseWriter, r *http.Request) *Token {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	var found *Token
+	for i := range srv.Tokens {
+		t := &srv.Tokens[i]
+		if ok && subtle.ConstantTimeCompare([]byte(given), []byte(t.Token)) == 1 {
+			found = t
+		}
+	}
+
+	switch {
+	case found == nil:
+		w.Header().Set("WWW-Authenticate", `Bearer realm="pdns-pipe"`)
+		fail(w, http.StatusUnauthorized, "Bad or missing bearer token")
+		return nil
+	case found.ReadOnly && !reading(r):
+		fail(w, http.StatusForbidden, "Token "+found.Name+" is read-only")
+		return nil
+	}
+	return found
+}
+
+// GET and POST /zones
+func (srv *Server) zones(w http.ResponseWriter, r *http.Request, user *Token) {
+	switch {
+	case reading(r):
+		zones, err := srv.Store.Zones()
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		reply(w, http.StatusOK, "", zones)
+
+	case r.Method == "POST":
+		var z zoneData
+		if err := decode(w, r, &z); err != nil {
+			fail(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		z.Name = store.Canonical(z.Name)
+		if err := store.CheckName(z.Name); err != nil {
+			fail(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// The zone's RRsets are checked before it is made, so that a
+		// bad RRset doesn't leave an empty zone behind
+		changes, err := check(z.Name, z.RRsets, func(string) ([]store.RRset, error) { return nil, nil })
+		if err != nil {
+			fail(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+
+		if err := srv.Store.CreateZone(z.Name); err != nil {
+			storeError(w, err)
+			return
+		}
+		if err := srv.Store.Apply(z.Name, changes...); err != nil {
+			// Don't leave an empty zone behind
+			if err := srv.Store.DeleteZone(z.Name); err != nil {
+				log.Printf("Removing zone %s: %v", z.Name, err)
+			}
+			storeError(w, err)
+			return
+		}
+		srv.audit(r, user, "create-zone", z.Name, nil, nil)
+		srv.auditChanges(r, user, z.Name, nil, changes)
+		srv.changed(z.Name)
+
+		w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+z.Name)
+		srv.replyZone(w, http.StatusCreated, z.Name)
+
+	default:
+		notAllowed(w, "GET, HEAD, POST")
+	}
+}
+
+// GET, PATCH and DELETE /zones/<zone>
+func (srv *Server) zone(w http.ResponseWriter, r *http.Request, user *Token, zone string) {
+	switch {
+	case reading(r):
+		rrsets, err := srv.list(zone)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		tag := etag(rrsets)
+		if notModified(w, r, tag) {
+			return
+		}
+		reply(w, http.StatusOK, tag, zoneData{Name: zone, RRsets: rrsets})
+
+	case r.Method == "PATCH":
+		var z zoneData
+		if err := decode(w, r, &z); err != nil {
+			fail(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if z.Name != "" && store.Canonical(z.Name) != zone {
+			fail(w, http.StatusBadRequest, "Zone name doesn't match the URL")
+			return
+		}
+
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+
+		rrsets, err := srv.list(zone)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		if preconditionFailed(w, r, etag(rrsets)) {
+			return
+		}
+		changes, err := check(zone, z.RRsets, func(name string) ([]store.RRset, error) {
+			return srv.Store.Get(zone, name, "ANY")
+		})
+		if err != nil {
+			fail(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		changes, _, err = srv.raiseSerial(zone, changes)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		if err := srv.Store.Apply(zone, changes...); err != nil {
+			storeError(w, err)
+			return
+		}
+
+		srv.auditChanges(r, user, zone, rrsets, changes)
+		srv.changed(zone)
+		srv.replyZone(w, http.StatusOK, zone)
+
+	case r.Method == "DELETE":
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+
+		rrsets, err := srv.list(zone)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		if preconditionFailed(w, r, etag(rrsets)) {
+			return
+		}
+		if err := srv.Store.DeleteZone(zone); err != nil {
+			storeError(w, err)
+			return
+		}
+		for i := range rrsets {
+			srv.audit(r, user, "change-rrset", zone, &rrsets[i], nil)
+		}
+		srv.audit(r, user, "delete-zone", zone, nil, nil)
+		srv.changed(zone)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		notAllowed(w, "GET, HEAD, PATCH, DELETE")
+	}
+}
+
+// GET, PUT and DELETE /zones/<zone>/rrsets/<name>/<type>
+func (srv *Server) rrset(w http.ResponseWriter, r *http.Request, user *Token, zone, name, qtype string) {
+	if qtype == "ANY" {
+		fail(w, http.StatusBadRequest, "Bad type: ANY")
+		return
+	}
+
+	switch {
+	case reading(r):
+		old, err := srv.get(zone, name, qtype)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		if old == nil {
+			fail(w, http.StatusNotFound, "No such RRset")
+			return
+		}
+		tag := etag(old)
+		if notModified(w, r, tag) {
+			return
+		}
+		reply(w, http.StatusOK, tag, old)
+
+	case r.Method == "PUT":
+		var set store.RRset
+		if err := decode(w, r, &set); err != nil {
+			fail(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if (set.Name != "" && store.Canonical(set.Name) != name) || (set.Type != "" && strings.ToUpper(set.Type) != qtype) {
+			fail(w, http.StatusBadRequest, "RRset name or type doesn't match the URL")
+			return
+		}
+		if len(set.Records) == 0 {
+			fail(w, http.StatusBadRequest, "No records given; use DELETE to remove an RRset")
+			return
+		}
+		set.Name, set.Type = name, qtype
+
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+
+		old, err := srv.get(zone, name, qtype)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		if preconditionFailed(w, r, etagOrNone(old)) {
+			return
+		}
+		changes, err := check(zone, []store.RRset{set}, func(name string) ([]store.RRset, error) {
+			return srv.Store.Get(zone, name, "ANY")
+		})
+		if err != nil {
+			fail(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		changes, soa, err := srv.raiseSerial(zone, changes)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		if err := srv.Store.Apply(zone, changes...); err != nil {
+			storeError(w, err)
+			return
+		}
+		srv.audit(r, user, "change-rrset", zone, old, &changes[0])
+		srv.auditSerial(r, user, zone, soa, changes)
+		srv.changed(zone)
+
+		status := http.StatusOK
+		if old == nil {
+			status = http.StatusCreated
+		}
+		reply(w, status, etag(&changes[0]), changes[0])
+
+	case r.Method == "DELETE":
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+
+		old, err := srv.get(zone, name, qtype)
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		if old == nil {
+			fail(w, http.StatusNotFound, "No such RRset")
+			return
+		}
+		if preconditionFailed(w, r, etag(old)) {
+			return
+		}
+		changes, soa, err := srv.raiseSerial(zone, []store.RRset{{Name: name, Type: qtype}})
+		if err != nil {
+			storeError(w, err)
+			return
+		}
+		if err := srv.Store.Apply(zone, changes...); err != nil {
+			storeError(w, err)
+			return
+		}
+		srv.audit(r, user, "change-rrset", zone, old, nil)
+		srv.auditSerial(r, user, zone, soa, changes)
+		srv.changed(zone)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		notAllowed(w, "GET, HEAD, PUT, DELETE")
+	}
+}
+
+// The RRsets of a zone, as an empty list rather than nil if there are none
+func (srv *Server) list(zone string) ([]store.RRset, error) {
+	rrsets, err := srv.Store.List(zone)
+	if rrsets == nil {
+		rrsets = []store.RRset{}
+	}
+	return rrsets, err
+}
+
+// An RRset, or nil if there isn't one
+func (srv *Server) get(zone, name, qtype string) (*store.RRset, error) {
+	rrsets, err := srv.Store.Get(zone, name, qtype)
+	if err != nil || len(rrsets) == 0 {
+		return nil, err
+	}
+	return &rrsets[0], nil
+}
+
+// Adds a change to the zone's SOA record, if it has one, raising its serial by
+// one. Changes that set the SOA record themselves are left alone. The SOA
+// record as it was is returned too, for the audit log.
+func (srv *Server) raiseSerial(zone string, changes []store.RRset) ([]store.RRset, *store.RRset, error) {
+	if len(changes) == 0 || find(changes, zone, "SOA") != nil {
+		return changes, nil, nil
+	}
+
+	old, err := srv.get(zone, zone, "SOA")
+	if err != nil || old == nil || len(old.Records) == 0 {
+		return changes, nil, err
+	}
+	soa, err := dsl.ParseSOA(old.Records[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	soa.Serial++
+	set := store.RRset{Name: zone, Type: "SOA", TTL: old.TTL, Records: []string{soa.String()}}
+	return append(changes, set), old, nil
+}
+
+// Writes an entry for the SOA record raiseSerial added to changes, if it did
+func (srv *Server) auditSerial(r *http.Request, user *Token, zone string, soa *store.RRset, changes []store.RRset) {
+	if soa != nil {
+		srv.audit(r, user, "change-rrset", zone, soa, &changes[len(changes)-1])
+	}
+}
+
+func (srv *Server) replyZone(w http.ResponseWriter, status int, zone string) {
+	rrsets, err := srv.list(zone)
+	if err != nil {
+		storeError(w, err)
+		return
+	}
+	reply(w, status, etag(rrsets), zoneData{Name: zone, RRsets: rrsets})
+}
+
+func (srv *Server) changed(zone string) {
+	if srv.OnChange != nil {
+		srv.OnChange(zone)
+	}
+}
+
+// Writes an entry to the audit log. Failing to is logged, but the change has
+// been made by then, so it isn't undone.
+func (srv *Server) audit(r *http.Request, user *Token, action, zone string, before, after *store.RRset) {
+	data, err := json.Marshal(entry{
+		Time:   time.Now().UTC(),
+		User:   user.Name,
+		Remote: r.RemoteAddr,
+		Action: action,
+		Zone:   zone,
+		Old:    before,
+		New:    after,
+	})
+	if err != nil {
+		log.Printf("Audit log: %v", err)
+		return
+	}
+
+	if srv.Audit == nil {
+		log.Print(string(data))
+		return
+	}
+	if _, err := srv.Audit.Write(append(data, '\n')); err != nil {
+		log.Printf("Audit log: %v", err)
+	}
+}
+
+// Writes an entry for each RRset that changes made, given the RRsets the zone
+// had before
+func (srv *Server) auditChanges(r *http.Request, user *Token, zone string, rrsets, changes []store.RRset) {
+	for i := range changes {
+		before, after := find(rrsets, changes[i].Name, changes[i].Type), &changes[i]
+		if len(after.Records) == 0 {
+			after = nil
+		}
+		if before != nil || after != nil {
+			srv.audit(r, user, "change-rrset", zone, before, after)
+		}
+	}
+}
+
+func find(rrsets []store.RRset, name, qtype string) *store.RRset {
+	for i := range rrsets {
+		if rrsets[i].Name == name && rrsets[i].Type == qtype {
+			return &rrsets[i]
+		}
+	}
+	return nil
+}
+
+func reading(r *http.Request) bool {
+	return r.Method == "GET" || r.Method == "HEAD"
+}
+
+// A strong ETag for a zone's RRsets or an RRset
+func etag(v interface{}) string {
+	data, _ := json.Marshal(v)
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// The ETag of an RRset, or "" if it doesn't exist
+func etagOrNone(set *store.RRset) string {
+	if set == nil {
+		return ""
+	}
+	return etag(set)
+}
+
+// Checks If-Match and If-None-Match against the current ETag of what a request
+// would change, which is "" if it doesn't exist, and replies if they fail
+func preconditionFailed(w http.ResponseWriter, r *http.Request, tag string) bool {
+	failed := false
+	if h := r.Header.Get("If-Match"); h != "" {
+		failed = tag == "" || (h != "*" && !matches(h, tag))
+	}
+	if h := r.Header.Get("If-None-Match"); h != "" && !failed {
+		failed = tag != "" && (h == "*" || matches(h, tag))
+	}
+
+	if failed {
+		fail(w, http.StatusPreconditionFailed, "Changed since it was read")
+	}
+	return failed
+}
+
+// Replies 304 to a GET whose If-None-Match header matches the ETag
+func notModified(w http.ResponseWriter, r *http.Request, tag string) bool {
+	h := r.Header.Get("If-None-Match")
+	if h == "" || (h != "*" && !matches(h, tag)) {
+		return false
+	}
+	w.Header().Set("ETag", tag)
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+func matches(header, tag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(t), "W/") == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func decode(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBody))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("Bad request body: %v", err)
+	}
+	return nil
+}
+
+func reply(w http.ResponseWriter, status int, tag string, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if tag != "" {
+		w.Header().Set("ETag", tag)
+	}
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func fail(w http.ResponseWriter, status int, msg string) {
+	reply(w, status, "", map[string]string{"error": msg})
+}
+
+func notAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	fail(w, http.StatusMethodNotAllowed, "Method not allowed")
+}
+
+func storeError(w http.ResponseWriter, err error) {
+	switch err {
+	case store.ErrNoZone:
+		fail(w, http.StatusNotFound, err.Error())
+	case store.ErrZoneExists:
+		fail(w, http.StatusConflict, err.Error())
+	default:
+		fail(w, http.StatusInternalServerError, err.Error())
+	}
+}
@@ -0,0 +1,434 @@
+package admin_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl/store"
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl/store/admin"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl/store/storetest"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const soa = `{"name": "example.com", "type": "SOA", "ttl": 3600, "records": ["ns1.example.com hostmaster.example.com 1 2 3 4 5"]}`
+
+func BuildServer(t *testing.T) (*Server, store.Store, *bytes.Buffer) {
+	s := store.NewMemory()
+	srv, err := New(s, Config{Tokens: []Token{
+		{Name: "admin", Token: "secret"},
+		{Name: "viewer", Token: "peek", ReadOnly: true},
+	}})
+	h.RefuteError(t, err, "New")
+	audit := &bytes.Buffer{}
+	srv.Audit = audit
+	return srv, s, audit
+}
+
+// Makes a request with the "secret" token, and any headers given as name and
+// value pairs
+func Do(srv http.Handler, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer secret")
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	return w
+}
+
+func AssertStatus(t *testing.T, exp int, w *httptest.ResponseRecorder, msg string) {
+	t.Helper()
+	if w.Code != exp {
+		t.Fatalf("%s: expected status %d, got %d: %s", msg, exp, w.Code, w.Body.String())
+	}
+}
+
+func AssertStored(t *testing.T, s store.Store, zone, exp string) {
+	t.Helper()
+	rrsets, err := s.List(zone)
+	h.RefuteError(t, err, "List")
+	h.AssertEqualString(t, exp, storetest.Dump(rrsets), "Wrong RRsets in "+zone)
+}
+
+func TestAuth(t *testing.T) {
+	srv, _, _ := BuildServer(t)
+
+	for _, auth := range []string{"", "Bearer nope", "Basic secret", "Bearer secret2"} {
+		r := httptest.NewRequest("GET", "/zones", nil)
+		r.Header.Set("Authorization", auth)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		AssertStatus(t, http.StatusUnauthorized, w, "Authorization: "+auth)
+		h.AssertEqualString(t, `Bearer realm="pdns-pipe"`, w.Header().Get("WWW-Authenticate"), "Wrong challenge")
+	}
+
+	r := httptest.NewRequest("GET", "/zones", nil)
+	r.Header.Set("Authorization", "Bearer peek")
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	AssertStatus(t, http.StatusOK, w, "Read-only token reading")
+
+	r = httptest.NewRequest("POST", "/zones", strings.NewReader(`{"name": "example.com"}`))
+	r.Header.Set("Authorization", "Bearer peek")
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	AssertStatus(t, http.StatusForbidden, w, "Read-only token writing")
+
+	_, err := New(store.NewMemory(), Config{Tokens: []Token{{Name: "blank"}}})
+	h.Assert(t, err != nil, "Expected an error for an empty token")
+}
+
+func TestZones(t *testing.T) {
+	srv, s, _ := BuildServer(t)
+
+	w := Do(srv, "POST", "/zones", `{"name": "Example.COM.", "rrsets": [`+soa+`]}`)
+	AssertStatus(t, http.StatusCreated, w, "POST /zones")
+	h.AssertEqualString(t, "/zones/example.com", w.Header().Get("Location"), "Wrong location")
+	h.Assert(t, w.Header().Get("ETag") != "", "Expected an ETag")
+	AssertStored(t, s, "example.com", "example.com SOA 3600 ns1.example.com hostmaster.example.com 1 2 3 4 5")
+
+	AssertStatus(t, http.StatusConflict, Do(srv, "POST", "/zones", `{"name": "example.com"}`), "Creating it again")
+	AssertStatus(t, http.StatusCreated, Do(srv, "POST", "/zones", `{"name": "example.org"}`), "POST /zones")
+
+	w = Do(srv, "GET", "/zones", "")
+	AssertStatus(t, http.StatusOK, w, "GET /zones")
+	h.AssertEqualString(t, `["example.com","example.org"]`, strings.TrimSpace(w.Body.String()), "Wrong zones")
+
+	w = Do(srv, "GET", "/zones/example.org", "")
+	AssertStatus(t, http.StatusOK, w, "GET /zones/example.org")
+	h.AssertEqualString(t, `{"name":"example.org","rrsets":[]}`, strings.TrimSpace(w.Body.String()), "Wrong zone")
+
+	w = Do(srv, "PATCH", "/zones/example.com", `{"rrsets": [
+		{"name": "www.example.com", "type": "A", "ttl": 60, "records": ["192.0.2.1", "192.0.2.2"]},
+		{"name": "www.example.com.", "type": "aaaa", "ttl": 60, "records": ["2001:db8::1"]}
+	]}`)
+	AssertStatus(t, http.StatusOK, w, "PATCH")
+	AssertStored(t, s, "example.com", strings.Join([]string{
+		"example.com SOA 3600 ns1.example.com hostmaster.example.com 2 2 3 4 5",
+		"www.example.com A 60 192.0.2.1,192.0.2.2",
+		"www.example.com AAAA 60 2001:db8::1",
+	}, "\n"))
+
+	w = Do(srv, "PATCH", "/zones/example.com", `{"rrsets": [{"name": "www.example.com", "type": "AAAA"}]}`)
+	AssertStatus(t, http.StatusOK, w, "PATCH deleting")
+	AssertStored(t, s, "example.com", strings.Join([]string{
+		"example.com SOA 3600 ns1.example.com hostmaster.example.com 3 2 3 4 5",
+		"www.example.com A 60 192.0.2.1,192.0.2.2",
+	}, "\n"))
+
+	AssertStatus(t, http.StatusNoContent, Do(srv, "DELETE", "/zones/example.org", ""), "DELETE")
+	AssertStatus(t, http.StatusNotFound, Do(srv, "DELETE", "/zones/example.org", ""), "DELETE again")
+	AssertStatus(t, http.StatusNotFound, Do(srv, "GET", "/zones/example.org", ""), "GET deleted zone")
+	AssertStatus(t, http.StatusNotFound, Do(srv, "GET", "/nope", ""), "GET /nope")
+
+	w = Do(srv, "PUT", "/zones", "")
+	AssertStatus(t, http.StatusMethodNotAllowed, w, "PUT /zones")
+	h.AssertEqualString(t, "GET, HEAD, POST", w.Header().Get("Allow"), "Wrong Allow header")
+}
+
+func TestRRsets(t *testing.T) {
+	srv, s, _ := BuildServer(t)
+	AssertStatus(t, http.StatusCreated, Do(srv, "POST", "/zones", `{"name": "example.com"}`), "POST /zones")
+
+	path := "/zones/example.com/rrsets/www.example.com/A"
+	AssertStatus(t, http.StatusNotFound, Do(srv, "GET", path, ""), "GET missing RRset")
+
+	w := Do(srv, "PUT", path, `{"ttl": 60, "records": ["192.0.2.1"]}`)
+	AssertStatus(t, http.StatusCreated, w, "PUT new RRset")
+	w = Do(srv, "PUT", path, `{"name": "WWW.example.com.", "type": "a", "ttl": 30, "records": ["192.0.2.2"]}`)
+	AssertStatus(t, http.StatusOK, w, "PUT existing RRset")
+	AssertStored(t, s, "example.com", "www.example.com A 30 192.0.2.2")
+
+	w = Do(srv, "GET", "/zones/example.com/rrsets/WWW.example.com./a", "")
+	AssertStatus(t, http.StatusOK, w, "GET RRset")
+	var set store.RRset
+	h.RefuteError(t, json.Unmarshal(w.Body.Bytes(), &set), "Decoding RRset")
+	h.AssertEqualString(t, "www.example.com A 30 192.0.2.2", storetest.Dump([]store.RRset{set}), "Wrong RRset")
+
+	AssertStatus(t, http.StatusBadRequest, Do(srv, "PUT", path, `{"name": "ftp.example.com", "ttl": 30, "records": ["192.0.2.2"]}`), "PUT to the wrong name")
+	AssertStatus(t, http.StatusBadRequest, Do(srv, "PUT", path, `{"ttl": 30, "records": []}`), "PUT with no records")
+	AssertStatus(t, http.StatusBadRequest, Do(srv, "PUT", path, `{"ttl": 30, "records": ["192.0.2.2"], "extra": 1}`), "PUT with unknown field")
+	AssertStatus(t, http.StatusBadRequest, Do(srv, "PUT", path, `{"ttl": 30, `), "PUT with bad JSON")
+	AssertStatus(t, http.StatusNotFound, Do(srv, "PUT", "/zones/example.org/rrsets/www.example.org/A", `{"ttl": 30, "records": ["192.0.2.2"]}`), "PUT to a missing zone")
+	AssertStatus(t, http.StatusBadRequest, Do(srv, "GET", "/zones/example.com/rrsets/www.example.com/ANY", ""), "GET ANY")
+
+	AssertStatus(t, http.StatusNoContent, Do(srv, "DELETE", path, ""), "DELETE RRset")
+	AssertStatus(t, http.StatusNotFound, Do(srv, "DELETE", path, ""), "DELETE RRset again")
+	AssertStored(t, s, "example.com", "")
+}
+
+func TestSerialIsRaised(t *testing.T) {
+	srv, s, audit := BuildServer(t)
+	AssertStatus(t, http.StatusCreated, Do(srv, "POST", "/zones", `{"name": "example.com", "rrsets": [`+soa+`]}`), "POST /zones")
+	AssertSerial := func(exp, msg string) {
+		t.Helper()
+		zc, err := store.Contents(s, "example.com")
+		h.RefuteError(t, err, "Contents")
+		h.AssertEqualString(t, exp, strings.Fields(zc.Records[0].Content)[2], msg)
+	}
+	AssertSerial("1", "Serial shouldn't change when the zone is made")
+
+	path := "/zones/example.com/rrsets/www.example.com/A"
+	AssertStatus(t, http.StatusCreated, Do(srv, "PUT", path, `{"ttl": 60, "records": ["192.0.2.1"]}`), "PUT")
+	AssertSerial("2", "PUT should raise the serial")
+	AssertStatus(t, http.StatusNoContent, Do(srv, "DELETE", path, ""), "DELETE")
+	AssertSerial("3", "DELETE should raise the serial")
+	AssertStatus(t, http.StatusOK, Do(srv, "PATCH", "/zones/example.com", `{"rrsets": [
+		{"name": "www.example.com", "type": "A", "ttl": 60, "records": ["192.0.2.1"]}
+	]}`), "PATCH")
+	AssertSerial("4", "PATCH should raise the serial")
+	AssertStatus(t, http.StatusOK, Do(srv, "PATCH", "/zones/example.com", `{"rrsets": []}`), "Empty PATCH")
+	AssertSerial("4", "A PATCH changing nothing shouldn't raise the serial")
+
+	// A change that sets the SOA record is left as it is
+	AssertStatus(t, http.StatusOK, Do(srv, "PATCH", "/zones/example.com", `{"rrsets": [
+		{"name": "example.com", "type": "SOA", "ttl": 3600, "records": ["ns1.example.com hostmaster.example.com 2024010100 2 3 4 5"]},
+		{"name": "www.example.com", "type": "A"}
+	]}`), "PATCH with an SOA")
+	AssertSerial("2024010100", "Serial should be as given")
+	AssertStatus(t, http.StatusOK, Do(srv, "PUT", "/zones/example.com/rrsets/example.com/SOA",
+		`{"ttl": 3600, "records": ["ns1.example.com hostmaster.example.com 2024010200 2 3 4 5"]}`), "PUT SOA")
+	AssertSerial("2024010200", "Serial should be as given")
+
+	h.Assert(t, strings.Contains(audit.String(), "hostmaster.example.com 3 2 3 4 5"), "Raised serials should be in the audit log")
+}
+
+func TestETags(t *testing.T) {
+	srv, _, _ := BuildServer(t)
+	AssertStatus(t, http.StatusCreated, Do(srv, "POST", "/zones", `{"name": "example.com"}`), "POST /zones")
+	path := "/zones/example.com/rrsets/www.example.com/A"
+
+	// Only creates an RRset if there isn't one
+	w := Do(srv, "PUT", path, `{"ttl": 60, "records": ["192.0.2.1"]}`, "If-None-Match", "*")
+	AssertStatus(t, http.StatusCreated, w, "PUT with If-None-Match")
+	first := w.Header().Get("ETag")
+	w = Do(srv, "PUT", path, `{"ttl": 60, "records": ["192.0.2.9"]}`, "If-None-Match", "*")
+	AssertStatus(t, http.StatusPreconditionFailed, w, "PUT with If-None-Match again")
+
+	w = Do(srv, "GET", path, "")
+	h.AssertEqualString(t, first, w.Header().Get("ETag"), "GET should give the ETag PUT did")
+	AssertStatus(t, http.StatusNotModified, Do(srv, "GET", path, "", "If-None-Match", first), "Conditional GET")
+
+	// Two clients change the RRset they read; the second loses
+	w = Do(srv, "PUT", path, `{"ttl": 60, "records": ["192.0.2.2"]}`, "If-Match", first)
+	AssertStatus(t, http.StatusOK, w, "PUT with matching If-Match")
+	second := w.Header().Get("ETag")
+	h.Assert(t, second != first, "ETag should change with the RRset")
+	AssertStatus(t, http.StatusPreconditionFailed, Do(srv, "PUT", path, `{"ttl": 60, "records": ["192.0.2.3"]}`, "If-Match", first), "PUT with stale If-Match")
+	AssertStatus(t, http.StatusPreconditionFailed, Do(srv, "DELETE", path, "", "If-Match", first), "DELETE with stale If-Match")
+	AssertStatus(t, http.StatusPreconditionFailed, Do(srv, "PUT", "/zones/example.com/rrsets/ftp.example.com/A", `{"ttl": 60, "records": ["192.0.2.3"]}`, "If-Match", "*"), "PUT to a missing RRset with If-Match")
+
+	// Zones too
+	w = Do(srv, "GET", "/zones/example.com", "")
+	zone := w.Header().Get("ETag")
+	w = Do(srv, "PATCH", "/zones/example.com", `{"rrsets": [{"name": "ftp.example.com", "type": "A", "ttl": 60, "records": ["192.0.2.4"]}]}`, "If-Match", zone)
+	AssertStatus(t, http.StatusOK, w, "PATCH with matching If-Match")
+	AssertStatus(t, http.StatusPreconditionFailed, Do(srv, "PATCH", "/zones/example.com", `{"rrsets": []}`, "If-Match", zone), "PATCH with stale If-Match")
+	AssertStatus(t, http.StatusPreconditionFailed, Do(srv, "DELETE", "/zones/example.com", "", "If-Match", zone), "DELETE with stale If-Match")
+	AssertStatus(t, http.StatusNoContent, Do(srv, "DELETE", "/zones/example.com", "", "If-Match", w.Header().Get("ETag")), "DELETE with matching If-Match")
+}
+
+func TestValidation(t *testing.T) {
+	srv, s, _ := BuildServer(t)
+	AssertStatus(t, http.StatusCreated, Do(srv, "POST", "/zones", `{"name": "example.com", "rrsets": [`+soa+`,
+		{"name": "alias.example.com", "type": "CNAME", "ttl": 60, "records": ["www.example.com"]},
+		{"name": "www.example.com", "type": "A", "ttl": 60, "records": ["192.0.2.1"]}
+	]}`), "POST /zones")
+
+	good := []string{
+		`{"name": "example.com", "type": "MX", "ttl": 60, "records": ["10 mail.example.com.", "0 ."]}`,
+		`{"name": "_sip._tcp.example.com", "type": "SRV", "ttl": 60, "records": ["10 5 5060 sip.example.com"]}`,
+		`{"name": "example.com", "type": "TXT", "ttl": 60, "records": ["\"v=spf1 -all\"", "\"a\" \"b \\\" c\""]}`,
+		`{"name": "example.com", "type": "CAA", "ttl": 60, "records": ["0 issue \"letsencrypt.org\""]}`,
+		`{"name": "www.example.com", "type": "AAAA", "ttl": 60, "records": ["2001:db8::1"]}`,
+		`{"name": "www.example.com", "type": "TLSA", "ttl": 60, "records": ["3 1 1 abcd"]}`,
+		`{"name": "*.example.com", "type": "A", "ttl": 60, "records": ["192.0.2.2"]}`,
+		`{"name": "alias.example.com", "type": "A"}`,
+	}
+	for _, set := range good {
+		w := Do(srv, "PATCH", "/zones/example.com", `{"rrsets": [`+set+`]}`)
+		AssertStatus(t, http.StatusOK, w, "PATCH "+set)
+	}
+
+	bad := []string{
+		`{"name": "www.example.com", "type": "A", "ttl": 60, "records": ["2001:db8::1"]}`,
+		`{"name": "www.example.com", "type": "A", "ttl": 60, "records": ["192.0.2.1", "192.0.2.1"]}`,
+		`{"name": "www.example.com", "type": "A", "ttl": 4294967296, "records": ["192.0.2.1"]}`,
+		`{"name": "www.example.com", "type": "AAAA", "ttl": 60, "records": ["::ffff:192.0.2.1"]}`,
+		`{"name": "www.example.org", "type": "A", "ttl": 60, "records": ["192.0.2.1"]}`,
+		`{"name": "example.com", "type": "MX", "ttl": 60, "records": ["mail.example.com"]}`,
+		`{"name": "example.com", "type": "MX", "ttl": 60, "records": ["70000 mail.example.com"]}`,
+		`{"name": "example.com", "type": "NS", "ttl": 60, "records": ["bad..name"]}`,
+		`{"name": "_sip._tcp.example.com", "type": "SRV", "ttl": 60, "records": ["10 5 sip.example.com"]}`,
+		`{"name": "example.com", "type": "TXT", "ttl": 60, "records": ["unquoted"]}`,
+		`{"name": "example.com", "type": "TXT", "ttl": 60, "records": ["\"a\"\"b\""]}`,
+		`{"name": "example.com", "type": "TXT", "ttl": 60, "records": ["\"` + strings.Repeat("x", 256) + `\""]}`,
+		`{"name": "example.com", "type": "CAA", "ttl": 60, "records": ["0 is-sue \"letsencrypt.org\""]}`,
+		`{"name": "www.example.com", "type": "SOA", "ttl": 60, "records": ["ns1.example.com hostmaster.example.com 1 2 3 4 5"]}`,
+		`{"name": "example.com", "type": "SOA", "ttl": 60, "records": ["ns1.example.com hostmaster.example.com 1 2 3 4"]}`,
+		`{"name": "example.com", "type": "CNAME", "ttl": 60, "records": ["www.example.com"]}`,
+		`{"name": "www.example.com", "type": "CNAME", "ttl": 60, "records": ["other.example.com"]}`,
+		`{"name": "alias.example.com", "type": "TXT", "ttl": 60, "records": ["\"a\""]}`,
+		`{"name": "ftp.example.com", "type": "CNAME", "ttl": 60, "records": ["a.example.com", "b.example.com"]}`,
+	}
+	for _, set := range bad {
+		w := Do(srv, "PATCH", "/zones/example.com", `{"rrsets": [`+set+`]}`)
+		AssertStatus(t, http.StatusBadRequest, w, "PATCH "+set)
+	}
+
+	// A CNAME can replace other data if the same change removes it
+	w := Do(srv, "PATCH", "/zones/example.com", `{"rrsets": [
+		{"name": "www.example.com", "type": "A"},
+		{"name": "www.example.com", "type": "AAAA"},
+		{"name": "www.example.com", "type": "TLSA"},
+		{"name": "www.example.com", "type": "CNAME", "ttl": 60, "records": ["alias.example.com"]}
+	]}`)
+	AssertStatus(t, http.StatusOK, w, "PATCH replacing records with a CNAME")
+
+	// Nothing is applied if one RRset is bad
+	w = Do(srv, "PATCH", "/zones/example.com", `{"rrsets": [
+		{"name": "ok.example.com", "type": "A", "ttl": 60, "records": ["192.0.2.1"]},
+		{"name": "bad.example.com", "type": "A", "ttl": 60, "records": ["nope"]}
+	]}`)
+	AssertStatus(t, http.StatusBadRequest, w, "PATCH with a bad RRset")
+	rrsets, err := s.Get("example.com", "ok.example.com", "ANY")
+	h.RefuteError(t, err, "Get")
+	h.AssertEqualInt(t, 0, len(rrsets), "Good RRset shouldn't have been applied")
+
+	// Nor is a zone created with a bad RRset
+	w = Do(srv, "POST", "/zones", `{"name": "example.org", "rrsets": [{"name": "example.org", "type": "A", "ttl": 60, "records": ["nope"]}]}`)
+	AssertStatus(t, http.StatusBadRequest, w, "POST with a bad RRset")
+	AssertStatus(t, http.StatusNotFound, Do(srv, "GET", "/zones/example.org", ""), "GET zone that shouldn't exist")
+}
+
+// A store whose changes to RRsets fail
+type failingStore struct {
+	store.Store
+}
+
+func (failingStore) Apply(zone string, changes ...store.RRset) error {
+	return errors.New("Disk full")
+}
+
+func TestFailedCreateLeavesNoZone(t *testing.T) {
+	s := store.NewMemory()
+	srv, err := New(failingStore{s}, Config{Tokens: []Token{{Name: "admin", Token: "secret"}}})
+	h.RefuteError(t, err, "New")
+	audit := &bytes.Buffer{}
+	srv.Audit = audit
+
+	w := Do(srv, "POST", "/zones", `{"name": "example.com", "rrsets": [`+soa+`]}`)
+	AssertStatus(t, http.StatusInternalServerError, w, "POST /zones")
+	zones, err := s.Zones()
+	h.RefuteError(t, err, "Zones")
+	h.AssertEqualInt(t, 0, len(zones), "The zone should have been removed")
+	h.AssertEqualString(t, "", audit.String(), "Nothing should be in the audit log")
+}
+
+func TestAuditLog(t *testing.T) {
+	srv, _, audit := BuildServer(t)
+	AssertStatus(t, http.StatusCreated, Do(srv, "POST", "/zones", `{"name": "example.com"}`), "POST /zones")
+	path := "/zones/example.com/rrsets/www.example.com/A"
+	AssertStatus(t, http.StatusCreated, Do(srv, "PUT", path, `{"ttl": 60, "records": ["192.0.2.1"]}`), "PUT")
+	AssertStatus(t, http.StatusOK, Do(srv, "PUT", path, `{"ttl": 60, "records": ["192.0.2.2"]}`), "PUT")
+	AssertStatus(t, http.StatusNoContent, Do(srv, "DELETE", path, ""), "DELETE")
+	AssertStatus(t, http.StatusCreated, Do(srv, "PUT", "/zones/example.com/rrsets/example.com/NS", `{"ttl": 60, "records": ["ns1.example.com"]}`), "PUT")
+	AssertStatus(t, http.StatusCreated, Do(srv, "PUT", path, `{"ttl": 60, "records": ["192.0.2.3"]}`), "PUT")
+	AssertStatus(t, http.StatusNoContent, Do(srv, "DELETE", "/zones/example.com", ""), "DELETE")
+	AssertStatus(t, http.StatusNotFound, Do(srv, "DELETE", "/zones/example.com", ""), "Failed DELETE")
+
+	var out []string
+	for _, line := range strings.Split(strings.TrimSpace(audit.String()), "\n") {
+		var e struct {
+			User, Remote, Action, Zone string
+			Old, New                   *store.RRset
+		}
+		h.RefuteError(t, json.Unmarshal([]byte(line), &e), "Decoding "+line)
+		sets := ""
+		for _, set := range []*store.RRset{e.Old, e.New} {
+			if set == nil {
+				sets += " -"
+			} else {
+				sets += " " + storetest.Dump([]store.RRset{*set})
+			}
+		}
+		out = append(out, e.User+" "+e.Remote+" "+e.Action+" "+e.Zone+sets)
+	}
+	h.AssertEqualString(t, strings.Join([]string{
+		"admin 192.0.2.1:1234 create-zone example.com - -",
+		"admin 192.0.2.1:1234 change-rrset example.com - www.example.com A 60 192.0.2.1",
+		"admin 192.0.2.1:1234 change-rrset example.com www.example.com A 60 192.0.2.1 www.example.com A 60 192.0.2.2",
+		"admin 192.0.2.1:1234 change-rrset example.com www.example.com A 60 192.0.2.2 -",
+		"admin 192.0.2.1:1234 change-rrset example.com - example.com NS 60 ns1.example.com",
+		"admin 192.0.2.1:1234 change-rrset example.com - www.example.com A 60 192.0.2.3",
+		"admin 192.0.2.1:1234 change-rrset example.com example.com NS 60 ns1.example.com -",
+		"admin 192.0.2.1:1234 change-rrset example.com www.example.com A 60 192.0.2.3 -",
+		"admin 192.0.2.1:1234 delete-zone example.com - -",
+	}, "\n"), strings.Join(out, "\n"), "Wrong audit log")
+}
+
+func TestAuditLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	srv, err := New(store.NewMemory(), Config{Tokens: []Token{{Name: "admin", Token: "secret"}}, AuditLog: path})
+	h.RefuteError(t, err, "New")
+	AssertStatus(t, http.StatusCreated, Do(srv, "POST", "/zones", `{"name": "example.com"}`), "POST /zones")
+	h.RefuteError(t, srv.Close(), "Close")
+
+	data, err := os.ReadFile(path)
+	h.RefuteError(t, err, "ReadFile")
+	h.Assert(t, strings.Contains(string(data), `"action":"create-zone"`), "Audit log file should have the change")
+}
+
+func TestChangesAreServed(t *testing.T) {
+	srv, s, _ := BuildServer(t)
+	d := dsl.New()
+	d.Cache(dsl.CacheOptions{})
+	store.Serve(d, s)
+	purged := []string{}
+	srv.OnChange = func(zone string) {
+		purged = append(purged, zone)
+		d.Purge(zone + "$")
+	}
+
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	request := func(method, path, body string) {
+		r, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		h.RefuteError(t, err, "NewRequest")
+		r.Header.Set("Authorization", "Bearer secret")
+		rsp, err := ts.Client().Do(r)
+		h.RefuteError(t, err, method+" "+path)
+		io.Copy(io.Discard, rsp.Body)
+		rsp.Body.Close()
+		h.Assert(t, rsp.StatusCode < 300, method+" "+path+" failed: "+rsp.Status)
+	}
+	lookup := func(exp string) {
+		t.Helper()
+		q := h.FakeQuery(3)
+		q.QType, q.QName = "A", "www.example.com"
+		rsp, err := d.Lookup(q)
+		h.RefuteError(t, err, "Lookup")
+		out := []string{}
+		for _, r := range rsp {
+			out = append(out, r.Content)
+		}
+		h.AssertEqualString(t, exp, strings.Join(out, " "), "Wrong answers")
+	}
+
+	request("POST", "/zones", `{"name": "example.com", "rrsets": [`+soa+`]}`)
+	lookup("")
+	request("PUT", "/zones/example.com/rrsets/www.example.com/A", `{"ttl": 60, "records": ["192.0.2.1"]}`)
+	lookup("192.0.2.1")
+	request("PUT", "/zones/example.com/rrsets/www.example.com/A", `{"ttl": 60, "records": ["192.0.2.2"]}`)
+	lookup("192.0.2.2")
+	h.AssertEqualString(t, "example.com example.com example.com", strings.Join(purged, " "), "Wrong zones changed")
+}
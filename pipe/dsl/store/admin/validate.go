@@ -0,0 +1,199 @@
+package admin
+
+import (
+	"fmt"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl/store"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// The largest TTL allowed (RFC 2181, section 8)
+const maxTTL = 1<<31 - 1
+
+// Checks RRsets to be applied to a zone, returning them normalised as
+// store.Normalise does. Their records are checked, and so is what each name
+// they touch would be left with; current gives the RRsets a name has now.
+func check(zone string, changes []store.RRset, current func(name string) ([]store.RRset, error)) ([]store.RRset, error) {
+	changes, err := store.Normalise(zone, changes)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	byName := make(map[string][]store.RRset)
+	for _, set := range changes {
+		if seen[set.Name+" "+set.Type] {
+			return nil, fmt.Errorf("%s %s is given more than once", set.Name, set.Type)
+		}
+		seen[set.Name+" "+set.Type] = true
+		byName[set.Name] = append(byName[set.Name], set)
+
+		if len(set.Records) > 0 {
+			if err := checkRRset(store.Canonical(zone), set); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for name, sets := range byName {
+		now, err := current(name)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkName(name, merge(now, sets)); err != nil {
+			return nil, err
+		}
+	}
+	return changes, nil
+}
+
+// The types a name would have after changes to its RRsets
+func merge(now, changes []store.RRset) map[string]bool {
+	types := make(map[string]bool)
+	for _, set := range now {
+		types[set.Type] = true
+	}
+	for _, set := range changes {
+		types[set.Type] = len(set.Records) > 0
+	}
+	return types
+}
+
+// Checks the types a name has go together
+func checkName(name string, types map[string]bool) error {
+	if !types["CNAME"] {
+		return nil
+	}
+	for qtype, present := range types {
+		if present && qtype != "CNAME" {
+			return fmt.Errorf("%s has a CNAME, so it can't have %s records too", name, qtype)
+		}
+	}
+	return nil
+}
+
+func checkRRset(zone string, set store.RRset) error {
+	if set.TTL > maxTTL {
+		return fmt.Errorf("Bad TTL for %s %s: %d", set.Name, set.Type, set.TTL)
+	}
+
+	switch set.Type {
+	case "SOA":
+		if set.Name != zone {
+			return fmt.Errorf("%s isn't the zone apex, so it can't have an SOA record", set.Name)
+		}
+		if len(set.Records) > 1 {
+			return fmt.Errorf("%s can only have one SOA record", set.Name)
+		}
+	case "CNAME":
+		if set.Name == zone {
+			return fmt.Errorf("%s is the zone apex, so it can't have a CNAME record", set.Name)
+		}
+		if len(set.Records) > 1 {
+			return fmt.Errorf("%s can only have one CNAME record", set.Name)
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, content := range set.Records {
+		if seen[content] {
+			return fmt.Errorf("Duplicate %s record for %s: %q", set.Type, set.Name, content)
+		}
+		seen[content] = true
+
+		if !goodContent(set.Type, content) {
+			return fmt.Errorf("Bad %s content for %s: %q", set.Type, set.Name, content)
+		}
+	}
+	return nil
+}
+
+// Checks the content of a record of the types we know the form of. Others are
+// taken as they are.
+func goodContent(qtype, content string) bool {
+	fields := strings.Fields(content)
+
+	switch qtype {
+	case "A":
+		addr, err := netip.ParseAddr(content)
+		return err == nil && addr.Is4()
+	case "AAAA":
+		addr, err := netip.ParseAddr(content)
+		return err == nil && addr.Is6() && !addr.Is4In6()
+	case "CNAME", "DNAME", "NS", "PTR":
+		return len(fields) == 1 && host(content)
+	case "MX":
+		return len(fields) == 2 && number(fields[0], 16) && (fields[1] == "." || host(fields[1]))
+	case "SRV":
+		return len(fields) == 4 && number(fields[0], 16) && number(fields[1], 16) && number(fields[2], 16) &&
+			(fields[3] == "." || host(fields[3]))
+	case "SOA":
+		_, err := dsl.ParseSOA(content)
+		return err == nil
+	case "TXT", "SPF":
+		return quoted(content)
+	case "CAA":
+		parts := strings.SplitN(content, " ", 3)
+		return len(parts) == 3 && number(parts[0], 8) && caaTag(parts[1]) && quoted(parts[2])
+	}
+	return true
+}
+
+func host(name string) bool {
+	return store.CheckName(store.Canonical(name)) == nil
+}
+
+func number(s string, bits int) bool {
+	_, err := strconv.ParseUint(s, 10, bits)
+	return err == nil
+}
+
+func caaTag(tag string) bool {
+	if tag == "" {
+		return false
+	}
+	for _, r := range tag {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// Checks content is one or more quoted strings, separated by spaces, of up to
+// 255 bytes each. Backslash escapes are allowed within the quotes.
+func quoted(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for s != "" {
+		if s[0] != '"' {
+			return false
+		}
+
+		i, n := 1, 0
+		for ; i < len(s) && s[i] != '"'; i, n = i+1, n+1 {
+			if s[i] != '\\' {
+				continue
+			}
+			if i+3 < len(s) && number(s[i+1:i+4], 8) {
+				i += 3
+			} else {
+				i++
+			}
+		}
+		if i >= len(s) || n > 255 {
+			return false
+		}
+
+		rest := strings.TrimLeft(s[i+1:], " ")
+		if rest != "" && rest == s[i+1:] {
+			return false
+		}
+		s = rest
+	}
+	return true
+}
@@ -0,0 +1,218 @@
+// Copyright 2015 Bytemark Computer Consulting Ltd. All rights reserved
+// Licensed under the GNU General Public License, version 2. See the LICENSE
+// file for more details
+
+// A store.Store kept in a BoltDB file, an embedded key/value store that needs
+// no server and no cgo. Usage:
+//
+//	s, err := boltstore.Open("/var/lib/pdns-pipe/records.bolt")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer s.Close()
+//	store.Serve(x, s)
+//
+// Each zone is a bucket within the "zones" bucket, holding one key per RRset:
+// the name and type, separated by a NUL byte. The values are JSON objects with
+// "ttl" and "records" members.
+//
+// A BoltDB file can only be open in one process at a time, so every pipe
+// process needs a file of its own (or they can share a store served some other
+// way). This package needs go.etcd.io/bbolt.
+package boltstore
+
+import (
+	"encoding/json"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl/store"
+	bolt "go.etcd.io/bbolt"
+	"strings"
+	"time"
+)
+
+var zonesBucket = []byte("zones")
+
+// A store in a BoltDB file
+type Store struct {
+	db *bolt.DB
+}
+
+type value struct {
+	TTL     int      `json:"ttl"`
+	Records []string `json:"records"`
+}
+
+// Open (or create) the BoltDB file at path, and use it as a store. If another
+// process has the file open, it is waited for for up to five seconds.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := New(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Use a BoltDB database that is already open as a store
+func New(db *bolt.DB) (*Store, error) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(zonesBucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Close the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) Zones() ([]string, error) {
+	zones := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(zonesBucket).ForEachBucket(func(k []byte) error {
+			zones = append(zones, string(k))
+			return nil
+		})
+	})
+	return zones, err
+}
+
+func (s *Store) CreateZone(zone string) error {
+	zone = store.Canonical(zone)
+	if err := store.CheckName(zone); err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.Bucket(zonesBucket).CreateBucket([]byte(zone))
+		if err == bolt.ErrBucketExists {
+			return store.ErrZoneExists
+		}
+		return err
+	})
+}
+
+func (s *Store) DeleteZone(zone string) error {
+	zone = store.Canonical(zone)
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		err := tx.Bucket(zonesBucket).DeleteBucket([]byte(zone))
+		if err == bolt.ErrBucketNotFound {
+			return store.ErrNoZone
+		}
+		return err
+	})
+}
+
+func (s *Store) Get(zone, name, qtype string) ([]store.RRset, error) {
+	zone, name, qtype = store.Canonical(zone), store.Canonical(name), strings.ToUpper(qtype)
+
+	var rrsets []store.RRset
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(zonesBucket).Bucket([]byte(zone))
+		if b == nil {
+			return store.ErrNoZone
+		}
+
+		if qtype != "ANY" {
+			v := b.Get(key(name, qtype))
+			if v == nil {
+				return nil
+			}
+			set, err := decode(key(name, qtype), v)
+			rrsets = append(rrsets, set)
+			return err
+		}
+
+		// Keys for a name sort together, by type
+		prefix := key(name, "")
+		c := b.Cursor()
+		for k, v := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = c.Next() {
+			set, err := decode(k, v)
+			if err != nil {
+				return err
+			}
+			rrsets = append(rrsets, set)
+		}
+		return nil
+	})
+	return rrsets, err
+}
+
+func (s *Store) List(zone string) ([]store.RRset, error) {
+	zone = store.Canonical(zone)
+
+	var rrsets []store.RRset
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(zonesBucket).Bucket([]byte(zone))
+		if b == nil {
+			return store.ErrNoZone
+		}
+		return b.ForEach(func(k, v []byte) error {
+			set, err := decode(k, v)
+			rrsets = append(rrsets, set)
+			return err
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	store.Sort(rrsets)
+	return rrsets, nil
+}
+
+func (s *Store) Apply(zone string, changes ...store.RRset) error {
+	changes, err := store.Normalise(zone, changes)
+	if err != nil {
+		return err
+	}
+	zone = store.Canonical(zone)
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(zonesBucket).Bucket([]byte(zone))
+		if b == nil {
+			return store.ErrNoZone
+		}
+
+		for _, set := range changes {
+			k := key(set.Name, set.Type)
+			if len(set.Records) == 0 {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+				continue
+			}
+
+			v, err := json.Marshal(value{TTL: set.TTL, Records: set.Records})
+			if err != nil {
+				return err
+			}
+			if err := b.Put(k, v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func key(name, qtype string) []byte {
+	return []byte(name + "\x00" + qtype)
+}
+
+func decode(k, v []byte) (store.RRset, error) {
+	var val value
+	if err := json.Unmarshal(v, &val); err != nil {
+		return store.RRset{}, err
+	}
+	name, qtype, _ := strings.Cut(string(k), "\x00")
+	return store.RRset{Name: name, Type: qtype, TTL: val.TTL, Records: val.Records}, nil
+}
@@ -0,0 +1,138 @@
+package store
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A store that keeps everything in memory
+type Memory struct {
+	mu    sync.RWMutex
+	zones map[string]names
+}
+
+// The RRsets of a zone, by name and then type
+type names map[string]map[string]RRset
+
+// Get a new, empty, in-memory store
+func NewMemory() *Memory {
+	return &Memory{zones: make(map[string]names)}
+}
+
+func (m *Memory) Zones() ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	zones := make([]string, 0, len(m.zones))
+	for zone := range m.zones {
+		zones = append(zones, zone)
+	}
+	sort.Strings(zones)
+	return zones, nil
+}
+
+func (m *Memory) CreateZone(zone string) error {
+	zone = Canonical(zone)
+	if err := CheckName(zone); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.zones[zone]; ok {
+		return ErrZoneExists
+	}
+	m.zones[zone] = make(names)
+	return nil
+}
+
+func (m *Memory) DeleteZone(zone string) error {
+	zone = Canonical(zone)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.zones[zone]; !ok {
+		return ErrNoZone
+	}
+	delete(m.zones, zone)
+	return nil
+}
+
+func (m *Memory) Get(zone, name, qtype string) ([]RRset, error) {
+	name, qtype = Canonical(name), strings.ToUpper(qtype)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sets, ok := m.zones[Canonical(zone)]
+	if !ok {
+		return nil, ErrNoZone
+	}
+
+	var out []RRset
+	for t, set := range sets[name] {
+		if qtype == "ANY" || t == qtype {
+			out = append(out, clone(set))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Type < out[j].Type })
+	return out, nil
+}
+
+func (m *Memory) List(zone string) ([]RRset, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sets, ok := m.zones[Canonical(zone)]
+	if !ok {
+		return nil, ErrNoZone
+	}
+
+	var out []RRset
+	for _, types := range sets {
+		for _, set := range types {
+			out = append(out, clone(set))
+		}
+	}
+	Sort(out)
+	return out, nil
+}
+
+func (m *Memory) Apply(zone string, changes ...RRset) error {
+	changes, err := Normalise(zone, changes)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sets, ok := m.zones[Canonical(zone)]
+	if !ok {
+		return ErrNoZone
+	}
+
+	for _, set := range changes {
+		types := sets[set.Name]
+		switch {
+		case len(set.Records) > 0 && types == nil:
+			sets[set.Name] = map[string]RRset{set.Type: set}
+		case len(set.Records) > 0:
+			types[set.Type] = set
+		default:
+			delete(types, set.Type)
+			if len(types) == 0 {
+				delete(sets, set.Name)
+			}
+		}
+	}
+	return nil
+}
+
+func clone(set RRset) RRset {
+	set.Records = append([]string(nil), set.Records...)
+	return set
+}
@@ -0,0 +1,105 @@
+package store
+
+import (
+	"errors"
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	"regexp"
+	"strconv"
+)
+
+// Answer queries for names in the zones of the store, whatever their type.
+// Names outside those zones are left to the DSL's other routes.
+//
+// A query for a type the name has no RRset of gets no answers (NODATA), unless
+// the name has a CNAME, in which case that is returned for PowerDNS to follow,
+// or followed within the DSL if DSL.ChaseCNAMEs is enabled.
+// ANY queries get every RRset at the name. NS records below a zone apex are
+// delegations, so they are sent as non-authoritative.
+func Serve(d *dsl.DSL, s Store) {
+	d.RegisterAnyType(regexp.MustCompile(`.*`), func(c *dsl.Context) {
+		answer(c, s)
+	})
+}
+
+func answer(c *dsl.Context, s Store) {
+	zones, err := s.Zones()
+	if err != nil {
+		c.Error = err
+		return
+	}
+	zone, ok := FindZone(zones, c.Query.QName)
+	if !ok {
+		return
+	}
+
+	name, qtype := Canonical(c.Query.QName), c.Query.QType
+	rrsets, err := s.Get(zone, name, qtype)
+	if err == nil && len(rrsets) == 0 && qtype != "CNAME" && qtype != "ANY" {
+		rrsets, err = s.Get(zone, name, "CNAME")
+	}
+	if err != nil {
+		c.Error = err
+		return
+	}
+
+	for _, set := range rrsets {
+		c.QType = set.Type
+		c.Auth = set.Type != "NS" || set.Name == zone
+		for _, content := range set.Records {
+			c.ReplyTTL(content, set.TTL)
+		}
+	}
+}
+
+// The records of a zone in the store, for zonefile.Write and the like. The
+// zone must have an SOA record.
+func Contents(s Store, zone string) (*dsl.ZoneContents, error) {
+	zone = Canonical(zone)
+	rrsets, err := s.List(zone)
+	if err != nil {
+		return nil, err
+	}
+	if len(rrsets) == 0 || rrsets[0].Type != "SOA" || rrsets[0].Name != zone {
+		return nil, errors.New("No SOA record for zone " + zone)
+	}
+
+	zc := &dsl.ZoneContents{Name: zone}
+	for _, set := range rrsets {
+		for _, content := range set.Records {
+			zc.Records = append(zc.Records, dsl.Record{Name: set.Name, Type: set.Type, TTL: dsl.TTL(set.TTL), Content: content})
+		}
+	}
+	return zc, nil
+}
+
+// Get a callback for backend.Backend.OnAXFR that transfers zones from the
+// store. PowerDNS only sends the zone name from protocol version 4 on, so
+// earlier versions can't be served.
+func Transfer(s Store) backend.AXFRCallback {
+	return func(b *backend.Backend, id int, zone string) ([]*backend.Response, error) {
+		if zone == "" {
+			return nil, errors.New("AXFR needs protocol version 4 or later")
+		}
+
+		zc, err := Contents(s, zone)
+		if err != nil {
+			return nil, err
+		}
+
+		responses := make([]*backend.Response, 0, len(zc.Records))
+		for _, r := range zc.Records {
+			responses = append(responses, &backend.Response{
+				ScopeBits: "0",
+				Auth:      "1",
+				QName:     r.Name,
+				QClass:    "IN",
+				QType:     r.Type,
+				TTL:       strconv.Itoa(*r.TTL),
+				Id:        strconv.Itoa(id),
+				Content:   r.Content,
+			})
+		}
+		return responses, nil
+	}
+}
@@ -0,0 +1,277 @@
+// Copyright 2015 Bytemark Computer Consulting Ltd. All rights reserved
+// Licensed under the GNU General Public License, version 2. See the LICENSE
+// file for more details
+
+// A store.Store kept in an SQLite database. Usage:
+//
+//	s, err := sqlstore.Open("/var/lib/pdns-pipe/records.db")
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer s.Close()
+//	store.Serve(x, s)
+//
+// The database has two tables, which are created if they don't exist:
+//
+//	zones   (name)
+//	records (zone, name, type, ttl, content, position)
+//
+// Each row of records holds one record of an RRset; position keeps the records
+// of an RRset in order. Other programs may change the tables too, as long as
+// they keep names in lower case without trailing dots, types in upper case,
+// and the same TTL for every record of an RRset.
+//
+// This package needs github.com/mattn/go-sqlite3, which needs cgo.
+package sqlstore
+
+import (
+	"database/sql"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl/store"
+	_ "github.com/mattn/go-sqlite3"
+	"strings"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS zones (
+	name TEXT PRIMARY KEY
+);
+CREATE TABLE IF NOT EXISTS records (
+	zone     TEXT NOT NULL,
+	name     TEXT NOT NULL,
+	type     TEXT NOT NULL,
+	ttl      INTEGER NOT NULL,
+	content  TEXT NOT NULL,
+	position INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS records_by_name ON records (zone, name, type);
+`
+
+// A store in an SQLite database
+type Store struct {
+	db *sql.DB
+}
+
+// Open (or create) the SQLite database at path, and use it as a store. Only
+// one connection is made, so changes are made one at a time; other processes
+// using the database are waited for, for up to five seconds.
+func Open(path string) (*Store, error) {
+	db, err := sql.Open("sqlite3", "file:"+path+"?_busy_timeout=5000")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+
+	s, err := New(db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Use an SQLite database that is already open as a store, creating the tables
+// if need be. The database must allow transactions to be used concurrently
+// (or have only one connection).
+func New(db *sql.DB) (*Store, error) {
+	if _, err := db.Exec(schema); err != nil {
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Close the database
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func (s *Store) Zones() ([]string, error) {
+	rows, err := s.db.Query(`SELECT name FROM zones ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	zones := []string{}
+	for rows.Next() {
+		var zone string
+		if err := rows.Scan(&zone); err != nil {
+			return nil, err
+		}
+		zones = append(zones, zone)
+	}
+	return zones, rows.Err()
+}
+
+func (s *Store) CreateZone(zone string) error {
+	zone = store.Canonical(zone)
+	if err := store.CheckName(zone); err != nil {
+		return err
+	}
+
+	return s.transaction(func(tx *sql.Tx) error {
+		if exists, err := zoneExists(tx, zone); err != nil || exists {
+			if exists {
+				return store.ErrZoneExists
+			}
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO zones (name) VALUES (?)`, zone)
+		return err
+	})
+}
+
+func (s *Store) DeleteZone(zone string) error {
+	zone = store.Canonical(zone)
+
+	return s.transaction(func(tx *sql.Tx) error {
+		res, err := tx.Exec(`DELETE FROM zones WHERE name = ?`, zone)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			if err == nil {
+				err = store.ErrNoZone
+			}
+			return err
+		}
+		_, err = tx.Exec(`DELETE FROM records WHERE zone = ?`, zone)
+		return err
+	})
+}
+
+func (s *Store) Get(zone, name, qtype string) ([]store.RRset, error) {
+	zone, name, qtype = store.Canonical(zone), store.Canonical(name), strings.ToUpper(qtype)
+
+	var rrsets []store.RRset
+	err := s.transaction(func(tx *sql.Tx) error {
+		if exists, err := zoneExists(tx, zone); err != nil || !exists {
+			if err == nil {
+				err = store.ErrNoZone
+			}
+			return err
+		}
+
+		query := `SELECT name, type, ttl, content FROM records WHERE zone = ? AND name = ?`
+		args := []interface{}{zone, name}
+		if qtype != "ANY" {
+			query += ` AND type = ?`
+			args = append(args, qtype)
+		}
+
+		var err error
+		rrsets, err = scan(tx.Query(query+` ORDER BY type, position`, args...))
+		return err
+	})
+	return rrsets, err
+}
+
+func (s *Store) List(zone string) ([]store.RRset, error) {
+	zone = store.Canonical(zone)
+
+	var rrsets []store.RRset
+	err := s.transaction(func(tx *sql.Tx) error {
+		if exists, err := zoneExists(tx, zone); err != nil || !exists {
+			if err == nil {
+				err = store.ErrNoZone
+			}
+			return err
+		}
+
+		var err error
+		rrsets, err = scan(tx.Query(
+			`SELECT name, type, ttl, content FROM records WHERE zone = ? ORDER BY name, type, position`,
+			zone,
+		))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	store.Sort(rrsets)
+	return rrsets, nil
+}
+
+func (s *Store) Apply(zone string, changes ...store.RRset) error {
+	changes, err := store.Normalise(zone, changes)
+	if err != nil {
+		return err
+	}
+	zone = store.Canonical(zone)
+
+	return s.transaction(func(tx *sql.Tx) error {
+		if exists, err := zoneExists(tx, zone); err != nil || !exists {
+			if err == nil {
+				err = store.ErrNoZone
+			}
+			return err
+		}
+
+		for _, set := range changes {
+			_, err := tx.Exec(
+				`DELETE FROM records WHERE zone = ? AND name = ? AND type = ?`,
+				zone, set.Name, set.Type,
+			)
+			if err != nil {
+				return err
+			}
+
+			for i, content := range set.Records {
+				_, err := tx.Exec(
+					`INSERT INTO records (zone, name, type, ttl, content, position) VALUES (?, ?, ?, ?, ?, ?)`,
+					zone, set.Name, set.Type, set.TTL, content, i,
+				)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// Runs f in a transaction, which is committed if f succeeds and rolled back if
+// it doesn't
+func (s *Store) transaction(f func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func zoneExists(tx *sql.Tx, zone string) (bool, error) {
+	var n int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM zones WHERE name = ?`, zone).Scan(&n)
+	return n > 0, err
+}
+
+// Reads rows of records into RRsets. Rows of the same RRset must be together.
+func scan(rows *sql.Rows, err error) ([]store.RRset, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rrsets []store.RRset
+	for rows.Next() {
+		var set store.RRset
+		var content string
+		if err := rows.Scan(&set.Name, &set.Type, &set.TTL, &content); err != nil {
+			return nil, err
+		}
+
+		last := len(rrsets) - 1
+		if last >= 0 && rrsets[last].Name == set.Name && rrsets[last].Type == set.Type {
+			rrsets[last].Records = append(rrsets[last].Records, content)
+			continue
+		}
+		set.Records = []string{content}
+		rrsets = append(rrsets, set)
+	}
+	return rrsets, rows.Err()
+}
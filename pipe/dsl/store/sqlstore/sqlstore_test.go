@@ -0,0 +1,38 @@
+package sqlstore_test
+
+import (
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl/store"
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl/store/sqlstore"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl/store/storetest"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"path/filepath"
+	"testing"
+)
+
+func OpenStore(t *testing.T, path string) *Store {
+	s, err := Open(path)
+	h.RefuteError(t, err, "Open")
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return OpenStore(t, filepath.Join(t.TempDir(), "records.db"))
+	})
+}
+
+func TestPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "records.db")
+	s := OpenStore(t, path)
+	h.RefuteError(t, s.CreateZone("example.com"), "CreateZone")
+	h.RefuteError(t, s.Apply("example.com",
+		store.RRset{Name: "www.example.com", Type: "A", TTL: 60, Records: []string{"192.0.2.2", "192.0.2.1"}},
+	), "Apply")
+	h.RefuteError(t, s.Close(), "Close")
+
+	s = OpenStore(t, path)
+	rrsets, err := s.List("example.com")
+	h.RefuteError(t, err, "List")
+	h.AssertEqualString(t, "www.example.com A 60 192.0.2.2,192.0.2.1", storetest.Dump(rrsets), "Wrong RRsets after reopening")
+}
@@ -0,0 +1,179 @@
+// Copyright 2015 Bytemark Computer Consulting Ltd. All rights reserved
+// Licensed under the GNU General Public License, version 2. See the LICENSE
+// file for more details
+
+// Record stores for DSL backends: zones of RRsets kept in memory, or in a
+// database, and served by the DSL without any callbacks of your own. Usage:
+//
+//	s := store.NewMemory()
+//	err := s.CreateZone("example.com")
+//	err = s.Apply("example.com",
+//		store.RRset{Name: "example.com", Type: "SOA", TTL: 3600, Records: []string{
+//			"ns1.example.com hostmaster.example.com 1 10800 900 604800 300",
+//		}},
+//		store.RRset{Name: "example.com", Type: "NS", TTL: 3600, Records: []string{
+//			"ns1.example.com", "ns2.example.com",
+//		}},
+//		store.RRset{Name: "www.example.com", Type: "A", TTL: 300, Records: []string{
+//			"192.0.2.1",
+//		}},
+//	)
+//
+//	store.Serve(x, s)
+//	pipe.OnAXFR(store.Transfer(s))
+//
+// Implementations backed by SQLite and BoltDB are in the sqlstore and
+// boltstore packages below this one. Other implementations can be checked
+// with the storetest package.
+package store
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Returned when a zone doesn't exist
+var ErrNoZone = errors.New("No such zone")
+
+// Returned when creating a zone that already exists
+var ErrZoneExists = errors.New("Zone already exists")
+
+// The records of one type at one name
+type RRset struct {
+	// The owner name, in lower case and without a trailing dot
+	Name string `json:"name"`
+
+	// The type, in upper case
+	Type string `json:"type"`
+
+	TTL int `json:"ttl"`
+
+	// The content of each record, in the form PowerDNS expects
+	Records []string `json:"records"`
+}
+
+// A set of zones holding RRsets. Implementations must be safe for concurrent
+// use. Names and types given to them are normalised as Normalise does.
+type Store interface {
+	// The names of the zones in the store, sorted
+	Zones() ([]string, error)
+
+	// Add a zone, with no RRsets. Returns ErrZoneExists if there is one
+	// with the same name.
+	CreateZone(zone string) error
+
+	// Remove a zone and all its RRsets. Returns ErrNoZone if there isn't
+	// one with the name.
+	DeleteZone(zone string) error
+
+	// The RRsets of the zone at the name, of the given type or, if that is
+	// "ANY", of every type (sorted by type). Returns ErrNoZone if the zone
+	// doesn't exist.
+	Get(zone, name, qtype string) ([]RRset, error)
+
+	// All the RRsets of a zone, sorted by Sort. Returns ErrNoZone if the
+	// zone doesn't exist.
+	List(zone string) ([]RRset, error)
+
+	// Replace RRsets of the zone with those given, all at once. An RRset
+	// with no records deletes the RRset of its name and type. Returns
+	// ErrNoZone if the zone doesn't exist, or an error from Normalise.
+	Apply(zone string, changes ...RRset) error
+}
+
+// Lower-cases a name and removes any trailing dot from it
+func Canonical(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// Checks that a name is a valid domain name. Names are taken to be canonical.
+func CheckName(name string) error {
+	if name == "" || len(name) > 253 {
+		return fmt.Errorf("Bad name: %q", name)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || strings.ContainsAny(label, " \t\n\"\\") {
+			return fmt.Errorf("Bad name: %q", name)
+		}
+	}
+	return nil
+}
+
+// Checks RRsets to be applied to a zone, returning copies with canonical names
+// and upper-case types. Every name must be within the zone, and the RRsets must
+// have a type and a TTL that isn't negative. For implementations of Store.
+func Normalise(zone string, changes []RRset) ([]RRset, error) {
+	zone = Canonical(zone)
+
+	out := make([]RRset, len(changes))
+	for i, set := range changes {
+		set.Name = Canonical(set.Name)
+		set.Type = strings.ToUpper(set.Type)
+		set.Records = append([]string(nil), set.Records...)
+
+		if err := CheckName(set.Name); err != nil {
+			return nil, err
+		}
+		if set.Name != zone && !strings.HasSuffix(set.Name, "."+zone) {
+			return nil, fmt.Errorf("%s is outside zone %s", set.Name, zone)
+		}
+		if set.Type == "" || set.Type == "ANY" || strings.ContainsAny(set.Type, " \t\n") {
+			return nil, fmt.Errorf("Bad type for %s: %q", set.Name, set.Type)
+		}
+		if set.TTL < 0 {
+			return nil, fmt.Errorf("Bad TTL for %s %s: %d", set.Name, set.Type, set.TTL)
+		}
+		for _, content := range set.Records {
+			if content == "" || strings.ContainsAny(content, "\t\n") {
+				return nil, fmt.Errorf("Bad content for %s %s: %q", set.Name, set.Type, content)
+			}
+		}
+		out[i] = set
+	}
+	return out, nil
+}
+
+// Sorts the RRsets of a zone: the SOA first, then the rest in canonical order
+// of their names (RFC 4034, section 6.1), with NS records first at each name
+// and the other types in alphabetical order.
+func Sort(rrsets []RRset) {
+	sort.SliceStable(rrsets, func(i, j int) bool {
+		a, b := rrsets[i], rrsets[j]
+		if (a.Type == "SOA") != (b.Type == "SOA") {
+			return a.Type == "SOA"
+		}
+		if a.Name != b.Name {
+			return canonicalLess(a.Name, b.Name)
+		}
+		if (a.Type == "NS") != (b.Type == "NS") {
+			return a.Type == "NS"
+		}
+		return a.Type < b.Type
+	})
+}
+
+// Orders names by their labels, compared from the right
+func canonicalLess(a, b string) bool {
+	al, bl := strings.Split(a, "."), strings.Split(b, ".")
+	for i, j := len(al)-1, len(bl)-1; i >= 0 && j >= 0; i, j = i-1, j-1 {
+		if al[i] != bl[j] {
+			return al[i] < bl[j]
+		}
+	}
+	return len(al) < len(bl)
+}
+
+// Finds the zone that the name belongs to: the longest zone name that is the
+// name itself or a suffix of it. Returns false if there isn't one.
+func FindZone(zones []string, name string) (string, bool) {
+	name = Canonical(name)
+	found, ok := "", false
+	for _, zone := range zones {
+		if (name == zone || strings.HasSuffix(name, "."+zone)) && (!ok || len(zone) > len(found)) {
+			found, ok = zone, true
+		}
+	}
+	return found, ok
+}
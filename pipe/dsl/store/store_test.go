@@ -0,0 +1,121 @@
+package store_test
+
+import (
+	"bytes"
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl/store"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl/store/storetest"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"strings"
+	"testing"
+)
+
+func TestMemory(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) Store { return NewMemory() })
+}
+
+func BuildStore(t *testing.T) Store {
+	s := NewMemory()
+	h.RefuteError(t, s.CreateZone("example.com"), "CreateZone")
+	h.RefuteError(t, s.Apply("example.com",
+		RRset{Name: "example.com", Type: "SOA", TTL: 3600, Records: []string{"ns1.example.com hostmaster.example.com 1 2 3 4 5"}},
+		RRset{Name: "example.com", Type: "NS", TTL: 3600, Records: []string{"ns1.example.com"}},
+		RRset{Name: "www.example.com", Type: "A", TTL: 60, Records: []string{"192.0.2.1", "192.0.2.2"}},
+		RRset{Name: "www.example.com", Type: "TLSA", TTL: 60, Records: []string{"3 1 1 abcd"}},
+		RRset{Name: "alias.example.com", Type: "CNAME", TTL: 300, Records: []string{"www.example.com"}},
+		RRset{Name: "sub.example.com", Type: "NS", TTL: 3600, Records: []string{"ns.sub.example.com"}},
+	), "Apply")
+	return s
+}
+
+func Query(qtype, qname string) *backend.Query {
+	q := h.FakeQuery(3)
+	q.QType, q.QName = qtype, qname
+	return q
+}
+
+func AssertAnswers(t *testing.T, d *dsl.DSL, q *backend.Query, exp string) {
+	t.Helper()
+	rsp, err := d.Lookup(q)
+	h.RefuteError(t, err, "Lookup")
+	out := make([]string, len(rsp))
+	for i, r := range rsp {
+		out[i] = r.QType + " " + r.TTL + " " + r.Auth + " " + r.Content
+	}
+	h.AssertEqualString(t, exp, strings.Join(out, "\n"), "Wrong answers for "+q.QType+" "+q.QName)
+}
+
+func TestServe(t *testing.T) {
+	d := dsl.New()
+	d.A(`other\.example\.net`, func(c *dsl.Context) { c.Reply("192.0.2.99") })
+	Serve(d, BuildStore(t))
+
+	AssertAnswers(t, d, Query("A", "WWW.example.com"), "A 60 1 192.0.2.1\nA 60 1 192.0.2.2")
+	AssertAnswers(t, d, Query("ANY", "www.example.com"), "A 60 1 192.0.2.1\nA 60 1 192.0.2.2\nTLSA 60 1 3 1 1 abcd")
+	AssertAnswers(t, d, Query("SOA", "example.com"), "SOA 3600 1 ns1.example.com hostmaster.example.com 1 2 3 4 5")
+
+	// NODATA, and NXDOMAIN (which PowerDNS works out from the ANY query)
+	AssertAnswers(t, d, Query("MX", "www.example.com"), "")
+	AssertAnswers(t, d, Query("ANY", "nope.example.com"), "")
+
+	// CNAMEs are given for other types, but only if there's no RRset of the type
+	AssertAnswers(t, d, Query("A", "alias.example.com"), "CNAME 300 1 www.example.com")
+	AssertAnswers(t, d, Query("CNAME", "alias.example.com"), "CNAME 300 1 www.example.com")
+
+	// Delegations aren't authoritative
+	AssertAnswers(t, d, Query("NS", "sub.example.com"), "NS 3600 0 ns.sub.example.com")
+	AssertAnswers(t, d, Query("NS", "example.com"), "NS 3600 1 ns1.example.com")
+
+	// Names outside the store's zones are left to other routes
+	AssertAnswers(t, d, Query("A", "other.example.net"), "A 3600 1 192.0.2.99")
+}
+
+func TestServeChasesCNAMEs(t *testing.T) {
+	d := dsl.New()
+	d.ChaseCNAMEs(true)
+	Serve(d, BuildStore(t))
+
+	AssertAnswers(t, d, Query("A", "alias.example.com"),
+		"CNAME 300 1 www.example.com\nA 60 1 192.0.2.1\nA 60 1 192.0.2.2")
+	AssertAnswers(t, d, Query("CNAME", "alias.example.com"), "CNAME 300 1 www.example.com")
+	AssertAnswers(t, d, Query("MX", "alias.example.com"), "CNAME 300 1 www.example.com")
+}
+
+func TestTransfer(t *testing.T) {
+	s := BuildStore(t)
+	rsp, err := Transfer(s)(nil, 7, "example.com")
+	h.RefuteError(t, err, "Transfer")
+	out := make([]string, len(rsp))
+	for i, r := range rsp {
+		out[i] = r.QName + " " + r.QType + " " + r.Id + " " + r.Content
+	}
+	h.AssertEqualString(t, strings.Join([]string{
+		"example.com SOA 7 ns1.example.com hostmaster.example.com 1 2 3 4 5",
+		"example.com NS 7 ns1.example.com",
+		"alias.example.com CNAME 7 www.example.com",
+		"sub.example.com NS 7 ns.sub.example.com",
+		"www.example.com A 7 192.0.2.1",
+		"www.example.com A 7 192.0.2.2",
+		"www.example.com TLSA 7 3 1 1 abcd",
+	}, "\n"), strings.Join(out, "\n"), "Wrong transfer")
+
+	_, err = Transfer(s)(nil, 7, "")
+	h.Assert(t, err != nil, "Expected an error without a zone name")
+
+	h.RefuteError(t, s.CreateZone("example.org"), "CreateZone")
+	_, err = Contents(s, "example.org")
+	h.AssertEqualString(t, "No SOA record for zone example.org", err.Error(), "Wrong error")
+}
+
+func TestTransferThroughBackend(t *testing.T) {
+	w := &bytes.Buffer{}
+	b := backend.New(bytes.NewBufferString("HELO\t4\nAXFR\t1\texample.com\n"), w, "")
+	h.RefuteError(t, b.Negotiate(), "Negotiate")
+	w.Reset()
+
+	b.OnAXFR(Transfer(BuildStore(t)))
+	h.RefuteError(t, b.Run(h.EmptyDispatch), "Run")
+	h.Assert(t, strings.HasPrefix(w.String(), "DATA\t0\t1\texample.com\tIN\tSOA\t3600\t1\t"), "Wrong output: "+w.String())
+	h.Assert(t, strings.HasSuffix(w.String(), "\tTLSA\t60\t1\t3 1 1 abcd\nEND\n"), "Wrong output: "+w.String())
+}
@@ -0,0 +1,192 @@
+// Copyright 2015 Bytemark Computer Consulting Ltd. All rights reserved
+// Licensed under the GNU General Public License, version 2. See the LICENSE
+// file for more details
+
+// Tests that implementations of store.Store behave as the interface says they
+// should. Usage, in a _test.go file:
+//
+//	func TestStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) store.Store {
+//			return mystore.New(t.TempDir())
+//		})
+//	}
+package storetest
+
+import (
+	"fmt"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl/store"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Runs the tests against stores returned by open, which should return a new,
+// empty store each time it is called
+func Run(t *testing.T, open func(t *testing.T) store.Store) {
+	tests := []struct {
+		name string
+		f    func(t *testing.T, s store.Store)
+	}{
+		{"Zones", testZones},
+		{"GetAndApply", testGetAndApply},
+		{"List", testList},
+		{"Errors", testErrors},
+		{"Concurrency", testConcurrency},
+	}
+	for _, test := range tests {
+		f := test.f
+		t.Run(test.name, func(t *testing.T) { f(t, open(t)) })
+	}
+}
+
+// Renders RRsets for comparison
+func Dump(rrsets []store.RRset) string {
+	out := make([]string, len(rrsets))
+	for i, set := range rrsets {
+		out[i] = fmt.Sprintf("%s %s %d %s", set.Name, set.Type, set.TTL, strings.Join(set.Records, ","))
+	}
+	return strings.Join(out, "\n")
+}
+
+func assertGet(t *testing.T, s store.Store, zone, name, qtype, exp string) {
+	t.Helper()
+	rrsets, err := s.Get(zone, name, qtype)
+	h.RefuteError(t, err, "Get")
+	h.AssertEqualString(t, exp, Dump(rrsets), "Wrong RRsets for "+name+" "+qtype)
+}
+
+func testZones(t *testing.T, s store.Store) {
+	zones, err := s.Zones()
+	h.RefuteError(t, err, "Zones")
+	h.AssertEqualInt(t, 0, len(zones), "New store should be empty")
+
+	for _, zone := range []string{"example.org", "Example.COM.", "sub.example.com"} {
+		h.RefuteError(t, s.CreateZone(zone), "CreateZone "+zone)
+	}
+	zones, err = s.Zones()
+	h.RefuteError(t, err, "Zones")
+	h.AssertEqualString(t, "example.com example.org sub.example.com", strings.Join(zones, " "), "Wrong zones")
+
+	h.RefuteError(t, s.Apply("example.com", store.RRset{Name: "www.example.com", Type: "A", TTL: 60, Records: []string{"192.0.2.1"}}), "Apply")
+	h.RefuteError(t, s.DeleteZone("example.com."), "DeleteZone")
+	zones, err = s.Zones()
+	h.RefuteError(t, err, "Zones")
+	h.AssertEqualString(t, "example.org sub.example.com", strings.Join(zones, " "), "Wrong zones after delete")
+
+	// Recreating a zone doesn't bring its RRsets back
+	h.RefuteError(t, s.CreateZone("example.com"), "CreateZone")
+	assertGet(t, s, "example.com", "www.example.com", "A", "")
+}
+
+func testGetAndApply(t *testing.T, s store.Store) {
+	h.RefuteError(t, s.CreateZone("example.com"), "CreateZone")
+	h.RefuteError(t, s.Apply("example.com",
+		store.RRset{Name: "WWW.example.com.", Type: "a", TTL: 60, Records: []string{"192.0.2.1", "192.0.2.2"}},
+		store.RRset{Name: "www.example.com", Type: "AAAA", TTL: 60, Records: []string{"2001:db8::1"}},
+		store.RRset{Name: "mail.example.com", Type: "MX", TTL: 300, Records: []string{"10 mx.example.com"}},
+	), "Apply")
+
+	assertGet(t, s, "example.com", "www.example.com", "A", "www.example.com A 60 192.0.2.1,192.0.2.2")
+	assertGet(t, s, "Example.com", "WWW.Example.com.", "a", "www.example.com A 60 192.0.2.1,192.0.2.2")
+	assertGet(t, s, "example.com", "www.example.com", "ANY",
+		"www.example.com A 60 192.0.2.1,192.0.2.2\nwww.example.com AAAA 60 2001:db8::1")
+	assertGet(t, s, "example.com", "www.example.com", "MX", "")
+	assertGet(t, s, "example.com", "nope.example.com", "ANY", "")
+
+	// Replacing and deleting RRsets
+	h.RefuteError(t, s.Apply("example.com",
+		store.RRset{Name: "www.example.com", Type: "A", TTL: 30, Records: []string{"192.0.2.3"}},
+		store.RRset{Name: "www.example.com", Type: "AAAA"},
+		store.RRset{Name: "mail.example.com", Type: "TXT"},
+	), "Apply")
+	assertGet(t, s, "example.com", "www.example.com", "ANY", "www.example.com A 30 192.0.2.3")
+	assertGet(t, s, "example.com", "mail.example.com", "ANY", "mail.example.com MX 300 10 mx.example.com")
+}
+
+func testList(t *testing.T, s store.Store) {
+	h.RefuteError(t, s.CreateZone("example.com"), "CreateZone")
+	h.RefuteError(t, s.CreateZone("example.org"), "CreateZone")
+	h.RefuteError(t, s.Apply("example.com",
+		store.RRset{Name: "www.example.com", Type: "A", TTL: 60, Records: []string{"192.0.2.1"}},
+		store.RRset{Name: "a.example.com", Type: "TXT", TTL: 60, Records: []string{`"a"`}},
+		store.RRset{Name: "example.com", Type: "NS", TTL: 3600, Records: []string{"ns1.example.com", "ns2.example.com"}},
+		store.RRset{Name: "example.com", Type: "MX", TTL: 3600, Records: []string{"10 mail.example.com"}},
+		store.RRset{Name: "example.com", Type: "SOA", TTL: 3600, Records: []string{"ns1.example.com hostmaster.example.com 1 2 3 4 5"}},
+		store.RRset{Name: "*.example.com", Type: "A", TTL: 60, Records: []string{"192.0.2.2"}},
+	), "Apply")
+	h.RefuteError(t, s.Apply("example.org",
+		store.RRset{Name: "example.org", Type: "A", TTL: 60, Records: []string{"192.0.2.3"}},
+	), "Apply")
+
+	rrsets, err := s.List("example.com")
+	h.RefuteError(t, err, "List")
+	h.AssertEqualString(t, strings.Join([]string{
+		"example.com SOA 3600 ns1.example.com hostmaster.example.com 1 2 3 4 5",
+		"example.com NS 3600 ns1.example.com,ns2.example.com",
+		"example.com MX 3600 10 mail.example.com",
+		"*.example.com A 60 192.0.2.2",
+		`a.example.com TXT 60 "a"`,
+		"www.example.com A 60 192.0.2.1",
+	}, "\n"), Dump(rrsets), "Wrong listing")
+
+	rrsets, err = s.List("example.org")
+	h.RefuteError(t, err, "List")
+	h.AssertEqualString(t, "example.org A 60 192.0.2.3", Dump(rrsets), "Wrong listing")
+}
+
+func testErrors(t *testing.T, s store.Store) {
+	h.RefuteError(t, s.CreateZone("example.com"), "CreateZone")
+
+	h.Assert(t, s.CreateZone("example.com") == store.ErrZoneExists, "Expected ErrZoneExists")
+	h.Assert(t, s.DeleteZone("example.org") == store.ErrNoZone, "Expected ErrNoZone from DeleteZone")
+	_, err := s.Get("example.org", "example.org", "A")
+	h.Assert(t, err == store.ErrNoZone, "Expected ErrNoZone from Get")
+	_, err = s.List("example.org")
+	h.Assert(t, err == store.ErrNoZone, "Expected ErrNoZone from List")
+	err = s.Apply("example.org", store.RRset{Name: "example.org", Type: "A", Records: []string{"192.0.2.1"}})
+	h.Assert(t, err == store.ErrNoZone, "Expected ErrNoZone from Apply")
+	h.Assert(t, s.CreateZone("bad..name") != nil, "Expected an error for a bad zone name")
+
+	bad := []store.RRset{
+		{Name: "www.example.org", Type: "A", Records: []string{"192.0.2.1"}},
+		{Name: "www.example.com", Type: "", Records: []string{"192.0.2.1"}},
+		{Name: "www.example.com", Type: "A", TTL: -1, Records: []string{"192.0.2.1"}},
+		{Name: "www.example.com", Type: "TXT", Records: []string{"a\tb"}},
+	}
+	for _, set := range bad {
+		// The good RRset must not be applied if a bad one comes with it
+		good := store.RRset{Name: "ok.example.com", Type: "A", Records: []string{"192.0.2.1"}}
+		h.Assert(t, s.Apply("example.com", good, set) != nil, "Expected an error for "+Dump([]store.RRset{set}))
+	}
+	assertGet(t, s, "example.com", "ok.example.com", "ANY", "")
+}
+
+func testConcurrency(t *testing.T, s store.Store) {
+	h.RefuteError(t, s.CreateZone("example.com"), "CreateZone")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("host%d.example.com", i)
+			errs <- s.Apply("example.com", store.RRset{Name: name, Type: "A", TTL: 60, Records: []string{"192.0.2.1"}})
+		}(i)
+		go func() {
+			defer wg.Done()
+			_, err := s.List("example.com")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		h.RefuteError(t, err, "Concurrent use")
+	}
+
+	rrsets, err := s.List("example.com")
+	h.RefuteError(t, err, "List")
+	h.AssertEqualInt(t, 20, len(rrsets), "Wrong number of RRsets")
+}
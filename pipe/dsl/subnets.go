@@ -0,0 +1,140 @@
+package dsl
+
+import (
+	"fmt"
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	"math/bits"
+	"net/netip"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Returns the network of the client on whose behalf the query was made: the
+// EDNS client subnet, if PowerDNS passed one on (protocol version 3), or the
+// remote address of the query as a single-address prefix otherwise.
+func (c *Context) ClientSubnet() (netip.Prefix, bool) {
+	return clientSubnet(c.Query)
+}
+
+func clientSubnet(q *backend.Query) (netip.Prefix, bool) {
+	if q.EdnsSubnetAddress != "" {
+		if prefix, err := parsePrefix(q.EdnsSubnetAddress); err == nil && prefix.Bits() > 0 {
+			return prefix, true
+		}
+	}
+
+	prefix, err := parsePrefix(q.RemoteIpAddress)
+	return prefix, err == nil
+}
+
+// Returns the address of the client; see Context.ClientSubnet
+func (c *Context) ClientAddr() (netip.Addr, bool) {
+	prefix, ok := c.ClientSubnet()
+	return prefix.Addr(), ok
+}
+
+// Parses an address, or an address with a prefix length. IPv4-mapped IPv6
+// addresses are unmapped.
+func parsePrefix(s string) (netip.Prefix, error) {
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return prefix, err
+	}
+	if addr := prefix.Addr(); addr.Is4In6() {
+		bits := prefix.Bits() - 96
+		if bits < 0 {
+			bits = 0
+		}
+		prefix = netip.PrefixFrom(addr.Unmap(), bits)
+	}
+	return prefix.Masked(), nil
+}
+
+// An entry in a subnet table
+type subnetEntry struct {
+	prefix netip.Prefix
+	fn     Callback
+}
+
+// Register a table of callbacks keyed by client network. When a query matches
+// the route, the callback for the longest prefix containing the client address
+// (see Context.ClientAddr) is run, with Context.ScopeBits set so resolvers
+// cache the answer for the right set of clients: the length of that prefix, or
+// more if longer prefixes within it would give other clients other answers. If
+// no prefix matches, nothing is run. The matcher is compiled as for the other
+// helpers, such as DSL.A.
+//
+//	x.Subnets("A", `www\.example\.com`, map[netip.Prefix]dsl.Callback{
+//		netip.MustParsePrefix("10.0.0.0/8"): internal,
+//		netip.MustParsePrefix("0.0.0.0/0"):  external,
+//		netip.MustParsePrefix("::/0"):       external,
+//	})
+func (d *DSL) Subnets(qtype, matcher string, table map[netip.Prefix]Callback) {
+	re := regexp.MustCompile(fmt.Sprintf("^(?i)%s$", matcher))
+	d.Register(qtype, re, SubnetCallback(table))
+}
+
+// Builds the callback used by DSL.Subnets, for use with other routes
+func SubnetCallback(table map[netip.Prefix]Callback) Callback {
+	entries := make([]subnetEntry, 0, len(table))
+	for prefix, fn := range table {
+		entries = append(entries, subnetEntry{prefix: prefix.Masked(), fn: fn})
+	}
+
+	// Longest prefixes first, so the first match is the best
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].prefix.Bits() > entries[j].prefix.Bits()
+	})
+
+	return func(c *Context) {
+		addr, ok := c.ClientAddr()
+		if !ok {
+			return
+		}
+
+		for i, entry := range entries {
+			if entry.prefix.Contains(addr) {
+				c.ScopeBits = scopeBits(addr, entry.prefix, entries[:i])
+				entry.fn(c)
+				return
+			}
+		}
+	}
+}
+
+// The scope of an answer chosen by the matched prefix: the shortest prefix of
+// the client address that leaves out all the longer prefixes that didn't match
+// (and so give other answers), but no shorter than the matched prefix
+func scopeBits(addr netip.Addr, matched netip.Prefix, longer []subnetEntry) int {
+	scope := matched.Bits()
+	for _, entry := range longer {
+		if entry.prefix.Addr().Is4() != addr.Is4() {
+			continue
+		}
+		if n := commonBits(addr, entry.prefix.Addr()) + 1; n > scope {
+			scope = n
+		}
+	}
+	return scope
+}
+
+// The number of leading bits two addresses of the same family have in common
+func commonBits(a, b netip.Addr) int {
+	as, bs := a.AsSlice(), b.AsSlice()
+	for i := range as {
+		if x := as[i] ^ bs[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(as) * 8
+}
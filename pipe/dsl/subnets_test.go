@@ -0,0 +1,61 @@
+package dsl_test
+
+import (
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"net/netip"
+	"testing"
+)
+
+func SubnetsDSL() *DSL {
+	d := New()
+	d.Subnets("A", `www\.example\.com`, map[netip.Prefix]Callback{
+		netip.MustParsePrefix("10.0.0.0/8"):    ReplyHandler("internal"),
+		netip.MustParsePrefix("10.1.2.0/24"):   ReplyHandler("office"),
+		netip.MustParsePrefix("0.0.0.0/0"):     ReplyHandler("external"),
+		netip.MustParsePrefix("2001:db8::/32"): ReplyHandler("v6"),
+	})
+	return d
+}
+
+func SubnetQuery(remote, ecs string) *backend.Query {
+	q := AQuery("www.example.com")
+	q.RemoteIpAddress = remote
+	q.EdnsSubnetAddress = ecs
+	return q
+}
+
+func AssertSubnetAnswer(t *testing.T, q *backend.Query, content, scope string) {
+	rsp := AssertLookup(t, SubnetsDSL(), q, 1, nil)
+	h.AssertEqualString(t, content, rsp[0].Content, "Wrong subnet chosen")
+	h.AssertEqualString(t, scope, rsp[0].ScopeBits, "Wrong scope")
+}
+
+func TestSubnetsPicksLongestPrefixFromECS(t *testing.T) {
+	AssertSubnetAnswer(t, SubnetQuery("192.0.2.1", "10.1.2.0/24"), "office", "24")
+	AssertSubnetAnswer(t, SubnetQuery("192.0.2.1", "10.9.0.0/16"), "internal", "13")
+	AssertSubnetAnswer(t, SubnetQuery("10.1.2.3", "198.51.100.0/24"), "external", "1")
+	AssertSubnetAnswer(t, SubnetQuery("192.0.2.1", "2001:db8:1::/48"), "v6", "32")
+}
+
+func TestSubnetsFallsBackToRemoteAddress(t *testing.T) {
+	AssertSubnetAnswer(t, SubnetQuery("10.1.2.3", ""), "office", "24")
+	AssertSubnetAnswer(t, SubnetQuery("10.1.2.3", "0.0.0.0/0"), "office", "24")
+	AssertSubnetAnswer(t, SubnetQuery("::ffff:10.2.0.1", ""), "internal", "15")
+}
+
+func TestSubnetsWithNoMatchDoesNothing(t *testing.T) {
+	AssertLookup(t, SubnetsDSL(), SubnetQuery("2001:db9::1", ""), 0, nil)
+	AssertLookup(t, SubnetsDSL(), SubnetQuery("bogus", ""), 0, nil)
+}
+
+func TestClientSubnet(t *testing.T) {
+	d := New()
+	var subnet netip.Prefix
+	d.A(`.*`, func(c *Context) { subnet, _ = c.ClientSubnet() })
+	AssertLookup(t, d, SubnetQuery("192.0.2.1", "::ffff:198.51.100.7/120"), 0, nil)
+	h.AssertEqualString(t, "198.51.100.0/24", subnet.String(), "Bad client subnet")
+	AssertLookup(t, d, SubnetQuery("192.0.2.1", ""), 0, nil)
+	h.AssertEqualString(t, "192.0.2.1/32", subnet.String(), "Bad client subnet")
+}
@@ -0,0 +1,140 @@
+package dsl
+
+import (
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	"net/netip"
+	"strconv"
+)
+
+// A view holds a separate set of routes, used for queries matching its
+// criteria. This gives split-horizon DNS: the same backend can give different
+// answers to internal and external clients, for instance. Usage:
+//
+//	internal := dsl.New()
+//	internal.A(`www\.example\.com`, internalAnswer)
+//	x.AddView(&dsl.View{
+//		Name:    "internal",
+//		Sources: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+//		Routes:  internal,
+//	})
+//
+// Every criterion that is given must match for the view to be selected; a view
+// with no criteria matches everything.
+type View struct {
+	// Placed in Context.View for callbacks run through this view, so it
+	// can be logged, etc.
+	Name string
+
+	// The remote address of the query (the resolver that sent it to
+	// PowerDNS) must be within one of these networks
+	Sources []netip.Prefix
+
+	// The local address the query was received on must be within one of
+	// these networks. This needs protocol version 2 or higher; with version
+	// 1, views that specify destinations never match.
+	Destinations []netip.Prefix
+
+	// The client network (the EDNS client subnet if present, or the remote
+	// address otherwise; see Context.ClientSubnet) must be within one of
+	// these networks. Since the answers then depend on the client, their
+	// ScopeBits are raised so that resolvers only give them to clients the
+	// same views would be chosen for.
+	Clients []netip.Prefix
+
+	// The routes used for queries in this view
+	Routes *DSL
+}
+
+// Add a view. When a query comes in, the views are checked in the order they
+// were added, and the routes of the first one that matches are used instead of
+// the routes registered directly against this DSL, which act as the default.
+func (d *DSL) AddView(v *View) {
+	if v.Routes != nil {
+		v.Routes.viewName = v.Name
+	}
+	d.views = append(d.views, v)
+}
+
+// Checks whether the view's criteria match the query
+func (v *View) matches(q *backend.Query) bool {
+	if len(v.Sources) > 0 {
+		remote, err := parsePrefix(q.RemoteIpAddress)
+		if err != nil || !contains(v.Sources, remote.Addr()) {
+			return false
+		}
+	}
+
+	if len(v.Destinations) > 0 {
+		local, err := parsePrefix(q.LocalIpAddress)
+		if err != nil || !contains(v.Destinations, local.Addr()) {
+			return false
+		}
+	}
+
+	if len(v.Clients) > 0 {
+		client, ok := clientSubnet(q)
+		if !ok || !contains(v.Clients, client.Addr()) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Finds the first view matching the query, if any, and the scope (as in
+// Context.ScopeBits) that the choice holds for. Views picked or passed over by
+// their Clients networks only hold for clients in as long a prefix as those
+// networks need, so answers mustn't be cached for a wider one.
+func (d *DSL) viewFor(q *backend.Query) (*View, int) {
+	scope := 0
+	client, ok := clientSubnet(q)
+	for _, v := range d.views {
+		if ok {
+			scope = max(scope, clientScope(client.Addr(), v.Clients))
+		}
+		if v.matches(q) {
+			return v, scope
+		}
+	}
+	return nil, scope
+}
+
+// The length of prefix of the client address that decides whether it is in
+// the networks or not
+func clientScope(addr netip.Addr, prefixes []netip.Prefix) int {
+	scope := 0
+	for _, prefix := range prefixes {
+		if prefix.Addr().Is4() != addr.Is4() {
+			continue
+		}
+		n := prefix.Bits()
+		if !prefix.Contains(addr) {
+			n = commonBits(addr, prefix.Addr()) + 1
+		}
+		scope = max(scope, n)
+	}
+	return scope
+}
+
+// Raises the scope of answers to at least the number of bits given
+func widenScope(answers []*backend.Response, bits int) {
+	if bits == 0 {
+		return
+	}
+	for i, answer := range answers {
+		if scope, err := strconv.Atoi(answer.ScopeBits); err == nil && scope < bits {
+			r := *answer
+			r.ScopeBits = strconv.Itoa(bits)
+			answers[i] = &r
+		}
+	}
+}
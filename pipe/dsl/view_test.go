@@ -0,0 +1,88 @@
+package dsl_test
+
+import (
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"net/netip"
+	"testing"
+)
+
+func Prefixes(strs ...string) []netip.Prefix {
+	out := make([]netip.Prefix, len(strs))
+	for i, str := range strs {
+		out[i] = netip.MustParsePrefix(str)
+	}
+	return out
+}
+
+func RoutesReplying(x string) *DSL {
+	d := New()
+	d.A(`.*`, func(c *Context) { c.Reply(x + " " + c.View) })
+	return d
+}
+
+func ViewDSL() *DSL {
+	d := RoutesReplying("default")
+	d.AddView(&View{Name: "office", Clients: Prefixes("10.1.0.0/16"), Routes: RoutesReplying("office")})
+	d.AddView(&View{Name: "internal", Sources: Prefixes("10.0.0.0/8"), Routes: RoutesReplying("internal")})
+	d.AddView(&View{
+		Name:         "listener",
+		Sources:      Prefixes("192.0.2.0/24"),
+		Destinations: Prefixes("198.51.100.53/32"),
+		Routes:       RoutesReplying("listener"),
+	})
+	return d
+}
+
+func AssertView(t *testing.T, remote, local, ecs, exp string) {
+	q := AQuery("www.example.com")
+	q.RemoteIpAddress = remote
+	q.LocalIpAddress = local
+	q.EdnsSubnetAddress = ecs
+	rsp := AssertLookup(t, ViewDSL(), q, 1, nil)
+	h.AssertEqualString(t, exp, rsp[0].Content, "Wrong view")
+}
+
+func TestFirstMatchingViewIsUsed(t *testing.T) {
+	AssertView(t, "10.1.2.3", "127.0.0.1", "", "office office")
+	AssertView(t, "10.2.2.3", "127.0.0.1", "", "internal internal")
+	AssertView(t, "10.2.2.3", "127.0.0.1", "10.1.5.0/24", "office office")
+}
+
+func TestViewsMatchOnDestination(t *testing.T) {
+	AssertView(t, "192.0.2.1", "198.51.100.53", "", "listener listener")
+	AssertView(t, "192.0.2.1", "198.51.100.54", "", "default ")
+	AssertView(t, "192.0.2.1", "", "", "default ")
+}
+
+func TestUnmatchedQueriesUseDefaultRoutes(t *testing.T) {
+	AssertView(t, "203.0.113.1", "127.0.0.1", "", "default ")
+}
+
+func TestValidateChecksViews(t *testing.T) {
+	d := New()
+	routes := New()
+	routes.Zone("example.com", nil)
+	d.AddView(&View{Name: "broken", Routes: routes})
+	err := d.Validate()
+	h.Assert(t, err != nil, "View errors should be reported")
+	h.AssertEqualString(t, "View broken: Zone example.com has no SOA record", err.Error(), "Bad error")
+}
+
+func AssertViewScope(t *testing.T, remote, ecs, exp, scope string) {
+	q := AQuery("www.example.com")
+	q.RemoteIpAddress = remote
+	q.EdnsSubnetAddress = ecs
+	rsp := AssertLookup(t, ViewDSL(), q, 1, nil)
+	h.AssertEqualString(t, exp, rsp[0].Content, "Wrong view")
+	h.AssertEqualString(t, scope, rsp[0].ScopeBits, "Wrong scope")
+}
+
+func TestViewsChosenByClientSetScope(t *testing.T) {
+	// Picked by the client network, so only good for clients within it
+	AssertViewScope(t, "10.2.2.3", "10.1.5.0/24", "office office", "16")
+
+	// Passed over by it, so only good for clients that are also outside
+	AssertViewScope(t, "192.0.2.1", "10.9.0.0/16", "default ", "13")
+	AssertViewScope(t, "10.2.2.3", "198.51.100.0/24", "internal internal", "1")
+}
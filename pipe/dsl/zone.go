@@ -0,0 +1,174 @@
+package dsl
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A zone groups routes under a common apex. Routes registered against a zone
+// are relative to the apex, and the zone answers its own SOA and NS queries
+// from the settings given to Zone.SOA and Zone.NS. Usage:
+//
+//	x.Zone("example.com", func(z *dsl.Zone) {
+//		z.SOA(dsl.SOA{
+//			MName: "ns1.example.com", RName: "hostmaster.example.com",
+//			Serial: 1, Refresh: 3600, Retry: 1800, Expire: 86400, Minimum: 3600,
+//		})
+//		z.NS("ns1.example.com", "ns2.example.com")
+//
+//		z.A("@", answer)   // example.com
+//		z.A("www", answer) // www.example.com
+//	})
+//
+//	// Zones without SOA or NS settings are reported here
+//	if err := x.Validate(); err != nil {
+//		log.Fatal(err)
+//	}
+type Zone struct {
+	// The apex of the zone, in lower case and without a trailing dot
+	Name string
+
+	// Replies from callbacks registered against this zone that don't
+	// specify a TTL will be given this instead. Defaults to the DSL's TTL.
+	DefaultTTL int
+
+	dsl *DSL
+	soa *SOA
+	ns  []string
+
+	// The hash of the zone's data last worked out for the DSL's Serials,
+	// and the generation of the DSL's routes it was worked out for
+	hash   string
+	hashAt uint64
+}
+
+// The fields of an SOA record. Times are given in seconds.
+type SOA struct {
+	MName   string
+	RName   string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	Minimum uint32
+}
+
+// Gives the SOA in the form used for the content of a response
+func (s SOA) String() string {
+	return fmt.Sprintf(
+		"%s %s %d %d %d %d %d",
+		s.MName, s.RName, s.Serial, s.Refresh, s.Retry, s.Expire, s.Minimum,
+	)
+}
+
+// Lower-cases a name and removes any trailing dot from it
+func canonical(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// Create (or find an existing) zone with the given apex, and run f against it
+// to register routes. SOA and NS callbacks for the apex are registered before
+// f is run, so they come first in ANY responses.
+func (d *DSL) Zone(name string, f func(z *Zone)) *Zone {
+	name = canonical(name)
+
+	z := d.findZone(name)
+	if z == nil {
+		z = &Zone{Name: name, DefaultTTL: d.defaultTTL, dsl: d}
+		d.zones = append(d.zones, z)
+
+		z.RegisterName("SOA", "@", func(c *Context) {
+			if z.soa == nil {
+				return
+			}
+			c.Reply(z.currentSOA(c.View).String())
+		})
+		z.RegisterName("NS", "@", func(c *Context) {
+			for _, ns := range z.ns {
+				c.Reply(ns)
+			}
+		})
+		for _, qtype := range []string{"SOA", "NS"} {
+			nodes := d.callbacks[qtype]
+			nodes[len(nodes)-1].settings = true
+		}
+	}
+
+	if f != nil {
+		f(z)
+	}
+
+	return z
+}
+
+func (d *DSL) findZone(name string) *Zone {
+	for _, z := range d.zones {
+		if z.Name == name {
+			return z
+		}
+	}
+	return nil
+}
+
+// Set the SOA record served at the zone apex. If the DSL has Serials (see
+// DSL.AutoSerial), they replace the serial given here.
+func (z *Zone) SOA(soa SOA) {
+	z.soa = &soa
+	z.dsl.generation++
+}
+
+// Set the NS records served at the zone apex. Replaces any previous set.
+func (z *Zone) NS(hosts ...string) {
+	z.ns = hosts
+	z.dsl.generation++
+}
+
+// Compile a matcher relative to the zone apex into a regular expression that
+// can be passed to Zone.Register. The rules are the same as for the DSL
+// helpers, except that:
+//
+// * "@" (or "") matches the apex itself
+// * Anything else has "\.<apex>" appended, so "www" matches www.example.com
+func (z *Zone) Compile(matcher string) *regexp.Regexp {
+	apex := regexp.QuoteMeta(z.Name)
+	if matcher == "" || matcher == "@" {
+		return regexp.MustCompile(fmt.Sprintf("^(?i)%s$", apex))
+	}
+	return regexp.MustCompile(fmt.Sprintf(`^(?i)(?:%s)\.%s$`, matcher, apex))
+}
+
+// Register a callback against the zone. This works like DSL.Register, but the
+// callback is run with the zone's DefaultTTL and has Context.Zone set.
+func (z *Zone) Register(qtype string, re *regexp.Regexp, f Callback) {
+	z.dsl.register(qtype, re, f, z)
+}
+
+// Checks that the routes registered make a servable set of zones: every zone
+// must have SOA and NS settings, and no name may have a CNAME alongside other
+// data. The routes of views, and DSLs mounted with DSL.Mount, are checked too.
+func (d *DSL) Validate() error {
+	for _, z := range d.zones {
+		if z.soa == nil {
+			return errors.New("Zone " + z.Name + " has no SOA record")
+		}
+		if len(z.ns) == 0 {
+			return errors.New("Zone " + z.Name + " has no NS records")
+		}
+	}
+	if err := d.validateCNAMEs(); err != nil {
+		return err
+	}
+	for _, m := range d.mounts {
+		if err := m.child.Validate(); err != nil {
+			return fmt.Errorf("Mount %s: %s", m.Name, err)
+		}
+	}
+	for _, v := range d.views {
+		if err := v.Routes.Validate(); err != nil {
+			return fmt.Errorf("View %s: %s", v.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package dsl_test
+
+import (
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"testing"
+)
+
+var ExampleSOA = SOA{
+	MName: "ns1.example.com", RName: "hostmaster.example.com",
+	Serial: 1, Refresh: 3600, Retry: 1800, Expire: 86400, Minimum: 300,
+}
+
+func BuildExampleZone(d *DSL) *Zone {
+	return d.Zone("Example.com.", func(z *Zone) {
+		z.SOA(ExampleSOA)
+		z.NS("ns1.example.com", "ns2.example.com")
+		z.A("@", ReplyHandler("192.0.2.1"))
+		z.A("www", ReplyHandler("192.0.2.2"))
+	})
+}
+
+func TestSOAString(t *testing.T) {
+	h.AssertEqualString(
+		t, "ns1.example.com hostmaster.example.com 1 3600 1800 86400 300",
+		ExampleSOA.String(), "Bad SOA serialisation",
+	)
+}
+
+func TestZoneAnswersSOAAndNSFromSettings(t *testing.T) {
+	d := New()
+	BuildExampleZone(d)
+
+	rsp := AssertLookup(t, d, SOAQuery(), 1, nil)
+	h.AssertEqualString(t, ExampleSOA.String(), rsp[0].Content, "Bad SOA answer")
+
+	q := SOAQuery()
+	q.QType = "NS"
+	rsp = AssertLookup(t, d, q, 2, nil)
+	h.AssertEqualString(t, "ns1.example.com", rsp[0].Content, "Bad NS answer")
+	h.AssertEqualString(t, "ns2.example.com", rsp[1].Content, "Bad NS answer")
+}
+
+func TestZoneAnyPutsSOAAndNSFirst(t *testing.T) {
+	d := New()
+	BuildExampleZone(d)
+	q := SOAQuery()
+	q.QType = "ANY"
+	rsp := AssertLookup(t, d, q, 4, nil)
+	h.AssertEqualString(t, "SOA", rsp[0].QType, "SOA should be first")
+	h.AssertEqualString(t, "NS", rsp[1].QType, "NS should be next")
+	h.AssertEqualString(t, "192.0.2.1", rsp[3].Content, "Apex A missing")
+}
+
+func TestZoneRoutesAreRelativeToApex(t *testing.T) {
+	d := New()
+	BuildExampleZone(d)
+	q := SOAQuery()
+	q.QType = "A"
+	q.QName = "WWW.example.com"
+	rsp := AssertLookup(t, d, q, 1, nil)
+	h.AssertEqualString(t, "192.0.2.2", rsp[0].Content, "Relative route not matched")
+
+	q.QName = "www.example.org"
+	AssertLookup(t, d, q, 0, nil)
+
+	q.QName = "wwwexample.com"
+	AssertLookup(t, d, q, 0, nil)
+}
+
+func TestZoneCaptureGroupsAreRelative(t *testing.T) {
+	d := New()
+	BuildExampleZone(d).TXT(`(.*)`, func(c *Context) { c.Reply(c.Matches[0]) })
+	q := SOAQuery()
+	q.QType = "TXT"
+	q.QName = "foo.bar.example.com"
+	rsp := AssertLookup(t, d, q, 1, nil)
+	h.AssertEqualString(t, "foo.bar", rsp[0].Content, "Bad capture")
+}
+
+func TestZoneDefaultTTLAndContext(t *testing.T) {
+	d := New()
+	var zone *Zone
+	z := d.Zone("example.com", func(z *Zone) {
+		z.DefaultTTL = 60
+		z.A("@", func(c *Context) { zone = c.Zone; c.Reply("192.0.2.1") })
+	})
+	d.A(`example\.com`, ReplyHandler("192.0.2.2"))
+
+	q := SOAQuery()
+	q.QType = "A"
+	rsp := AssertLookup(t, d, q, 2, nil)
+	h.AssertEqualString(t, "60", rsp[0].TTL, "Zone TTL not used")
+	h.AssertEqualString(t, "3600", rsp[1].TTL, "DSL TTL not used outside zone")
+	h.Assert(t, zone == z, "Context.Zone not set")
+}
+
+func TestZoneCanBeReopened(t *testing.T) {
+	d := New()
+	a := BuildExampleZone(d)
+	b := d.Zone("example.com", nil)
+	h.Assert(t, a == b, "Zone should have been reused")
+}
+
+func TestValidateRequiresSOAAndNS(t *testing.T) {
+	d := New()
+	h.RefuteError(t, d.Validate(), "Empty DSL should validate")
+
+	z := d.Zone("example.com", nil)
+	err := d.Validate()
+	h.Assert(t, err != nil, "Missing SOA not reported")
+	h.AssertEqualString(t, "Zone example.com has no SOA record", err.Error(), "Bad error")
+
+	z.SOA(ExampleSOA)
+	err = d.Validate()
+	h.Assert(t, err != nil, "Missing NS not reported")
+	h.AssertEqualString(t, "Zone example.com has no NS records", err.Error(), "Bad error")
+
+	z.NS("ns1.example.com")
+	h.RefuteError(t, d.Validate(), "Complete zone should validate")
+}
+
+func TestStringGroupsRoutesByZone(t *testing.T) {
+	d := New()
+	d.A(`foo`, NullHandler)
+	d.Zone("example.com", func(z *Zone) { z.A("www", NullHandler) })
+
+	exp := "A\t:\t^(?i)foo$\n" +
+		"zone example.com\n" +
+		"A\t:\t^(?i)(?:www)\\.example\\.com$\n" +
+		"SOA\t:\t^(?i)example\\.com$\n" +
+		"NS\t:\t^(?i)example\\.com$\n"
+	h.AssertEqualString(t, exp, d.String(), "Bad table")
+}
@@ -0,0 +1,135 @@
+package zonefile
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Handles $GENERATE start-stop[/step] lhs [ttl] [class] type rhs, as in BIND.
+// In lhs and rhs, "$" is replaced by the iterator, and ${offset,width,base}
+// gives more control: base is d, o, x, X, n or N (n and N give the nibbles in
+// reverse order, separated by dots, as used under ip6.arpa). "\$" is a literal
+// dollar sign.
+func (p *parser) generate(args []token) error {
+	if len(args) < 3 {
+		return fmt.Errorf("$GENERATE takes a range, a name, a type and content")
+	}
+
+	start, stop, step, err := parseRange(args[0].text)
+	if err != nil {
+		return err
+	}
+
+	for i := start; i <= stop; i += step {
+		tokens := make([]token, 0, len(args)-1)
+		for _, t := range args[1:] {
+			text, err := substitute(t.text, i)
+			if err != nil {
+				return err
+			}
+			tokens = append(tokens, token{text: text, quoted: t.quoted})
+		}
+		if err := p.record(tokens, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseRange(s string) (int, int, int, error) {
+	bad := fmt.Errorf("Bad $GENERATE range: %q", s)
+	step := 1
+
+	if i := strings.Index(s, "/"); i >= 0 {
+		n, err := strconv.Atoi(s[i+1:])
+		if err != nil || n < 1 {
+			return 0, 0, 0, bad
+		}
+		s, step = s[:i], n
+	}
+
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, 0, bad
+	}
+	start, err1 := strconv.Atoi(parts[0])
+	stop, err2 := strconv.Atoi(parts[1])
+	if err1 != nil || err2 != nil || start < 0 || stop < start || stop-start > 65535 {
+		return 0, 0, 0, bad
+	}
+	return start, stop, step, nil
+}
+
+func substitute(s string, i int) (string, error) {
+	var out strings.Builder
+	for pos := 0; pos < len(s); pos++ {
+		switch {
+		case s[pos] == '\\' && pos+1 < len(s) && s[pos+1] == '$':
+			out.WriteByte('$')
+			pos++
+		case s[pos] != '$':
+			out.WriteByte(s[pos])
+		case pos+1 < len(s) && s[pos+1] == '{':
+			end := strings.Index(s[pos:], "}")
+			if end < 0 {
+				return "", fmt.Errorf("Unterminated ${ in %q", s)
+			}
+			formatted, err := format(s[pos+2:pos+end], i)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(formatted)
+			pos += end
+		default:
+			out.WriteString(strconv.Itoa(i))
+		}
+	}
+	return out.String(), nil
+}
+
+// Formats the iterator according to "offset[,width[,base]]"
+func format(spec string, i int) (string, error) {
+	bad := fmt.Errorf("Bad $GENERATE modifier: %q", spec)
+	parts := strings.Split(spec, ",")
+	if len(parts) > 3 {
+		return "", bad
+	}
+
+	offset, width, base := 0, 0, "d"
+	var err error
+	if offset, err = strconv.Atoi(parts[0]); err != nil {
+		return "", bad
+	}
+	if len(parts) > 1 {
+		if width, err = strconv.Atoi(parts[1]); err != nil || width < 0 {
+			return "", bad
+		}
+	}
+	if len(parts) > 2 {
+		base = parts[2]
+	}
+
+	n := i + offset
+	switch base {
+	case "d":
+		return fmt.Sprintf("%0*d", width, n), nil
+	case "o":
+		return fmt.Sprintf("%0*o", width, n), nil
+	case "x":
+		return fmt.Sprintf("%0*x", width, n), nil
+	case "X":
+		return fmt.Sprintf("%0*X", width, n), nil
+	case "n", "N":
+		hex := fmt.Sprintf("%0*x", width, n)
+		if base == "N" {
+			hex = strings.ToUpper(hex)
+		}
+		nibbles := make([]string, len(hex))
+		for j := range hex {
+			nibbles[len(hex)-1-j] = hex[j : j+1]
+		}
+		return strings.Join(nibbles, "."), nil
+	}
+	return "", bad
+}
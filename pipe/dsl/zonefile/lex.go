@@ -0,0 +1,126 @@
+package zonefile
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A logical line of a zone file: parentheses may have joined several physical
+// lines together, and comments have been removed
+type line struct {
+	// The physical line the logical one started on
+	num int
+
+	// Whether the line began with whitespace, so has no owner name
+	indented bool
+
+	tokens []token
+}
+
+type token struct {
+	text string
+
+	// Quoted strings are given without the quotes, but with any escapes
+	// left as they were
+	quoted bool
+}
+
+// Splits zone file data into logical lines of tokens
+func lex(data string) ([]line, error) {
+	var lines []line
+	var tok strings.Builder
+	cur := line{num: 1}
+	num, depth := 1, 0
+	inToken, inQuote, fresh := false, false, true
+
+	flush := func() {
+		if inToken {
+			cur.tokens = append(cur.tokens, token{text: tok.String(), quoted: inQuote})
+			tok.Reset()
+			inToken, inQuote = false, false
+		}
+	}
+
+	for i := 0; i < len(data); i++ {
+		ch := data[i]
+
+		if inQuote {
+			switch ch {
+			case '\\':
+				tok.WriteByte(ch)
+				if i+1 < len(data) {
+					i++
+					tok.WriteByte(data[i])
+				}
+			case '"':
+				flush()
+			case '\n':
+				return nil, fmt.Errorf("line %d: Unterminated quoted string", num)
+			default:
+				tok.WriteByte(ch)
+			}
+			continue
+		}
+
+		if ch != ' ' && ch != '\t' && ch != '\r' && ch != '\n' {
+			fresh = false
+		}
+
+		switch ch {
+		case ';':
+			for i+1 < len(data) && data[i+1] != '\n' {
+				i++
+			}
+		case '"':
+			flush()
+			inToken, inQuote = true, true
+		case '(':
+			flush()
+			depth++
+		case ')':
+			flush()
+			if depth == 0 {
+				return nil, fmt.Errorf("line %d: Unbalanced parentheses", num)
+			}
+			depth--
+		case ' ', '\t', '\r':
+			if fresh && !inToken && len(cur.tokens) == 0 && depth == 0 {
+				cur.indented = true
+			}
+			flush()
+		case '\n':
+			flush()
+			num++
+			fresh = true
+			if depth == 0 {
+				if len(cur.tokens) > 0 {
+					lines = append(lines, cur)
+				}
+				cur = line{num: num}
+			}
+		case '\\':
+			inToken = true
+			tok.WriteByte(ch)
+			if i+1 < len(data) {
+				i++
+				tok.WriteByte(data[i])
+			}
+		default:
+			inToken = true
+			tok.WriteByte(ch)
+		}
+	}
+
+	if inQuote {
+		return nil, errors.New("Unterminated quoted string at end of file")
+	}
+	if depth > 0 {
+		return nil, errors.New("Unbalanced parentheses at end of file")
+	}
+	flush()
+	if len(cur.tokens) > 0 {
+		lines = append(lines, cur)
+	}
+	return lines, nil
+}
@@ -0,0 +1,67 @@
+package zonefile
+
+import (
+	"bufio"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Enumerate a zone with DSL.Contents, and write it out with Write
+func Export(w io.Writer, d *dsl.DSL, zone string) error {
+	zc, err := d.Contents(zone)
+	if err != nil {
+		return err
+	}
+	return Write(w, zc)
+}
+
+// Write the contents of a zone as a zone file, one record per line with
+// absolute names and explicit TTLs, the SOA first. Routes that can't be
+// enumerated are listed in comments at the end. The output can be read back
+// with Parse.
+func Write(w io.Writer, zc *dsl.ZoneContents) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("$ORIGIN " + absolute(zc.Name) + "\n")
+
+	for _, r := range zc.Records {
+		bw.WriteString(strings.Join([]string{
+			absolute(r.Name), strconv.Itoa(*r.TTL), "IN", r.Type, fileContent(r.Type, r.Content),
+		}, "\t") + "\n")
+	}
+
+	if len(zc.Dynamic) > 0 {
+		bw.WriteString("\n; Dynamic routes, whose records can't be listed:\n")
+		for _, desc := range zc.Dynamic {
+			bw.WriteString("; " + strings.Replace(desc, "\n", " ", -1) + "\n")
+		}
+	}
+
+	return bw.Flush()
+}
+
+// Adds the trailing dot to a name
+func absolute(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// Turns the content of a record, in the form PowerDNS uses, into the form used
+// in zone files, by making the names in it absolute
+func fileContent(qtype, content string) string {
+	positions := namePositions[qtype]
+	if len(positions) == 0 {
+		return content
+	}
+
+	fields := strings.Fields(content)
+	for _, pos := range positions {
+		if pos < len(fields) {
+			fields[pos] = absolute(fields[pos])
+		}
+	}
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,362 @@
+// Copyright 2015 Bytemark Computer Consulting Ltd. All rights reserved
+// Licensed under the GNU General Public License, version 2. See the LICENSE
+// file for more details
+
+// Reads RFC 1035 ("BIND") zone files into static DSL records. Usage:
+//
+//	// Into a zone, which takes its SOA and NS settings from the file
+//	x.Zone("example.com", func(z *dsl.Zone) {
+//		if err := zonefile.LoadZone(z, "/etc/zones/example.com.zone"); err != nil {
+//			log.Fatal(err)
+//		}
+//	})
+//
+//	// Or straight into the DSL, SOA and NS records included
+//	err := zonefile.Load(x, "/etc/zones/example.org.zone", "example.org")
+//
+// The $ORIGIN, $TTL, $INCLUDE and $GENERATE directives are supported, as are
+// relative names, "@", owner names carried over from the previous record,
+// parentheses spanning lines, comments and quoted strings. Only the IN class
+// is supported. TTLs may use BIND-style units, such as 1h30m.
+//
+// Names in record content are made absolute for the types we know to contain
+// them (NS, CNAME, MX, SRV, SOA and so on); other content is passed through as
+// it is, which suits PowerDNS for most types.
+//
+// Zones can be written out again, as the DSL sees them, with Export:
+//
+//	err := zonefile.Export(os.Stdout, x, "example.com")
+package zonefile
+
+import (
+	"fmt"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// How deeply $INCLUDE may be nested
+const maxIncludeDepth = 10
+
+// Parse the zone file at path, with the given initial origin
+func ParseFile(path, origin string) ([]dsl.Record, error) {
+	p := &parser{origin: canonical(origin)}
+	if err := p.parseFile(path); err != nil {
+		return nil, err
+	}
+	return p.records, nil
+}
+
+// Parse zone file data from a reader, with the given initial origin. Files
+// named in $INCLUDE directives are relative to the working directory.
+func Parse(r io.Reader, origin string) ([]dsl.Record, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parser{origin: canonical(origin)}
+	if err := p.parse(string(data), "", "."); err != nil {
+		return nil, err
+	}
+	return p.records, nil
+}
+
+// Parse the zone file at path, and register its records with DSL.Static
+func Load(d *dsl.DSL, path, origin string) error {
+	records, err := ParseFile(path, origin)
+	if err != nil {
+		return err
+	}
+	d.Static(records...)
+	return nil
+}
+
+// Parse the zone file at path, using the zone apex as the origin, and register
+// its records with Zone.Static. Every record must be within the zone.
+func LoadZone(z *dsl.Zone, path string) error {
+	records, err := ParseFile(path, z.Name)
+	if err != nil {
+		return err
+	}
+
+	for i, r := range records {
+		if r.Name != z.Name && !strings.HasSuffix(r.Name, "."+z.Name) {
+			return fmt.Errorf("%s: %s is outside zone %s", path, r.Name, z.Name)
+		}
+		records[i].Name = r.Name + "."
+	}
+	z.Static(records...)
+	return nil
+}
+
+func canonical(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+type parser struct {
+	records []dsl.Record
+	origin  string
+	owner   string
+	depth   int
+
+	// $TTL, the last TTL given explicitly, and the SOA minimum
+	defaultTTL, lastTTL, soaMinimum int
+	hasDefault, hasLast, hasSOA     bool
+}
+
+func (p *parser) parseFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return p.parse(string(data), path, filepath.Dir(path))
+}
+
+func (p *parser) parse(data, file, dir string) error {
+	lines, err := lex(data)
+	if err != nil {
+		return where(file, err)
+	}
+
+	for _, l := range lines {
+		var err error
+		if !l.indented && strings.HasPrefix(l.tokens[0].text, "$") {
+			err = p.directive(l, dir)
+		} else {
+			err = p.record(l.tokens, l.indented)
+		}
+		if err != nil {
+			return where(file, fmt.Errorf("line %d: %s", l.num, err))
+		}
+	}
+	return nil
+}
+
+func where(file string, err error) error {
+	if file == "" {
+		return err
+	}
+	return fmt.Errorf("%s: %s", file, err)
+}
+
+func (p *parser) directive(l line, dir string) error {
+	args := l.tokens[1:]
+	switch strings.ToUpper(l.tokens[0].text) {
+	case "$ORIGIN":
+		if len(args) != 1 {
+			return fmt.Errorf("$ORIGIN takes one name")
+		}
+		p.origin = p.absolute(args[0].text)
+
+	case "$TTL":
+		if len(args) != 1 {
+			return fmt.Errorf("$TTL takes one TTL")
+		}
+		ttl, ok := parseTTL(args[0].text)
+		if !ok {
+			return fmt.Errorf("Bad TTL: %q", args[0].text)
+		}
+		p.defaultTTL, p.hasDefault = ttl, true
+
+	case "$INCLUDE":
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf("$INCLUDE takes a file name and an optional origin")
+		}
+		if p.depth >= maxIncludeDepth {
+			return fmt.Errorf("$INCLUDE nested too deeply")
+		}
+
+		// The origin and owner of this file aren't changed by the include
+		origin, owner := p.origin, p.owner
+		if len(args) == 2 {
+			p.origin = p.absolute(args[1].text)
+		}
+		path := args[0].text
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+
+		p.depth++
+		err := p.parseFile(path)
+		p.depth--
+		p.origin, p.owner = origin, owner
+		return err
+
+	case "$GENERATE":
+		return p.generate(args)
+
+	default:
+		return fmt.Errorf("Unknown directive: %s", l.tokens[0].text)
+	}
+	return nil
+}
+
+func (p *parser) record(tokens []token, indented bool) error {
+	if indented {
+		if p.owner == "" {
+			return fmt.Errorf("No owner name")
+		}
+	} else {
+		p.owner = p.absolute(tokens[0].text)
+		tokens = tokens[1:]
+	}
+
+	ttl, hasTTL := 0, false
+	for len(tokens) > 0 {
+		text := tokens[0].text
+		if isClass(text) {
+			if !strings.EqualFold(text, "IN") {
+				return fmt.Errorf("Only the IN class is supported")
+			}
+		} else if n, ok := parseTTL(text); ok && !hasTTL {
+			ttl, hasTTL = n, true
+		} else {
+			break
+		}
+		tokens = tokens[1:]
+	}
+	if len(tokens) == 0 {
+		return fmt.Errorf("No record type")
+	}
+
+	qtype := strings.ToUpper(tokens[0].text)
+	content, err := p.content(qtype, tokens[1:])
+	if err != nil {
+		return err
+	}
+
+	if qtype == "SOA" {
+		soa, _ := dsl.ParseSOA(content)
+		p.soaMinimum, p.hasSOA = int(soa.Minimum), true
+	}
+
+	switch {
+	case hasTTL:
+		p.lastTTL, p.hasLast = ttl, true
+	case p.hasDefault:
+		ttl = p.defaultTTL
+	case p.hasLast:
+		ttl = p.lastTTL
+	case p.hasSOA:
+		ttl = p.soaMinimum
+	default:
+		return fmt.Errorf("No TTL given, and no $TTL or SOA record to take it from")
+	}
+
+	p.records = append(p.records, dsl.Record{Name: p.owner, Type: qtype, TTL: dsl.TTL(ttl), Content: content})
+	return nil
+}
+
+// Turns a name in the zone file into an absolute one, without a trailing dot
+func (p *parser) absolute(name string) string {
+	switch {
+	case name == "@":
+		return p.origin
+	case strings.HasSuffix(name, "."):
+		return canonical(name)
+	case p.origin == "":
+		return canonical(name)
+	}
+	return canonical(name + "." + p.origin)
+}
+
+func isClass(s string) bool {
+	switch strings.ToUpper(s) {
+	case "IN", "CH", "CS", "HS":
+		return true
+	}
+	return false
+}
+
+// Parses a TTL in seconds, or with BIND-style units: 1w2d3h4m5s
+func parseTTL(s string) (int, bool) {
+	if n, err := strconv.ParseUint(s, 10, 31); err == nil {
+		return int(n), true
+	}
+
+	total, n, digits := 0, 0, false
+	for _, ch := range strings.ToLower(s) {
+		switch {
+		case ch >= '0' && ch <= '9':
+			n, digits = n*10+int(ch-'0'), true
+			continue
+		case !digits:
+			return 0, false
+		case ch == 's':
+		case ch == 'm':
+			n *= 60
+		case ch == 'h':
+			n *= 3600
+		case ch == 'd':
+			n *= 86400
+		case ch == 'w':
+			n *= 604800
+		default:
+			return 0, false
+		}
+		total, n, digits = total+n, 0, false
+	}
+	if digits || total > 1<<31-1 {
+		return 0, false
+	}
+	return total, true
+}
+
+// The positions of names in the content of the types we know about
+var namePositions = map[string][]int{
+	"NS": {0}, "CNAME": {0}, "PTR": {0}, "DNAME": {0},
+	"MB": {0}, "MD": {0}, "MF": {0}, "MG": {0}, "MR": {0},
+	"MX": {1}, "AFSDB": {1}, "RT": {1}, "KX": {1},
+	"SRV": {3}, "NAPTR": {5},
+	"SOA": {0, 1}, "RP": {0, 1}, "MINFO": {0, 1},
+}
+
+// Builds the content of a record, in the form PowerDNS expects
+func (p *parser) content(qtype string, rdata []token) (string, error) {
+	if len(rdata) == 0 {
+		return "", fmt.Errorf("No content for %s record", qtype)
+	}
+
+	fields := make([]string, len(rdata))
+	for i, t := range rdata {
+		switch {
+		case t.quoted:
+			fields[i] = `"` + t.text + `"`
+		case qtype == "TXT" || qtype == "SPF":
+			fields[i] = `"` + strings.Replace(t.text, `"`, `\"`, -1) + `"`
+		default:
+			fields[i] = t.text
+		}
+	}
+
+	for _, pos := range namePositions[qtype] {
+		if pos >= len(fields) {
+			return "", fmt.Errorf("Too few fields for %s record", qtype)
+		}
+		if fields[pos] != "." {
+			fields[pos] = p.absolute(fields[pos])
+		}
+	}
+
+	if qtype == "SOA" {
+		if len(fields) != 7 {
+			return "", fmt.Errorf("SOA record should have 7 fields")
+		}
+		if _, err := strconv.ParseUint(fields[2], 10, 32); err != nil {
+			return "", fmt.Errorf("Bad SOA serial: %q", fields[2])
+		}
+		for i := 3; i < 7; i++ {
+			n, ok := parseTTL(fields[i])
+			if !ok {
+				return "", fmt.Errorf("Bad SOA timer: %q", fields[i])
+			}
+			fields[i] = strconv.Itoa(n)
+		}
+	}
+
+	return strings.Join(fields, " "), nil
+}
@@ -0,0 +1,226 @@
+package zonefile_test
+
+import (
+	"fmt"
+	"github.com/BytemarkHosting/go-pdns/pipe/backend"
+	"github.com/BytemarkHosting/go-pdns/pipe/dsl"
+	. "github.com/BytemarkHosting/go-pdns/pipe/dsl/zonefile"
+	h "github.com/BytemarkHosting/go-pdns/pipe/test_helpers"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const exampleZone = `
+$ORIGIN example.com.
+$TTL 1h
+@	IN	SOA	ns1 hostmaster (
+		2015010101 ; serial
+		3h 15m 1w 300 )
+	IN	NS	ns1
+	IN	NS	ns2.example.net.
+	IN	MX	10 mail
+www	300	IN	A	192.0.2.1
+	IN	300	AAAA	2001:db8::1
+mail	A	192.0.2.2
+*.dyn	A	192.0.2.3
+txt	TXT	"hello world" "say \"hi\"; ok" unquoted
+_sip._tcp	SRV	0 5 5060 sip
+null	MX	0 .
+`
+
+func Dump(records []dsl.Record) string {
+	out := make([]string, len(records))
+	for i, r := range records {
+		out[i] = fmt.Sprintf("%s %d %s %s", r.Name, *r.TTL, r.Type, r.Content)
+	}
+	return strings.Join(out, "\n")
+}
+
+func AssertParse(t *testing.T, zone, origin, exp string) {
+	records, err := Parse(strings.NewReader(zone), origin)
+	h.RefuteError(t, err, "Parse")
+	h.AssertEqualString(t, exp, Dump(records), "Wrong records")
+}
+
+func AssertParseError(t *testing.T, zone, exp string) {
+	_, err := Parse(strings.NewReader(zone), "example.com")
+	if err == nil {
+		t.Fatalf("Expected error %q", exp)
+	}
+	h.AssertEqualString(t, exp, err.Error(), "Wrong error")
+}
+
+func TestParse(t *testing.T) {
+	AssertParse(t, exampleZone, "", strings.Join([]string{
+		"example.com 3600 SOA ns1.example.com hostmaster.example.com 2015010101 10800 900 604800 300",
+		"example.com 3600 NS ns1.example.com",
+		"example.com 3600 NS ns2.example.net",
+		"example.com 3600 MX 10 mail.example.com",
+		"www.example.com 300 A 192.0.2.1",
+		"www.example.com 300 AAAA 2001:db8::1",
+		"mail.example.com 3600 A 192.0.2.2",
+		"*.dyn.example.com 3600 A 192.0.2.3",
+		`txt.example.com 3600 TXT "hello world" "say \"hi\"; ok" "unquoted"`,
+		"_sip._tcp.example.com 3600 SRV 0 5 5060 sip.example.com",
+		"null.example.com 3600 MX 0 .",
+	}, "\n"))
+}
+
+func TestTTLDefaults(t *testing.T) {
+	// Without $TTL, the last TTL given is used, or else the SOA minimum
+	AssertParse(t, "@ SOA ns1 hm 1 2 3 4 60\na A 192.0.2.1\nb 1d A 192.0.2.2\nc A 192.0.2.3\n", "example.com",
+		"example.com 60 SOA ns1.example.com hm.example.com 1 2 3 4 60\n"+
+			"a.example.com 60 A 192.0.2.1\n"+
+			"b.example.com 86400 A 192.0.2.2\n"+
+			"c.example.com 86400 A 192.0.2.3",
+	)
+	AssertParseError(t, "a A 192.0.2.1", "line 1: No TTL given, and no $TTL or SOA record to take it from")
+}
+
+func TestGenerate(t *testing.T) {
+	AssertParse(t, "$TTL 300\n$GENERATE 1-3 host-$ A 192.0.2.$\n", "example.com",
+		"host-1.example.com 300 A 192.0.2.1\n"+
+			"host-2.example.com 300 A 192.0.2.2\n"+
+			"host-3.example.com 300 A 192.0.2.3",
+	)
+	AssertParse(t, "$TTL 300\n$GENERATE 10-30/10 ${-9,3,d} 60 IN PTR ip-${0,2,x}-\\$.example.com.\n", "2.0.192.in-addr.arpa",
+		"001.2.0.192.in-addr.arpa 60 PTR ip-0a-$.example.com\n"+
+			"011.2.0.192.in-addr.arpa 60 PTR ip-14-$.example.com\n"+
+			"021.2.0.192.in-addr.arpa 60 PTR ip-1e-$.example.com",
+	)
+	AssertParse(t, "$TTL 300\n$GENERATE 171-171 ${0,4,n} PTR x\n", "8.b.d.0.1.0.0.2.ip6.arpa",
+		"b.a.0.0.8.b.d.0.1.0.0.2.ip6.arpa 300 PTR x.8.b.d.0.1.0.0.2.ip6.arpa",
+	)
+	AssertParseError(t, "$GENERATE 3-1 x A 192.0.2.1", `line 1: Bad $GENERATE range: "3-1"`)
+}
+
+func TestParseErrors(t *testing.T) {
+	AssertParseError(t, "$TTL 1h\nwww A (192.0.2.1", "Unbalanced parentheses at end of file")
+	AssertParseError(t, "$TTL 1h\nwww TXT \"oops\n", "line 2: Unterminated quoted string")
+	AssertParseError(t, "$TTL 1h\n\n  A 192.0.2.1", "line 3: No owner name")
+	AssertParseError(t, "$TTL 1h\nwww CH A 192.0.2.1", "line 2: Only the IN class is supported")
+	AssertParseError(t, "$TTL 1h\nwww A", "line 2: No content for A record")
+	AssertParseError(t, "$TTL 1h\n@ SOA ns1 hm x 1 2 3 4", `line 2: Bad SOA serial: "x"`)
+	AssertParseError(t, "$BOGUS", "line 1: Unknown directive: $BOGUS")
+}
+
+func WriteFile(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	h.RefuteError(t, os.WriteFile(path, []byte(content), 0644), "Writing "+name)
+	return path
+}
+
+func TestInclude(t *testing.T) {
+	dir := t.TempDir()
+	WriteFile(t, dir, "hosts.inc", "www A 192.0.2.1\n")
+	path := WriteFile(t, dir, "example.com.zone",
+		"$TTL 300\n$INCLUDE hosts.inc sub.example.com.\nmail A 192.0.2.2\n$INCLUDE missing.inc\n",
+	)
+
+	_, err := ParseFile(path, "example.com")
+	h.Assert(t, err != nil && strings.HasPrefix(err.Error(), path+": line 4: open "), "Missing include should fail: "+fmt.Sprint(err))
+
+	WriteFile(t, dir, "example.com.zone", "$TTL 300\n$INCLUDE hosts.inc sub.example.com.\nmail A 192.0.2.2\n")
+	records, err := ParseFile(path, "example.com")
+	h.RefuteError(t, err, "ParseFile")
+	h.AssertEqualString(t, "www.sub.example.com 300 A 192.0.2.1\nmail.example.com 300 A 192.0.2.2", Dump(records), "Wrong records")
+
+	// Includes can't go on forever
+	WriteFile(t, dir, "loop.inc", "$INCLUDE loop.inc\n")
+	_, err = ParseFile(filepath.Join(dir, "loop.inc"), "example.com")
+	h.Assert(t, err != nil && strings.HasSuffix(err.Error(), "$INCLUDE nested too deeply"), "Loop should fail")
+}
+
+func Query(qtype, qname string) *backend.Query {
+	q := h.FakeQuery(3)
+	q.QType, q.QName = qtype, qname
+	return q
+}
+
+func AssertAnswers(t *testing.T, d *dsl.DSL, q *backend.Query, exp string) {
+	rsp, err := d.Lookup(q)
+	h.RefuteError(t, err, "Lookup")
+	out := make([]string, len(rsp))
+	for i, r := range rsp {
+		out[i] = r.QType + " " + r.TTL + " " + r.Content
+	}
+	h.AssertEqualString(t, exp, strings.Join(out, "\n"), "Wrong answers for "+q.QName)
+}
+
+func TestLoadZone(t *testing.T) {
+	path := WriteFile(t, t.TempDir(), "example.com.zone", exampleZone)
+
+	d := dsl.New()
+	var err error
+	d.Zone("example.com", func(z *dsl.Zone) { err = LoadZone(z, path) })
+	h.RefuteError(t, err, "LoadZone")
+	h.RefuteError(t, d.Validate(), "Validate")
+
+	AssertAnswers(t, d, Query("SOA", "example.com"), "SOA 3600 ns1.example.com hostmaster.example.com 2015010101 10800 900 604800 300")
+	AssertAnswers(t, d, Query("NS", "example.com"), "NS 3600 ns1.example.com\nNS 3600 ns2.example.net")
+	AssertAnswers(t, d, Query("ANY", "www.example.com"), "A 300 192.0.2.1\nAAAA 300 2001:db8::1")
+	AssertAnswers(t, d, Query("A", "foo.dyn.example.com"), "A 3600 192.0.2.3")
+	AssertAnswers(t, d, Query("A", "mail.dyn.example.com"), "A 3600 192.0.2.3")
+
+	path = WriteFile(t, t.TempDir(), "bad.zone", "$TTL 1h\nwww.example.org. A 192.0.2.1\n")
+	d.Zone("example.com", func(z *dsl.Zone) { err = LoadZone(z, path) })
+	h.AssertEqualString(t, path+": www.example.org is outside zone example.com", err.Error(), "Wrong error")
+}
+
+func TestLoad(t *testing.T) {
+	path := WriteFile(t, t.TempDir(), "example.com.zone", exampleZone)
+
+	d := dsl.New()
+	h.RefuteError(t, Load(d, path, "example.com"), "Load")
+	AssertAnswers(t, d, Query("MX", "example.com"), "MX 3600 10 mail.example.com")
+	AssertAnswers(t, d, Query("TXT", "txt.example.com"), `TXT 3600 "hello world" "say \"hi\"; ok" "unquoted"`)
+}
+
+func TestLoadZeroTTL(t *testing.T) {
+	path := WriteFile(t, t.TempDir(), "zero.zone", "$TTL 0\nwww 0 IN A 192.0.2.1\nftp IN A 192.0.2.2\nmail 60 IN A 192.0.2.3\n")
+
+	d := dsl.New()
+	h.RefuteError(t, Load(d, path, "example.com"), "Load")
+	AssertAnswers(t, d, Query("A", "www.example.com"), "A 0 192.0.2.1")
+	AssertAnswers(t, d, Query("A", "ftp.example.com"), "A 0 192.0.2.2")
+	AssertAnswers(t, d, Query("A", "mail.example.com"), "A 60 192.0.2.3")
+}
+
+func TestExport(t *testing.T) {
+	d := dsl.New()
+	var err error
+	d.Zone("example.com", func(z *dsl.Zone) {
+		err = LoadZone(z, WriteFile(t, t.TempDir(), "example.com.zone", exampleZone))
+		z.TXT("dyn", func(c *dsl.Context) { c.Reply(`"dynamic"`) })
+	})
+	h.RefuteError(t, err, "LoadZone")
+
+	var out strings.Builder
+	h.RefuteError(t, Export(&out, d, "example.com"), "Export")
+	h.AssertEqualString(t, strings.Join([]string{
+		"$ORIGIN example.com.",
+		"example.com.\t3600\tIN\tSOA\tns1.example.com. hostmaster.example.com. 2015010101 10800 900 604800 300",
+		"example.com.\t3600\tIN\tNS\tns1.example.com.",
+		"example.com.\t3600\tIN\tNS\tns2.example.net.",
+		"example.com.\t3600\tIN\tMX\t10 mail.example.com.",
+		"_sip._tcp.example.com.\t3600\tIN\tSRV\t0 5 5060 sip.example.com.",
+		"*.dyn.example.com.\t3600\tIN\tA\t192.0.2.3",
+		"mail.example.com.\t3600\tIN\tA\t192.0.2.2",
+		"null.example.com.\t3600\tIN\tMX\t0 .",
+		"txt.example.com.\t3600\tIN\tTXT\t\"hello world\" \"say \\\"hi\\\"; ok\" \"unquoted\"",
+		"www.example.com.\t300\tIN\tA\t192.0.2.1",
+		"www.example.com.\t300\tIN\tAAAA\t2001:db8::1",
+		"",
+		"; Dynamic routes, whose records can't be listed:",
+		`; TXT route matching ^(?i)(?:dyn)\.example\.com$`,
+		"",
+	}, "\n"), out.String(), "Wrong zone file")
+
+	// What we write can be read back in
+	records, err := Parse(strings.NewReader(out.String()), "")
+	h.RefuteError(t, err, "Parse")
+	zc, _ := d.Contents("example.com")
+	h.AssertEqualString(t, Dump(zc.Records), Dump(records), "Records changed")
+}